@@ -0,0 +1,822 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/cli"
+	"github.com/tis24dev/proxmox-backup/internal/config"
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/notify"
+	"github.com/tis24dev/proxmox-backup/internal/orchestrator"
+	"github.com/tis24dev/proxmox-backup/internal/storage"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+// commandBackend pairs an initialized storage backend with its --location selector
+type commandBackend struct {
+	selector string
+	backend  storage.Storage
+}
+
+// initCommandBackends creates the storage backends selected via --location.
+// Backends that fail to initialize are logged and skipped unless they are critical.
+func initCommandBackends(cfg *config.Config, logger *logging.Logger, args *cli.Args) ([]commandBackend, error) {
+	var backends []commandBackend
+
+	if args.IncludesLocation(cli.LocationPrimary) {
+		local, err := storage.NewLocalStorage(cfg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("initialize local storage: %w", err)
+		}
+		backends = append(backends, commandBackend{selector: cli.LocationPrimary, backend: local})
+	}
+
+	if args.IncludesLocation(cli.LocationSecondary) {
+		if cfg.SecondaryEnabled {
+			secondary, err := storage.NewSecondaryStorage(cfg, logger)
+			if err != nil {
+				logging.Warning("Failed to initialize secondary storage: %v", err)
+			} else {
+				backends = append(backends, commandBackend{selector: cli.LocationSecondary, backend: secondary})
+			}
+		} else if args.Location == cli.LocationSecondary {
+			return nil, fmt.Errorf("secondary storage is disabled (SECONDARY_ENABLED=false)")
+		}
+	}
+
+	if args.IncludesLocation(cli.LocationCloud) {
+		if cfg.CloudEnabled {
+			cloud, err := storage.NewCloudStorage(cfg, logger)
+			if err != nil {
+				logging.Warning("Failed to initialize cloud storage: %v", err)
+			} else {
+				backends = append(backends, commandBackend{selector: cli.LocationCloud, backend: cloud})
+			}
+		} else if args.Location == cli.LocationCloud {
+			return nil, fmt.Errorf("cloud storage is disabled (CLOUD_ENABLED=false)")
+		}
+	}
+
+	return backends, nil
+}
+
+// repositorySnapshots returns the deduplicating repository of a backend
+// (BACKUP_REPOSITORY) and its snapshots, newest first. Backends that cannot
+// hold a repository, or hold none, return no snapshots.
+func repositorySnapshots(ctx context.Context, item commandBackend, logger *logging.Logger) (*backup.Repository, []*types.BackupMetadata, error) {
+	rb, ok := item.backend.(storage.RepositoryBackend)
+	if !ok {
+		return nil, nil, nil
+	}
+	repo := backup.NewRepository(rb.RepositoryStore(), logger)
+	snapshots, err := storage.RepositorySnapshots(ctx, repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	return repo, snapshots, nil
+}
+
+// runReadOnlyCommand dispatches the commands that only read stored backups
+func runReadOnlyCommand(ctx context.Context, out io.Writer, cfg *config.Config, logger *logging.Logger, args *cli.Args) int {
+	switch args.Command {
+	case cli.CommandList:
+		return runListCommand(ctx, out, cfg, logger, args)
+	case cli.CommandStatus:
+		return runStatusCommand(ctx, out, cfg, logger, args)
+	case cli.CommandVerify:
+		return runVerifyCommand(ctx, out, cfg, logger, args)
+	case cli.CommandDiff:
+		return runDiffCommand(ctx, out, cfg, logger, args)
+	case cli.CommandSearch:
+		return runSearchCommand(ctx, out, cfg, logger, args)
+	}
+	logging.Error("Command %s is not read-only", args.Command)
+	return types.ExitGenericError.Int()
+}
+
+func writeJSON(w io.Writer, value any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(value)
+}
+
+// listEntry is one backup, merged across the locations that hold it
+type listEntry struct {
+	Name           string            `json:"name"`
+	Timestamp      time.Time         `json:"timestamp"`
+	Size           int64             `json:"size"`
+	Compression    string            `json:"compression,omitempty"`
+	EncryptionMode string            `json:"encryption_mode,omitempty"`
+	ProxmoxType    string            `json:"proxmox_type,omitempty"`
+	Version        string            `json:"version,omitempty"`
+	Locations      []string          `json:"locations"`
+	Paths          map[string]string `json:"paths"`
+	// SingleLocation is set when only one of the listed locations holds the backup
+	SingleLocation bool `json:"single_location"`
+}
+
+// runListCommand prints the backups stored on the selected backends, one
+// row per backup with the locations holding it
+func runListCommand(ctx context.Context, out io.Writer, cfg *config.Config, logger *logging.Logger, args *cli.Args) int {
+	backends, err := initCommandBackends(cfg, logger, args)
+	if err != nil {
+		logging.Error("%v", err)
+		return types.ExitConfigError.Int()
+	}
+
+	byName := make(map[string]*listEntry)
+	listed := 0
+	failed := false
+	for _, item := range backends {
+		_, snapshots, err := repositorySnapshots(ctx, item, logger)
+		if err != nil {
+			logging.Warning("%s: unable to list repository snapshots: %v", item.backend.Name(), err)
+			failed = true
+		}
+		for _, b := range snapshots {
+			mergeListEntry(byName, item.selector, b)
+		}
+
+		backups, err := item.backend.List(ctx)
+		if err != nil {
+			logging.Warning("%s: unable to list backups: %v", item.backend.Name(), err)
+			failed = true
+			continue
+		}
+		listed++
+		for _, b := range backups {
+			mergeListEntry(byName, item.selector, b)
+		}
+	}
+
+	entries := make([]listEntry, 0, len(byName))
+	singles := 0
+	for _, e := range byName {
+		e.SingleLocation = listed > 1 && len(e.Locations) == 1
+		if e.SingleLocation {
+			singles++
+		}
+		entries = append(entries, *e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].Timestamp.Equal(entries[j].Timestamp) {
+			return entries[i].Timestamp.After(entries[j].Timestamp)
+		}
+		return entries[i].Name < entries[j].Name
+	})
+
+	if args.JSONOutput {
+		if err := writeJSON(out, entries); err != nil {
+			logging.Error("Failed to encode backup list: %v", err)
+			return types.ExitGenericError.Int()
+		}
+	} else {
+		writeListTable(out, entries, singles)
+	}
+
+	if failed {
+		return types.ExitStorageError.Int()
+	}
+	return types.ExitSuccess.Int()
+}
+
+// mergeListEntry adds a backup listed by one location. A bundle and its
+// raw archive are the same backup; fields missing from a location (cloud
+// listings carry no manifest) are taken from the others.
+func mergeListEntry(byName map[string]*listEntry, location string, b *types.BackupMetadata) {
+	name := strings.TrimSuffix(filepath.Base(b.BackupFile), ".bundle.tar")
+	e, ok := byName[name]
+	if !ok {
+		e = &listEntry{Name: name, Paths: make(map[string]string)}
+		byName[name] = e
+	}
+	if _, seen := e.Paths[location]; !seen {
+		e.Locations = append(e.Locations, location)
+	}
+	if current, seen := e.Paths[location]; !seen || strings.HasSuffix(b.BackupFile, ".bundle.tar") && !strings.HasSuffix(current, ".bundle.tar") {
+		e.Paths[location] = b.BackupFile
+	}
+
+	if e.Timestamp.IsZero() {
+		e.Timestamp = b.Timestamp
+	}
+	if e.Size == 0 {
+		e.Size = b.Size
+	}
+	if e.Compression == "" {
+		e.Compression = string(b.Compression)
+	}
+	if e.EncryptionMode == "" {
+		e.EncryptionMode = b.EncryptionMode
+	}
+	if e.ProxmoxType == "" {
+		e.ProxmoxType = string(b.ProxmoxType)
+	}
+	if e.Version == "" {
+		e.Version = b.Version
+	}
+}
+
+func writeListTable(out io.Writer, entries []listEntry, singles int) {
+	const row = "%-19s %10s  %-11s %-10s %-4s  %-24s %s\n"
+	fmt.Fprintf(out, row, "TIMESTAMP", "SIZE", "COMPRESSION", "ENCRYPTION", "TYPE", "LOCATIONS", "NAME")
+	for _, e := range entries {
+		locations := strings.Join(e.Locations, ",")
+		if e.SingleLocation {
+			locations += " (only)"
+		}
+		fmt.Fprintf(out, row, e.Timestamp.Format("2006-01-02 15:04:05"), formatBytes(e.Size),
+			orDash(e.Compression), orDash(e.EncryptionMode), orDash(e.ProxmoxType), locations, e.Name)
+	}
+	fmt.Fprintf(out, "\n%s found", formatBackupNoun(len(entries)))
+	if singles > 0 {
+		fmt.Fprintf(out, ", %d stored in a single location", singles)
+	}
+	fmt.Fprintln(out)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+type statusEntry struct {
+	Location       string     `json:"location"`
+	Name           string     `json:"name"`
+	Backups        int        `json:"backups"`
+	TotalSize      int64      `json:"total_size"`
+	NewestBackup   *time.Time `json:"newest_backup,omitempty"`
+	OldestBackup   *time.Time `json:"oldest_backup,omitempty"`
+	AvailableSpace int64      `json:"available_space,omitempty"`
+	TotalSpace     int64      `json:"total_space,omitempty"`
+	Retention      string     `json:"retention"`
+	Error          string     `json:"error,omitempty"`
+	// Snapshots and RepositorySize describe the deduplicating repository
+	Snapshots      int   `json:"repository_snapshots,omitempty"`
+	RepositorySize int64 `json:"repository_size,omitempty"`
+}
+
+// runStatusCommand prints usage statistics for every enabled backend
+func runStatusCommand(ctx context.Context, out io.Writer, cfg *config.Config, logger *logging.Logger, args *cli.Args) int {
+	backends, err := initCommandBackends(cfg, logger, args)
+	if err != nil {
+		logging.Error("%v", err)
+		return types.ExitConfigError.Int()
+	}
+
+	entries := make([]statusEntry, 0, len(backends))
+	failed := false
+	for _, item := range backends {
+		entry := statusEntry{
+			Location:  item.selector,
+			Name:      item.backend.Name(),
+			Retention: describeRetention(storage.NewRetentionConfigFromConfig(cfg, item.backend.Location())),
+		}
+		stats, err := item.backend.GetStats(ctx)
+		if err != nil {
+			entry.Error = err.Error()
+			failed = true
+		} else {
+			entry.Backups = stats.TotalBackups
+			entry.TotalSize = stats.TotalSize
+			entry.NewestBackup = stats.NewestBackup
+			entry.OldestBackup = stats.OldestBackup
+			entry.AvailableSpace = stats.AvailableSpace
+			entry.TotalSpace = stats.TotalSpace
+		}
+		if err := addRepositoryStatus(ctx, item, logger, &entry); err != nil {
+			if entry.Error == "" {
+				entry.Error = err.Error()
+			}
+			failed = true
+		}
+		entries = append(entries, entry)
+	}
+
+	if args.JSONOutput {
+		if err := writeJSON(out, entries); err != nil {
+			logging.Error("Failed to encode status: %v", err)
+			return types.ExitGenericError.Int()
+		}
+	} else {
+		for _, e := range entries {
+			fmt.Fprintf(out, "%s (%s)\n", e.Name, e.Location)
+			if e.Error != "" {
+				fmt.Fprintf(out, "  Error: %s\n", e.Error)
+				continue
+			}
+			fmt.Fprintf(out, "  Backups: %d (%s)\n", e.Backups, formatBytes(e.TotalSize))
+			if e.Snapshots > 0 {
+				fmt.Fprintf(out, "  Repository: %d snapshots (%s)\n", e.Snapshots, formatBytes(e.RepositorySize))
+			}
+			if e.NewestBackup != nil {
+				fmt.Fprintf(out, "  Latest backup: %s (%s ago)\n", e.NewestBackup.Format("2006-01-02 15:04:05"),
+					formatDuration(time.Since(*e.NewestBackup).Truncate(time.Second)))
+			} else {
+				fmt.Fprintf(out, "  Latest backup: none\n")
+			}
+			if e.TotalSpace > 0 {
+				fmt.Fprintf(out, "  Free space: %s of %s\n", formatBytes(e.AvailableSpace), formatBytes(e.TotalSpace))
+			}
+			fmt.Fprintf(out, "  Retention: %s\n", e.Retention)
+		}
+	}
+
+	if failed {
+		return types.ExitStorageError.Int()
+	}
+	return types.ExitSuccess.Int()
+}
+
+// addRepositoryStatus adds the snapshots of the repository of a backend, if
+// any, to its status; the newest and oldest backup cover both kinds
+func addRepositoryStatus(ctx context.Context, item commandBackend, logger *logging.Logger, entry *statusEntry) error {
+	repo, snapshots, err := repositorySnapshots(ctx, item, logger)
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	size, err := repo.Size(ctx)
+	if err != nil {
+		return fmt.Errorf("repository size: %w", err)
+	}
+	entry.Snapshots = len(snapshots)
+	entry.RepositorySize = size
+	if newest := snapshots[0].Timestamp; entry.NewestBackup == nil || newest.After(*entry.NewestBackup) {
+		entry.NewestBackup = &newest
+	}
+	if oldest := snapshots[len(snapshots)-1].Timestamp; entry.OldestBackup == nil || oldest.Before(*entry.OldestBackup) {
+		entry.OldestBackup = &oldest
+	}
+	return nil
+}
+
+func describeRetention(rc storage.RetentionConfig) string {
+	if rc.Policy == "gfs" {
+		return fmt.Sprintf("gfs (daily=%d, weekly=%d, monthly=%d, yearly=%d)", rc.Daily, rc.Weekly, rc.Monthly, rc.Yearly)
+	}
+	if rc.MaxBackups > 0 {
+		return fmt.Sprintf("simple (keep %d newest)", rc.MaxBackups)
+	}
+	return "disabled"
+}
+
+// runPruneCommand applies the configured retention policy to the selected backends
+func runPruneCommand(ctx context.Context, cfg *config.Config, logger *logging.Logger, args *cli.Args, dryRun bool) int {
+	backends, err := initCommandBackends(cfg, logger, args)
+	if err != nil {
+		logging.Error("%v", err)
+		return types.ExitConfigError.Int()
+	}
+
+	failed := false
+	for _, item := range backends {
+		rc := storage.NewRetentionConfigFromConfig(cfg, item.backend.Location())
+		if rc.Policy != "gfs" && rc.MaxBackups <= 0 {
+			logging.Skip("%s: retention disabled", item.backend.Name())
+			continue
+		}
+		logging.Step("%s: applying retention (%s)", item.backend.Name(), describeRetention(rc))
+
+		if dryRun {
+			backups, err := item.backend.List(ctx)
+			if err != nil {
+				logging.Warning("%s: unable to list backups: %v", item.backend.Name(), err)
+				failed = true
+			} else {
+				candidates := pruneCandidates(backups, rc)
+				for _, b := range candidates {
+					logging.Info("[DRY RUN] Would delete %s", b.BackupFile)
+				}
+				logging.Info("%s: %d of %d backups would be deleted", item.backend.Name(), len(candidates), len(backups))
+			}
+		} else if deleted, err := item.backend.ApplyRetention(ctx, rc); err != nil {
+			logging.Warning("%s: retention failed: %v", item.backend.Name(), err)
+			failed = true
+		} else {
+			logging.Info("✓ %s: deleted %d old backups", item.backend.Name(), deleted)
+		}
+
+		if err := pruneRepository(ctx, item, rc, logger, dryRun); err != nil {
+			logging.Warning("%s: repository retention failed: %v", item.backend.Name(), err)
+			failed = true
+		}
+	}
+
+	if failed {
+		return types.ExitStorageError.Int()
+	}
+	return types.ExitSuccess.Int()
+}
+
+// pruneRepository applies retention to the snapshots of the repository of a
+// backend, then removes the blobs no remaining snapshot refers to. A dry run
+// lists the snapshots and counts the blobs that would be removed.
+func pruneRepository(ctx context.Context, item commandBackend, rc storage.RetentionConfig, logger *logging.Logger, dryRun bool) error {
+	repo, snapshots, err := repositorySnapshots(ctx, item, logger)
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	if !dryRun {
+		deleted, err := storage.ApplyRepositoryRetention(ctx, repo, rc, logger)
+		if err != nil {
+			return err
+		}
+		logging.Info("✓ %s: deleted %d old repository snapshots", item.backend.Name(), deleted)
+		return nil
+	}
+
+	candidates := pruneCandidates(snapshots, rc)
+	removing := make([]string, 0, len(candidates))
+	for _, s := range candidates {
+		logging.Info("[DRY RUN] Would delete snapshot %s", s.BackupFile)
+		removing = append(removing, s.BackupFile)
+	}
+	blobs, err := repo.UnreferencedBlobs(ctx, removing)
+	if err != nil {
+		return err
+	}
+	var freed int64
+	for _, blob := range blobs {
+		freed += blob.Size
+	}
+	logging.Info("%s: %d of %d repository snapshots would be deleted, and %d unreferenced blobs (%s)",
+		item.backend.Name(), len(candidates), len(snapshots), len(blobs), formatBytes(freed))
+	return nil
+}
+
+// pruneCandidates returns the backups that retention would delete (backups must be newest first)
+func pruneCandidates(backups []*types.BackupMetadata, rc storage.RetentionConfig) []*types.BackupMetadata {
+	var candidates []*types.BackupMetadata
+	if rc.Policy == "gfs" {
+		classification := storage.ClassifyBackupsGFS(backups, rc)
+		for _, b := range backups {
+			if classification[b] == storage.CategoryDelete {
+				candidates = append(candidates, b)
+			}
+		}
+		return candidates
+	}
+	return storage.SimpleRetentionCandidates(backups, rc.MaxBackups)
+}
+
+type verifyEntry struct {
+	Location string `json:"location"`
+	// Snapshot is set for repository snapshots, whose Stream reports the
+	// blobs re-hashed
+	Snapshot bool `json:"snapshot,omitempty"`
+	orchestrator.VerifyResult
+}
+
+// runVerifyCommand re-hashes every stored backup on the selected backends,
+// compares it with the .sha256 sidecar and manifest checksum and
+// test-decompresses the tar stream. Repository snapshots are checked the
+// same way, and every blob they refer to is re-hashed.
+func runVerifyCommand(ctx context.Context, out io.Writer, cfg *config.Config, logger *logging.Logger, args *cli.Args) int {
+	backends, err := initCommandBackends(cfg, logger, args)
+	if err != nil {
+		logging.Error("%v", err)
+		return types.ExitConfigError.Int()
+	}
+
+	wanted := make(map[string]struct{}, len(args.Positional))
+	for _, name := range args.Positional {
+		wanted[strings.TrimSuffix(filepath.Base(name), ".bundle.tar")] = struct{}{}
+	}
+	opts := orchestrator.VerifyOptions{Deep: args.VerifyDeep, IdentityFile: args.IdentityFile}
+
+	entries := []verifyEntry{}
+	listFailed := false
+	for _, item := range backends {
+		repo, snapshots, err := repositorySnapshots(ctx, item, logger)
+		if err != nil {
+			logging.Warning("%s: unable to list repository snapshots: %v", item.backend.Name(), err)
+			listFailed = true
+		}
+		for _, s := range snapshots {
+			if len(wanted) > 0 {
+				if _, ok := wanted[s.BackupFile]; !ok {
+					continue
+				}
+			}
+			if err := ctx.Err(); err != nil {
+				logging.Error("Verification interrupted: %v", err)
+				return types.ExitGenericError.Int()
+			}
+			logging.Debug("%s: verifying snapshot %s", item.backend.Name(), s.BackupFile)
+			entries = append(entries, verifyEntry{
+				Location:     item.selector,
+				Snapshot:     true,
+				VerifyResult: orchestrator.VerifyRepositorySnapshot(ctx, repo, item.backend.Location(), s, opts),
+			})
+		}
+
+		backups, err := item.backend.List(ctx)
+		if err != nil {
+			logging.Warning("%s: unable to list backups: %v", item.backend.Name(), err)
+			listFailed = true
+			continue
+		}
+		bundled := make(map[string]bool, len(backups))
+		for _, b := range backups {
+			if name := filepath.Base(b.BackupFile); strings.HasSuffix(name, ".bundle.tar") {
+				bundled[strings.TrimSuffix(name, ".bundle.tar")] = true
+			}
+		}
+		for _, b := range backups {
+			name := filepath.Base(b.BackupFile)
+			archive := strings.TrimSuffix(name, ".bundle.tar")
+			if archive == name && bundled[name] {
+				// The bundle carries the same archive
+				continue
+			}
+			if len(wanted) > 0 {
+				if _, ok := wanted[archive]; !ok {
+					continue
+				}
+			}
+			if err := ctx.Err(); err != nil {
+				logging.Error("Verification interrupted: %v", err)
+				return types.ExitGenericError.Int()
+			}
+			logging.Debug("%s: verifying %s", item.backend.Name(), name)
+			entries = append(entries, verifyEntry{
+				Location:     item.selector,
+				VerifyResult: orchestrator.VerifyStoredBackup(ctx, item.backend, b, opts),
+			})
+		}
+	}
+
+	if args.JSONOutput {
+		if err := writeJSON(out, entries); err != nil {
+			logging.Error("Failed to encode verification result: %v", err)
+			return types.ExitGenericError.Int()
+		}
+	} else {
+		for _, e := range entries {
+			switch {
+			case e.Status == orchestrator.VerifyOK && e.Snapshot:
+				logging.Info("✓ %s [%s]: checksum %s, blobs %s", e.Name, e.Location, e.Method, e.Stream)
+			case e.Status == orchestrator.VerifyOK:
+				logging.Info("✓ %s [%s]: checksum %s, tar stream %s", e.Name, e.Location, e.Method, e.Stream)
+			default:
+				logging.Error("✗ %s [%s]: %s (%s)", e.Name, e.Location, e.Status, e.Detail)
+			}
+		}
+	}
+
+	return verifyExitCode(entries, listFailed)
+}
+
+// verifyExitCode returns ExitVerificationError when a backup is corrupted or
+// cannot be checked against a recorded checksum, and ExitStorageError when a
+// backup or a backend could not be read
+func verifyExitCode(entries []verifyEntry, listFailed bool) int {
+	unreadable := listFailed
+	for _, e := range entries {
+		switch e.Status {
+		case orchestrator.VerifyCorrupted, orchestrator.VerifyMissingSidecar:
+			return types.ExitVerificationError.Int()
+		case orchestrator.VerifyUnreadable:
+			unreadable = true
+		}
+	}
+	if unreadable {
+		return types.ExitStorageError.Int()
+	}
+	return types.ExitSuccess.Int()
+}
+
+// drillIdentity describes this host in restore drill notifications
+type drillIdentity struct {
+	hostname    string
+	proxmoxType types.ProxmoxType
+	serverID    string
+	serverMAC   string
+}
+
+type drillResult struct {
+	Status          string                     `json:"status"`
+	Storage         string                     `json:"storage"`
+	Backup          string                     `json:"backup,omitempty"`
+	Created         *time.Time                 `json:"created,omitempty"`
+	Files           int                        `json:"files"`
+	IndexedFiles    int                        `json:"indexed_files,omitempty"`
+	DurationSeconds float64                    `json:"duration_seconds"`
+	Checks          []notify.RestoreDrillCheck `json:"checks"`
+	Error           string                     `json:"error,omitempty"`
+}
+
+// runDrillCommand restores the newest backup of a storage into a throwaway
+// directory, checks the expected key files and sends the result through the
+// configured notification channels
+func runDrillCommand(ctx context.Context, out io.Writer, cfg *config.Config, logger *logging.Logger, args *cli.Args, host drillIdentity) int {
+	opts := orchestrator.RestoreDrillOptions{
+		Storage:       cfg.RestoreDrillStorage,
+		IdentityFile:  cfg.RestoreDrillIdentityFile,
+		WorkDir:       cfg.RestoreDrillWorkDir,
+		ExpectedFiles: cfg.RestoreDrillExpectedFiles,
+		Keep:          args.DrillKeep,
+	}
+	if args.DrillStorage != "" {
+		opts.Storage = args.DrillStorage
+	}
+	if args.IdentityFile != "" {
+		opts.IdentityFile = args.IdentityFile
+	}
+	if opts.Storage == "" {
+		opts.Storage = cli.LocationPrimary
+	}
+
+	logging.Step("Restore drill: newest backup from %s storage", opts.Storage)
+	report := orchestrator.RunRestoreDrill(ctx, cfg, logger, opts)
+
+	exitCode := types.ExitSuccess.Int()
+	status := notify.StatusSuccess
+	if report.Error != "" || len(report.Missing()) > 0 {
+		exitCode = types.ExitVerificationError.Int()
+		status = notify.StatusFailure
+	}
+
+	if args.JSONOutput {
+		result := drillResult{
+			Status:          status.String(),
+			Storage:         report.Storage,
+			Backup:          report.Backup,
+			Files:           report.Files,
+			IndexedFiles:    report.IndexedFiles,
+			DurationSeconds: report.Duration.Seconds(),
+			Checks:          report.Checks,
+			Error:           report.Error,
+		}
+		if !report.Created.IsZero() {
+			result.Created = &report.Created
+		}
+		if result.Checks == nil {
+			result.Checks = []notify.RestoreDrillCheck{}
+		}
+		if err := writeJSON(out, result); err != nil {
+			logging.Error("Failed to encode restore drill result: %v", err)
+			return types.ExitGenericError.Int()
+		}
+	} else {
+		for _, c := range report.Checks {
+			if c.Found {
+				logging.Info("✓ %s", c.Path)
+			} else {
+				logging.Error("✗ %s missing", c.Path)
+			}
+		}
+		switch {
+		case report.Error != "":
+			logging.Error("Restore drill failed: %s", report.Error)
+		case status == notify.StatusFailure:
+			logging.Error("Restore drill of %s: %d of %d expected files missing", report.Backup, len(report.Missing()), len(report.Checks))
+		default:
+			logging.Info("✓ Restore drill of %s passed: %d files restored in %s", report.Backup, report.Files,
+				formatDuration(report.Duration.Truncate(time.Second)))
+		}
+	}
+
+	if args.NoNotify {
+		logging.Skip("Restore drill notifications disabled (--no-notify)")
+		return exitCode
+	}
+	data := &notify.NotificationData{
+		Event:         notify.EventRestoreDrill,
+		Status:        status,
+		ExitCode:      exitCode,
+		Hostname:      host.hostname,
+		ProxmoxType:   host.proxmoxType,
+		ServerID:      host.serverID,
+		ServerMAC:     host.serverMAC,
+		BackupDate:    time.Now(),
+		BackupFile:    report.Backup,
+		ScriptVersion: version,
+		RestoreDrill:  report,
+	}
+	if report.Error != "" {
+		data.StatusMessage = "Restore drill failed: " + report.Error
+	}
+	logging.Step("Sending restore drill notifications")
+	for _, notifier := range initNotifiers(cfg, host.proxmoxType, logger) {
+		result, err := notifier.Send(ctx, data)
+		switch {
+		case err != nil:
+			logging.Warning("%s: failed: %v", notifier.Name(), err)
+		case !result.Success:
+			logging.Warning("%s: failure reported: %v", notifier.Name(), result.Error)
+		default:
+			logging.Info("✓ %s: sent", notifier.Name())
+		}
+	}
+	return exitCode
+}
+
+// runDiffCommand compares two backups and prints the differences
+func runDiffCommand(ctx context.Context, out io.Writer, cfg *config.Config, logger *logging.Logger, args *cli.Args) int {
+	opts := orchestrator.BackupDiffOptions{
+		From:         args.Positional[0],
+		To:           args.Positional[1],
+		IdentityFile: args.IdentityFile,
+		Paths:        args.Paths,
+		Categories:   args.Categories,
+		Summary:      args.DiffSummary,
+	}
+
+	logging.Step("Comparing %s with %s", opts.From, opts.To)
+	report, err := orchestrator.DiffBackups(ctx, cfg, logger, opts)
+	if err != nil {
+		logging.Error("Backup diff failed: %v", err)
+		return types.ExitGenericError.Int()
+	}
+
+	if args.JSONOutput {
+		if report.Entries == nil {
+			report.Entries = []orchestrator.BackupDiffEntry{}
+		}
+		err = writeJSON(out, report)
+	} else {
+		err = orchestrator.WriteBackupDiffReport(out, report)
+	}
+	if err != nil {
+		logging.Error("Failed to write backup diff: %v", err)
+		return types.ExitGenericError.Int()
+	}
+	return types.ExitSuccess.Int()
+}
+
+// runSearchCommand finds the backups holding a file or content pattern, or
+// prints one version of a file with --show
+func runSearchCommand(ctx context.Context, out io.Writer, cfg *config.Config, logger *logging.Logger, args *cli.Args) int {
+	if args.SearchShow != "" {
+		if err := orchestrator.WriteBackupFile(ctx, cfg, logger, args.SearchShow, args.Positional[0], args.IdentityFile, out); err != nil {
+			logging.Error("Failed to print %s from %s: %v", args.Positional[0], args.SearchShow, err)
+			return types.ExitGenericError.Int()
+		}
+		return types.ExitSuccess.Int()
+	}
+
+	opts := orchestrator.BackupSearchOptions{
+		Content:      args.SearchContent,
+		IdentityFile: args.IdentityFile,
+		Location:     args.Location,
+	}
+	if len(args.Positional) > 0 {
+		opts.Pattern = args.Positional[0]
+	}
+
+	logging.Step("Searching stored backups")
+	report, err := orchestrator.SearchBackups(ctx, cfg, logger, opts)
+	if err != nil {
+		logging.Error("Backup search failed: %v", err)
+		return types.ExitGenericError.Int()
+	}
+
+	if args.JSONOutput {
+		if report.Matches == nil {
+			report.Matches = []orchestrator.BackupSearchMatch{}
+		}
+		err = writeJSON(out, report)
+	} else {
+		err = orchestrator.WriteBackupSearchReport(out, report)
+	}
+	if err != nil {
+		logging.Error("Failed to write search result: %v", err)
+		return types.ExitGenericError.Int()
+	}
+	return types.ExitSuccess.Int()
+}
+
+// runConfigCommand validates or prints the loaded configuration
+func runConfigCommand(out io.Writer, cfg *config.Config, args *cli.Args) int {
+	switch args.ConfigAction {
+	case cli.ConfigActionShow:
+		for _, key := range cfg.Keys() {
+			value, _ := cfg.Get(key)
+			fmt.Fprintf(out, "%s=%s\n", key, maskConfigValue(key, value))
+		}
+	default:
+		fmt.Fprintf(out, "✓ Configuration is valid: %s\n", args.ConfigPath)
+	}
+	return types.ExitSuccess.Int()
+}
+
+func maskConfigValue(key, value string) string {
+	upper := strings.ToUpper(key)
+	for _, marker := range []string{"TOKEN", "SECRET", "PASSWORD", "PASS", "KEY"} {
+		if strings.Contains(upper, marker) && value != "" {
+			return "********"
+		}
+	}
+	return value
+}
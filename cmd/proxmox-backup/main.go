@@ -86,6 +86,16 @@ func run() int {
 	// Parse command-line arguments
 	args := cli.Parse()
 
+	// Keep stdout clean for machine-readable output and file contents
+	// (search --show): only the command handlers write to commandOutput,
+	// while the banner and the log go to logOutput
+	var commandOutput, logOutput io.Writer = os.Stdout, os.Stdout
+	if args.JSONOutput || args.SearchShow != "" {
+		logOutput = os.Stderr
+	}
+	bootstrap.SetOutput(logOutput)
+	logging.GetDefaultLogger().SetOutput(logOutput)
+
 	// Handle version flag
 	if args.ShowVersion {
 		cli.ShowVersion()
@@ -94,7 +104,7 @@ func run() int {
 
 	// Handle help flag
 	if args.ShowHelp {
-		cli.ShowHelp()
+		cli.ShowHelp(args)
 		return types.ExitSuccess.Int()
 	}
 
@@ -187,8 +197,14 @@ func run() int {
 		return types.ExitConfigError.Int()
 	}
 
+	if args.Command == cli.CommandConfig {
+		return runConfigCommand(commandOutput, cfg, args)
+	}
+
 	// Pre-flight: if features require network, verify basic connectivity
-	if needs, reasons := featuresNeedNetwork(cfg); needs {
+	// (only backups and restore drills send notifications)
+	sendsNotifications := args.Command == cli.CommandBackup || (args.Command == cli.CommandDrill && !args.NoNotify)
+	if needs, reasons := featuresNeedNetwork(cfg); needs && sendsNotifications {
 		if cfg.DisableNetworkPreflight {
 			logging.Warning("WARNING: Network preflight disabled via DISABLE_NETWORK_PREFLIGHT; features: %s", strings.Join(reasons, ", "))
 		} else {
@@ -207,10 +223,18 @@ func run() int {
 
 	// Initialize logger with configuration
 	logger := logging.New(logLevel, cfg.UseColor)
+	logger.SetOutput(logOutput)
 	logging.SetDefaultLogger(logger)
 	bootstrap.SetLevel(logLevel)
 	bootstrap.Flush(logger)
 
+	// Read-only commands (often run from monitoring loops) create no backup
+	// log and skip the security pre-flight, which only guards backups
+	if args.Command.ReadOnly() {
+		defer cleanupAfterRun(logger)
+		return runReadOnlyCommand(ctx, commandOutput, cfg, logger, args)
+	}
+
 	// Open log file for real-time writing (will be closed after notifications)
 	hostname := resolveHostname()
 	startTime := time.Now()
@@ -308,7 +332,7 @@ func run() int {
 	if logTelegramInfo {
 		logging.Info("Server Telegram: %s", telegramServerStatus)
 	}
-	fmt.Println()
+	fmt.Fprintln(logOutput)
 
 	execInfo := getExecInfo()
 	execPath := execInfo.ExecPath
@@ -316,11 +340,65 @@ func run() int {
 		logging.Error("Security checks failed: %v", secErr)
 		return types.ExitSecurityError.Int()
 	}
-	fmt.Println()
+	fmt.Fprintln(logOutput)
+
+	switch args.Command {
+	case cli.CommandPrune:
+		return runPruneCommand(ctx, cfg, logger, args, dryRun)
+	case cli.CommandDrill:
+		return runDrillCommand(ctx, commandOutput, cfg, logger, args, drillIdentity{
+			hostname:    hostname,
+			proxmoxType: envInfo.Type,
+			serverID:    serverIDValue,
+			serverMAC:   serverMACValue,
+		})
+	}
+
+	if args.Command == cli.CommandRestore && args.RollbackID != "" {
+		rollbackOpts := orchestrator.RollbackOptions{
+			ID:           args.RollbackID,
+			Delete:       args.RollbackDelete,
+			IdentityFile: args.IdentityFile,
+			AssumeYes:    args.AssumeYes,
+			Output:       commandOutput,
+		}
+		if err := orchestrator.RunRestoreRollback(ctx, cfg, logger, rollbackOpts); err != nil {
+			if errors.Is(err, orchestrator.ErrRollbackAborted) {
+				logging.Info("Rollback aborted by user")
+				return types.ExitSuccess.Int()
+			}
+			logging.Error("Rollback failed: %v", err)
+			return types.ExitGenericError.Int()
+		}
+		return types.ExitSuccess.Int()
+	}
 
-	if args.Restore {
-		logging.Info("Restore mode enabled - starting interactive workflow...")
-		if err := orchestrator.RunRestoreWorkflow(ctx, cfg, logger, version); err != nil {
+	if args.Command == cli.CommandRestore {
+		restoreOpts := orchestrator.RestoreOptions{
+			Source:           args.RestoreSource,
+			IdentityFile:     args.IdentityFile,
+			TargetRoot:       args.TargetRoot,
+			AssumeYes:        args.AssumeYes,
+			Paths:            args.Paths,
+			Categories:       args.Categories,
+			Diff:             args.Diff,
+			DiffFile:         args.DiffFile,
+			DryRun:           dryRun,
+			PlanJSON:         args.JSONOutput,
+			Output:           commandOutput,
+			NoRollback:       args.NoRollback,
+			NoServiceActions: args.NoServices,
+			PVEMode:          args.PVEMode,
+			MapHost:          args.MapHost,
+			MapIPs:           args.MapIPs,
+			MapInterfaces:    args.MapInterfaces,
+		}
+		if restoreOpts.Source != "" {
+			logging.Info("Restore mode enabled - source: %s", restoreOpts.Source)
+		} else {
+			logging.Info("Restore mode enabled - starting interactive workflow...")
+		}
+		if err := orchestrator.RunRestoreWorkflow(ctx, cfg, logger, version, restoreOpts); err != nil {
 			if errors.Is(err, orchestrator.ErrRestoreAborted) || errors.Is(err, orchestrator.ErrDecryptAborted) {
 				logging.Info("Restore workflow aborted by user")
 				return types.ExitSuccess.Int()
@@ -332,7 +410,7 @@ func run() int {
 		return types.ExitSuccess.Int()
 	}
 
-	if args.Decrypt {
+	if args.Command == cli.CommandDecrypt {
 		logging.Info("Decrypt mode enabled - starting interactive workflow...")
 		if err := orchestrator.RunDecryptWorkflow(ctx, cfg, logger, version); err != nil {
 			if errors.Is(err, orchestrator.ErrDecryptAborted) {
@@ -540,98 +618,8 @@ func run() int {
 	// Initialize notification channels
 	logging.Step("Initializing notification channels")
 
-	// Telegram notifications
-	if cfg.TelegramEnabled {
-		telegramConfig := notify.TelegramConfig{
-			Enabled:       true,
-			Mode:          notify.TelegramMode(cfg.TelegramBotType),
-			BotToken:      cfg.TelegramBotToken,
-			ChatID:        cfg.TelegramChatID,
-			ServerAPIHost: cfg.TelegramServerAPIHost,
-			ServerID:      cfg.ServerID,
-		}
-		telegramNotifier, err := notify.NewTelegramNotifier(telegramConfig, logger)
-		if err != nil {
-			logging.Warning("Failed to initialize Telegram notifier: %v", err)
-		} else {
-			telegramAdapter := orchestrator.NewNotificationAdapter(telegramNotifier, logger)
-			orch.RegisterNotificationChannel(telegramAdapter)
-			logging.Info("✓ Telegram initialized (mode: %s)", cfg.TelegramBotType)
-		}
-	} else {
-		logging.Skip("Telegram: disabled")
-	}
-
-	// Email notifications
-	if cfg.EmailEnabled {
-		emailConfig := notify.EmailConfig{
-			Enabled:          true,
-			DeliveryMethod:   notify.EmailDeliveryMethod(cfg.EmailDeliveryMethod),
-			FallbackSendmail: cfg.EmailFallbackSendmail,
-			Recipient:        cfg.EmailRecipient,
-			From:             cfg.EmailFrom,
-			CloudRelayConfig: notify.CloudRelayConfig{
-				WorkerURL:   cfg.CloudflareWorkerURL,
-				WorkerToken: cfg.CloudflareWorkerToken,
-				HMACSecret:  cfg.CloudflareHMACSecret,
-				Timeout:     cfg.WorkerTimeout,
-				MaxRetries:  cfg.WorkerMaxRetries,
-				RetryDelay:  cfg.WorkerRetryDelay,
-			},
-		}
-		emailNotifier, err := notify.NewEmailNotifier(emailConfig, envInfo.Type, logger)
-		if err != nil {
-			logging.Warning("Failed to initialize Email notifier: %v", err)
-		} else {
-			emailAdapter := orchestrator.NewNotificationAdapter(emailNotifier, logger)
-			orch.RegisterNotificationChannel(emailAdapter)
-			logging.Info("✓ Email initialized (method: %s)", cfg.EmailDeliveryMethod)
-		}
-	} else {
-		logging.Skip("Email: disabled")
-	}
-
-	// Gotify notifications
-	if cfg.GotifyEnabled {
-		gotifyConfig := notify.GotifyConfig{
-			Enabled:         true,
-			ServerURL:       cfg.GotifyServerURL,
-			Token:           cfg.GotifyToken,
-			PrioritySuccess: cfg.GotifyPrioritySuccess,
-			PriorityWarning: cfg.GotifyPriorityWarning,
-			PriorityFailure: cfg.GotifyPriorityFailure,
-		}
-		gotifyNotifier, err := notify.NewGotifyNotifier(gotifyConfig, logger)
-		if err != nil {
-			logging.Warning("Failed to initialize Gotify notifier: %v", err)
-		} else {
-			gotifyAdapter := orchestrator.NewNotificationAdapter(gotifyNotifier, logger)
-			orch.RegisterNotificationChannel(gotifyAdapter)
-			logging.Info("✓ Gotify initialized")
-		}
-	} else {
-		logging.Skip("Gotify: disabled")
-	}
-
-	// Webhook Notifications
-	if cfg.WebhookEnabled {
-		logging.Debug("Initializing webhook notifier...")
-		webhookConfig := cfg.BuildWebhookConfig()
-		logging.Debug("Webhook config built: %d endpoints configured", len(webhookConfig.Endpoints))
-
-		webhookNotifier, err := notify.NewWebhookNotifier(webhookConfig, logger)
-		if err != nil {
-			logging.Warning("Failed to initialize Webhook notifier: %v", err)
-		} else {
-			logging.Debug("Creating webhook notification adapter...")
-			webhookAdapter := orchestrator.NewNotificationAdapter(webhookNotifier, logger)
-
-			logging.Debug("Registering webhook notification channel with orchestrator...")
-			orch.RegisterNotificationChannel(webhookAdapter)
-			logging.Info("✓ Webhook initialized (%d endpoint(s))", len(webhookConfig.Endpoints))
-		}
-	} else {
-		logging.Skip("Webhook: disabled")
+	for _, notifier := range initNotifiers(cfg, envInfo.Type, logger) {
+		orch.RegisterNotificationChannel(orchestrator.NewNotificationAdapter(notifier, logger))
 	}
 
 	fmt.Println()
@@ -828,10 +816,15 @@ func run() int {
 	fmt.Println("  make build         - Build binary")
 	fmt.Println("  --help             - Show all options")
 	fmt.Println("  --dry-run          - Test without changes")
-	fmt.Println("  --install          - Re-run interactive installation/setup")
+	fmt.Println("  config install     - Re-run interactive installation/setup")
 	fmt.Println("  --newkey           - Generate a new encryption key for backups")
-	fmt.Println("  --decrypt          - Decrypt an existing backup archive")
-	fmt.Println("  --restore          - Restore data from a decrypted backup")
+	fmt.Println("  list | status      - Inspect stored backups and storage usage")
+	fmt.Println("  verify | prune     - Check archive checksums / apply retention")
+	fmt.Println("  decrypt            - Decrypt an existing backup archive")
+	fmt.Println("  restore            - Restore data from a decrypted backup")
+	fmt.Println("  drill              - Test-restore the newest backup and notify the result")
+	fmt.Println("  diff               - Compare two backups (files and config diffs)")
+	fmt.Println("  search             - Find the backups holding a file or content")
 	fmt.Println()
 
 	return finalExitCode
@@ -1828,3 +1821,98 @@ func isLocalPath(path string) bool {
 	}
 	return filepath.IsAbs(clean)
 }
+
+// initNotifiers creates the notification channels enabled in the configuration.
+// Channels that fail to initialize are logged and skipped.
+func initNotifiers(cfg *config.Config, proxmoxType types.ProxmoxType, logger *logging.Logger) []notify.Notifier {
+	var notifiers []notify.Notifier
+
+	// Telegram notifications
+	if cfg.TelegramEnabled {
+		telegramConfig := notify.TelegramConfig{
+			Enabled:       true,
+			Mode:          notify.TelegramMode(cfg.TelegramBotType),
+			BotToken:      cfg.TelegramBotToken,
+			ChatID:        cfg.TelegramChatID,
+			ServerAPIHost: cfg.TelegramServerAPIHost,
+			ServerID:      cfg.ServerID,
+		}
+		telegramNotifier, err := notify.NewTelegramNotifier(telegramConfig, logger)
+		if err != nil {
+			logging.Warning("Failed to initialize Telegram notifier: %v", err)
+		} else {
+			notifiers = append(notifiers, telegramNotifier)
+			logging.Info("✓ Telegram initialized (mode: %s)", cfg.TelegramBotType)
+		}
+	} else {
+		logging.Skip("Telegram: disabled")
+	}
+
+	// Email notifications
+	if cfg.EmailEnabled {
+		emailConfig := notify.EmailConfig{
+			Enabled:          true,
+			DeliveryMethod:   notify.EmailDeliveryMethod(cfg.EmailDeliveryMethod),
+			FallbackSendmail: cfg.EmailFallbackSendmail,
+			Recipient:        cfg.EmailRecipient,
+			From:             cfg.EmailFrom,
+			CloudRelayConfig: notify.CloudRelayConfig{
+				WorkerURL:   cfg.CloudflareWorkerURL,
+				WorkerToken: cfg.CloudflareWorkerToken,
+				HMACSecret:  cfg.CloudflareHMACSecret,
+				Timeout:     cfg.WorkerTimeout,
+				MaxRetries:  cfg.WorkerMaxRetries,
+				RetryDelay:  cfg.WorkerRetryDelay,
+			},
+		}
+		emailNotifier, err := notify.NewEmailNotifier(emailConfig, proxmoxType, logger)
+		if err != nil {
+			logging.Warning("Failed to initialize Email notifier: %v", err)
+		} else {
+			notifiers = append(notifiers, emailNotifier)
+			logging.Info("✓ Email initialized (method: %s)", cfg.EmailDeliveryMethod)
+		}
+	} else {
+		logging.Skip("Email: disabled")
+	}
+
+	// Gotify notifications
+	if cfg.GotifyEnabled {
+		gotifyConfig := notify.GotifyConfig{
+			Enabled:         true,
+			ServerURL:       cfg.GotifyServerURL,
+			Token:           cfg.GotifyToken,
+			PrioritySuccess: cfg.GotifyPrioritySuccess,
+			PriorityWarning: cfg.GotifyPriorityWarning,
+			PriorityFailure: cfg.GotifyPriorityFailure,
+		}
+		gotifyNotifier, err := notify.NewGotifyNotifier(gotifyConfig, logger)
+		if err != nil {
+			logging.Warning("Failed to initialize Gotify notifier: %v", err)
+		} else {
+			notifiers = append(notifiers, gotifyNotifier)
+			logging.Info("✓ Gotify initialized")
+		}
+	} else {
+		logging.Skip("Gotify: disabled")
+	}
+
+	// Webhook Notifications
+	if cfg.WebhookEnabled {
+		logging.Debug("Initializing webhook notifier...")
+		webhookConfig := cfg.BuildWebhookConfig()
+		logging.Debug("Webhook config built: %d endpoints configured", len(webhookConfig.Endpoints))
+
+		webhookNotifier, err := notify.NewWebhookNotifier(webhookConfig, logger)
+		if err != nil {
+			logging.Warning("Failed to initialize Webhook notifier: %v", err)
+		} else {
+			notifiers = append(notifiers, webhookNotifier)
+			logging.Info("✓ Webhook initialized (%d endpoint(s))", len(webhookConfig.Endpoints))
+		}
+	} else {
+		logging.Skip("Webhook: disabled")
+	}
+
+	return notifiers
+}
@@ -6,6 +6,9 @@ toolchain go1.25.4
 
 require (
 	filippo.io/age v1.1.1
+	github.com/dsnet/compress v0.0.1
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
 	golang.org/x/crypto v0.4.0
 	golang.org/x/term v0.37.0
 )
@@ -3,12 +3,12 @@ package backup
 import (
 	"archive/tar"
 	"bufio"
-	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"syscall"
@@ -19,18 +19,6 @@ import (
 	"github.com/tis24dev/proxmox-backup/internal/types"
 )
 
-var lookPath = exec.LookPath
-
-// WithLookPathOverride temporaneamente sostituisce lookPath (per i test) e
-// restituisce una funzione di ripristino da invocare con defer.
-func WithLookPathOverride(fn func(string) (string, error)) func() {
-	original := lookPath
-	lookPath = fn
-	return func() {
-		lookPath = original
-	}
-}
-
 // Archiver handles tar archive creation with compression
 type Archiver struct {
 	logger               *logging.Logger
@@ -42,6 +30,7 @@ type Archiver struct {
 	requestedCompression types.CompressionType
 	encryptArchive       bool
 	ageRecipients        []age.Recipient
+	index                *ContentIndex
 }
 
 // ArchiverConfig holds configuration for archive creation
@@ -55,7 +44,7 @@ type ArchiverConfig struct {
 	AgeRecipients      []age.Recipient
 }
 
-// CompressionError rappresenta un errore di compressione esterna (xz/zstd)
+// CompressionError rappresenta un errore dello stadio di compressione
 type CompressionError struct {
 	Algorithm string
 	Err       error
@@ -166,47 +155,18 @@ func (a *Archiver) CompressionThreads() int {
 	return a.compressionThreads
 }
 
-// ResolveCompression ensures the configured compression is available and normalizes
-// the compression level. If the requested algorithm is unavailable it falls back
-// to gzip, keeping the caller informed via logs.
+// ResolveCompression normalizes the compression level for the configured
+// algorithm. Every algorithm is compressed in-process (see Compressor), so
+// only an unknown type falls back to gzip.
 func (a *Archiver) ResolveCompression() types.CompressionType {
 	a.logger.Debug("Resolving compression (requested=%s level=%d mode=%s)", a.requestedCompression, a.compressionLevel, a.CompressionMode())
 	switch a.compression {
-	case types.CompressionXZ:
-		if _, err := lookPath("xz"); err != nil {
-			a.logger.Warning("xz command not available: %v", err)
-			a.compression = types.CompressionGzip
-			a.compressionLevel = normalizeLevelForCompression(a.compression, a.compressionLevel)
-		}
-	case types.CompressionZstd:
-		if _, err := lookPath("zstd"); err != nil {
-			a.logger.Warning("zstd command not available: %v", err)
-			a.compression = types.CompressionGzip
-			a.compressionLevel = normalizeLevelForCompression(a.compression, a.compressionLevel)
-		} else {
-			a.compressionLevel = normalizeLevelForCompression(a.compression, a.compressionLevel)
-		}
-	case types.CompressionPigz:
-		if _, err := lookPath("pigz"); err != nil {
-			a.logger.Warning("pigz command not available: %v", err)
-			a.compression = types.CompressionGzip
-			a.compressionLevel = normalizeLevelForCompression(a.compression, a.compressionLevel)
-		}
-	case types.CompressionBzip2:
-		if _, err := lookPath("pbzip2"); err != nil {
-			if _, err := lookPath("bzip2"); err != nil {
-				a.logger.Warning("bzip2 command not available: %v", err)
-				a.compression = types.CompressionGzip
-				a.compressionLevel = normalizeLevelForCompression(a.compression, a.compressionLevel)
-			}
-		}
-	case types.CompressionLZMA:
-		if _, err := lookPath("lzma"); err != nil {
-			a.logger.Warning("lzma command not available: %v", err)
-			a.compression = types.CompressionGzip
-			a.compressionLevel = normalizeLevelForCompression(a.compression, a.compressionLevel)
-		}
-	case types.CompressionGzip:
+	case types.CompressionGzip,
+		types.CompressionPigz,
+		types.CompressionXZ,
+		types.CompressionBzip2,
+		types.CompressionLZMA,
+		types.CompressionZstd:
 		a.compressionLevel = normalizeLevelForCompression(a.compression, a.compressionLevel)
 	case types.CompressionNone:
 		a.compressionLevel = 0
@@ -271,50 +231,9 @@ func requiresExtremeMode(mode string) bool {
 	}
 }
 
-func buildPigzArgs(level, threads int, mode string) []string {
-	args := make([]string, 0, 4)
-	if threads > 0 {
-		args = append(args, fmt.Sprintf("-p%d", threads))
-	}
-	args = append(args, fmt.Sprintf("-%d", level))
-	if requiresExtremeMode(mode) {
-		args = append(args, "--best")
-	}
-	args = append(args, "-c")
-	return args
-}
-
-func buildXZArgs(level, threads int, mode string) []string {
-	args := []string{fmt.Sprintf("-%d", level)}
-	if threads > 0 {
-		args = append(args, fmt.Sprintf("-T%d", threads))
-	} else {
-		args = append(args, "-T0")
-	}
-	if requiresExtremeMode(mode) {
-		args = append(args, "--extreme")
-	}
-	args = append(args, "-c")
-	return args
-}
-
-func buildZstdArgs(level, threads int) []string {
-	args := make([]string, 0, 5)
-	if level > 19 {
-		args = append(args, "--ultra")
-	}
-	args = append(args, fmt.Sprintf("-%d", level))
-	if threads > 0 {
-		args = append(args, fmt.Sprintf("-T%d", threads))
-	} else {
-		args = append(args, "-T0")
-	}
-	args = append(args, "-q", "-c")
-	return args
-}
-
 // writeTar writes the directory contents to the provided writer as a tar archive
 func (a *Archiver) writeTar(ctx context.Context, sourceDir string, w io.Writer) error {
+	a.index = &ContentIndex{Version: ContentIndexVersion, CreatedAt: time.Now().UTC()}
 	tarWriter := tar.NewWriter(w)
 	err := a.addToTar(ctx, tarWriter, sourceDir, "")
 	if closeErr := tarWriter.Close(); err == nil {
@@ -380,157 +299,39 @@ func (a *Archiver) CreateArchive(ctx context.Context, sourceDir, outputPath stri
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	// Choose compression method
-	switch actualCompression {
-	case types.CompressionGzip:
-		return a.createGzipArchive(ctx, sourceDir, outputPath)
-	case types.CompressionPigz:
-		return a.createPigzArchive(ctx, sourceDir, outputPath)
-	case types.CompressionXZ:
-		return a.createXZArchive(ctx, sourceDir, outputPath)
-	case types.CompressionBzip2:
-		return a.createBzip2Archive(ctx, sourceDir, outputPath)
-	case types.CompressionLZMA:
-		return a.createLzmaArchive(ctx, sourceDir, outputPath)
-	case types.CompressionZstd:
-		return a.createZstdArchive(ctx, sourceDir, outputPath)
-	case types.CompressionNone:
-		return a.createTarArchive(ctx, sourceDir, outputPath)
-	default:
-		return fmt.Errorf("unsupported compression type: %s", actualCompression)
-	}
-}
-
-// createGzipArchive creates a gzip-compressed tar archive using Go's stdlib
-func (a *Archiver) createGzipArchive(ctx context.Context, sourceDir, outputPath string) (err error) {
-	a.logger.Debug("Creating gzip archive with level %d (mode %s)", a.compressionLevel, a.CompressionMode())
-
-	// Create output file
-	outFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+	compressorConfig := CompressorConfig{
+		Compression: actualCompression,
+		Level:       a.compressionLevel,
+		Threads:     a.compressionThreads,
+		Mode:        a.compressionMode,
 	}
-	defer outFile.Close()
-
-	writer, finalizeEncryption, err := a.wrapEncryptionWriter(outFile)
+	compressor, err := NewCompressor(compressorConfig)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if cerr := finalizeEncryption(); cerr != nil {
-			if err == nil {
-				err = fmt.Errorf("finalize encrypted archive: %w", cerr)
-			} else {
-				a.logger.Warning("Failed to finalize encrypted archive: %v", cerr)
-			}
-		}
-	}()
-
-	// Create gzip writer targeting final writer (possibly encrypted)
-	gzWriter, err := gzip.NewWriterLevel(writer, a.compressionLevel)
-	if err != nil {
-		return fmt.Errorf("failed to create gzip writer: %w", err)
-	}
-	defer gzWriter.Close()
-
-	// Stream tar content into gzip writer
-	if err := a.writeTar(ctx, sourceDir, gzWriter); err != nil {
-		return fmt.Errorf("failed to write tar stream: %w", err)
+	if compressionModeIgnored(compressorConfig) {
+		a.logger.Warning("COMPRESSION_MODE=%s has no effect on %s compression; only the level (%d) is applied",
+			a.CompressionMode(), actualCompression, a.compressionLevel)
 	}
-
-	return nil
+	return a.writeCompressedArchive(ctx, sourceDir, outputPath, compressor)
 }
 
-func (a *Archiver) createPigzArchive(ctx context.Context, sourceDir, outputPath string) error {
-	a.logger.Debug("Creating pigz archive with level %d (mode %s)", a.compressionLevel, a.CompressionMode())
-	args := buildPigzArgs(a.compressionLevel, a.compressionThreads, a.CompressionMode())
-	cmd := exec.CommandContext(ctx, "pigz", args...)
-	return a.pipeTarThroughCommand(ctx, sourceDir, outputPath, cmd, "pigz")
-}
-
-// createTarArchive creates an uncompressed tar archive
-func (a *Archiver) createTarArchive(ctx context.Context, sourceDir, outputPath string) (err error) {
-	a.logger.Debug("Creating uncompressed tar archive")
+// writeCompressedArchive streams the tar archive of sourceDir through the
+// compression stage and, when enabled, age encryption into outputPath
+func (a *Archiver) writeCompressedArchive(ctx context.Context, sourceDir, outputPath string, compressor Compressor) (err error) {
+	algorithm := string(compressor.Algorithm())
+	a.logger.Debug("Creating %s archive with level %d (mode %s)", algorithm, a.compressionLevel, a.CompressionMode())
 
-	// Create output file
 	outFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
 	if err != nil {
 		return fmt.Errorf("failed to create output file: %w", err)
 	}
-	defer outFile.Close()
-
-	writer, finalizeEncryption, err := a.wrapEncryptionWriter(outFile)
-	if err != nil {
-		return err
-	}
 	defer func() {
-		if cerr := finalizeEncryption(); cerr != nil {
-			if err == nil {
-				err = fmt.Errorf("finalize encrypted archive: %w", cerr)
-			} else {
-				a.logger.Warning("Failed to finalize encrypted archive: %v", cerr)
-			}
+		if cerr := outFile.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close archive: %w", cerr)
 		}
 	}()
 
-	if err := a.writeTar(ctx, sourceDir, writer); err != nil {
-		return fmt.Errorf("failed to write tar archive: %w", err)
-	}
-	return nil
-}
-
-func (a *Archiver) createBzip2Archive(ctx context.Context, sourceDir, outputPath string) error {
-	a.logger.Debug("Creating bzip2 archive with level %d (mode %s)", a.compressionLevel, a.CompressionMode())
-	var cmd *exec.Cmd
-	if a.compressionThreads > 1 {
-		if _, err := lookPath("pbzip2"); err == nil {
-			cmd = exec.CommandContext(ctx, "pbzip2",
-				fmt.Sprintf("-%d", a.compressionLevel),
-				fmt.Sprintf("-p%d", a.compressionThreads),
-				"-c",
-			)
-		}
-	}
-	if cmd == nil {
-		cmd = exec.CommandContext(ctx, "bzip2",
-			fmt.Sprintf("-%d", a.compressionLevel),
-			"-c",
-		)
-	}
-	return a.pipeTarThroughCommand(ctx, sourceDir, outputPath, cmd, "bzip2")
-}
-
-func (a *Archiver) createLzmaArchive(ctx context.Context, sourceDir, outputPath string) error {
-	a.logger.Debug("Creating lzma archive with level %d (mode %s)", a.compressionLevel, a.CompressionMode())
-	levelFlag := fmt.Sprintf("-%d", a.compressionLevel)
-	if requiresExtremeMode(a.CompressionMode()) {
-		levelFlag += "e"
-	}
-	cmd := exec.CommandContext(ctx, "lzma",
-		levelFlag,
-		"-c",
-	)
-	return a.pipeTarThroughCommand(ctx, sourceDir, outputPath, cmd, "lzma")
-}
-
-// createXZArchive creates an xz-compressed tar archive using external xz command
-func (a *Archiver) createXZArchive(ctx context.Context, sourceDir, outputPath string) (err error) {
-	a.logger.Debug("Creating xz archive with level %d (mode %s)", a.compressionLevel, a.CompressionMode())
-
-	args := buildXZArgs(a.compressionLevel, a.compressionThreads, a.CompressionMode())
-	cmd := exec.CommandContext(ctx, "xz", args...)
-	if err := a.attachStderrLogger(cmd, "xz"); err != nil {
-		return fmt.Errorf("capture xz output: %w", err)
-	}
-
-	outFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
-	}
-	defer outFile.Close()
-
-	pr, pw := io.Pipe()
-	cmd.Stdin = pr
 	writer, finalizeEncryption, err := a.wrapEncryptionWriter(outFile)
 	if err != nil {
 		return err
@@ -544,196 +345,37 @@ func (a *Archiver) createXZArchive(ctx context.Context, sourceDir, outputPath st
 			}
 		}
 	}()
-	cmd.Stdout = writer
-
-	errChan := make(chan error, 1)
-	go func() {
-		defer close(errChan)
-		err := a.writeTar(ctx, sourceDir, pw)
-		if err != nil {
-			pw.CloseWithError(err)
-		} else {
-			pw.Close()
-		}
-		errChan <- err
-	}()
-
-	if err := cmd.Start(); err != nil {
-		pw.Close()
-		if startErr := <-errChan; startErr != nil {
-			return startErr
-		}
-		return fmt.Errorf("failed to start xz: %w", err)
-	}
-
-	tarErr := <-errChan
-	if tarErr != nil {
-		if cmd.Process != nil {
-			_ = cmd.Process.Kill()
-		}
-		_ = cmd.Wait()
-		return tarErr
-	}
-
-	if err := cmd.Wait(); err != nil {
-		return &CompressionError{Algorithm: "xz", Err: err}
-	}
-
-	a.logger.Debug("XZ compression completed successfully")
-	return nil
-}
-
-// createZstdArchive creates a zstd-compressed tar archive using external zstd command
-func (a *Archiver) createZstdArchive(ctx context.Context, sourceDir, outputPath string) (err error) {
-	a.logger.Debug("Creating zstd archive with level %d (mode %s)", a.compressionLevel, a.CompressionMode())
-
-	args := buildZstdArgs(a.compressionLevel, a.compressionThreads)
-	cmd := exec.CommandContext(ctx, "zstd", args...)
-	if err := a.attachStderrLogger(cmd, "zstd"); err != nil {
-		return fmt.Errorf("capture zstd output: %w", err)
-	}
 
-	outFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	stage, err := compressor.NewWriter(writer)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
-	}
-	defer outFile.Close()
-
-	pr, pw := io.Pipe()
-	cmd.Stdin = pr
-	writer, finalizeEncryption, err := a.wrapEncryptionWriter(outFile)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if cerr := finalizeEncryption(); cerr != nil {
-			if err == nil {
-				err = fmt.Errorf("finalize encrypted archive: %w", cerr)
-			} else {
-				a.logger.Warning("Failed to finalize encrypted archive: %v", cerr)
-			}
-		}
-	}()
-	cmd.Stdout = writer
-
-	errChan := make(chan error, 1)
-	go func() {
-		defer close(errChan)
-		err := a.writeTar(ctx, sourceDir, pw)
-		if err != nil {
-			pw.CloseWithError(err)
-		} else {
-			pw.Close()
-		}
-		errChan <- err
-	}()
-
-	if err := cmd.Start(); err != nil {
-		pw.Close()
-		if startErr := <-errChan; startErr != nil {
-			return startErr
-		}
-		return fmt.Errorf("failed to start zstd: %w", err)
+		return &CompressionError{Algorithm: algorithm, Err: err}
 	}
-
-	tarErr := <-errChan
-	if tarErr != nil {
-		if cmd.Process != nil {
-			_ = cmd.Process.Kill()
-		}
-		_ = cmd.Wait()
-		return tarErr
+	compressed := &compressionWriter{w: stage, algorithm: algorithm}
+	if err := a.writeTar(ctx, sourceDir, compressed); err != nil {
+		_ = stage.Close()
+		return fmt.Errorf("failed to write tar stream: %w", err)
 	}
-
-	if err := cmd.Wait(); err != nil {
-		return &CompressionError{Algorithm: "zstd", Err: err}
+	if err := stage.Close(); err != nil {
+		return &CompressionError{Algorithm: algorithm, Err: err}
 	}
 
-	a.logger.Debug("Zstd compression completed successfully")
+	a.logger.Debug("%s compression completed successfully", strings.ToUpper(algorithm))
 	return nil
 }
 
-func (a *Archiver) attachStderrLogger(cmd *exec.Cmd, algo string) error {
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return err
-	}
-
-	tag := strings.ToUpper(algo)
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			a.logger.Info("[%s] %s", tag, scanner.Text())
-		}
-		if err := scanner.Err(); err != nil {
-			a.logger.Debug("[%s] stderr read error: %v", tag, err)
-		}
-	}()
-
-	return nil
+// compressionWriter reports the write failures of a compression stage as
+// CompressionError, so that they keep their exit code
+type compressionWriter struct {
+	w         io.Writer
+	algorithm string
 }
 
-func (a *Archiver) pipeTarThroughCommand(ctx context.Context, sourceDir, outputPath string, cmd *exec.Cmd, algo string) (err error) {
-	outFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
-	}
-	defer outFile.Close()
-
-	pr, pw := io.Pipe()
-	cmd.Stdin = pr
-	writer, finalizeEncryption, err := a.wrapEncryptionWriter(outFile)
+func (c *compressionWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
 	if err != nil {
-		return err
-	}
-	defer func() {
-		if cerr := finalizeEncryption(); cerr != nil {
-			if err == nil {
-				err = fmt.Errorf("finalize encrypted archive: %w", cerr)
-			} else {
-				a.logger.Warning("Failed to finalize encrypted archive: %v", cerr)
-			}
-		}
-	}()
-	cmd.Stdout = writer
-	if err := a.attachStderrLogger(cmd, algo); err != nil {
-		return fmt.Errorf("capture %s output: %w", algo, err)
-	}
-
-	errChan := make(chan error, 1)
-	go func() {
-		defer close(errChan)
-		if err := a.writeTar(ctx, sourceDir, pw); err != nil {
-			pw.CloseWithError(err)
-			errChan <- err
-			return
-		}
-		pw.Close()
-		errChan <- nil
-	}()
-
-	if err := cmd.Start(); err != nil {
-		pw.Close()
-		if startErr := <-errChan; startErr != nil {
-			return startErr
-		}
-		return fmt.Errorf("failed to start %s: %w", algo, err)
-	}
-
-	if tarErr := <-errChan; tarErr != nil {
-		if cmd.Process != nil {
-			_ = cmd.Process.Kill()
-		}
-		_ = cmd.Wait()
-		return tarErr
+		err = &CompressionError{Algorithm: c.algorithm, Err: err}
 	}
-
-	if err := cmd.Wait(); err != nil {
-		return &CompressionError{Algorithm: algo, Err: err}
-	}
-
-	a.logger.Debug("%s compression completed successfully", strings.ToUpper(algo))
-	return nil
+	return n, err
 }
 
 // addToTar recursively adds files and directories to a tar archive
@@ -821,6 +463,7 @@ func (a *Archiver) addToTar(ctx context.Context, tarWriter *tar.Writer, sourceDi
 		}
 
 		// If it's a regular file (not symlink, dir, etc), write its content
+		var sum string
 		if linkInfo.Mode().IsRegular() {
 			file, err := os.Open(path)
 			if err != nil {
@@ -829,20 +472,31 @@ func (a *Archiver) addToTar(ctx context.Context, tarWriter *tar.Writer, sourceDi
 			}
 			defer file.Close()
 
-			if _, err := io.Copy(tarWriter, file); err != nil {
+			hash := sha256.New()
+			if _, err := io.Copy(io.MultiWriter(tarWriter, hash), file); err != nil {
 				a.logger.Warning("Failed to write file %s to archive: %v", path, err)
 				return nil
 			}
+			sum = hex.EncodeToString(hash.Sum(nil))
 
 			a.logger.Debug("Added file to archive: %s", archivePath)
 		} else if linkInfo.Mode()&os.ModeSymlink != 0 {
 			a.logger.Debug("Added symlink to archive: %s -> %s", archivePath, linkTarget)
 		}
 
+		if a.index != nil {
+			a.index.Entries = append(a.index.Entries, newIndexEntry(header, sum))
+		}
 		return nil
 	})
 }
 
+// ContentIndex returns the index of the entries written by the last
+// CreateArchive call, or nil when no archive was written
+func (a *Archiver) ContentIndex() *ContentIndex {
+	return a.index
+}
+
 // GetArchiveExtension returns the appropriate file extension for the compression type
 func (a *Archiver) GetArchiveExtension() string {
 	var ext string
@@ -922,95 +576,52 @@ func (a *Archiver) VerifyArchive(ctx context.Context, archivePath string) error
 		return nil
 	}
 
-	// Test archive integrity based on compression type
-	switch a.compression {
-	case types.CompressionXZ:
-		return a.verifyXZArchive(ctx, archivePath)
-	case types.CompressionZstd:
-		return a.verifyZstdArchive(ctx, archivePath)
-	case types.CompressionGzip:
-		return a.verifyGzipArchive(ctx, archivePath)
-	case types.CompressionNone:
-		return a.verifyTarArchive(ctx, archivePath)
-	default:
-		a.logger.Warning("Unknown compression type, skipping detailed verification")
-		return nil
-	}
-}
-
-// verifyXZArchive tests XZ compression and tar integrity
-func (a *Archiver) verifyXZArchive(ctx context.Context, archivePath string) error {
-	a.logger.Debug("Testing XZ compression integrity")
-
-	// Test XZ compression integrity
-	cmd := exec.CommandContext(ctx, "xz", "--test", archivePath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("xz integrity test failed: %w (output: %s)", err, string(output))
-	}
-
-	a.logger.Debug("XZ compression test passed")
-
-	// Test tar listing (decompress and list without extracting)
-	cmd = exec.CommandContext(ctx, "tar", "-tJf", archivePath)
-	cmd.Stdout = nil // Discard output
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("tar listing failed: %w (output: %s)", err, string(output))
-	}
-
-	a.logger.Debug("Archive verification passed: XZ compression and tar structure are valid")
-	return nil
+	return a.verifyArchiveStream(ctx, archivePath)
 }
 
-// verifyZstdArchive tests Zstd compression and tar integrity
-func (a *Archiver) verifyZstdArchive(ctx context.Context, archivePath string) error {
-	a.logger.Debug("Testing Zstd compression integrity")
+// verifyArchiveStream decompresses the archive and reads every tar entry,
+// which checks both the checksums of the compressed format and the tar
+// structure
+func (a *Archiver) verifyArchiveStream(ctx context.Context, archivePath string) error {
+	a.logger.Debug("Testing %s compression and tar integrity", a.compression)
 
-	// Test Zstd compression integrity
-	cmd := exec.CommandContext(ctx, "zstd", "--test", archivePath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("zstd integrity test failed: %w (output: %s)", err, string(output))
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("open archive: %w", err)
 	}
+	defer file.Close()
 
-	a.logger.Debug("Zstd compression test passed")
-
-	// Test tar listing (decompress and list without extracting)
-	cmd = exec.CommandContext(ctx, "tar", "--use-compress-program=zstd", "-tf", archivePath)
-	cmd.Stdout = nil // Discard output
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("tar listing failed: %w (output: %s)", err, string(output))
+	stream, err := NewDecompressor(bufio.NewReader(file), a.compression)
+	if err != nil {
+		return fmt.Errorf("%s integrity test failed: %w", a.compression, err)
 	}
+	defer stream.Close()
 
-	a.logger.Debug("Archive verification passed: Zstd compression and tar structure are valid")
-	return nil
-}
-
-// verifyGzipArchive tests Gzip compression and tar integrity
-func (a *Archiver) verifyGzipArchive(ctx context.Context, archivePath string) error {
-	a.logger.Debug("Testing Gzip compression integrity")
-
-	// Test tar listing (tar will test gzip integrity automatically)
-	cmd := exec.CommandContext(ctx, "tar", "-tzf", archivePath)
-	cmd.Stdout = nil // Discard output
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("tar/gzip verification failed: %w (output: %s)", err, string(output))
+	tarReader := tar.NewReader(stream)
+	entries := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("tar listing failed after %d entries: %w", entries, err)
+		}
+		if _, err := io.Copy(io.Discard, tarReader); err != nil {
+			return fmt.Errorf("%s integrity test failed: %w", a.compression, err)
+		}
+		entries++
 	}
-
-	a.logger.Debug("Archive verification passed: Gzip compression and tar structure are valid")
-	return nil
-}
-
-// verifyTarArchive tests uncompressed tar integrity
-func (a *Archiver) verifyTarArchive(ctx context.Context, archivePath string) error {
-	a.logger.Debug("Testing uncompressed tar integrity")
-
-	// Test tar listing
-	cmd := exec.CommandContext(ctx, "tar", "-tf", archivePath)
-	cmd.Stdout = nil // Discard output
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("tar verification failed: %w (output: %s)", err, string(output))
+	// Read past the tar trailer so the end of the compressed stream and its
+	// checksum are verified too
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		return fmt.Errorf("%s integrity test failed: %w", a.compression, err)
 	}
 
-	a.logger.Debug("Archive verification passed: Tar structure is valid")
+	a.logger.Debug("Archive verification passed: %s compression and tar structure are valid (%d entries)", a.compression, entries)
 	return nil
 }
 
@@ -179,95 +179,197 @@ func TestEstimateCompressionRatio(t *testing.T) {
 	}
 }
 
-func TestResolveCompressionFallbackToGzip(t *testing.T) {
+func TestResolveCompressionWithoutTools(t *testing.T) {
 	logger := logging.New(types.LogLevelInfo, false)
-	config := &ArchiverConfig{
-		Compression:      types.CompressionXZ,
-		CompressionLevel: 9,
-		DryRun:           false,
-	}
-	archiver := NewArchiver(logger, config)
+	// Compression runs in-process: no binary in PATH is needed
+	t.Setenv("PATH", t.TempDir())
 
-	original := lookPath
-	restore := WithLookPathOverride(func(binary string) (string, error) {
-		if binary == "xz" {
-			return "", fmt.Errorf("xz not available")
-		}
-		return original(binary)
-	})
-	t.Cleanup(restore)
-
-	actual := archiver.ResolveCompression()
-	if actual != types.CompressionGzip {
-		t.Fatalf("expected fallback to gzip, got %s", actual)
+	archiver := NewArchiver(logger, &ArchiverConfig{Compression: types.CompressionXZ, CompressionLevel: 12})
+	if actual := archiver.ResolveCompression(); actual != types.CompressionXZ {
+		t.Fatalf("expected xz without the xz binary, got %s", actual)
 	}
-	if archiver.CompressionLevel() < 1 || archiver.CompressionLevel() > 9 {
-		t.Fatalf("gzip compression level should be normalized to 1-9, got %d", archiver.CompressionLevel())
+	if archiver.CompressionLevel() != 6 {
+		t.Fatalf("xz compression level should be normalized to 6, got %d", archiver.CompressionLevel())
+	}
+
+	archiver = NewArchiver(logger, &ArchiverConfig{Compression: "brotli", CompressionLevel: 9})
+	if actual := archiver.ResolveCompression(); actual != types.CompressionGzip {
+		t.Fatalf("expected fallback to gzip for an unknown type, got %s", actual)
 	}
 }
 
-func TestBuildXZArgs(t *testing.T) {
+func TestNewCompressor(t *testing.T) {
 	tests := []struct {
 		name     string
-		level    int
-		threads  int
-		mode     string
-		expected []string
+		config   CompressorConfig
+		expected Compressor
 	}{
 		{
-			name:     "standard auto threads",
-			level:    6,
-			threads:  0,
-			mode:     "standard",
-			expected: []string{"-6", "-T0", "-c"},
+			name:     "pigz best in ultra mode",
+			config:   CompressorConfig{Compression: types.CompressionPigz, Level: 6, Threads: 4, Mode: "ultra"},
+			expected: pigzCompressor{level: 9, threads: 4},
+		},
+		{
+			name:     "bzip2 single thread unless requested",
+			config:   CompressorConfig{Compression: types.CompressionBzip2, Level: 9},
+			expected: bzip2Compressor{level: 9, threads: 1},
+		},
+		{
+			name:     "xz preset dictionary",
+			config:   CompressorConfig{Compression: types.CompressionXZ, Level: 9, Threads: 2, Mode: "ultra"},
+			expected: xzCompressor{dictCap: 64 << 20, threads: 2},
+		},
+		{
+			name:     "lzma invalid level",
+			config:   CompressorConfig{Compression: types.CompressionLZMA, Level: 15},
+			expected: lzmaCompressor{dictCap: 8 << 20},
 		},
 		{
-			name:     "ultra with threads",
-			level:    9,
-			threads:  4,
-			mode:     "ultra",
-			expected: []string{"-9", "-T4", "--extreme", "-c"},
+			name:     "zstd ultra level",
+			config:   CompressorConfig{Compression: types.CompressionZstd, Level: 22, Threads: 3},
+			expected: zstdCompressor{level: 22, threads: 3},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			args := buildXZArgs(tt.level, tt.threads, tt.mode)
-			if !reflect.DeepEqual(args, tt.expected) {
-				t.Fatalf("buildXZArgs(%d,%d,%s) = %#v; want %#v", tt.level, tt.threads, tt.mode, args, tt.expected)
+			compressor, err := NewCompressor(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(compressor, tt.expected) {
+				t.Fatalf("NewCompressor(%+v) = %#v; want %#v", tt.config, compressor, tt.expected)
 			}
 		})
 	}
+
+	if _, err := NewCompressor(CompressorConfig{Compression: "brotli"}); err == nil {
+		t.Error("NewCompressor accepted an unknown compression type")
+	}
 }
 
-func TestBuildZstdArgs(t *testing.T) {
+func TestCompressionModeIgnored(t *testing.T) {
 	tests := []struct {
-		name     string
-		level    int
-		threads  int
-		expected []string
+		config  CompressorConfig
+		ignored bool
 	}{
-		{
-			name:     "standard level",
-			level:    15,
-			threads:  2,
-			expected: []string{"-15", "-T2", "-q", "-c"},
-		},
-		{
-			name:     "ultra level",
-			level:    22,
-			threads:  0,
-			expected: []string{"--ultra", "-22", "-T0", "-q", "-c"},
-		},
+		{CompressorConfig{Compression: types.CompressionXZ, Mode: "ultra"}, true},
+		{CompressorConfig{Compression: types.CompressionLZMA, Mode: "maximum"}, true},
+		{CompressorConfig{Compression: types.CompressionZstd, Mode: "ultra"}, true},
+		{CompressorConfig{Compression: types.CompressionXZ, Mode: "standard"}, false},
+		{CompressorConfig{Compression: types.CompressionPigz, Mode: "ultra"}, false},
 	}
-
 	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			args := buildZstdArgs(tt.level, tt.threads)
-			if !reflect.DeepEqual(args, tt.expected) {
-				t.Fatalf("buildZstdArgs(%d,%d) = %#v; want %#v", tt.level, tt.threads, args, tt.expected)
-			}
-		})
+		if got := compressionModeIgnored(tt.config); got != tt.ignored {
+			t.Errorf("compressionModeIgnored(%+v) = %v; want %v", tt.config, got, tt.ignored)
+		}
+	}
+}
+
+func TestCreateArchiveCompressesInProcess(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.New(types.LogLevelInfo, false)
+	t.Setenv("PATH", t.TempDir())
+
+	// A few MiB, so that the multi-threaded stages split the stream
+	source := t.TempDir()
+	var content strings.Builder
+	for i := 0; content.Len() < 3<<20; i++ {
+		fmt.Fprintf(&content, "node%d: 10.0.%d.%d vmbr%d\n", i%7, i%256, i*31%256, i%3)
+	}
+	files := map[string]string{"etc/hosts": "127.0.0.1 localhost\n", "var/log/big.log": content.String()}
+	writeTestFiles(t, source, files)
+
+	for _, compression := range []types.CompressionType{
+		types.CompressionGzip, types.CompressionPigz, types.CompressionBzip2,
+		types.CompressionXZ, types.CompressionLZMA, types.CompressionZstd,
+	} {
+		for _, threads := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s-%d", compression, threads), func(t *testing.T) {
+				archiver := NewArchiver(logger, &ArchiverConfig{Compression: compression, CompressionLevel: 1, CompressionThreads: threads})
+				outputPath := filepath.Join(t.TempDir(), "backup"+archiver.GetArchiveExtension())
+				if err := archiver.CreateArchive(ctx, source, outputPath); err != nil {
+					t.Fatalf("CreateArchive: %v", err)
+				}
+				if err := archiver.VerifyArchive(ctx, outputPath); err != nil {
+					t.Fatalf("VerifyArchive: %v", err)
+				}
+				if got := readArchiveFiles(t, outputPath, compression); !reflect.DeepEqual(got, files) {
+					t.Errorf("archive content differs from the source (%d files)", len(got))
+				}
+
+				data, err := os.ReadFile(outputPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(outputPath, data[:len(data)*2/3], 0o640); err != nil {
+					t.Fatal(err)
+				}
+				if err := archiver.VerifyArchive(ctx, outputPath); err == nil {
+					t.Error("VerifyArchive accepted a truncated archive")
+				}
+			})
+		}
+	}
+}
+
+func TestParallelWriterKeepsOrder(t *testing.T) {
+	var out strings.Builder
+	pw := newParallelWriter(&out, 7, 3, func(src []byte) ([]byte, error) {
+		return []byte("[" + string(src) + "]"), nil
+	})
+	for _, chunk := range []string{"abc", "defghijk", "lmnopqrstuvwxyz", "0123"} {
+		if _, err := pw.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[abcdefg][hijklmn][opqrstu][vwxyz01][23]"; out.String() != want {
+		t.Errorf("parallel writer wrote %q, want %q", out.String(), want)
+	}
+
+	failing := newParallelWriter(io.Discard, 4, 2, func(src []byte) ([]byte, error) {
+		return nil, errors.New("encoder failed")
+	})
+	_, err := failing.Write([]byte(strings.Repeat("x", 64)))
+	if closeErr := failing.Close(); err == nil && closeErr == nil {
+		t.Error("parallel writer did not report the encoder error")
+	}
+}
+
+// readArchiveFiles returns the regular files of a compressed tar archive
+func readArchiveFiles(t *testing.T, path string, compression types.CompressionType) map[string]string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	stream, err := NewDecompressor(file, compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	files := make(map[string]string)
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[strings.TrimPrefix(hdr.Name, "./")] = string(body)
 	}
 }
 
@@ -29,6 +29,15 @@ type Manifest struct {
 	Hostname         string    `json:"hostname"`
 	ScriptVersion    string    `json:"script_version,omitempty"`
 	EncryptionMode   string    `json:"encryption_mode,omitempty"`
+	ContentIndex     string    `json:"content_index,omitempty"`
+	// Incremental backups name the archive they are based on; ChainDepth
+	// counts the incremental backups back to the full one
+	Parent       string `json:"parent,omitempty"`
+	ParentSHA256 string `json:"parent_sha256,omitempty"`
+	ChainDepth   int    `json:"chain_depth,omitempty"`
+	// Archives split by SplitArchive list their volumes in order;
+	// ArchiveSize and SHA256 still describe the whole archive
+	Volumes []ArchiveVolume `json:"volumes,omitempty"`
 }
 
 // GenerateChecksum calculates SHA256 checksum of a file
@@ -49,6 +49,8 @@ type Collector struct {
 	dryRun     bool
 	rootsMu    sync.RWMutex
 	rootsCache map[string][]string
+	sectionsMu sync.Mutex
+	sections   map[string]string
 }
 
 func (c *Collector) incFilesProcessed() {
@@ -316,6 +318,7 @@ func (c *Collector) CollectAll(ctx context.Context) error {
 		c.logger.Warning("Unknown Proxmox type, collecting generic system info only")
 		c.logger.Debug("Skipping hypervisor-specific collection because type is unknown")
 	}
+	c.claimSection(string(c.proxType))
 
 	// Collect common system information (always collect)
 	if err := ctx.Err(); err != nil {
@@ -325,6 +328,7 @@ func (c *Collector) CollectAll(ctx context.Context) error {
 	if err := c.CollectSystemInfo(ctx); err != nil {
 		c.logger.Warning("System info collection had warnings: %v", err)
 	}
+	c.claimSection("system")
 	c.logger.Debug("Baseline system information collected successfully")
 
 	stats := c.GetStats()
@@ -334,6 +338,47 @@ func (c *Collector) CollectAll(ctx context.Context) error {
 	return nil
 }
 
+// Sections returns the collector section that staged each path, keyed by
+// the slash-separated path relative to the temporary directory
+func (c *Collector) Sections() map[string]string {
+	c.sectionsMu.Lock()
+	defer c.sectionsMu.Unlock()
+
+	sections := make(map[string]string, len(c.sections))
+	for path, section := range c.sections {
+		sections[path] = section
+	}
+	return sections
+}
+
+// claimSection attributes every staged path not claimed by an earlier
+// collection step to the named section
+func (c *Collector) claimSection(name string) {
+	if c.dryRun {
+		return
+	}
+
+	c.sectionsMu.Lock()
+	defer c.sectionsMu.Unlock()
+	if c.sections == nil {
+		c.sections = make(map[string]string)
+	}
+	_ = filepath.WalkDir(c.tempDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(c.tempDir, path)
+		if err != nil || rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if _, ok := c.sections[rel]; !ok {
+			c.sections[rel] = name
+		}
+		return nil
+	})
+}
+
 // NOTE: CollectPVEConfigs, CollectPBSConfigs, and CollectSystemInfo are now in separate files:
 // - collector_pve.go
 // - collector_pbs.go
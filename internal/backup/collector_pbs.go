@@ -39,6 +39,7 @@ func (c *Collector) CollectPBSConfigs(ctx context.Context) error {
 		return fmt.Errorf("failed to collect PBS directories: %w", err)
 	}
 	c.logger.Debug("PBS directory collection completed")
+	c.claimSection("pbs/directories")
 
 	datastores, err := c.getDatastoreList(ctx)
 	if err != nil {
@@ -55,6 +56,7 @@ func (c *Collector) CollectPBSConfigs(ctx context.Context) error {
 		return fmt.Errorf("failed to collect PBS commands: %w", err)
 	}
 	c.logger.Debug("PBS command output collection completed")
+	c.claimSection("pbs/commands")
 
 	// Collect datastore configurations
 	if c.config.BackupDatastoreConfigs {
@@ -65,6 +67,7 @@ func (c *Collector) CollectPBSConfigs(ctx context.Context) error {
 		} else {
 			c.logger.Debug("Datastore configuration collection completed")
 		}
+		c.claimSection("pbs/datastores")
 	} else {
 		c.logger.Skip("PBS datastore configuration backup disabled.")
 	}
@@ -78,6 +81,7 @@ func (c *Collector) CollectPBSConfigs(ctx context.Context) error {
 		} else {
 			c.logger.Debug("User configuration collection completed")
 		}
+		c.claimSection("pbs/users")
 	} else {
 		c.logger.Skip("PBS user/ACL backup disabled.")
 	}
@@ -89,6 +93,7 @@ func (c *Collector) CollectPBSConfigs(ctx context.Context) error {
 		} else {
 			c.logger.Debug("PXAR metadata collection completed")
 		}
+		c.claimSection("pbs/pxar")
 	} else {
 		c.logger.Skip("PBS PXAR metadata collection disabled.")
 	}
@@ -73,6 +73,7 @@ func (c *Collector) CollectPVEConfigs(ctx context.Context) error {
 		return fmt.Errorf("failed to collect PVE directories: %w", err)
 	}
 	c.logger.Debug("PVE directory collection completed")
+	c.claimSection("pve/directories")
 
 	// Collect PVE commands output
 	c.logger.Debug("Collecting PVE command outputs and runtime state")
@@ -81,6 +82,7 @@ func (c *Collector) CollectPVEConfigs(ctx context.Context) error {
 		return fmt.Errorf("failed to collect PVE commands: %w", err)
 	}
 	c.logger.Debug("PVE command output collection completed")
+	c.claimSection("pve/commands")
 
 	// Collect VM/CT configurations
 	if c.config.BackupVMConfigs {
@@ -92,6 +94,7 @@ func (c *Collector) CollectPVEConfigs(ctx context.Context) error {
 		} else {
 			c.logger.Debug("VM/CT configuration collection completed")
 		}
+		c.claimSection("pve/guest-configs")
 	} else {
 		c.logger.Skip("VM/container configuration backup disabled.")
 	}
@@ -103,6 +106,7 @@ func (c *Collector) CollectPVEConfigs(ctx context.Context) error {
 		} else {
 			c.logger.Debug("PVE job collection completed")
 		}
+		c.claimSection("pve/jobs")
 	}
 
 	if c.config.BackupPVESchedules {
@@ -112,6 +116,7 @@ func (c *Collector) CollectPVEConfigs(ctx context.Context) error {
 		} else {
 			c.logger.Debug("PVE schedule collection completed")
 		}
+		c.claimSection("pve/schedules")
 	}
 
 	if c.config.BackupPVEReplication {
@@ -121,6 +126,7 @@ func (c *Collector) CollectPVEConfigs(ctx context.Context) error {
 		} else {
 			c.logger.Debug("PVE replication collection completed")
 		}
+		c.claimSection("pve/replication")
 	}
 
 	if c.config.BackupPVEBackupFiles {
@@ -130,6 +136,7 @@ func (c *Collector) CollectPVEConfigs(ctx context.Context) error {
 		} else {
 			c.logger.Debug("PVE datastore metadata collection completed")
 		}
+		c.claimSection("pve/storage-metadata")
 	}
 
 	if c.config.BackupCephConfig {
@@ -139,6 +146,7 @@ func (c *Collector) CollectPVEConfigs(ctx context.Context) error {
 		} else {
 			c.logger.Debug("Ceph information collection completed")
 		}
+		c.claimSection("pve/ceph")
 	}
 
 	c.logger.Info("PVE configuration collection completed")
@@ -172,14 +180,6 @@ func (c *Collector) collectPVEDirectories(ctx context.Context, clustered bool) e
 			"Corosync configuration"); err != nil {
 			c.logger.Warning("Failed to copy corosync.conf: %v", err)
 		}
-
-		// Cluster directory
-		if err := c.safeCopyDir(ctx,
-			clusterPath,
-			c.targetPathFor(clusterPath),
-			"PVE cluster data"); err != nil {
-			c.logger.Warning("Failed to copy cluster data: %v", err)
-		}
 	} else {
 		if !c.config.BackupClusterConfig {
 			c.logger.Skip("PVE cluster backup disabled")
@@ -189,6 +189,17 @@ func (c *Collector) collectPVEDirectories(ctx context.Context, clustered bool) e
 		}
 	}
 
+	// Cluster directory: config.db backs /etc/pve on standalone nodes too,
+	// and is what an offline restore (restore --pve-mode database) writes back
+	if c.config.BackupClusterConfig {
+		if err := c.safeCopyDir(ctx,
+			clusterPath,
+			c.targetPathFor(clusterPath),
+			"PVE cluster data"); err != nil {
+			c.logger.Warning("Failed to copy cluster data: %v", err)
+		}
+	}
+
 	// Firewall configuration
 	if c.config.BackupPVEFirewall {
 		firewallSrc := filepath.Join(pveConfigPath, "firewall")
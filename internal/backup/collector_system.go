@@ -24,6 +24,7 @@ func (c *Collector) CollectSystemInfo(ctx context.Context) error {
 		return fmt.Errorf("failed to collect system directories: %w", err)
 	}
 	c.logger.Debug("System directories collection completed")
+	c.claimSection("system/directories")
 
 	// Collect system commands output
 	c.logger.Debug("Collecting system command outputs and runtime state")
@@ -31,6 +32,7 @@ func (c *Collector) CollectSystemInfo(ctx context.Context) error {
 		return fmt.Errorf("failed to collect system commands: %w", err)
 	}
 	c.logger.Debug("System command collection completed")
+	c.claimSection("system/commands")
 
 	// Collect kernel information
 	c.logger.Debug("Collecting kernel information (uname/modules)")
@@ -40,6 +42,7 @@ func (c *Collector) CollectSystemInfo(ctx context.Context) error {
 	} else {
 		c.logger.Debug("Kernel information collected successfully")
 	}
+	c.claimSection("system/kernel")
 
 	// Collect hardware information
 	c.logger.Debug("Collecting hardware inventory (CPU/memory/devices)")
@@ -49,6 +52,7 @@ func (c *Collector) CollectSystemInfo(ctx context.Context) error {
 	} else {
 		c.logger.Debug("Hardware inventory collected successfully")
 	}
+	c.claimSection("system/hardware")
 
 	if c.config.BackupCriticalFiles {
 		c.logger.Debug("Collecting critical files specified in configuration")
@@ -57,6 +61,7 @@ func (c *Collector) CollectSystemInfo(ctx context.Context) error {
 		} else {
 			c.logger.Debug("Critical files collected successfully")
 		}
+		c.claimSection("system/critical-files")
 	}
 
 	if len(c.config.CustomBackupPaths) > 0 {
@@ -66,6 +71,7 @@ func (c *Collector) CollectSystemInfo(ctx context.Context) error {
 		} else {
 			c.logger.Debug("Custom paths collected successfully")
 		}
+		c.claimSection("system/custom-paths")
 	}
 
 	if c.config.BackupScriptDir {
@@ -75,6 +81,7 @@ func (c *Collector) CollectSystemInfo(ctx context.Context) error {
 		} else {
 			c.logger.Debug("Script directories collected successfully")
 		}
+		c.claimSection("system/scripts")
 	}
 
 	if c.config.BackupScriptRepository {
@@ -84,6 +91,7 @@ func (c *Collector) CollectSystemInfo(ctx context.Context) error {
 		} else {
 			c.logger.Debug("Script repository collected successfully")
 		}
+		c.claimSection("system/script-repository")
 	}
 
 	if c.config.BackupSSHKeys {
@@ -93,6 +101,7 @@ func (c *Collector) CollectSystemInfo(ctx context.Context) error {
 		} else {
 			c.logger.Debug("SSH keys collected successfully")
 		}
+		c.claimSection("system/ssh-keys")
 	}
 
 	if c.config.BackupRootHome {
@@ -102,6 +111,7 @@ func (c *Collector) CollectSystemInfo(ctx context.Context) error {
 		} else {
 			c.logger.Debug("Root home directory collected successfully")
 		}
+		c.claimSection("system/root-home")
 	}
 
 	if c.config.BackupUserHomes {
@@ -111,6 +121,7 @@ func (c *Collector) CollectSystemInfo(ctx context.Context) error {
 		} else {
 			c.logger.Debug("User home directories collected successfully")
 		}
+		c.claimSection("system/user-homes")
 	}
 
 	c.logger.Info("System information collection completed")
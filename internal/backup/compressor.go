@@ -0,0 +1,373 @@
+package backup
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	dsbzip2 "github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Compressor is a compression stage of the archive pipeline. Every
+// algorithm runs in-process, so creating an archive needs no external tool.
+type Compressor interface {
+	// Algorithm returns the compression type the stage writes
+	Algorithm() types.CompressionType
+	// NewWriter returns the writer the tar stream is written to. Close
+	// flushes the compressed stream to w; w itself is not closed.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// CompressorConfig selects and tunes a Compressor. Level and Mode follow the
+// command line presets of each tool (see normalizeLevelForCompression);
+// Threads 0 means one per CPU.
+type CompressorConfig struct {
+	Compression types.CompressionType
+	Level       int
+	Threads     int
+	Mode        string
+}
+
+// gzipJobSize is the size of the independent jobs of the multi-threaded
+// gzip stage: large enough that splitting the stream costs little ratio,
+// small enough to keep threads*job in memory
+const gzipJobSize = 1 << 20
+
+// xzPresetDictCap is the dictionary size of the xz/lzma presets -0 to -9
+var xzPresetDictCap = [10]int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// NewCompressor returns the stage for cfg.Compression with its level
+// normalized like the configuration of the Bash script
+func NewCompressor(cfg CompressorConfig) (Compressor, error) {
+	level := normalizeLevelForCompression(cfg.Compression, cfg.Level)
+	extreme := requiresExtremeMode(normalizeCompressionMode(cfg.Mode))
+	switch cfg.Compression {
+	case types.CompressionNone:
+		return noneCompressor{}, nil
+	case types.CompressionGzip:
+		return gzipCompressor{level: level}, nil
+	case types.CompressionPigz:
+		if extreme {
+			level = gzip.BestCompression
+		}
+		return pigzCompressor{level: level, threads: compressionThreads(cfg.Threads)}, nil
+	case types.CompressionBzip2:
+		// Like the Bash script, bzip2 uses several threads (pbzip2) only
+		// when they are requested explicitly
+		threads := 1
+		if cfg.Threads > 1 {
+			threads = cfg.Threads
+		}
+		return bzip2Compressor{level: level, threads: threads}, nil
+	case types.CompressionXZ:
+		return xzCompressor{dictCap: xzPresetDictCap[level], threads: compressionThreads(cfg.Threads)}, nil
+	case types.CompressionLZMA:
+		return lzmaCompressor{dictCap: xzPresetDictCap[level]}, nil
+	case types.CompressionZstd:
+		return zstdCompressor{level: level, threads: compressionThreads(cfg.Threads)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression type: %s", cfg.Compression)
+	}
+}
+
+// compressionModeIgnored reports whether cfg asks for a maximum or ultra
+// mode the stage has no counterpart for: xz and lzma --extreme, and zstd
+// --ultra, whose levels up to 22 the level alone selects here
+func compressionModeIgnored(cfg CompressorConfig) bool {
+	if !requiresExtremeMode(normalizeCompressionMode(cfg.Mode)) {
+		return false
+	}
+	switch cfg.Compression {
+	case types.CompressionXZ, types.CompressionLZMA, types.CompressionZstd:
+		return true
+	}
+	return false
+}
+
+// compressionThreads resolves COMPRESSION_THREADS, where 0 means automatic
+func compressionThreads(threads int) int {
+	if threads > 0 {
+		return threads
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+type noneCompressor struct{}
+
+func (noneCompressor) Algorithm() types.CompressionType { return types.CompressionNone }
+
+func (noneCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+func (gzipCompressor) Algorithm() types.CompressionType { return types.CompressionGzip }
+
+func (c gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+// pigzCompressor writes gzip on several threads, one gzip member per job
+type pigzCompressor struct {
+	level   int
+	threads int
+}
+
+func (pigzCompressor) Algorithm() types.CompressionType { return types.CompressionPigz }
+
+func (c pigzCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if c.threads == 1 {
+		return gzip.NewWriterLevel(w, c.level)
+	}
+	return newParallelWriter(w, gzipJobSize, c.threads, func(src []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&buf, c.level)
+		if err != nil {
+			return nil, err
+		}
+		return encodeJob(&buf, zw, src)
+	}), nil
+}
+
+// bzip2Compressor writes bzip2; with several threads every job is a
+// complete bzip2 stream, like pbzip2
+type bzip2Compressor struct {
+	level   int
+	threads int
+}
+
+func (bzip2Compressor) Algorithm() types.CompressionType { return types.CompressionBzip2 }
+
+func (c bzip2Compressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	config := &dsbzip2.WriterConfig{Level: c.level}
+	if c.threads == 1 {
+		return dsbzip2.NewWriter(w, config)
+	}
+	return newParallelWriter(w, c.level*100000, c.threads, func(src []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		zw, err := dsbzip2.NewWriter(&buf, config)
+		if err != nil {
+			return nil, err
+		}
+		return encodeJob(&buf, zw, src)
+	}), nil
+}
+
+// xzCompressor writes xz; with several threads every job is an xz stream
+// of three dictionaries, the block size of xz -T. The level selects the
+// dictionary of the xz preset; --extreme has no in-process counterpart
+// (the binary tree match finder is far too slow), so the mode is ignored
+// with a warning.
+type xzCompressor struct {
+	dictCap int
+	threads int
+}
+
+func (xzCompressor) Algorithm() types.CompressionType { return types.CompressionXZ }
+
+func (c xzCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	config := xz.WriterConfig{DictCap: c.dictCap}
+	if c.threads == 1 {
+		return config.NewWriter(w)
+	}
+	return newParallelWriter(w, max(3*c.dictCap, 1<<20), c.threads, func(src []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		zw, err := config.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		return encodeJob(&buf, zw, src)
+	}), nil
+}
+
+// lzmaCompressor writes the legacy .lzma format, which holds a single
+// stream and therefore runs on one thread
+type lzmaCompressor struct {
+	dictCap int
+}
+
+func (lzmaCompressor) Algorithm() types.CompressionType { return types.CompressionLZMA }
+
+func (c lzmaCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return lzma.WriterConfig{DictCap: c.dictCap, EOSMarker: true}.NewWriter(w)
+}
+
+// zstdCompressor writes zstd. Levels 1-22 map to the encoder levels of
+// the zstd package, whose encoder compresses on several threads itself.
+type zstdCompressor struct {
+	level   int
+	threads int
+}
+
+func (zstdCompressor) Algorithm() types.CompressionType { return types.CompressionZstd }
+
+func (c zstdCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)), zstd.WithEncoderConcurrency(c.threads))
+}
+
+// encodeJob compresses src through zw into buf
+func encodeJob(buf *bytes.Buffer, zw io.WriteCloser, src []byte) ([]byte, error) {
+	if _, err := zw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parallelWriter splits the stream into jobs that are compressed on up to
+// threads goroutines. Each job is an independent member of the format and
+// the members are written in order: the decoders read their concatenation
+// as a single stream.
+type parallelWriter struct {
+	w       io.Writer
+	encode  func(src []byte) ([]byte, error)
+	size    int
+	buf     []byte
+	slots   chan struct{}
+	queue   chan chan parallelJob
+	done    chan struct{}
+	started bool
+	closed  bool
+
+	mu  sync.Mutex
+	err error
+}
+
+type parallelJob struct {
+	out []byte
+	err error
+}
+
+func newParallelWriter(w io.Writer, size, threads int, encode func(src []byte) ([]byte, error)) *parallelWriter {
+	p := &parallelWriter{
+		w:      w,
+		encode: encode,
+		size:   size,
+		buf:    make([]byte, 0, size),
+		slots:  make(chan struct{}, threads),
+		queue:  make(chan chan parallelJob, threads),
+		done:   make(chan struct{}),
+	}
+	go p.drain()
+	return p
+}
+
+func (p *parallelWriter) Write(b []byte) (int, error) {
+	if p.closed {
+		return 0, fmt.Errorf("write to closed compressor")
+	}
+	written := 0
+	for len(b) > 0 {
+		if err := p.failed(); err != nil {
+			return written, err
+		}
+		n := copy(p.buf[len(p.buf):cap(p.buf)], b)
+		p.buf = p.buf[:len(p.buf)+n]
+		written += n
+		b = b[n:]
+		if len(p.buf) == cap(p.buf) {
+			p.submit()
+		}
+	}
+	return written, nil
+}
+
+// Close compresses the last job and waits until every job is written
+func (p *parallelWriter) Close() error {
+	if p.closed {
+		return p.failed()
+	}
+	p.closed = true
+	if len(p.buf) > 0 || !p.started {
+		p.submit()
+	}
+	close(p.queue)
+	<-p.done
+	return p.failed()
+}
+
+func (p *parallelWriter) submit() {
+	src := p.buf
+	p.buf = make([]byte, 0, p.size)
+	p.started = true
+	result := make(chan parallelJob, 1)
+	p.slots <- struct{}{}
+	p.queue <- result
+	go func() {
+		out, err := p.encode(src)
+		<-p.slots
+		result <- parallelJob{out: out, err: err}
+	}()
+}
+
+// drain writes the jobs in submission order as they complete
+func (p *parallelWriter) drain() {
+	defer close(p.done)
+	for result := range p.queue {
+		job := <-result
+		if p.failed() != nil {
+			continue
+		}
+		if job.err == nil {
+			_, job.err = p.w.Write(job.out)
+		}
+		if job.err != nil {
+			p.mu.Lock()
+			p.err = job.err
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *parallelWriter) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// NewDecompressor returns the decoded stream of an archive compressed with
+// compression. Every format is decoded in-process; a truncated or corrupted
+// stream is reported as a read error.
+func NewDecompressor(r io.Reader, compression types.CompressionType) (io.ReadCloser, error) {
+	switch compression {
+	case types.CompressionNone:
+		return io.NopCloser(r), nil
+	case types.CompressionGzip, types.CompressionPigz:
+		return gzip.NewReader(r)
+	case types.CompressionXZ:
+		dec, err := xz.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("open xz stream: %w", err)
+		}
+		return io.NopCloser(dec), nil
+	case types.CompressionZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("open zstd stream: %w", err)
+		}
+		return dec.IOReadCloser(), nil
+	case types.CompressionBzip2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case types.CompressionLZMA:
+		dec, err := lzma.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("open lzma stream: %w", err)
+		}
+		return io.NopCloser(dec), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression type: %s", compression)
+	}
+}
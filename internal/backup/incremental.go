@@ -0,0 +1,225 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+)
+
+const (
+	// IncrementalStateName is the archive entry (relative to the archive
+	// root) of incremental backups that names the parent and lists the
+	// paths removed since it.
+	IncrementalStateName = ".incremental.json"
+	// IncrementalNameMarker precedes the archive extension of incremental
+	// backups (host-backup-20250101-010000.incr.tar.xz), so retention
+	// recognises them from a file listing without reading the manifest.
+	IncrementalNameMarker = ".incr"
+)
+
+// IncrementalState is stored in every incremental archive
+type IncrementalState struct {
+	Parent string `json:"parent"`
+	// Deleted lists the index paths (/etc/...) of the parent that the
+	// restore removes before applying the archive: entries that no longer
+	// exist and entries whose type changed. Children of a listed directory
+	// are not repeated.
+	Deleted []string `json:"deleted"`
+}
+
+// IncrementalResult summarizes PrepareIncremental
+type IncrementalResult struct {
+	State     IncrementalState
+	Changed   int // new or changed files and symlinks left in the tree
+	Unchanged int // files and symlinks removed from the tree
+}
+
+// IsIncrementalName reports whether a backup file name carries
+// IncrementalNameMarker
+func IsIncrementalName(name string) bool {
+	return strings.Contains(filepath.Base(name), IncrementalNameMarker+".tar")
+}
+
+// PrepareIncremental reduces the collected tree in root to what changed
+// since the parent backup: files and symlinks whose content, link target,
+// mode and owner match the parent index are removed (directories are always
+// kept) and the parent entries missing from root are recorded in
+// IncrementalStateName. The modification time is not compared: collected
+// copies get a new one on every run. It must run before ApplyOptimizations,
+// because the index describes the files as restored.
+func PrepareIncremental(ctx context.Context, logger *logging.Logger, root string, parent *ContentIndex, parentName string) (*IncrementalResult, error) {
+	previous := make(map[string]IndexEntry, len(parent.Entries))
+	for _, entry := range parent.Entries {
+		previous[entry.Path] = entry
+	}
+
+	result := &IncrementalResult{State: IncrementalState{Parent: parentName, Deleted: []string{}}}
+	present := make(map[string]struct{})
+	var unchanged []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		entry, err := workspaceIndexEntry(p, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		present[entry.Path] = struct{}{}
+
+		old, ok := previous[entry.Path]
+		switch {
+		case ok && old.Type != entry.Type:
+			// The restore removes the old entry before writing the new one
+			result.State.Deleted = append(result.State.Deleted, entry.Path)
+			if entry.Type != IndexTypeDir {
+				result.Changed++
+			}
+		case entry.Type == IndexTypeDir:
+			// Directories are always archived
+		case ok && old.SHA256 == entry.SHA256 && old.Link == entry.Link && old.Mode == entry.Mode &&
+			old.UID == entry.UID && old.GID == entry.GID:
+			unchanged = append(unchanged, p)
+		default:
+			result.Changed++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("compare with parent backup: %w", err)
+	}
+
+	for _, p := range unchanged {
+		if err := os.Remove(p); err != nil {
+			return nil, fmt.Errorf("drop unchanged file: %w", err)
+		}
+	}
+	result.Unchanged = len(unchanged)
+
+	for _, entry := range parent.Entries {
+		if _, ok := present[entry.Path]; !ok && !result.State.Removes(path.Dir(entry.Path)) {
+			result.State.Deleted = append(result.State.Deleted, entry.Path)
+		}
+	}
+	sort.Strings(result.State.Deleted)
+
+	data, err := json.MarshalIndent(&result.State, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("encode incremental state: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, IncrementalStateName), data, 0640); err != nil {
+		return nil, fmt.Errorf("write incremental state: %w", err)
+	}
+
+	logger.Debug("Incremental against %s: %d changed, %d unchanged, %d deleted",
+		parentName, result.Changed, result.Unchanged, len(result.State.Deleted))
+	return result, nil
+}
+
+// workspaceIndexEntry builds the index entry the archiver would record for
+// a file of the collected tree
+func workspaceIndexEntry(p, rel string) (IndexEntry, error) {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(p); err != nil {
+			return IndexEntry{}, err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	header.Name = rel
+
+	sum := ""
+	if info.Mode().IsRegular() {
+		if sum, err = hashFile(p); err != nil {
+			return IndexEntry{}, err
+		}
+	}
+	return newIndexEntry(header, sum), nil
+}
+
+// Removes reports whether the restore deletes an index path, directly or
+// through one of its parent directories
+func (s *IncrementalState) Removes(name string) bool {
+	for _, deleted := range s.Deleted {
+		if name == deleted || strings.HasPrefix(name, strings.TrimSuffix(deleted, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadIncrementalState reads the IncrementalStateName file of an extracted
+// incremental archive
+func LoadIncrementalState(statePath string) (*IncrementalState, error) {
+	file, err := os.Open(statePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("incremental archive has no %s", IncrementalStateName)
+		}
+		return nil, fmt.Errorf("read incremental state: %w", err)
+	}
+	defer file.Close()
+	return ReadIncrementalState(file)
+}
+
+// ReadIncrementalState parses an IncrementalStateName file, e.g. straight
+// from the archive entry
+func ReadIncrementalState(r io.Reader) (*IncrementalState, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read incremental state: %w", err)
+	}
+	var state IncrementalState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parse incremental state: %w", err)
+	}
+	return &state, nil
+}
+
+// ApplyIncremental makes the index of an incremental archive describe the
+// whole backup: the parent entries the archive neither replaces nor deletes
+// are added back and the state file is dropped, so listing, search, diff
+// and the next incremental backup see the complete tree.
+func (idx *ContentIndex) ApplyIncremental(state *IncrementalState, parent *ContentIndex) {
+	own := make(map[string]struct{}, len(idx.Entries))
+	entries := idx.Entries[:0]
+	for _, entry := range idx.Entries {
+		if entry.Path == "/"+IncrementalStateName {
+			continue
+		}
+		own[entry.Path] = struct{}{}
+		entries = append(entries, entry)
+	}
+	for _, entry := range parent.Entries {
+		if _, ok := own[entry.Path]; ok || state.Removes(entry.Path) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	idx.Entries = entries
+}
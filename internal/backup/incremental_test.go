@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+// indexTree builds the content index the archiver would store for root
+func indexTree(t *testing.T, root string) *ContentIndex {
+	t.Helper()
+	index := &ContentIndex{Version: ContentIndexVersion}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		entry, err := workspaceIndexEntry(p, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		index.Entries = append(index.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, body := range files {
+		target := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, []byte(body), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPrepareIncremental(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"etc/hosts":      "127.0.0.1 localhost\n",
+		"etc/hostname":   "pve1\n",
+		"etc/old/x.conf": "x\n",
+		"etc/swap":       "file\n",
+	})
+	if err := os.Symlink("hosts", filepath.Join(root, "etc/link")); err != nil {
+		t.Fatal(err)
+	}
+	parent := indexTree(t, root)
+
+	// The next collection: one file changed, one added, one directory gone
+	// and a file replaced by a directory
+	if err := os.RemoveAll(filepath.Join(root, "etc/old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "etc/swap")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, root, map[string]string{
+		"etc/hosts":       "127.0.0.1 localhost pve1\n",
+		"etc/new.conf":    "n\n",
+		"etc/swap/inside": "dir\n",
+	})
+
+	logger := logging.New(types.LogLevelInfo, false)
+	result, err := PrepareIncremental(context.Background(), logger, root, parent, "pve1-backup-20250101-010000.tar.xz")
+	if err != nil {
+		t.Fatalf("PrepareIncremental: %v", err)
+	}
+	if result.Changed != 3 || result.Unchanged != 2 {
+		t.Errorf("changed = %d, unchanged = %d", result.Changed, result.Unchanged)
+	}
+	if want := []string{"/etc/old", "/etc/swap"}; !reflect.DeepEqual(result.State.Deleted, want) {
+		t.Errorf("deleted = %v, want %v", result.State.Deleted, want)
+	}
+	for _, gone := range []string{"etc/hostname", "etc/link"} {
+		if _, err := os.Lstat(filepath.Join(root, gone)); !os.IsNotExist(err) {
+			t.Errorf("unchanged %s left in the tree (%v)", gone, err)
+		}
+	}
+	for _, kept := range []string{"etc/hosts", "etc/new.conf", "etc/swap/inside"} {
+		if _, err := os.Lstat(filepath.Join(root, kept)); err != nil {
+			t.Errorf("changed %s removed: %v", kept, err)
+		}
+	}
+
+	state, err := LoadIncrementalState(filepath.Join(root, IncrementalStateName))
+	if err != nil {
+		t.Fatalf("LoadIncrementalState: %v", err)
+	}
+	if state.Parent != "pve1-backup-20250101-010000.tar.xz" || !state.Removes("/etc/old/x.conf") || state.Removes("/etc/hosts") {
+		t.Errorf("state = %+v", state)
+	}
+
+	// The stored index describes the whole backup
+	index := indexTree(t, root)
+	index.ApplyIncremental(state, parent)
+	var paths []string
+	for _, entry := range index.Entries {
+		paths = append(paths, entry.Path)
+	}
+	want := []string{"/etc", "/etc/hostname", "/etc/hosts", "/etc/link", "/etc/new.conf", "/etc/swap", "/etc/swap/inside"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("index paths = %v, want %v", paths, want)
+	}
+	if swap, _ := index.Lookup("/etc/swap"); swap.Type != IndexTypeDir {
+		t.Errorf("/etc/swap = %+v", swap)
+	}
+}
+
+func TestIsIncrementalName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"/backup/pve1-backup-20250101-010000.incr.tar.xz":                true,
+		"pve1-backup-20250101-010000.incr.tar.zst.age.bundle.tar":        true,
+		"pve1-backup-20250101-010000.tar.xz":                             false,
+		"pve1-backup-20250101-010000.tar.xz.bundle.tar":                  false,
+		"/backup/incr.tar/pve1-backup-20250101-010000.tar.gz.bundle.tar": false,
+	} {
+		if got := IsIncrementalName(name); got != want {
+			t.Errorf("IsIncrementalName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// ContentIndexSuffix is appended to the archive name to form the name of
+	// its content index, both as a sidecar file and as a bundle member
+	ContentIndexSuffix = ".index.json.gz"
+	// ContentIndexVersion is the format version written by this release
+	ContentIndexVersion = 1
+)
+
+// ErrNoContentIndex is returned when a backup carries no content index
+// (backups created before the index was introduced)
+var ErrNoContentIndex = errors.New("backup has no content index")
+
+// Entry types of a content index
+const (
+	IndexTypeFile    = "file"
+	IndexTypeDir     = "dir"
+	IndexTypeSymlink = "symlink"
+	IndexTypeOther   = "other"
+)
+
+// IndexEntry describes one entry of a backup archive
+type IndexEntry struct {
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size,omitempty"`
+	Mode    string    `json:"mode"`
+	UID     int       `json:"uid"`
+	GID     int       `json:"gid"`
+	User    string    `json:"user,omitempty"`
+	Group   string    `json:"group,omitempty"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Link    string    `json:"link,omitempty"`
+	Section string    `json:"section,omitempty"`
+	// Blob names the repository blob of the content when it is not SHA256
+	// (encrypted repository snapshots)
+	Blob string `json:"blob,omitempty"`
+}
+
+// blob returns the name of the repository blob holding the content
+func (e IndexEntry) blob() string {
+	if e.Blob != "" {
+		return e.Blob
+	}
+	return e.SHA256
+}
+
+// ContentIndex lists every entry of a backup archive. It is stored next to
+// the archive (gzip-compressed JSON) and never encrypted, so it can be read
+// without decrypting or decompressing the archive itself.
+type ContentIndex struct {
+	Version   int          `json:"version"`
+	Archive   string       `json:"archive,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	Entries   []IndexEntry `json:"entries"`
+}
+
+// newIndexEntry builds the index entry of a tar header
+func newIndexEntry(header *tar.Header, sum string) IndexEntry {
+	entry := IndexEntry{
+		Path:    "/" + strings.TrimPrefix(path.Clean("/"+header.Name), "/"),
+		Mode:    fmt.Sprintf("%04o", header.Mode&0o7777),
+		UID:     header.Uid,
+		GID:     header.Gid,
+		User:    header.Uname,
+		Group:   header.Gname,
+		ModTime: header.ModTime.UTC(),
+		SHA256:  sum,
+	}
+	switch header.Typeflag {
+	case tar.TypeReg:
+		entry.Type = IndexTypeFile
+		entry.Size = header.Size
+	case tar.TypeDir:
+		entry.Type = IndexTypeDir
+	case tar.TypeSymlink:
+		entry.Type = IndexTypeSymlink
+		entry.Link = header.Linkname
+	default:
+		entry.Type = IndexTypeOther
+	}
+	return entry
+}
+
+// Files returns the number of regular files in the index
+func (idx *ContentIndex) Files() int {
+	count := 0
+	for _, entry := range idx.Entries {
+		if entry.Type == IndexTypeFile {
+			count++
+		}
+	}
+	return count
+}
+
+// Lookup returns the entry stored for an absolute path
+func (idx *ContentIndex) Lookup(name string) (IndexEntry, bool) {
+	name = path.Clean("/" + name)
+	for _, entry := range idx.Entries {
+		if entry.Path == name {
+			return entry, true
+		}
+	}
+	return IndexEntry{}, false
+}
+
+// AssignSections records the collector section of every entry. sections is
+// keyed by the path relative to the staging directory (see
+// Collector.Sections); entries created after collection inherit the section
+// of their nearest recorded parent directory.
+func (idx *ContentIndex) AssignSections(sections map[string]string) {
+	if len(sections) == 0 {
+		return
+	}
+	for i := range idx.Entries {
+		rel := strings.TrimPrefix(idx.Entries[i].Path, "/")
+		for rel != "." && rel != "" {
+			if section, ok := sections[rel]; ok {
+				idx.Entries[i].Section = section
+				break
+			}
+			rel = path.Dir(rel)
+		}
+	}
+}
+
+// ApplyOptimizations makes the index describe the files a restore produces
+// rather than their optimized form: chunked files replace their chunks and
+// marker, deduplicated files replace their symlink and reversible
+// prefiltered files get their original size and hash back.
+func (idx *ContentIndex) ApplyOptimizations(manifest *OptimizationManifest) {
+	if manifest.Empty() {
+		return
+	}
+
+	original := func(entry *IndexEntry, file OptimizedFile) {
+		entry.Type = IndexTypeFile
+		entry.Size = file.Size
+		entry.SHA256 = file.SHA256
+		entry.Mode = fmt.Sprintf("%04o", file.Mode&0o7777)
+		entry.UID = file.UID
+		entry.GID = file.GID
+		entry.ModTime = file.ModTime.UTC()
+		entry.Link = ""
+	}
+
+	chunked := make(map[string]OptimizedFile, len(manifest.Chunked))
+	for _, file := range manifest.Chunked {
+		chunked["/"+file.Path+ChunkMarkerSuffix] = file
+	}
+	deduplicated := make(map[string]OptimizedFile, len(manifest.Deduplicated))
+	for _, file := range manifest.Deduplicated {
+		deduplicated["/"+file.Path] = file
+	}
+	prefiltered := make(map[string]OptimizedFile, len(manifest.Prefiltered))
+	for _, file := range manifest.Prefiltered {
+		if file.Reversible {
+			prefiltered["/"+file.Path] = file.OptimizedFile
+		}
+	}
+
+	entries := idx.Entries[:0]
+	for _, entry := range idx.Entries {
+		if entry.Path == "/"+OptimizationManifestName || entry.Path == "/"+ChunkDirName ||
+			strings.HasPrefix(entry.Path, "/"+ChunkDirName+"/") {
+			continue
+		}
+		if file, ok := chunked[entry.Path]; ok {
+			entry.Path = "/" + file.Path
+			original(&entry, file)
+		}
+		if file, ok := deduplicated[entry.Path]; ok {
+			original(&entry, file)
+		}
+		if file, ok := prefiltered[entry.Path]; ok {
+			entry.Size = file.Size
+			entry.SHA256 = file.SHA256
+		}
+		entries = append(entries, entry)
+	}
+	idx.Entries = entries
+}
+
+// IndexTree builds the content index of the collected tree in root, with
+// the entries the archiver would record for it
+func IndexTree(ctx context.Context, root string) (*ContentIndex, error) {
+	idx := &ContentIndex{Version: ContentIndexVersion, CreatedAt: time.Now().UTC()}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		entry, err := workspaceIndexEntry(p, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		idx.Entries = append(idx.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("index %s: %w", root, err)
+	}
+	return idx, nil
+}
+
+// WriteContentIndex stores the index as gzip-compressed JSON
+func WriteContentIndex(idx *ContentIndex, outputPath string) (err error) {
+	file, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("create content index: %w", err)
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close content index: %w", cerr)
+		}
+	}()
+
+	zw := gzip.NewWriter(file)
+	if err := json.NewEncoder(zw).Encode(idx); err != nil {
+		return fmt.Errorf("write content index: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("write content index: %w", err)
+	}
+	return nil
+}
+
+// ReadContentIndex decodes an index written by WriteContentIndex
+func ReadContentIndex(r io.Reader) (*ContentIndex, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("read content index: %w", err)
+	}
+	defer zr.Close()
+
+	var idx ContentIndex
+	if err := json.NewDecoder(zr).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("parse content index: %w", err)
+	}
+	if idx.Version > ContentIndexVersion {
+		return nil, fmt.Errorf("content index version %d is newer than supported (%d)", idx.Version, ContentIndexVersion)
+	}
+	return &idx, nil
+}
+
+// LoadContentIndex reads an index sidecar file
+func LoadContentIndex(indexPath string) (*ContentIndex, error) {
+	file, err := os.Open(indexPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNoContentIndex
+		}
+		return nil, fmt.Errorf("open content index: %w", err)
+	}
+	defer file.Close()
+	return ReadContentIndex(file)
+}
+
+// ReadContentIndexFromBundle scans a bundle for its index member. The
+// archive member is skipped without being read when r is seekable.
+func ReadContentIndexFromBundle(r io.Reader) (*ContentIndex, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, ErrNoContentIndex
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read bundle: %w", err)
+		}
+		if strings.HasSuffix(hdr.Name, ContentIndexSuffix) {
+			return ReadContentIndex(tr)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+func TestCreateArchiveBuildsContentIndex(t *testing.T) {
+	logger := logging.New(types.LogLevelInfo, false)
+	archiver := NewArchiver(logger, &ArchiverConfig{Compression: types.CompressionGzip, CompressionLevel: 6})
+	tempDir := t.TempDir()
+
+	source := filepath.Join(tempDir, "source")
+	if err := os.MkdirAll(filepath.Join(source, "etc", "pve"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("dir: local\n")
+	if err := os.WriteFile(filepath.Join(source, "etc", "pve", "storage.cfg"), content, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("storage.cfg", filepath.Join(source, "etc", "pve", "storage.link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if archiver.ContentIndex() != nil {
+		t.Fatal("index should be nil before an archive is written")
+	}
+	if err := archiver.CreateArchive(context.Background(), source, filepath.Join(tempDir, "test.tar.gz")); err != nil {
+		t.Fatalf("CreateArchive failed: %v", err)
+	}
+
+	index := archiver.ContentIndex()
+	if index == nil || index.Version != ContentIndexVersion {
+		t.Fatalf("index = %+v", index)
+	}
+	if len(index.Entries) != 4 || index.Files() != 1 {
+		t.Fatalf("entries = %+v", index.Entries)
+	}
+
+	sum := sha256.Sum256(content)
+	file, ok := index.Lookup("etc/pve/storage.cfg")
+	if !ok {
+		t.Fatal("storage.cfg not indexed")
+	}
+	if file.Path != "/etc/pve/storage.cfg" || file.Type != IndexTypeFile || file.Size != int64(len(content)) ||
+		file.Mode != "0640" || file.SHA256 != hex.EncodeToString(sum[:]) || file.UID != os.Getuid() {
+		t.Errorf("file entry = %+v", file)
+	}
+	if link, _ := index.Lookup("/etc/pve/storage.link"); link.Type != IndexTypeSymlink || link.Link != "storage.cfg" || link.SHA256 != "" {
+		t.Errorf("symlink entry = %+v", link)
+	}
+	if dir, _ := index.Lookup("/etc"); dir.Type != IndexTypeDir {
+		t.Errorf("dir entry = %+v", dir)
+	}
+}
+
+func TestContentIndexAssignSections(t *testing.T) {
+	index := &ContentIndex{Entries: []IndexEntry{
+		{Path: "/etc/pve/storage.cfg"},
+		{Path: "/etc/network/interfaces"},
+		{Path: "/var/lib/proxmox-backup-info/backup_metadata.txt"},
+	}}
+	index.AssignSections(map[string]string{
+		"etc/pve":                 "pve/directories",
+		"etc/pve/storage.cfg":     "pve/directories",
+		"etc/network":             "system/directories",
+		"etc/network/interfaces":  "system/directories",
+		"var/lib/proxmox-backup-": "system/commands",
+	})
+
+	want := []string{"pve/directories", "system/directories", ""}
+	for i, entry := range index.Entries {
+		if entry.Section != want[i] {
+			t.Errorf("%s: section = %q, want %q", entry.Path, entry.Section, want[i])
+		}
+	}
+}
+
+func TestContentIndexApplyOptimizations(t *testing.T) {
+	index := &ContentIndex{Entries: []IndexEntry{
+		{Path: "/" + OptimizationManifestName, Type: IndexTypeFile},
+		{Path: "/" + ChunkDirName, Type: IndexTypeDir},
+		{Path: "/" + ChunkDirName + "/var/log/big.log.001.chunk", Type: IndexTypeFile},
+		{Path: "/var/log/big.log" + ChunkMarkerSuffix, Type: IndexTypeFile, Mode: "0640"},
+		{Path: "/etc/a.conf", Type: IndexTypeFile, Size: 4, SHA256: "filtered"},
+		{Path: "/etc/b.conf", Type: IndexTypeSymlink, Link: "a.conf"},
+		{Path: "/etc/c.conf", Type: IndexTypeFile, Size: 3, SHA256: "lossy"},
+	}}
+	index.ApplyOptimizations(&OptimizationManifest{
+		Chunked:      []OptimizedFile{{Path: "var/log/big.log", Size: 100, SHA256: "big", Mode: 0o644}},
+		Deduplicated: []OptimizedFile{{Path: "etc/b.conf", Size: 4, SHA256: "filtered", Mode: 0o640}},
+		Prefiltered: []PrefilteredFile{
+			{OptimizedFile: OptimizedFile{Path: "etc/a.conf", Size: 6, SHA256: "original-a"}, Reversible: true},
+			{OptimizedFile: OptimizedFile{Path: "etc/b.conf", Size: 6, SHA256: "original-a"}, Reversible: true},
+			{OptimizedFile: OptimizedFile{Path: "etc/c.conf", Size: 5, SHA256: "original-c"}},
+		},
+	})
+
+	if len(index.Entries) != 4 {
+		t.Fatalf("entries = %+v", index.Entries)
+	}
+	if big, ok := index.Lookup("/var/log/big.log"); !ok || big.Size != 100 || big.SHA256 != "big" || big.Mode != "0644" {
+		t.Errorf("chunked entry = %+v", big)
+	}
+	if a, _ := index.Lookup("/etc/a.conf"); a.Size != 6 || a.SHA256 != "original-a" {
+		t.Errorf("prefiltered entry = %+v", a)
+	}
+	if b, _ := index.Lookup("/etc/b.conf"); b.Type != IndexTypeFile || b.Link != "" || b.SHA256 != "original-a" {
+		t.Errorf("deduplicated entry = %+v", b)
+	}
+	if c, _ := index.Lookup("/etc/c.conf"); c.SHA256 != "lossy" {
+		t.Errorf("irreversible prefilter entry = %+v", c)
+	}
+}
+
+func TestContentIndexRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	index := &ContentIndex{
+		Version: ContentIndexVersion,
+		Archive: "host-backup.tar.xz",
+		Entries: []IndexEntry{{Path: "/etc/hostname", Type: IndexTypeFile, Size: 5, Mode: "0644", Section: "system/directories"}},
+	}
+	indexPath := filepath.Join(dir, index.Archive+ContentIndexSuffix)
+	if err := WriteContentIndex(index, indexPath); err != nil {
+		t.Fatalf("WriteContentIndex() error: %v", err)
+	}
+
+	loaded, err := LoadContentIndex(indexPath)
+	if err != nil {
+		t.Fatalf("LoadContentIndex() error: %v", err)
+	}
+	if loaded.Archive != index.Archive || len(loaded.Entries) != 1 || loaded.Entries[0] != index.Entries[0] {
+		t.Errorf("loaded = %+v", loaded)
+	}
+
+	if _, err := LoadContentIndex(filepath.Join(dir, "missing"+ContentIndexSuffix)); !errors.Is(err, ErrNoContentIndex) {
+		t.Errorf("missing index error = %v", err)
+	}
+
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bundle bytes.Buffer
+	tw := tar.NewWriter(&bundle)
+	members := []struct {
+		name string
+		data []byte
+	}{
+		{index.Archive, []byte("archive data")},
+		{index.Archive + ".sha256", []byte("sum  host-backup.tar.xz\n")},
+		{index.Archive + ContentIndexSuffix, data},
+	}
+	for _, m := range members {
+		if err := tw.WriteHeader(&tar.Header{Name: m.name, Mode: 0o640, Size: int64(len(m.data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(m.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fromBundle, err := ReadContentIndexFromBundle(bytes.NewReader(bundle.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadContentIndexFromBundle() error: %v", err)
+	}
+	if len(fromBundle.Entries) != 1 || fromBundle.Entries[0].Path != "/etc/hostname" {
+		t.Errorf("bundle index = %+v", fromBundle)
+	}
+
+	var empty bytes.Buffer
+	if err := tar.NewWriter(&empty).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadContentIndexFromBundle(&empty); !errors.Is(err, ErrNoContentIndex) {
+		t.Errorf("bundle without index error = %v", err)
+	}
+}
+
+func TestCollectorSections(t *testing.T) {
+	logger := logging.New(types.LogLevelInfo, false)
+	tempDir := t.TempDir()
+	collector := NewCollector(logger, GetDefaultCollectorConfig(), tempDir, types.ProxmoxVE, false)
+
+	write := func(rel string) {
+		t.Helper()
+		path := filepath.Join(tempDir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("etc/pve/storage.cfg")
+	collector.claimSection("pve/directories")
+	write("etc/network/interfaces")
+	collector.claimSection("system/directories")
+
+	sections := collector.Sections()
+	if sections["etc/pve/storage.cfg"] != "pve/directories" || sections["etc"] != "pve/directories" {
+		t.Errorf("pve paths = %v", sections)
+	}
+	if sections["etc/network/interfaces"] != "system/directories" {
+		t.Errorf("system paths = %v", sections)
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/tis24dev/proxmox-backup/internal/logging"
 )
@@ -30,6 +32,112 @@ func (c OptimizationConfig) Enabled() bool {
 	return c.EnableChunking || c.EnableDeduplication || c.EnablePrefilter
 }
 
+const (
+	// OptimizationManifestName is the archive entry (relative to the archive
+	// root) describing the optimizations that restore has to undo.
+	OptimizationManifestName = ".optimizations.json"
+	// ChunkDirName is the directory holding the chunks of split files.
+	ChunkDirName = "chunked_files"
+	// ChunkMarkerSuffix marks a file that was replaced by its chunks.
+	ChunkMarkerSuffix = ".chunked"
+)
+
+// OptimizationManifest records the original state of every file changed by
+// chunking or deduplication so that restore can rebuild and verify it.
+type OptimizationManifest struct {
+	Chunked      []OptimizedFile   `json:"chunked,omitempty"`
+	Deduplicated []OptimizedFile   `json:"deduplicated,omitempty"`
+	Prefiltered  []PrefilteredFile `json:"prefiltered,omitempty"`
+}
+
+// OptimizedFile describes an original file. Paths are relative to the archive root.
+type OptimizedFile struct {
+	Path    string    `json:"path"`
+	Target  string    `json:"target,omitempty"` // dedup: file holding the same content
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	Mode    uint32    `json:"mode"`
+	UID     int       `json:"uid"`
+	GID     int       `json:"gid"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Prefilter transformations recorded in the manifest.
+const (
+	PrefilterNormalizeText   = "normalize-text"
+	PrefilterNormalizeConfig = "normalize-config"
+	PrefilterMinifyJSON      = "minify-json"
+)
+
+// PrefilteredFile describes a file rewritten by the prefilter stage. The
+// embedded record describes the original file; when Reversible is true,
+// Reverse rebuilds it from the archived content.
+type PrefilteredFile struct {
+	OptimizedFile
+	Transform      string      `json:"transform"`
+	FilteredSHA256 string      `json:"filtered_sha256"`
+	Reversible     bool        `json:"reversible"`
+	Reverse        []ReverseOp `json:"reverse,omitempty"`
+}
+
+// ReverseOp emits lines of the original file: Count lines of the filtered
+// content starting at Line (1-based), each wrapped in Prefix and Suffix,
+// or the literal Text when Line is 0.
+type ReverseOp struct {
+	Line   int    `json:"l,omitempty"`
+	Count  int    `json:"n,omitempty"`
+	Prefix string `json:"p,omitempty"`
+	Suffix string `json:"s,omitempty"`
+	Text   string `json:"t,omitempty"`
+}
+
+// Empty reports whether the manifest records no change.
+func (m *OptimizationManifest) Empty() bool {
+	return m == nil || (len(m.Chunked) == 0 && len(m.Deduplicated) == 0 && len(m.Prefiltered) == 0)
+}
+
+// LoadOptimizationManifest parses a manifest stream.
+func LoadOptimizationManifest(r io.Reader) (*OptimizationManifest, error) {
+	var m OptimizationManifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("parse optimization manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// ChunkPath returns the path of chunk index (1-based) for the original file
+// path, both relative to the archive root.
+func ChunkPath(path string, index int) string {
+	return fmt.Sprintf("%s.%03d.chunk", filepath.Join(ChunkDirName, path), index)
+}
+
+func newOptimizedFile(root, path string, info os.FileInfo, hash string) (OptimizedFile, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return OptimizedFile{}, err
+	}
+	file := OptimizedFile{
+		Path:    filepath.ToSlash(rel),
+		Size:    info.Size(),
+		SHA256:  hash,
+		Mode:    uint32(info.Mode().Perm()),
+		ModTime: info.ModTime(),
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		file.UID = int(st.Uid)
+		file.GID = int(st.Gid)
+	}
+	return file, nil
+}
+
+func writeOptimizationManifest(root string, manifest *OptimizationManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(root, OptimizationManifestName), data, 0640)
+}
+
 // ApplyOptimizations executes the requested optimizations in sequence.
 func ApplyOptimizations(ctx context.Context, logger *logging.Logger, root string, cfg OptimizationConfig) error {
 	if !cfg.Enabled() {
@@ -39,37 +147,49 @@ func ApplyOptimizations(ctx context.Context, logger *logging.Logger, root string
 	logger.Info("Running backup optimizations (chunking=%v dedup=%v prefilter=%v)",
 		cfg.EnableChunking, cfg.EnableDeduplication, cfg.EnablePrefilter)
 
-	if cfg.EnableDeduplication {
-		logger.Debug("Starting deduplication stage")
-		if err := deduplicateFiles(ctx, logger, root); err != nil {
-			logger.Warning("File deduplication failed: %v", err)
-		} else {
-			logger.Debug("Deduplication stage completed")
-		}
-	}
+	manifest := &OptimizationManifest{}
 
+	// Prefilter runs first: the hashes recorded by deduplication and chunking
+	// must describe the content that is actually archived.
 	if cfg.EnablePrefilter {
 		logger.Debug("Starting prefilter stage (max file size %d bytes)", cfg.PrefilterMaxFileSizeBytes)
-		if err := prefilterFiles(ctx, logger, root, cfg.PrefilterMaxFileSizeBytes); err != nil {
+		if err := prefilterFiles(ctx, logger, root, cfg.PrefilterMaxFileSizeBytes, manifest); err != nil {
 			logger.Warning("Content prefilter failed: %v", err)
 		} else {
 			logger.Debug("Prefilter stage completed")
 		}
 	}
 
+	if cfg.EnableDeduplication {
+		logger.Debug("Starting deduplication stage")
+		if err := deduplicateFiles(ctx, logger, root, manifest); err != nil {
+			logger.Warning("File deduplication failed: %v", err)
+		} else {
+			logger.Debug("Deduplication stage completed")
+		}
+	}
+
 	if cfg.EnableChunking {
 		logger.Debug("Starting chunking stage (chunk size %d bytes threshold %d bytes)", cfg.ChunkSizeBytes, cfg.ChunkThresholdBytes)
-		if err := chunkLargeFiles(ctx, logger, root, cfg.ChunkSizeBytes, cfg.ChunkThresholdBytes); err != nil {
+		if err := chunkLargeFiles(ctx, logger, root, cfg.ChunkSizeBytes, cfg.ChunkThresholdBytes, manifest); err != nil {
 			logger.Warning("Chunking failed: %v", err)
 		} else {
 			logger.Debug("Chunking stage completed")
 		}
 	}
 
+	if !manifest.Empty() {
+		if err := writeOptimizationManifest(root, manifest); err != nil {
+			return fmt.Errorf("write optimization manifest: %w", err)
+		}
+		logger.Debug("Optimization manifest written (%d chunked, %d deduplicated, %d prefiltered)",
+			len(manifest.Chunked), len(manifest.Deduplicated), len(manifest.Prefiltered))
+	}
+
 	return nil
 }
 
-func deduplicateFiles(ctx context.Context, logger *logging.Logger, root string) error {
+func deduplicateFiles(ctx context.Context, logger *logging.Logger, root string, manifest *OptimizationManifest) error {
 	logger.Debug("Scanning files for deduplication")
 
 	hashes := make(map[string]string)
@@ -104,10 +224,20 @@ func deduplicateFiles(ctx context.Context, logger *logging.Logger, root string)
 		}
 
 		if existing, ok := hashes[hash]; ok {
+			record, err := newOptimizedFile(root, path, info, hash)
+			if err != nil {
+				return nil
+			}
+			targetRel, err := filepath.Rel(root, existing)
+			if err != nil {
+				return nil
+			}
+			record.Target = filepath.ToSlash(targetRel)
 			if err := replaceWithSymlink(existing, path); err != nil {
 				logger.Warning("Failed to replace duplicate %s: %v", path, err)
 				return nil
 			}
+			manifest.Deduplicated = append(manifest.Deduplicated, record)
 			duplicates++
 			logger.Debug("Deduplicated %s → %s", path, existing)
 		} else {
@@ -149,7 +279,7 @@ func replaceWithSymlink(target, duplicate string) error {
 	return os.Symlink(rel, duplicate)
 }
 
-func chunkLargeFiles(ctx context.Context, logger *logging.Logger, root string, chunkSize, threshold int64) error {
+func chunkLargeFiles(ctx context.Context, logger *logging.Logger, root string, chunkSize, threshold int64, manifest *OptimizationManifest) error {
 	if chunkSize <= 0 {
 		chunkSize = 10 * 1024 * 1024
 	}
@@ -158,7 +288,7 @@ func chunkLargeFiles(ctx context.Context, logger *logging.Logger, root string, c
 	}
 	logger.Debug("Scanning %s for files >= %d bytes to chunk (chunk size %d)", root, threshold, chunkSize)
 
-	chunkDir := filepath.Join(root, "chunked_files")
+	chunkDir := filepath.Join(root, ChunkDirName)
 	if err := os.MkdirAll(chunkDir, 0755); err != nil {
 		return fmt.Errorf("create chunk dir: %w", err)
 	}
@@ -193,6 +323,15 @@ func chunkLargeFiles(ctx context.Context, logger *logging.Logger, root string, c
 		if err != nil {
 			return nil
 		}
+		hash, err := hashFile(path)
+		if err != nil {
+			logger.Warning("Failed to hash %s: %v", path, err)
+			return nil
+		}
+		record, err := newOptimizedFile(root, path, info, hash)
+		if err != nil {
+			return nil
+		}
 		destBase := filepath.Join(chunkDir, rel)
 		if err := splitFile(path, destBase, chunkSize); err != nil {
 			logger.Warning("Failed to chunk %s: %v", path, err)
@@ -201,8 +340,10 @@ func chunkLargeFiles(ctx context.Context, logger *logging.Logger, root string, c
 
 		if err := os.Remove(path); err != nil {
 			logger.Warning("Failed to remove original file %s after chunking: %v", path, err)
-		} else if err := os.WriteFile(path+".chunked", []byte{}, 0640); err != nil {
+		} else if err := os.WriteFile(path+ChunkMarkerSuffix, []byte{}, 0640); err != nil {
 			logger.Warning("Failed to write chunk marker for %s: %v", path, err)
+		} else {
+			manifest.Chunked = append(manifest.Chunked, record)
 		}
 		processed++
 		logger.Debug("Chunked %s into %s", path, destBase)
@@ -277,13 +418,13 @@ func writeChunk(src *os.File, chunkPath string, buf []byte, limit int64) (bool,
 	return false, nil
 }
 
-func prefilterFiles(ctx context.Context, logger *logging.Logger, root string, maxSize int64) error {
+func prefilterFiles(ctx context.Context, logger *logging.Logger, root string, maxSize int64, manifest *OptimizationManifest) error {
 	if maxSize <= 0 {
 		maxSize = 8 * 1024 * 1024
 	}
 	logger.Debug("Prefiltering files under %s (max size %d bytes)", root, maxSize)
 
-	var processed int
+	var processed, irreversible int
 	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -291,7 +432,7 @@ func prefilterFiles(ctx context.Context, logger *logging.Logger, root string, ma
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
-		if d.IsDir() {
+		if d.IsDir() || !d.Type().IsRegular() {
 			return nil
 		}
 
@@ -303,20 +444,31 @@ func prefilterFiles(ctx context.Context, logger *logging.Logger, root string, ma
 			return nil
 		}
 
-		ext := strings.ToLower(filepath.Ext(path))
-		switch ext {
+		var transform string
+		switch strings.ToLower(filepath.Ext(path)) {
 		case ".txt", ".log", ".md":
-			if err := normalizeTextFile(path); err == nil {
-				processed++
-			}
+			transform = PrefilterNormalizeText
 		case ".conf", ".cfg", ".ini":
-			if err := normalizeConfigFile(path); err == nil {
-				processed++
-			}
+			transform = PrefilterNormalizeConfig
 		case ".json":
-			if err := minifyJSON(path); err == nil {
-				processed++
-			}
+			transform = PrefilterMinifyJSON
+		default:
+			return nil
+		}
+
+		record, err := prefilterFile(root, path, info, transform)
+		if err != nil {
+			logger.Debug("Prefilter skipped %s: %v", path, err)
+			return nil
+		}
+		if record == nil {
+			return nil
+		}
+		manifest.Prefiltered = append(manifest.Prefiltered, *record)
+		processed++
+		if !record.Reversible {
+			irreversible++
+			logger.Debug("Prefiltered %s (%s) cannot be reversed on restore", path, transform)
 		}
 		return nil
 	})
@@ -325,29 +477,145 @@ func prefilterFiles(ctx context.Context, logger *logging.Logger, root string, ma
 		return fmt.Errorf("prefilter walk failed: %w", err)
 	}
 
-	logger.Info("Prefilter completed: %d files optimized", processed)
+	logger.Info("Prefilter completed: %d files optimized (%d not reversible on restore)", processed, irreversible)
 	return nil
 }
 
-func normalizeTextFile(path string) error {
+// prefilterFile rewrites path with the given transformation and returns the
+// record needed to undo it, or nil when the content did not change.
+func prefilterFile(root, path string, info os.FileInfo, transform string) (*PrefilteredFile, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	normalized := bytes.ReplaceAll(data, []byte("\r"), nil)
-	if bytes.Equal(data, normalized) {
-		return nil
+
+	var filtered []byte
+	var lineKey func(string) string
+	switch transform {
+	case PrefilterNormalizeText:
+		filtered = normalizeText(data)
+		lineKey = func(line string) string { return strings.ReplaceAll(line, "\r", "") }
+	case PrefilterNormalizeConfig:
+		filtered = normalizeConfig(data)
+		lineKey = strings.TrimSpace
+	case PrefilterMinifyJSON:
+		if filtered, err = minifyJSON(data); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown prefilter transform %q", transform)
 	}
-	return os.WriteFile(path, normalized, 0640)
+	if bytes.Equal(data, filtered) {
+		return nil, nil
+	}
+
+	original, err := newOptimizedFile(root, path, info, sha256Hex(data))
+	if err != nil {
+		return nil, err
+	}
+	record := &PrefilteredFile{
+		OptimizedFile:  original,
+		Transform:      transform,
+		FilteredSHA256: sha256Hex(filtered),
+	}
+	if lineKey != nil {
+		ops := buildReverseOps(data, filtered, lineKey)
+		if rebuilt, err := applyReverseOps(ops, filtered); err == nil && bytes.Equal(rebuilt, data) {
+			record.Reversible = true
+			record.Reverse = ops
+		}
+	}
+
+	if err := os.WriteFile(path, filtered, 0640); err != nil {
+		return nil, err
+	}
+	return record, nil
 }
 
-func normalizeConfigFile(path string) error {
-	data, err := os.ReadFile(path)
+// ReversePrefilter rebuilds the original content of a prefiltered file from
+// its archived content and verifies it against the recorded hash.
+func ReversePrefilter(filtered []byte, record PrefilteredFile) ([]byte, error) {
+	if sum := sha256Hex(filtered); sum != record.FilteredSHA256 {
+		return nil, fmt.Errorf("archived content sha256 %s does not match the prefilter record %s", sum, record.FilteredSHA256)
+	}
+	if !record.Reversible {
+		return nil, fmt.Errorf("%s is not reversible", record.Transform)
+	}
+	original, err := applyReverseOps(record.Reverse, filtered)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if int64(len(original)) != record.Size {
+		return nil, fmt.Errorf("size mismatch: rebuilt %d bytes, original %d bytes", len(original), record.Size)
+	}
+	if sum := sha256Hex(original); sum != record.SHA256 {
+		return nil, fmt.Errorf("sha256 mismatch: rebuilt %s, original %s", sum, record.SHA256)
 	}
+	return original, nil
+}
+
+// buildReverseOps maps every original line to the filtered line it became
+// (lineKey applies the per-line transformation) and keeps the lines the
+// prefilter dropped or altered beyond that as literal text.
+func buildReverseOps(original, filtered []byte, lineKey func(string) string) []ReverseOp {
+	positions := make(map[string][]int)
+	for i, line := range strings.Split(string(filtered), "\n") {
+		positions[line] = append(positions[line], i+1)
+	}
+
+	var ops []ReverseOp
+	for _, line := range strings.Split(string(original), "\n") {
+		key := lineKey(line)
+		candidates := positions[key]
+		at := strings.Index(line, key)
+		if len(candidates) == 0 || at < 0 {
+			ops = append(ops, ReverseOp{Text: line})
+			continue
+		}
+		positions[key] = candidates[1:]
+		op := ReverseOp{Line: candidates[0], Count: 1, Prefix: line[:at], Suffix: line[at+len(key):]}
+		if n := len(ops); n > 0 && op.Prefix == "" && op.Suffix == "" {
+			last := &ops[n-1]
+			if last.Line > 0 && last.Prefix == "" && last.Suffix == "" && last.Line+last.Count == op.Line {
+				last.Count++
+				continue
+			}
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func applyReverseOps(ops []ReverseOp, filtered []byte) ([]byte, error) {
+	lines := strings.Split(string(filtered), "\n")
+	var out []string
+	for _, op := range ops {
+		if op.Line == 0 {
+			out = append(out, op.Text)
+			continue
+		}
+		if op.Line < 1 || op.Count < 1 || op.Line-1+op.Count > len(lines) {
+			return nil, fmt.Errorf("reverse record references lines %d-%d of %d", op.Line, op.Line+op.Count-1, len(lines))
+		}
+		for _, line := range lines[op.Line-1 : op.Line-1+op.Count] {
+			out = append(out, op.Prefix+line+op.Suffix)
+		}
+	}
+	return []byte(strings.Join(out, "\n")), nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%x", sum[:])
+}
+
+func normalizeText(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte("\r"), nil)
+}
+
+func normalizeConfig(data []byte) []byte {
 	lines := strings.Split(string(data), "\n")
-	filtered := lines[:0]
+	filtered := lines[:0:0]
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
 		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
@@ -356,21 +624,13 @@ func normalizeConfigFile(path string) error {
 		filtered = append(filtered, line)
 	}
 	sort.Strings(filtered)
-	return os.WriteFile(path, []byte(strings.Join(filtered, "\n")), 0640)
+	return []byte(strings.Join(filtered, "\n"))
 }
 
-func minifyJSON(path string) error {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return err
-	}
+func minifyJSON(data []byte) ([]byte, error) {
 	var tmp any
 	if err := json.Unmarshal(data, &tmp); err != nil {
-		return err
-	}
-	minified, err := json.Marshal(tmp)
-	if err != nil {
-		return err
+		return nil, err
 	}
-	return os.WriteFile(path, minified, 0640)
+	return json.Marshal(tmp)
 }
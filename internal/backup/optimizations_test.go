@@ -0,0 +1,165 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+func TestApplyOptimizationsWritesManifest(t *testing.T) {
+	logger := logging.New(types.LogLevelInfo, false)
+	root := t.TempDir()
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), 100) // 1600 bytes
+	dup := []byte("same content\n")
+	files := map[string][]byte{
+		"var/lib/large.db":    large,
+		"etc/a/original.key":  dup,
+		"etc/b/duplicate.key": dup,
+		"etc/small.key":       []byte("small\n"),
+	}
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := OptimizationConfig{
+		EnableChunking:      true,
+		EnableDeduplication: true,
+		ChunkSizeBytes:      700,
+		ChunkThresholdBytes: 1000,
+	}
+	if err := ApplyOptimizations(context.Background(), logger, root, cfg); err != nil {
+		t.Fatalf("ApplyOptimizations: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(root, OptimizationManifestName))
+	if err != nil {
+		t.Fatalf("manifest not written: %v", err)
+	}
+	defer f.Close()
+	manifest, err := LoadOptimizationManifest(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Chunked) != 1 || manifest.Chunked[0].Path != "var/lib/large.db" {
+		t.Fatalf("chunked = %+v", manifest.Chunked)
+	}
+	chunked := manifest.Chunked[0]
+	if chunked.Size != int64(len(large)) || chunked.Mode != 0o600 || len(chunked.SHA256) != 64 {
+		t.Errorf("chunked record = %+v", chunked)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, err := os.Stat(filepath.Join(root, ChunkPath("var/lib/large.db", i))); err != nil {
+			t.Errorf("chunk %d: %v", i, err)
+		}
+	}
+
+	if len(manifest.Deduplicated) != 1 {
+		t.Fatalf("deduplicated = %+v", manifest.Deduplicated)
+	}
+	d := manifest.Deduplicated[0]
+	if d.Path != "etc/b/duplicate.key" || d.Target != "etc/a/original.key" || d.Size != int64(len(dup)) {
+		t.Errorf("deduplicated record = %+v", d)
+	}
+	if info, err := os.Lstat(filepath.Join(root, d.Path)); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("duplicate not replaced by a symlink: %v", err)
+	}
+}
+
+func TestApplyOptimizationsWithoutChangesWritesNoManifest(t *testing.T) {
+	logger := logging.New(types.LogLevelInfo, false)
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "hosts"), []byte("127.0.0.1 localhost\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := OptimizationConfig{EnableChunking: true, EnableDeduplication: true}
+	if err := ApplyOptimizations(context.Background(), logger, root, cfg); err != nil {
+		t.Fatalf("ApplyOptimizations: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, OptimizationManifestName)); !os.IsNotExist(err) {
+		t.Errorf("manifest written although nothing was optimized (err=%v)", err)
+	}
+}
+
+func TestPrefilterRecordsReversibleChanges(t *testing.T) {
+	logger := logging.New(types.LogLevelInfo, false)
+	root := t.TempDir()
+
+	files := map[string]string{
+		"etc/vzdump.conf":   "# vzdump defaults\n\n  tmpdir: /var/tmp  \nbwlimit: 0\n; legacy\nstorage: local\n",
+		"notes/readme.txt":  "line one\r\nline two\r\nmixed\rcarriage\r\n",
+		"etc/cluster.json":  "{\n  \"nodes\": [\"pve1\", \"pve2\"],\n  \"version\": 1.50\n}\n",
+		"etc/unchanged.cfg": "a=1\nb=2",
+	}
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ApplyOptimizations(context.Background(), logger, root, OptimizationConfig{EnablePrefilter: true}); err != nil {
+		t.Fatalf("ApplyOptimizations: %v", err)
+	}
+	f, err := os.Open(filepath.Join(root, OptimizationManifestName))
+	if err != nil {
+		t.Fatalf("manifest not written: %v", err)
+	}
+	defer f.Close()
+	manifest, err := LoadOptimizationManifest(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := make(map[string]PrefilteredFile)
+	for _, rec := range manifest.Prefiltered {
+		records[rec.Path] = rec
+	}
+	if len(records) != 3 {
+		t.Fatalf("prefiltered = %+v; want 3 records (unchanged files are not recorded)", manifest.Prefiltered)
+	}
+
+	for _, name := range []string{"etc/vzdump.conf", "notes/readme.txt"} {
+		rec := records[name]
+		if !rec.Reversible {
+			t.Errorf("%s: %s not reversible", name, rec.Transform)
+			continue
+		}
+		filtered, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(filtered) == files[name] {
+			t.Errorf("%s was not prefiltered", name)
+		}
+		original, err := ReversePrefilter(filtered, rec)
+		if err != nil {
+			t.Errorf("%s: ReversePrefilter: %v", name, err)
+		} else if string(original) != files[name] {
+			t.Errorf("%s: reversed = %q; want %q", name, original, files[name])
+		}
+		if _, err := ReversePrefilter(append(filtered, 'x'), rec); err == nil {
+			t.Errorf("%s: ReversePrefilter accepted altered content", name)
+		}
+	}
+
+	if rec := records["etc/cluster.json"]; rec.Transform != PrefilterMinifyJSON || rec.Reversible {
+		t.Errorf("cluster.json record = %+v; want irreversible %s", rec, PrefilterMinifyJSON)
+	}
+}
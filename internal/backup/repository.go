@@ -0,0 +1,885 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+)
+
+// A repository stores file contents once, as content-addressed blobs, and
+// every backup as a snapshot naming them. Below <storage>/repository:
+//
+//	blobs/<aa>/<id>                  gzip-compressed content, age-encrypted
+//	                                 when archive encryption is enabled
+//	snapshots/<name>.snapshot[.age]  content index of the backup, encrypted
+//	                                 like the blobs; Blob (or SHA256) names
+//	                                 the blob
+//	snapshots/<name>.snapshot[.age].{sha256,metadata,index.json.gz}
+//	                                 the sidecars of a raw archive
+//	keys/<keyid>.age                 blob key, encrypted like the blobs
+//	locks/<kind>-<unixnano>-<host>-<pid>.lock
+//	                                 held while a snapshot is written or
+//	                                 the repository is pruned
+//
+// Unencrypted blobs are named by the SHA-256 of their content. Encrypted
+// blobs are named by an HMAC-SHA256 of it, keyed with a secret blob key, so
+// the blob names alone do not tell whether a known file is stored. The
+// plain content index sidecar names the blob of every file, so retention
+// can remove unreferenced blobs without any key.
+const (
+	// RepositoryDirName is the repository directory inside a storage
+	RepositoryDirName = "repository"
+	// SnapshotExtension replaces the archive extension of repository backups
+	SnapshotExtension = ".snapshot"
+	// RepositorySnapshotDir holds the snapshots and their sidecars, laid out
+	// like raw archives in a backup directory
+	RepositorySnapshotDir = "snapshots"
+
+	repositoryBlobDir = "blobs"
+	repositoryKeyDir  = "keys"
+	repositoryLockDir = "locks"
+
+	// Lock kinds: a write may not overlap a prune, which could remove the
+	// blobs the write is about to reference
+	repositoryLockWrite = "write"
+	repositoryLockPrune = "prune"
+	// repositoryLockStale is the age after which a lock left behind by an
+	// interrupted run is ignored
+	repositoryLockStale = 24 * time.Hour
+)
+
+// BlobKeySize is the size of the key naming the blobs of encrypted
+// snapshots
+const BlobKeySize = 32
+
+// ageHeader starts every age-encrypted file
+var ageHeader = []byte("age-encryption.org/")
+
+// ErrRepositoryLocked is returned when a snapshot is written while the
+// repository is pruned, or the other way round
+var ErrRepositoryLocked = errors.New("repository is locked")
+
+// ErrBlobDamaged is returned when a blob is missing or does not hold the
+// content a snapshot expects
+var ErrBlobDamaged = errors.New("repository blob damaged")
+
+// RepositoryFile is a file listed in a repository store
+type RepositoryFile struct {
+	Name string // slash-separated, relative to the listed directory
+	Size int64
+}
+
+// RepositoryStore holds the files of a repository: a local directory or an
+// rclone remote. Names are slash-separated paths relative to the repository
+// root.
+type RepositoryStore interface {
+	// List returns every file below dir; a missing dir is empty
+	List(ctx context.Context, dir string) ([]RepositoryFile, error)
+	// Put stores the content of localFile as name, replacing it atomically
+	// where the store allows it
+	Put(ctx context.Context, name, localFile string) error
+	// Open streams a stored file
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// Remove deletes a file; a missing file is not an error
+	Remove(ctx context.Context, name string) error
+	// String describes the store in log messages
+	String() string
+}
+
+// Repository reads and writes the snapshots of a RepositoryStore
+type Repository struct {
+	store  RepositoryStore
+	logger *logging.Logger
+}
+
+// NewRepository creates a repository on store
+func NewRepository(store RepositoryStore, logger *logging.Logger) *Repository {
+	return &Repository{store: store, logger: logger}
+}
+
+// String describes the repository location
+func (r *Repository) String() string {
+	return r.store.String()
+}
+
+// SnapshotResult summarizes WriteSnapshot
+type SnapshotResult struct {
+	File        string // snapshot file name
+	SHA256      string // of the stored snapshot file
+	Size        int64  // of the stored snapshot file
+	Files       int    // regular files in the snapshot
+	NewBlobs    int
+	NewBytes    int64 // stored size of the new blobs
+	ReusedBlobs int
+}
+
+// SnapshotFile returns the file name of the snapshot of backup name
+// (host-backup-timestamp)
+func SnapshotFile(name string, encrypted bool) string {
+	if encrypted {
+		return name + SnapshotExtension + ".age"
+	}
+	return name + SnapshotExtension
+}
+
+// WriteSnapshot stores the tree in root, described by index, as snapshot
+// name (host-backup-timestamp). Contents already in the repository are not
+// uploaded again. The sidecars are written after the blobs and the snapshot,
+// the .metadata last, so an interrupted run leaves no visible snapshot. It
+// fails with ErrRepositoryLocked while the repository is pruned.
+//
+// Encrypted blobs are named with blobKey (see NewBlobKey), a copy of which
+// is stored in the repository, encrypted for recipients. Without recipients
+// the key is not used.
+func (r *Repository) WriteSnapshot(ctx context.Context, root, name string, index *ContentIndex, manifest Manifest, recipients []age.Recipient, blobKey []byte) (*SnapshotResult, error) {
+	file := SnapshotFile(name, len(recipients) > 0)
+	result := &SnapshotResult{File: file}
+
+	release, err := r.lock(ctx, repositoryLockWrite, repositoryLockPrune)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	stored, err := r.blobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp("", "proxmox-repository-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if len(recipients) == 0 {
+		blobKey = nil
+	} else if blobKey != nil {
+		if err := r.storeBlobKey(ctx, blobKey, recipients, tmp); err != nil {
+			return nil, err
+		}
+	}
+
+	snapshot := *index
+	snapshot.Entries = append([]IndexEntry(nil), index.Entries...)
+	for i := range snapshot.Entries {
+		entry := &snapshot.Entries[i]
+		if entry.Type != IndexTypeFile {
+			continue
+		}
+		if blobKey != nil {
+			entry.Blob = keyedBlobID(blobKey, entry.SHA256)
+		}
+		blob := entry.blob()
+		result.Files++
+		if _, ok := stored[blob]; ok {
+			result.ReusedBlobs++
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		blobPath := filepath.Join(tmp, "blob")
+		size, err := encodeBlob(filepath.Join(root, filepath.FromSlash(entry.Path)), blobPath, entry.SHA256, recipients)
+		if err != nil {
+			return nil, fmt.Errorf("store %s: %w", entry.Path, err)
+		}
+		if err := r.store.Put(ctx, blobName(blob), blobPath); err != nil {
+			return nil, fmt.Errorf("store %s: %w", entry.Path, err)
+		}
+		stored[blob] = struct{}{}
+		result.NewBlobs++
+		result.NewBytes += size
+	}
+
+	snapshot.Archive = file
+	snapshotPath := filepath.Join(tmp, file)
+	if err := writeSnapshotFile(&snapshot, snapshotPath, recipients); err != nil {
+		return nil, err
+	}
+	if result.SHA256, err = GenerateChecksum(ctx, r.logger, snapshotPath); err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(snapshotPath); err == nil {
+		result.Size = info.Size()
+	}
+
+	manifest.ArchivePath = file
+	manifest.ArchiveSize = result.Size
+	manifest.SHA256 = result.SHA256
+	manifest.ContentIndex = file + ContentIndexSuffix
+	checksumPath := snapshotPath + ".sha256"
+	if err := os.WriteFile(checksumPath, []byte(fmt.Sprintf("%s  %s\n", result.SHA256, file)), 0640); err != nil {
+		return nil, fmt.Errorf("write checksum file: %w", err)
+	}
+	if err := WriteContentIndex(&snapshot, snapshotPath+ContentIndexSuffix); err != nil {
+		return nil, err
+	}
+	if err := CreateManifest(ctx, r.logger, &manifest, snapshotPath+".metadata"); err != nil {
+		return nil, err
+	}
+	for _, suffix := range []string{"", ContentIndexSuffix, ".sha256", ".metadata"} {
+		if err := r.store.Put(ctx, snapshotName(file+suffix), snapshotPath+suffix); err != nil {
+			return nil, fmt.Errorf("store snapshot %s: %w", file+suffix, err)
+		}
+	}
+
+	r.logger.Debug("Snapshot %s stored in %s: %d files, %d new blobs (%s), %d already stored",
+		file, r.store, result.Files, result.NewBlobs, FormatBytes(result.NewBytes), result.ReusedBlobs)
+	return result, nil
+}
+
+// Snapshots lists the complete snapshots (those with a .metadata sidecar),
+// sorted by name
+func (r *Repository) Snapshots(ctx context.Context) ([]string, error) {
+	files, err := r.store.List(ctx, RepositorySnapshotDir)
+	if err != nil {
+		return nil, fmt.Errorf("list snapshots in %s: %w", r.store, err)
+	}
+	var snapshots []string
+	for _, f := range files {
+		if name, ok := strings.CutSuffix(f.Name, ".metadata"); ok && !strings.Contains(name, "/") {
+			snapshots = append(snapshots, name)
+		}
+	}
+	sort.Strings(snapshots)
+	return snapshots, nil
+}
+
+// OpenSnapshotFile streams a snapshot file or one of its sidecars as stored
+func (r *Repository) OpenSnapshotFile(ctx context.Context, file string) (io.ReadCloser, error) {
+	return r.store.Open(ctx, snapshotName(file))
+}
+
+// RemoveSnapshot deletes a snapshot and its sidecars. The blobs stay until
+// Prune finds them unreferenced.
+func (r *Repository) RemoveSnapshot(ctx context.Context, file string) error {
+	for _, suffix := range []string{".metadata", "", ".sha256", ContentIndexSuffix} {
+		if err := r.store.Remove(ctx, snapshotName(file+suffix)); err != nil {
+			return fmt.Errorf("remove snapshot %s: %w", file+suffix, err)
+		}
+	}
+	return nil
+}
+
+// Prune removes the blobs no snapshot refers to. It reads the content
+// index of every snapshot and removes nothing when one cannot be read. It
+// fails with ErrRepositoryLocked while a snapshot is written, since the
+// blobs of that snapshot are not referenced yet.
+func (r *Repository) Prune(ctx context.Context) (removed int, freed int64, err error) {
+	release, err := r.lock(ctx, repositoryLockPrune, repositoryLockWrite)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+
+	blobs, err := r.UnreferencedBlobs(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, blob := range blobs {
+		if err := ctx.Err(); err != nil {
+			return removed, freed, err
+		}
+		if err := r.store.Remove(ctx, blob.Name); err != nil {
+			return removed, freed, fmt.Errorf("remove blob %s: %w", path.Base(blob.Name), err)
+		}
+		removed++
+		freed += blob.Size
+	}
+	return removed, freed, nil
+}
+
+// UnreferencedBlobs lists the blobs no snapshot refers to once the
+// snapshots in removing are gone, which is what Prune would remove after
+// they are deleted. Names are relative to the repository root.
+func (r *Repository) UnreferencedBlobs(ctx context.Context, removing []string) ([]RepositoryFile, error) {
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gone := make(map[string]bool, len(removing))
+	for _, file := range removing {
+		gone[file] = true
+	}
+	referenced := make(map[string]struct{})
+	for _, file := range snapshots {
+		if gone[file] {
+			continue
+		}
+		index, err := r.readIndex(ctx, file)
+		if err != nil {
+			return nil, fmt.Errorf("read content index of snapshot %s: %w", file, err)
+		}
+		for _, entry := range index.Entries {
+			if entry.Type == IndexTypeFile {
+				referenced[entry.blob()] = struct{}{}
+			}
+		}
+	}
+
+	blobs, err := r.store.List(ctx, repositoryBlobDir)
+	if err != nil {
+		return nil, fmt.Errorf("list blobs in %s: %w", r.store, err)
+	}
+	var unreferenced []RepositoryFile
+	for _, blob := range blobs {
+		if _, ok := referenced[path.Base(blob.Name)]; ok {
+			continue
+		}
+		unreferenced = append(unreferenced, RepositoryFile{Name: path.Join(repositoryBlobDir, blob.Name), Size: blob.Size})
+	}
+	return unreferenced, nil
+}
+
+// BlobCheck summarizes CheckBlobs
+type BlobCheck struct {
+	Blobs    int // distinct blobs the snapshot refers to
+	Verified int // blobs decompressed and compared with their content hash
+}
+
+// CheckBlobs reads every blob a snapshot refers to, as listed by its content
+// index. Each blob is decrypted with identities, decompressed and compared
+// with the hash and size of its content; encrypted blobs are only read to
+// their end when no identity is given. Missing or damaged blobs return an
+// error wrapping ErrBlobDamaged.
+func (r *Repository) CheckBlobs(ctx context.Context, file string, identities []age.Identity) (BlobCheck, error) {
+	var check BlobCheck
+	index, err := r.readIndex(ctx, file)
+	if err != nil {
+		return check, fmt.Errorf("read content index of snapshot %s: %w", file, err)
+	}
+	stored, err := r.blobs(ctx)
+	if err != nil {
+		return check, err
+	}
+	seen := make(map[string]bool)
+	for _, entry := range index.Entries {
+		if entry.Type != IndexTypeFile || seen[entry.blob()] {
+			continue
+		}
+		seen[entry.blob()] = true
+		check.Blobs++
+		if _, ok := stored[entry.blob()]; !ok {
+			return check, fmt.Errorf("%w: blob %s of %s is missing", ErrBlobDamaged, entry.blob(), entry.Path)
+		}
+		verified, err := r.checkBlob(ctx, entry, identities)
+		if err != nil {
+			return check, fmt.Errorf("%s: %w", entry.Path, err)
+		}
+		if verified {
+			check.Verified++
+		}
+	}
+	return check, nil
+}
+
+// Size returns the stored size of all blobs and snapshot files
+func (r *Repository) Size(ctx context.Context) (int64, error) {
+	var total int64
+	for _, dir := range []string{repositoryBlobDir, RepositorySnapshotDir} {
+		files, err := r.store.List(ctx, dir)
+		if err != nil {
+			return 0, err
+		}
+		for _, f := range files {
+			total += f.Size
+		}
+	}
+	return total, nil
+}
+
+// WriteTar writes the tree described by a decrypted snapshot as a tar
+// stream, reading every file from its blob. Blob contents are verified
+// against the snapshot.
+func (r *Repository) WriteTar(ctx context.Context, snapshot io.Reader, identities []age.Identity, w io.Writer) error {
+	index, err := ReadContentIndex(snapshot)
+	if err != nil {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+	tw := tar.NewWriter(w)
+	for _, entry := range index.Entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		header, err := snapshotHeader(entry)
+		if err != nil {
+			return err
+		}
+		if header == nil {
+			r.logger.Debug("Skipping %s (%s) from snapshot", entry.Path, entry.Type)
+			continue
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("write tar header %s: %w", entry.Path, err)
+		}
+		if entry.Type == IndexTypeFile {
+			if err := r.copyBlob(ctx, tw, entry, identities); err != nil {
+				return fmt.Errorf("read %s: %w", entry.Path, err)
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// NewBlobKey returns a random blob key
+func NewBlobKey() ([]byte, error) {
+	key := make([]byte, BlobKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate blob key: %w", err)
+	}
+	return key, nil
+}
+
+// BlobKeyID identifies a blob key without revealing it
+func BlobKeyID(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("proxmox-backup blob key id"))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// storeBlobKey keeps a copy of the blob key in the repository, encrypted
+// for recipients, unless it is already there
+func (r *Repository) storeBlobKey(ctx context.Context, key []byte, recipients []age.Recipient, tmp string) error {
+	files, err := r.store.List(ctx, repositoryKeyDir)
+	if err != nil {
+		return fmt.Errorf("list keys in %s: %w", r.store, err)
+	}
+	name := BlobKeyID(key) + ".age"
+	for _, f := range files {
+		if f.Name == name {
+			return nil
+		}
+	}
+	if len(files) > 0 {
+		r.logger.Info("Repository %s holds blobs named with another key; their contents are stored once more under key %s", r.store, BlobKeyID(key))
+	}
+
+	keyPath := filepath.Join(tmp, name)
+	out, err := os.OpenFile(keyPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("store blob key: %w", err)
+	}
+	defer out.Close()
+	w, err := age.Encrypt(out, recipients...)
+	if err != nil {
+		return fmt.Errorf("encrypt blob key: %w", err)
+	}
+	if _, err := fmt.Fprintln(w, hex.EncodeToString(key)); err != nil {
+		return fmt.Errorf("encrypt blob key: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("encrypt blob key: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("store blob key: %w", err)
+	}
+	if err := r.store.Put(ctx, path.Join(repositoryKeyDir, name), keyPath); err != nil {
+		return fmt.Errorf("store blob key in %s: %w", r.store, err)
+	}
+	return nil
+}
+
+// lock stores a lock of kind, then looks for a lock of the conflicting kind.
+// Whoever stores its lock second sees the other one and backs off, so a
+// write and a prune never overlap. Locks older than repositoryLockStale are
+// ignored. The returned function removes the lock.
+func (r *Repository) lock(ctx context.Context, kind, conflict string) (func(), error) {
+	now := time.Now()
+	host, _ := os.Hostname()
+	name := path.Join(repositoryLockDir, fmt.Sprintf("%s-%d-%s-%d.lock", kind, now.UnixNano(), host, os.Getpid()))
+
+	tmp, err := os.CreateTemp("", "proxmox-repository-lock-*")
+	if err != nil {
+		return nil, fmt.Errorf("create lock: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	fmt.Fprintf(tmp, "%s lock of %s (pid %d) since %s\n", kind, host, os.Getpid(), now.Format(time.RFC3339))
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("create lock: %w", err)
+	}
+	if err := r.store.Put(ctx, name, tmp.Name()); err != nil {
+		return nil, fmt.Errorf("store lock in %s: %w", r.store, err)
+	}
+	release := func() {
+		if err := r.store.Remove(context.WithoutCancel(ctx), name); err != nil {
+			r.logger.Warning("Failed to remove repository lock %s: %v", name, err)
+		}
+	}
+
+	locks, err := r.store.List(ctx, repositoryLockDir)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("list locks in %s: %w", r.store, err)
+	}
+	for _, l := range locks {
+		lockKind, created, ok := parseLockName(path.Base(l.Name))
+		if !ok || lockKind != conflict {
+			continue
+		}
+		if now.Sub(created) > repositoryLockStale {
+			r.logger.Warning("Ignoring stale %s lock %s in %s (created %s)", lockKind, l.Name, r.store, created.Format("2006-01-02 15:04:05"))
+			continue
+		}
+		release()
+		return nil, fmt.Errorf("%w: %s lock %s held since %s", ErrRepositoryLocked, lockKind, l.Name, created.Format("2006-01-02 15:04:05"))
+	}
+	return release, nil
+}
+
+// parseLockName returns the kind and creation time of a lock file
+func parseLockName(name string) (string, time.Time, bool) {
+	base, ok := strings.CutSuffix(name, ".lock")
+	if !ok {
+		return "", time.Time{}, false
+	}
+	parts := strings.SplitN(base, "-", 3)
+	if len(parts) < 2 {
+		return "", time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return parts[0], time.Unix(0, nanos), true
+}
+
+// blobs returns the content hashes stored in the repository
+func (r *Repository) blobs(ctx context.Context) (map[string]struct{}, error) {
+	files, err := r.store.List(ctx, repositoryBlobDir)
+	if err != nil {
+		return nil, fmt.Errorf("list blobs in %s: %w", r.store, err)
+	}
+	stored := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		stored[path.Base(f.Name)] = struct{}{}
+	}
+	return stored, nil
+}
+
+func (r *Repository) readIndex(ctx context.Context, file string) (*ContentIndex, error) {
+	reader, err := r.store.Open(ctx, snapshotName(file+ContentIndexSuffix))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ReadContentIndex(reader)
+}
+
+// copyBlob writes the content of a file entry, decrypting and
+// decompressing its blob
+func (r *Repository) copyBlob(ctx context.Context, w io.Writer, entry IndexEntry, identities []age.Identity) error {
+	raw, err := r.store.Open(ctx, blobName(entry.blob()))
+	if err != nil {
+		return fmt.Errorf("open blob %s: %w", entry.blob(), err)
+	}
+	defer raw.Close()
+
+	buffered := bufio.NewReader(raw)
+	if isAgeEncrypted(buffered) && len(identities) == 0 {
+		return fmt.Errorf("blob %s is encrypted and no identity was given", entry.blob())
+	}
+	return decodeBlob(buffered, w, entry, identities)
+}
+
+// checkBlob verifies the blob of a file entry, reporting whether its
+// content could be compared with the content hash
+func (r *Repository) checkBlob(ctx context.Context, entry IndexEntry, identities []age.Identity) (bool, error) {
+	raw, err := r.store.Open(ctx, blobName(entry.blob()))
+	if err != nil {
+		return false, fmt.Errorf("open blob %s: %w", entry.blob(), err)
+	}
+	defer raw.Close()
+
+	buffered := bufio.NewReader(raw)
+	if isAgeEncrypted(buffered) && len(identities) == 0 {
+		if _, err := io.Copy(io.Discard, buffered); err != nil {
+			return false, fmt.Errorf("read blob %s: %w", entry.blob(), err)
+		}
+		return false, nil
+	}
+	return true, decodeBlob(buffered, io.Discard, entry, identities)
+}
+
+// decodeBlob decrypts and decompresses a blob into w, checking the content
+// against entry
+func decodeBlob(buffered *bufio.Reader, w io.Writer, entry IndexEntry, identities []age.Identity) error {
+	var plain io.Reader = buffered
+	if isAgeEncrypted(buffered) {
+		var err error
+		if plain, err = age.Decrypt(plain, identities...); err != nil {
+			var noMatch *age.NoIdentityMatchError
+			if errors.As(err, &noMatch) {
+				return fmt.Errorf("decrypt blob %s: %w", entry.blob(), err)
+			}
+			return fmt.Errorf("%w: decrypt blob %s: %v", ErrBlobDamaged, entry.blob(), err)
+		}
+	}
+	zr, err := gzip.NewReader(plain)
+	if err != nil {
+		return fmt.Errorf("%w: decompress blob %s: %v", ErrBlobDamaged, entry.blob(), err)
+	}
+	defer zr.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hash), zr)
+	if err != nil {
+		return fmt.Errorf("%w: decompress blob %s: %v", ErrBlobDamaged, entry.blob(), err)
+	}
+	if n != entry.Size || hex.EncodeToString(hash.Sum(nil)) != entry.SHA256 {
+		return fmt.Errorf("%w: blob %s does not match its content hash", ErrBlobDamaged, entry.blob())
+	}
+	return nil
+}
+
+func isAgeEncrypted(r *bufio.Reader) bool {
+	head, _ := r.Peek(len(ageHeader))
+	return bytes.Equal(head, ageHeader)
+}
+
+// snapshotHeader builds the tar header of a snapshot entry; entries that
+// cannot be restored from a snapshot return nil
+func snapshotHeader(entry IndexEntry) (*tar.Header, error) {
+	mode, err := strconv.ParseInt(entry.Mode, 8, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mode %q of %s", entry.Mode, entry.Path)
+	}
+	header := &tar.Header{
+		Name:    "." + entry.Path,
+		Mode:    mode,
+		Uid:     entry.UID,
+		Gid:     entry.GID,
+		Uname:   entry.User,
+		Gname:   entry.Group,
+		ModTime: entry.ModTime,
+		Format:  tar.FormatPAX,
+	}
+	switch entry.Type {
+	case IndexTypeFile:
+		header.Typeflag = tar.TypeReg
+		header.Size = entry.Size
+	case IndexTypeDir:
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+	case IndexTypeSymlink:
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = entry.Link
+	default:
+		return nil, nil
+	}
+	return header, nil
+}
+
+// encodeBlob compresses (and encrypts) src into dst, checking that the
+// content still has hash sum. It returns the size of dst.
+func encodeBlob(src, dst, sum string, recipients []age.Recipient) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	var sink io.WriteCloser = nopWriteCloser{out}
+	if len(recipients) > 0 {
+		if sink, err = age.Encrypt(out, recipients...); err != nil {
+			return 0, fmt.Errorf("encrypt: %w", err)
+		}
+	}
+	zw := gzip.NewWriter(sink)
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(zw, hash), in); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	if err := sink.Close(); err != nil {
+		return 0, err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != sum {
+		return 0, fmt.Errorf("content changed after indexing")
+	}
+	info, err := out.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), out.Close()
+}
+
+// writeSnapshotFile stores the snapshot index, encrypted for recipients
+func writeSnapshotFile(snapshot *ContentIndex, outputPath string, recipients []age.Recipient) (err error) {
+	file, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close snapshot: %w", cerr)
+		}
+	}()
+
+	var sink io.WriteCloser = nopWriteCloser{file}
+	if len(recipients) > 0 {
+		if sink, err = age.Encrypt(file, recipients...); err != nil {
+			return fmt.Errorf("encrypt snapshot: %w", err)
+		}
+	}
+	zw := gzip.NewWriter(sink)
+	if err := json.NewEncoder(zw).Encode(snapshot); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := sink.Close(); err != nil {
+		return fmt.Errorf("encrypt snapshot: %w", err)
+	}
+	return nil
+}
+
+// keyedBlobID names the blob of content hash sum in encrypted snapshots
+func keyedBlobID(key []byte, sum string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sum))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func blobName(id string) string {
+	return path.Join(repositoryBlobDir, id[:2], id)
+}
+
+func snapshotName(file string) string {
+	return path.Join(RepositorySnapshotDir, file)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// dirRepositoryStore keeps a repository in a local directory
+type dirRepositoryStore struct {
+	root string
+}
+
+// NewDirRepositoryStore returns the store of a repository kept in the
+// local directory root (primary and secondary storage)
+func NewDirRepositoryStore(root string) RepositoryStore {
+	return &dirRepositoryStore{root: root}
+}
+
+func (s *dirRepositoryStore) String() string {
+	return s.root
+}
+
+func (s *dirRepositoryStore) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (s *dirRepositoryStore) List(ctx context.Context, dir string) ([]RepositoryFile, error) {
+	base := s.path(dir)
+	var files []RepositoryFile
+	err := filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == base && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, RepositoryFile{Name: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	return files, err
+}
+
+func (s *dirRepositoryStore) Put(ctx context.Context, name, localFile string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	target := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(target), 0o750); err != nil {
+		return err
+	}
+	tmp := target + ".tmp"
+	if err := copyRepositoryFile(localFile, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+func (s *dirRepositoryStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Open(s.path(name))
+}
+
+func (s *dirRepositoryStore) Remove(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func copyRepositoryFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
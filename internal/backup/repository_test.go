@@ -0,0 +1,279 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+// snapshotTree reads a snapshot back as a map of file contents
+func snapshotTree(t *testing.T, repo *Repository, file string, identity age.Identity) map[string]string {
+	t.Helper()
+	ctx := context.Background()
+	raw, err := repo.OpenSnapshotFile(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	plain, err := age.Decrypt(raw, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := repo.WriteTar(ctx, plain, []age.Identity{identity}, &out); err != nil {
+		t.Fatalf("WriteTar: %v", err)
+	}
+	files := make(map[string]string)
+	tr := tar.NewReader(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			files[hdr.Name] = string(body)
+		case tar.TypeSymlink:
+			files[hdr.Name] = "-> " + hdr.Linkname
+		}
+	}
+	return files
+}
+
+func TestRepositorySnapshots(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.New(types.LogLevelInfo, false)
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients := []age.Recipient{identity.Recipient()}
+	blobKey, err := NewBlobKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoRoot := filepath.Join(t.TempDir(), RepositoryDirName)
+	repo := NewRepository(NewDirRepositoryStore(repoRoot), logger)
+
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"etc/hosts":        "127.0.0.1 localhost\n",
+		"etc/hostname":     "pve1\n",
+		"etc/pve/copy.cfg": "127.0.0.1 localhost\n",
+	})
+	if err := os.Symlink("hosts", filepath.Join(root, "etc/link")); err != nil {
+		t.Fatal(err)
+	}
+	index, err := IndexTree(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := repo.WriteSnapshot(ctx, root, "pve1-backup-20250101-010000", index, Manifest{EncryptionMode: "age"}, recipients, blobKey)
+	if err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+	if first.File != "pve1-backup-20250101-010000.snapshot.age" || first.Files != 3 || first.NewBlobs != 2 || first.ReusedBlobs != 1 {
+		t.Errorf("first snapshot = %+v", first)
+	}
+
+	// Encrypted blobs are not named by the hash of their content, and the
+	// key is kept in the repository for the holders of the identity
+	hosts, _ := index.Lookup("/etc/hosts")
+	if _, err := os.Stat(filepath.Join(repoRoot, filepath.FromSlash(blobName(hosts.SHA256)))); !os.IsNotExist(err) {
+		t.Errorf("blob named by the content hash exists (err=%v)", err)
+	}
+	if _, err := os.Stat(filepath.Join(repoRoot, filepath.FromSlash(blobName(keyedBlobID(blobKey, hosts.SHA256))))); err != nil {
+		t.Errorf("keyed blob missing: %v", err)
+	}
+	stored, err := os.Open(filepath.Join(repoRoot, repositoryKeyDir, BlobKeyID(blobKey)+".age"))
+	if err != nil {
+		t.Fatalf("stored blob key: %v", err)
+	}
+	plainKey, err := age.Decrypt(stored, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(plainKey); string(data) != hex.EncodeToString(blobKey)+"\n" {
+		t.Errorf("stored blob key = %q", data)
+	}
+	stored.Close()
+
+	// The next day only the hostname changes
+	writeTestFiles(t, root, map[string]string{"etc/hostname": "pve2\n"})
+	if index, err = IndexTree(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+	second, err := repo.WriteSnapshot(ctx, root, "pve1-backup-20250102-010000", index, Manifest{EncryptionMode: "age"}, recipients, blobKey)
+	if err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+	if second.NewBlobs != 1 || second.ReusedBlobs != 2 {
+		t.Errorf("second snapshot = %+v", second)
+	}
+
+	manifest, err := LoadManifest(filepath.Join(repoRoot, RepositorySnapshotDir, second.File+".metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.ArchivePath != second.File || manifest.SHA256 != second.SHA256 || manifest.ContentIndex != second.File+ContentIndexSuffix {
+		t.Errorf("manifest = %+v", manifest)
+	}
+
+	got := snapshotTree(t, repo, first.File, identity)
+	want := map[string]string{
+		"./etc/hosts":        "127.0.0.1 localhost\n",
+		"./etc/hostname":     "pve1\n",
+		"./etc/pve/copy.cfg": "127.0.0.1 localhost\n",
+		"./etc/link":         "-> hosts",
+	}
+	if len(got) != len(want) {
+		t.Errorf("snapshot tree = %v", got)
+	}
+	for name, body := range want {
+		if got[name] != body {
+			t.Errorf("%s = %q, want %q", name, got[name], body)
+		}
+	}
+
+	// Verification re-hashes every blob only when it can decrypt them
+	check, err := repo.CheckBlobs(ctx, second.File, []age.Identity{identity})
+	if err != nil || check.Blobs != 2 || check.Verified != 2 {
+		t.Errorf("CheckBlobs with identity = %+v (%v), want 2 verified blobs", check, err)
+	}
+	check, err = repo.CheckBlobs(ctx, second.File, nil)
+	if err != nil || check.Blobs != 2 || check.Verified != 0 {
+		t.Errorf("CheckBlobs without identity = %+v (%v), want 2 unverified blobs", check, err)
+	}
+
+	// Removing the first snapshot frees only the old hostname
+	unreferenced, err := repo.UnreferencedBlobs(ctx, []string{first.File})
+	if err != nil || len(unreferenced) != 1 {
+		t.Fatalf("UnreferencedBlobs = %v (%v), want the old hostname", unreferenced, err)
+	}
+	if err := repo.RemoveSnapshot(ctx, first.File); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := repo.Snapshots(ctx)
+	if err != nil || len(snapshots) != 1 || snapshots[0] != second.File {
+		t.Fatalf("snapshots = %v (%v)", snapshots, err)
+	}
+	removed, _, err := repo.Prune(ctx)
+	if err != nil || removed != 1 {
+		t.Fatalf("Prune removed %d blobs (%v)", removed, err)
+	}
+	if got := snapshotTree(t, repo, second.File, identity); got["./etc/hostname"] != "pve2\n" || got["./etc/hosts"] != "127.0.0.1 localhost\n" {
+		t.Errorf("second snapshot after prune = %v", got)
+	}
+}
+
+func TestRepositoryDetectsDamagedBlob(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.New(types.LogLevelInfo, false)
+	repoRoot := t.TempDir()
+	repo := NewRepository(NewDirRepositoryStore(repoRoot), logger)
+
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"etc/hosts": "127.0.0.1 localhost\n"})
+	index, err := IndexTree(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := repo.WriteSnapshot(ctx, root, "pve1-backup-20250101-010000", index, Manifest{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := index.Lookup("/etc/hosts")
+	other := t.TempDir()
+	writeTestFiles(t, other, map[string]string{"blob": "127.0.0.1 evil\n"})
+	if _, err := encodeBlob(filepath.Join(other, "blob"), filepath.Join(repoRoot, filepath.FromSlash(blobName(entry.SHA256))), sha256Hex([]byte("127.0.0.1 evil\n")), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := repo.OpenSnapshotFile(ctx, result.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	if err := repo.WriteTar(ctx, snapshot, nil, io.Discard); err == nil {
+		t.Error("WriteTar accepted a blob that does not match its hash")
+	}
+	if _, err := repo.CheckBlobs(ctx, result.File, nil); !errors.Is(err, ErrBlobDamaged) {
+		t.Errorf("CheckBlobs on a damaged blob: err = %v, want ErrBlobDamaged", err)
+	}
+	if err := os.Remove(filepath.Join(repoRoot, filepath.FromSlash(blobName(entry.SHA256)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CheckBlobs(ctx, result.File, nil); !errors.Is(err, ErrBlobDamaged) {
+		t.Errorf("CheckBlobs on a missing blob: err = %v, want ErrBlobDamaged", err)
+	}
+}
+
+func TestRepositoryLocks(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.New(types.LogLevelInfo, false)
+	repoRoot := t.TempDir()
+	repo := NewRepository(NewDirRepositoryStore(repoRoot), logger)
+
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"etc/hosts": "127.0.0.1 localhost\n"})
+	index, err := IndexTree(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockDir := filepath.Join(repoRoot, repositoryLockDir)
+	writeLock := func(kind string, created time.Time) string {
+		t.Helper()
+		name := filepath.Join(lockDir, fmt.Sprintf("%s-%d-other-1.lock", kind, created.UnixNano()))
+		if err := os.MkdirAll(lockDir, 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, nil, 0o640); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	// A running prune blocks writes, a running write blocks prunes
+	prune := writeLock(repositoryLockPrune, time.Now())
+	if _, err := repo.WriteSnapshot(ctx, root, "pve1-backup-20250101-010000", index, Manifest{}, nil, nil); !errors.Is(err, ErrRepositoryLocked) {
+		t.Errorf("WriteSnapshot during prune: err = %v, want ErrRepositoryLocked", err)
+	}
+	os.Remove(prune)
+	write := writeLock(repositoryLockWrite, time.Now())
+	if _, _, err := repo.Prune(ctx); !errors.Is(err, ErrRepositoryLocked) {
+		t.Errorf("Prune during write: err = %v, want ErrRepositoryLocked", err)
+	}
+	os.Remove(write)
+
+	// Stale locks of interrupted runs are ignored and own locks released
+	writeLock(repositoryLockWrite, time.Now().Add(-2*repositoryLockStale))
+	writeLock(repositoryLockPrune, time.Now().Add(-2*repositoryLockStale))
+	if _, err := repo.WriteSnapshot(ctx, root, "pve1-backup-20250101-010000", index, Manifest{}, nil, nil); err != nil {
+		t.Fatalf("WriteSnapshot with stale lock: %v", err)
+	}
+	if _, _, err := repo.Prune(ctx); err != nil {
+		t.Fatalf("Prune with stale lock: %v", err)
+	}
+	if locks, _ := os.ReadDir(lockDir); len(locks) != 2 {
+		t.Errorf("locks left = %d, want only the 2 stale ones", len(locks))
+	}
+}
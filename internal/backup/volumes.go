@@ -0,0 +1,204 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+)
+
+// volumeDigits is the minimum width of the volume number (.001, .002, ...)
+const volumeDigits = 3
+
+// ErrVolumeMismatch reports a volume whose content does not match the
+// checksum recorded when the archive was split
+var ErrVolumeMismatch = errors.New("volume does not match its checksum")
+
+// ArchiveVolume is one volume of an archive split by SplitArchive
+type ArchiveVolume struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// VolumeName returns the file name of volume n (counted from 1) of archive
+func VolumeName(archive string, n int) string {
+	return fmt.Sprintf("%s.%0*d", archive, volumeDigits, n)
+}
+
+// ParseVolumeName reports whether name is a volume of a split archive and
+// returns the name of the archive and the volume number
+func ParseVolumeName(name string) (string, int, bool) {
+	ext := path.Ext(name)
+	digits := strings.TrimPrefix(ext, ".")
+	if len(digits) < volumeDigits {
+		return "", 0, false
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return "", 0, false
+		}
+	}
+	n, err := strconv.Atoi(digits)
+	archive := strings.TrimSuffix(name, ext)
+	if err != nil || n < 1 || !strings.Contains(archive, ".tar") {
+		return "", 0, false
+	}
+	return archive, n, true
+}
+
+// SplitArchive splits archivePath into volumes of at most volumeSize bytes,
+// written next to it as <archive>.001, <archive>.002, ... Every volume gets
+// a "<sha256>  <name>" .sha256 file. The archive is removed once all the
+// volumes are written; on failure the volumes are removed instead.
+func SplitArchive(ctx context.Context, logger *logging.Logger, archivePath string, volumeSize int64) ([]ArchiveVolume, error) {
+	if volumeSize <= 0 {
+		return nil, fmt.Errorf("invalid volume size %d", volumeSize)
+	}
+	in, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("open archive: %w", err)
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat archive: %w", err)
+	}
+	count := int(max((info.Size()+volumeSize-1)/volumeSize, 1))
+
+	dir := filepath.Dir(archivePath)
+	volumes := make([]ArchiveVolume, 0, count)
+	removeVolumes := func() {
+		for _, v := range volumes {
+			os.Remove(filepath.Join(dir, v.Name))
+			os.Remove(filepath.Join(dir, v.Name+".sha256"))
+		}
+	}
+	for n := 1; n <= count; n++ {
+		if err := ctx.Err(); err != nil {
+			removeVolumes()
+			return nil, err
+		}
+		volume, err := writeVolume(in, dir, VolumeName(filepath.Base(archivePath), n), volumeSize)
+		if volume.Name != "" {
+			volumes = append(volumes, volume)
+		}
+		if err != nil {
+			removeVolumes()
+			return nil, err
+		}
+	}
+
+	if err := os.Remove(archivePath); err != nil {
+		removeVolumes()
+		return nil, fmt.Errorf("remove split archive: %w", err)
+	}
+	logger.Debug("Archive %s split into %d volume(s) of up to %s", filepath.Base(archivePath), len(volumes), FormatBytes(volumeSize))
+	return volumes, nil
+}
+
+// writeVolume copies up to size bytes of r into dir/name and writes the
+// checksum file of the volume
+func writeVolume(r io.Reader, dir, name string, size int64) (ArchiveVolume, error) {
+	volumePath := filepath.Join(dir, name)
+	out, err := os.OpenFile(volumePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return ArchiveVolume{}, fmt.Errorf("create volume %s: %w", name, err)
+	}
+	volume := ArchiveVolume{Name: name}
+	hasher := sha256.New()
+	volume.Size, err = io.CopyN(io.MultiWriter(out, hasher), r, size)
+	if err == io.EOF {
+		err = nil
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return volume, fmt.Errorf("write volume %s: %w", name, err)
+	}
+	volume.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	checksum := fmt.Sprintf("%s  %s\n", volume.SHA256, name)
+	if err := os.WriteFile(volumePath+".sha256", []byte(checksum), 0o640); err != nil {
+		return volume, fmt.Errorf("write checksum of volume %s: %w", name, err)
+	}
+	return volume, nil
+}
+
+// OpenVolumes returns the volumes of a split archive as one stream. open
+// returns the stored volume of the given name; the volumes are opened one
+// at a time, in order. Each volume with a recorded SHA256 is checked once
+// read to its end, and a mismatch is reported as ErrVolumeMismatch.
+func OpenVolumes(volumes []ArchiveVolume, open func(name string) (io.ReadCloser, error)) io.ReadCloser {
+	return &volumeReader{volumes: volumes, open: open}
+}
+
+type volumeReader struct {
+	volumes []ArchiveVolume
+	open    func(name string) (io.ReadCloser, error)
+	next    int
+	current io.ReadCloser
+	hasher  hash.Hash
+}
+
+func (v *volumeReader) Read(p []byte) (int, error) {
+	for {
+		if v.current == nil {
+			if v.next == len(v.volumes) {
+				return 0, io.EOF
+			}
+			name := v.volumes[v.next].Name
+			rc, err := v.open(name)
+			if err != nil {
+				return 0, fmt.Errorf("open volume %s: %w", name, err)
+			}
+			v.current, v.hasher = rc, sha256.New()
+			v.next++
+		}
+		n, err := v.current.Read(p)
+		v.hasher.Write(p[:n])
+		if err != io.EOF {
+			return n, err
+		}
+		if err := v.finishVolume(); err != nil || n > 0 {
+			return n, err
+		}
+	}
+}
+
+// finishVolume closes the volume read to its end and checks its hash
+func (v *volumeReader) finishVolume() error {
+	volume := v.volumes[v.next-1]
+	err := v.current.Close()
+	v.current = nil
+	if err != nil {
+		return fmt.Errorf("close volume %s: %w", volume.Name, err)
+	}
+	if volume.SHA256 == "" {
+		return nil
+	}
+	if actual := hex.EncodeToString(v.hasher.Sum(nil)); !strings.EqualFold(actual, volume.SHA256) {
+		return fmt.Errorf("%w: %s (expected %s, got %s)", ErrVolumeMismatch, volume.Name, volume.SHA256, actual)
+	}
+	return nil
+}
+
+func (v *volumeReader) Close() error {
+	if v.current == nil {
+		return nil
+	}
+	err := v.current.Close()
+	v.current = nil
+	return err
+}
@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+func TestSplitArchiveAndOpenVolumes(t *testing.T) {
+	logger := logging.New(types.LogLevelInfo, false)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	data := make([]byte, 2500)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	archivePath := filepath.Join(dir, "pve1-backup-20250101-010000.tar.xz")
+	if err := os.WriteFile(archivePath, data, 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	volumes, err := SplitArchive(ctx, logger, archivePath, 1000)
+	if err != nil {
+		t.Fatalf("SplitArchive: %v", err)
+	}
+	if len(volumes) != 3 || volumes[0].Size != 1000 || volumes[1].Size != 1000 || volumes[2].Size != 500 {
+		t.Fatalf("volumes = %+v, want 1000/1000/500 bytes", volumes)
+	}
+	if _, err := os.Stat(archivePath); !os.IsNotExist(err) {
+		t.Errorf("archive still present after split (err=%v)", err)
+	}
+	for i, v := range volumes {
+		if want := VolumeName(filepath.Base(archivePath), i+1); v.Name != want {
+			t.Errorf("volume %d name = %s, want %s", i+1, v.Name, want)
+		}
+		part := data[i*1000 : i*1000+int(v.Size)]
+		sum := sha256.Sum256(part)
+		if v.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("volume %s sha256 = %s", v.Name, v.SHA256)
+		}
+		sidecar, err := os.ReadFile(filepath.Join(dir, v.Name+".sha256"))
+		if err != nil || string(sidecar) != v.SHA256+"  "+v.Name+"\n" {
+			t.Errorf("volume %s checksum file = %q (%v)", v.Name, sidecar, err)
+		}
+	}
+
+	open := func(name string) (io.ReadCloser, error) { return os.Open(filepath.Join(dir, name)) }
+	rc := OpenVolumes(volumes, open)
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("joined volumes differ from the archive (%d bytes, err=%v)", len(got), err)
+	}
+
+	// A damaged volume is reported once it is read to its end
+	damaged := filepath.Join(dir, volumes[1].Name)
+	part, err := os.ReadFile(damaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part[10] ^= 0xff
+	if err := os.WriteFile(damaged, part, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	rc = OpenVolumes(volumes, open)
+	_, err = io.ReadAll(rc)
+	rc.Close()
+	if !errors.Is(err, ErrVolumeMismatch) {
+		t.Errorf("damaged volume: err = %v, want ErrVolumeMismatch", err)
+	}
+
+	// An archive of an exact multiple of the volume size has no empty volume
+	exact := filepath.Join(dir, "exact.tar.gz")
+	if err := os.WriteFile(exact, data[:2000], 0o640); err != nil {
+		t.Fatal(err)
+	}
+	volumes, err = SplitArchive(ctx, logger, exact, 1000)
+	if err != nil || len(volumes) != 2 {
+		t.Errorf("exact split = %+v (%v), want 2 volumes", volumes, err)
+	}
+}
+
+func TestParseVolumeName(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive string
+		n       int
+		ok      bool
+	}{
+		{"pve1-backup-20250101-010000.tar.xz.001", "pve1-backup-20250101-010000.tar.xz", 1, true},
+		{"pve1-backup-20250101-010000.tar.zst.age.012", "pve1-backup-20250101-010000.tar.zst.age", 12, true},
+		{"pve1-backup-20250101-010000.tar.1000", "pve1-backup-20250101-010000.tar", 1000, true},
+		{"pve1-backup-20250101-010000.tar.000", "", 0, false},
+		{"pve1-backup-20250101-010000.tar.01", "", 0, false},
+		{"pve1-backup-20250101-010000.tar.xz", "", 0, false},
+		{"pve1-backup-20250101-010000.tar.xz.001.sha256", "", 0, false},
+		{"notes.001", "", 0, false},
+	}
+	for _, tt := range tests {
+		archive, n, ok := ParseVolumeName(tt.name)
+		if archive != tt.archive || n != tt.n || ok != tt.ok {
+			t.Errorf("ParseVolumeName(%q) = %q, %d, %v; want %q, %d, %v", tt.name, archive, n, ok, tt.archive, tt.n, tt.ok)
+		}
+	}
+}
@@ -3,13 +3,50 @@ package cli
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/tis24dev/proxmox-backup/internal/types"
 )
 
+// Command identifies the operation requested on the command line
+type Command string
+
+const (
+	CommandBackup  Command = "backup"
+	CommandList    Command = "list"
+	CommandVerify  Command = "verify"
+	CommandRestore Command = "restore"
+	CommandDecrypt Command = "decrypt"
+	CommandPrune   Command = "prune"
+	CommandStatus  Command = "status"
+	CommandConfig  Command = "config"
+	CommandDrill   Command = "drill"
+	CommandDiff    Command = "diff"
+	CommandSearch  Command = "search"
+)
+
+// Config subcommand actions
+const (
+	ConfigActionValidate = "validate"
+	ConfigActionShow     = "show"
+	ConfigActionInstall  = "install"
+)
+
+// Storage selectors accepted by --location
+const (
+	LocationAll       = "all"
+	LocationPrimary   = "primary"
+	LocationSecondary = "secondary"
+	LocationCloud     = "cloud"
+)
+
 // Args holds the parsed command-line arguments
 type Args struct {
+	Command          Command
 	ConfigPath       string
 	ConfigPathSource string
 	LogLevel         types.LogLevel
@@ -20,66 +57,465 @@ type Args struct {
 	Decrypt          bool
 	Restore          bool
 	Install          bool
+
+	// Subcommand options
+	JSONOutput   bool
+	Location     string
+	ConfigAction string
+	Positional   []string
+	VerifyDeep   bool
+
+	// Restore options
+	RestoreSource  string
+	IdentityFile   string
+	TargetRoot     string
+	AssumeYes      bool
+	Paths          []string
+	Categories     []string
+	Diff           bool
+	DiffFile       string
+	RollbackID     string
+	RollbackDelete bool
+	NoRollback     bool
+	NoServices     bool
+	PVEMode        string
+	MapHost        string
+	MapIPs         []string
+	MapInterfaces  []string
+
+	// Restore drill options
+	DrillStorage string
+	DrillKeep    bool
+	NoNotify     bool
+
+	// Backup diff options
+	DiffSummary bool
+
+	// Backup search options
+	SearchContent string
+	SearchShow    string
+
+	usage func()
+}
+
+type commandSpec struct {
+	summary     string
+	usage       string
+	examples    []string
+	setupFlags  func(fs *flag.FlagSet, args *Args)
+	positionals func(args *Args, rest []string) error
+}
+
+var commandSpecs = map[Command]commandSpec{
+	CommandBackup: {
+		summary: "Run a full backup (collection, archive, storage, notifications)",
+		usage:   "backup [options]",
+		examples: []string{
+			"backup -c /path/to/config.env",
+			"backup --dry-run --log-level debug",
+		},
+		setupFlags: func(fs *flag.FlagSet, args *Args) {
+			fs.BoolVar(&args.ForceNewKey, "newkey", args.ForceNewKey,
+				"Reset AGE recipients and run the interactive setup (interactive mode only)")
+			fs.BoolVar(&args.ForceNewKey, "age-newkey", args.ForceNewKey,
+				"Alias for --newkey")
+		},
+	},
+	CommandList: {
+		summary: "List backups available on the configured storage backends",
+		usage:   "list [options]",
+		examples: []string{
+			"list",
+			"list --location cloud --json",
+			"list --json | jq '.[] | select(.single_location)'",
+		},
+		setupFlags: func(fs *flag.FlagSet, args *Args) {
+			registerLocationFlag(fs, args)
+			fs.BoolVar(&args.JSONOutput, "json", false, "Print the result as JSON")
+		},
+	},
+	CommandVerify: {
+		summary: "Verify stored backups against their checksums and test-decompress them",
+		usage:   "verify [options] [backup-name ...]",
+		examples: []string{
+			"verify",
+			"verify --location secondary",
+			"verify --location cloud --deep host-backup-20250101-010101.tar.xz",
+			"verify --identity /root/age.key host-backup-20250101-010101.snapshot.age",
+		},
+		setupFlags: func(fs *flag.FlagSet, args *Args) {
+			registerLocationFlag(fs, args)
+			fs.BoolVar(&args.JSONOutput, "json", false, "Print the result as JSON")
+			fs.BoolVar(&args.VerifyDeep, "deep", false,
+				"Download cloud backups and test-decompress them even when the remote can compute the checksum")
+			fs.StringVar(&args.IdentityFile, "identity", "",
+				"AGE identity file used to decrypt and re-hash the blobs of encrypted repository snapshots")
+		},
+		positionals: acceptPositionals,
+	},
+	CommandRestore: {
+		summary: "Restore a backup bundle onto this system",
+		usage:   "restore [options] [bundle-path|remote:bundle|latest [from primary|secondary|cloud]]",
+		examples: []string{
+			"restore",
+			"restore --identity /root/age.key --yes latest from secondary",
+			"restore --identity /root/age.key --target /tmp/restore --yes gdrive:pbs-backups/host-backup-20250101-010101.tar.xz.age.bundle.tar",
+			"restore --source /backup/host-backup-20250101-010101.tar.xz.bundle.tar --target /tmp/restore --yes",
+			"restore --path /etc/network/interfaces --path /etc/pve/qemu-server/105.conf latest",
+			"restore --category network,ssh latest from secondary",
+			"restore --target /root/restore-staging --diff --diff-file /root/restore.diff latest",
+			"restore --dry-run --json --category network latest > restore-plan.json",
+			"restore --no-services --category network latest",
+			"restore --pve-mode database --identity /root/age.key latest",
+			"restore --map-host pve2 --map-ip 192.168.1.10=192.168.1.20 --map-iface eno1=enp3s0 latest",
+			"restore --rollback list",
+			"restore --rollback 20250101-010203",
+			"restore --rollback all --delete",
+		},
+		setupFlags: func(fs *flag.FlagSet, args *Args) {
+			fs.StringVar(&args.RestoreSource, "source", "",
+				"Bundle path, rclone reference (remote:path/bundle) or selector (latest, \"latest from cloud\"); enables non-interactive selection")
+			fs.StringVar(&args.IdentityFile, "identity", "",
+				"AGE identity file (or file holding the passphrase) used to decrypt without prompting")
+			fs.StringVar(&args.TargetRoot, "target", "/",
+				"Directory to restore into (default: system root)")
+			fs.BoolVar(&args.AssumeYes, "yes", false,
+				"Do not ask for confirmation")
+			fs.BoolVar(&args.AssumeYes, "y", false,
+				"Do not ask for confirmation (shorthand)")
+			fs.Var(&listFlag{values: &args.Paths}, "path",
+				"Restore only this file or directory (repeatable)")
+			fs.Var(&listFlag{values: &args.Categories, split: true}, "category",
+				"Restore only these categories: network, pve-firewall, pbs-datastore, cron, ssh (repeatable or comma-separated)")
+			fs.BoolVar(&args.Diff, "diff", false,
+				"After restoring into --target, report added/changed/identical/missing files against the live system")
+			fs.StringVar(&args.DiffFile, "diff-file", "",
+				"Write the --diff report to this file instead of stdout (implies --diff)")
+			fs.BoolVar(&args.JSONOutput, "json", false,
+				"Print the restore plan as JSON (combine with --dry-run to only produce the plan)")
+			fs.StringVar(&args.RollbackID, "rollback", "",
+				"Undo a previous restore using its pre-restore snapshot (id, latest or list)")
+			fs.BoolVar(&args.RollbackDelete, "delete", false,
+				"With --rollback: delete the snapshot (id, latest or all) instead of applying it")
+			fs.BoolVar(&args.NoRollback, "no-rollback", false,
+				"Do not take the pre-restore rollback snapshot")
+			fs.BoolVar(&args.NoServices, "no-services", false,
+				"Do not stop, start or reload the services whose files are restored")
+			fs.StringVar(&args.PVEMode, "pve-mode", "",
+				"How /etc/pve is restored to /: files (through the mounted cluster filesystem, default) or database (config.db offline, standalone nodes only)")
+			fs.StringVar(&args.MapHost, "map-host", "",
+				"Restore onto another host: rename the source node (old=new, or new to take old from the backup manifest)")
+			fs.Var(&listFlag{values: &args.MapIPs}, "map-ip",
+				"Replace a source IP address in the restored configs (old=new, repeatable)")
+			fs.Var(&listFlag{values: &args.MapInterfaces}, "map-iface",
+				"Replace a source network interface name in the restored configs (old=new, repeatable)")
+		},
+		positionals: func(args *Args, rest []string) error {
+			if len(rest) == 0 {
+				return nil
+			}
+			if args.RestoreSource != "" {
+				return fmt.Errorf("backup given both via --source and as argument")
+			}
+			args.RestoreSource = strings.Join(rest, " ")
+			return nil
+		},
+	},
+	CommandDrill: {
+		summary: "Restore the newest backup into a throwaway directory and report the result",
+		usage:   "drill [options]",
+		examples: []string{
+			"drill",
+			"drill --from cloud --identity /root/drill.key",
+			"drill --keep --no-notify --json",
+		},
+		setupFlags: func(fs *flag.FlagSet, args *Args) {
+			fs.StringVar(&args.DrillStorage, "from", "",
+				"Storage to take the newest backup from: primary, secondary or cloud (default: RESTORE_DRILL_STORAGE)")
+			fs.StringVar(&args.IdentityFile, "identity", "",
+				"Test AGE identity file used to decrypt the backup (default: RESTORE_DRILL_IDENTITY_FILE)")
+			fs.BoolVar(&args.DrillKeep, "keep", false,
+				"Keep the restored files instead of removing them")
+			fs.BoolVar(&args.NoNotify, "no-notify", false,
+				"Do not send the result through the notification channels")
+			fs.BoolVar(&args.JSONOutput, "json", false, "Print the result as JSON")
+		},
+	},
+	CommandDiff: {
+		summary: "Compare two backups: added/removed/modified files and config diffs",
+		usage:   "diff [options] <backup-a> <backup-b>",
+		examples: []string{
+			"diff --identity /root/age.key host-backup-20250106-010000 host-backup-20250110-010000",
+			"diff --identity /root/age.key --category network /backup/old.tar.xz.age.bundle.tar latest",
+			"diff --summary --json \"latest from secondary\" latest",
+		},
+		setupFlags: func(fs *flag.FlagSet, args *Args) {
+			fs.StringVar(&args.IdentityFile, "identity", "",
+				"AGE identity file (or file holding the passphrase) used to decrypt both backups")
+			fs.Var(&listFlag{values: &args.Paths}, "path",
+				"Compare only this file or directory (repeatable)")
+			fs.Var(&listFlag{values: &args.Categories, split: true}, "category",
+				"Compare only these categories: network, pve-firewall, pbs-datastore, cron, ssh (repeatable or comma-separated)")
+			fs.BoolVar(&args.DiffSummary, "summary", false,
+				"Compare the content indexes only (no decryption or download, no text diffs)")
+			fs.BoolVar(&args.JSONOutput, "json", false, "Print the result as JSON")
+		},
+		positionals: func(args *Args, rest []string) error {
+			if len(rest) != 2 {
+				return fmt.Errorf("diff needs exactly two backups, got %d", len(rest))
+			}
+			args.Positional = rest
+			return nil
+		},
+	},
+	CommandSearch: {
+		summary: "Find the backups holding a file (by path glob) or a content pattern",
+		usage:   "search [options] [path-glob]",
+		examples: []string{
+			"search 112.conf",
+			"search --location cloud '/etc/pve/qemu-server/*.conf'",
+			"search --identity /root/age.key --content 'scsi1: .*vm-112-disk-1' /etc/pve/qemu-server",
+			"search --show host-backup-20250106-010000 /etc/pve/qemu-server/112.conf > 112.conf.monday",
+		},
+		setupFlags: func(fs *flag.FlagSet, args *Args) {
+			registerLocationFlag(fs, args)
+			fs.StringVar(&args.SearchContent, "content", "",
+				"Regular expression matched against the lines of the selected files (decrypts the backups)")
+			fs.StringVar(&args.IdentityFile, "identity", "",
+				"AGE identity file (or file holding the passphrase) used to decrypt backups")
+			fs.StringVar(&args.SearchShow, "show", "",
+				"Print the file given as argument from this backup to stdout")
+			fs.BoolVar(&args.JSONOutput, "json", false, "Print the result as JSON")
+		},
+		positionals: func(args *Args, rest []string) error {
+			if len(rest) > 1 {
+				return fmt.Errorf("search takes a single path glob, got %d", len(rest))
+			}
+			args.Positional = rest
+			return nil
+		},
+	},
+	CommandDecrypt: {
+		summary: "Decrypt an encrypted bundle into a plaintext bundle",
+		usage:   "decrypt [options]",
+		examples: []string{
+			"decrypt",
+		},
+	},
+	CommandPrune: {
+		summary: "Apply the configured retention policy without running a backup",
+		usage:   "prune [options]",
+		examples: []string{
+			"prune --dry-run",
+			"prune --location primary",
+		},
+		setupFlags: func(fs *flag.FlagSet, args *Args) {
+			registerLocationFlag(fs, args)
+		},
+	},
+	CommandStatus: {
+		summary: "Show storage usage and the latest backup of each backend",
+		usage:   "status [options]",
+		examples: []string{
+			"status",
+			"status --json",
+		},
+		setupFlags: func(fs *flag.FlagSet, args *Args) {
+			fs.BoolVar(&args.JSONOutput, "json", false, "Print the result as JSON")
+		},
+	},
+	CommandConfig: {
+		summary: "Validate, show or (re)create the configuration file",
+		usage:   "config [options] [validate|show|install]",
+		examples: []string{
+			"config validate -c /path/to/config.env",
+			"config install",
+		},
+		positionals: func(args *Args, rest []string) error {
+			args.ConfigAction = ConfigActionValidate
+			if len(rest) == 0 {
+				return nil
+			}
+			if len(rest) > 1 {
+				return fmt.Errorf("config accepts a single action, got %q", strings.Join(rest, " "))
+			}
+			switch rest[0] {
+			case ConfigActionValidate, ConfigActionShow, ConfigActionInstall:
+				args.ConfigAction = rest[0]
+			default:
+				return fmt.Errorf("unknown config action %q (valid: validate, show, install)", rest[0])
+			}
+			if args.ConfigAction == ConfigActionInstall {
+				args.Install = true
+			}
+			return nil
+		},
+	},
+}
+
+// ReadOnly reports whether the command only reads stored backups: it runs
+// without a backup log file and without the security pre-flight
+func (c Command) ReadOnly() bool {
+	switch c {
+	case CommandList, CommandStatus, CommandVerify, CommandDiff, CommandSearch:
+		return true
+	}
+	return false
+}
+
+// Commands returns the list of supported subcommands in alphabetical order
+func Commands() []Command {
+	commands := make([]Command, 0, len(commandSpecs))
+	for cmd := range commandSpecs {
+		commands = append(commands, cmd)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i] < commands[j] })
+	return commands
 }
 
 // Parse parses command-line arguments and returns Args struct
 func Parse() *Args {
+	args, err := ParseArgs(os.Args[1:], os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(types.ExitConfigError.Int())
+	}
+	return args
+}
+
+// ParseArgs parses argv (without the program name) into Args. Global options
+// may appear both before and after the subcommand name; when no subcommand is
+// given the legacy flags (--restore, --decrypt, --install) select the command
+// and everything else runs a backup.
+func ParseArgs(argv []string, output io.Writer) (*Args, error) {
 	args := &Args{}
 
 	const defaultConfigPath = "./configs/backup.env"
 	configFlag := newStringFlag(defaultConfigPath)
+	var logLevelStr string
 
-	// Define flags
-	flag.Var(configFlag, "config", "Path to configuration file")
-	flag.Var(configFlag, "c", "Path to configuration file (shorthand)")
+	global := flag.NewFlagSet(programName(), flag.ContinueOnError)
+	global.SetOutput(output)
+	registerGlobalFlags(global, args, configFlag, &logLevelStr)
+	commandSpecs[CommandBackup].setupFlags(global, args)
 
-	var logLevelStr string
-	flag.StringVar(&logLevelStr, "log-level", "",
-		"Log level (debug|info|warning|error|critical)")
-	flag.StringVar(&logLevelStr, "l", "",
-		"Log level (shorthand)")
+	global.BoolVar(&args.Decrypt, "decrypt", false,
+		"Run the interactive decrypt workflow (same as the decrypt command)")
+	global.BoolVar(&args.Restore, "restore", false,
+		"Run the interactive restore workflow (same as the restore command)")
+	global.BoolVar(&args.Install, "install", false,
+		"Run the interactive installer (same as config install)")
 
-	flag.BoolVar(&args.DryRun, "dry-run", false,
-		"Perform a dry run without making actual changes")
-	flag.BoolVar(&args.DryRun, "n", false,
-		"Perform a dry run (shorthand)")
+	global.Usage = func() { printGlobalUsage(output, global) }
+	args.usage = global.Usage
 
-	flag.BoolVar(&args.ShowVersion, "version", false,
-		"Show version information")
-	flag.BoolVar(&args.ShowVersion, "v", false,
-		"Show version information (shorthand)")
+	if err := global.Parse(argv); err != nil {
+		return nil, err
+	}
 
-	flag.BoolVar(&args.ShowHelp, "help", false,
-		"Show help message")
-	flag.BoolVar(&args.ShowHelp, "h", false,
-		"Show help message (shorthand)")
+	rest := global.Args()
+	switch {
+	case len(rest) > 0:
+		cmd := Command(rest[0])
+		spec, ok := commandSpecs[cmd]
+		if !ok {
+			global.Usage()
+			return nil, fmt.Errorf("unknown command %q", rest[0])
+		}
+		if args.Restore || args.Decrypt || args.Install {
+			return nil, fmt.Errorf("legacy flags --restore/--decrypt/--install cannot be combined with the %s command", cmd)
+		}
+		args.Command = cmd
+
+		fs := flag.NewFlagSet(fmt.Sprintf("%s %s", programName(), cmd), flag.ContinueOnError)
+		fs.SetOutput(output)
+		registerGlobalFlags(fs, args, configFlag, &logLevelStr)
+		if spec.setupFlags != nil {
+			spec.setupFlags(fs, args)
+		}
+		fs.Usage = func() { printCommandUsage(output, spec, fs) }
+		args.usage = fs.Usage
+
+		if err := fs.Parse(rest[1:]); err != nil {
+			return nil, err
+		}
+		if spec.positionals != nil {
+			if err := spec.positionals(args, fs.Args()); err != nil {
+				return nil, err
+			}
+		} else if len(fs.Args()) > 0 {
+			return nil, fmt.Errorf("unexpected arguments for %s: %s", cmd, strings.Join(fs.Args(), " "))
+		}
+	case args.Restore && args.Decrypt:
+		return nil, fmt.Errorf("--restore and --decrypt are mutually exclusive")
+	case args.Restore:
+		args.Command = CommandRestore
+	case args.Decrypt:
+		args.Command = CommandDecrypt
+	case args.Install:
+		args.Command = CommandConfig
+		args.ConfigAction = ConfigActionInstall
+	default:
+		args.Command = CommandBackup
+	}
+
+	switch args.Command {
+	case CommandRestore:
+		args.Restore = true
+		if args.DiffFile != "" {
+			args.Diff = true
+		}
+		if args.Diff && filepath.Clean(args.TargetRoot) == "/" {
+			return nil, fmt.Errorf("--diff requires --target pointing to a staging directory")
+		}
+		if args.RollbackID != "" && (args.RestoreSource != "" || len(args.Paths) > 0 || len(args.Categories) > 0 || args.Diff) {
+			return nil, fmt.Errorf("--rollback cannot be combined with a backup source or selection")
+		}
+		if args.RollbackDelete && (args.RollbackID == "" || args.RollbackID == "list") {
+			return nil, fmt.Errorf("--delete requires --rollback <id|latest|all>")
+		}
+		if args.JSONOutput && args.RestoreSource == "" {
+			return nil, fmt.Errorf("--json requires a backup source: the interactive selection cannot share stdout with the plan")
+		}
+		if args.RollbackID == "all" && !args.RollbackDelete {
+			return nil, fmt.Errorf("--rollback all is only valid with --delete")
+		}
+		switch args.PVEMode {
+		case "", "files", "database":
+		default:
+			return nil, fmt.Errorf("invalid --pve-mode %q (valid: files, database)", args.PVEMode)
+		}
+		if args.PVEMode == "database" && args.NoServices {
+			return nil, fmt.Errorf("--pve-mode database cannot be combined with --no-services: pve-cluster must be stopped while config.db is replaced")
+		}
+		for _, mapping := range append(args.MapIPs, args.MapInterfaces...) {
+			if from, to, ok := strings.Cut(mapping, "="); !ok || from == "" || to == "" {
+				return nil, fmt.Errorf("invalid mapping %q: expected old=new", mapping)
+			}
+		}
+	case CommandDecrypt:
+		args.Decrypt = true
+	case CommandSearch:
+		switch {
+		case args.SearchShow != "" && (len(args.Positional) != 1 || args.SearchContent != "" || args.JSONOutput):
+			return nil, fmt.Errorf("--show needs exactly one file path and cannot be combined with --content or --json")
+		case len(args.Positional) == 0 && args.SearchContent == "":
+			return nil, fmt.Errorf("search needs a path glob or --content")
+		}
+	case CommandDrill:
+		switch args.DrillStorage {
+		case "", LocationPrimary, LocationSecondary, LocationCloud:
+		default:
+			return nil, fmt.Errorf("invalid --from %q (valid: primary, secondary, cloud)", args.DrillStorage)
+		}
+	}
 
-	flag.BoolVar(&args.ForceNewKey, "newkey", false,
-		"Reset AGE recipients and run the interactive setup (interactive mode only)")
-	flag.BoolVar(&args.ForceNewKey, "age-newkey", false,
-		"Alias for --newkey")
-
-	flag.BoolVar(&args.Decrypt, "decrypt", false,
-		"Run the interactive decrypt workflow (converts encrypted bundles into plaintext bundles)")
-	flag.BoolVar(&args.Restore, "restore", false,
-		"Run the interactive restore workflow (select bundle, optionally decrypt, apply to system)")
-	flag.BoolVar(&args.Install, "install", false,
-		"Run the interactive installer (generate/configure backup.env)")
-
-	// Custom usage message
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Proxmox Backup Manager - Go Edition\n\n")
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		flag.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nExamples:\n")
-		fmt.Fprintf(os.Stderr, "  %s -c /path/to/config.env\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s --dry-run --log-level debug\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s --version\n", os.Args[0])
-	}
-
-	// Parse flags
-	flag.Parse()
+	if err := validateLocation(args.Location); err != nil {
+		return nil, err
+	}
+	if args.Location == "" {
+		args.Location = LocationAll
+	}
 
 	args.ConfigPath = configFlag.value
 	if configFlag.set {
@@ -95,7 +531,105 @@ func Parse() *Args {
 		args.LogLevel = types.LogLevelNone // Will be overridden by config
 	}
 
-	return args
+	return args, nil
+}
+
+// Usage prints the help text for the parsed command
+func (a *Args) Usage() {
+	if a != nil && a.usage != nil {
+		a.usage()
+		return
+	}
+	flag.Usage()
+}
+
+// IncludesLocation reports whether the --location selector covers loc
+func (a *Args) IncludesLocation(loc string) bool {
+	return a.Location == "" || a.Location == LocationAll || a.Location == loc
+}
+
+func registerGlobalFlags(fs *flag.FlagSet, args *Args, configFlag *stringFlag, logLevel *string) {
+	fs.Var(configFlag, "config", "Path to configuration file")
+	fs.Var(configFlag, "c", "Path to configuration file (shorthand)")
+
+	fs.StringVar(logLevel, "log-level", *logLevel,
+		"Log level (debug|info|warning|error|critical)")
+	fs.StringVar(logLevel, "l", *logLevel,
+		"Log level (shorthand)")
+
+	fs.BoolVar(&args.DryRun, "dry-run", args.DryRun,
+		"Perform a dry run without making actual changes")
+	fs.BoolVar(&args.DryRun, "n", args.DryRun,
+		"Perform a dry run (shorthand)")
+
+	fs.BoolVar(&args.ShowVersion, "version", args.ShowVersion,
+		"Show version information")
+	fs.BoolVar(&args.ShowVersion, "v", args.ShowVersion,
+		"Show version information (shorthand)")
+
+	fs.BoolVar(&args.ShowHelp, "help", args.ShowHelp,
+		"Show help message")
+	fs.BoolVar(&args.ShowHelp, "h", args.ShowHelp,
+		"Show help message (shorthand)")
+}
+
+func registerLocationFlag(fs *flag.FlagSet, args *Args) {
+	fs.StringVar(&args.Location, "location", LocationAll,
+		"Storage backend to use (all|primary|secondary|cloud)")
+}
+
+func acceptPositionals(args *Args, rest []string) error {
+	args.Positional = append([]string(nil), rest...)
+	return nil
+}
+
+func validateLocation(loc string) error {
+	switch loc {
+	case "", LocationAll, LocationPrimary, LocationSecondary, LocationCloud:
+		return nil
+	default:
+		return fmt.Errorf("invalid --location %q (valid: all, primary, secondary, cloud)", loc)
+	}
+}
+
+func programName() string {
+	if len(os.Args) > 0 && os.Args[0] != "" {
+		return filepath.Base(os.Args[0])
+	}
+	return "proxmox-backup"
+}
+
+func printGlobalUsage(w io.Writer, fs *flag.FlagSet) {
+	name := programName()
+	fmt.Fprintf(w, "Usage: %s [options] <command> [command options]\n\n", name)
+	fmt.Fprintf(w, "Proxmox Backup Manager - Go Edition\n\n")
+	fmt.Fprintf(w, "Commands:\n")
+	for _, cmd := range Commands() {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd, commandSpecs[cmd].summary)
+	}
+	fmt.Fprintf(w, "\nWithout a command a backup is executed.\n\n")
+	fmt.Fprintf(w, "Options:\n")
+	fs.PrintDefaults()
+	fmt.Fprintf(w, "\nExamples:\n")
+	fmt.Fprintf(w, "  %s -c /path/to/config.env\n", name)
+	fmt.Fprintf(w, "  %s --dry-run --log-level debug\n", name)
+	fmt.Fprintf(w, "  %s list --json\n", name)
+	fmt.Fprintf(w, "  %s <command> --help\n", name)
+	fmt.Fprintf(w, "  %s --version\n", name)
+}
+
+func printCommandUsage(w io.Writer, spec commandSpec, fs *flag.FlagSet) {
+	name := programName()
+	fmt.Fprintf(w, "Usage: %s %s\n\n", name, spec.usage)
+	fmt.Fprintf(w, "%s\n\n", spec.summary)
+	fmt.Fprintf(w, "Options:\n")
+	fs.PrintDefaults()
+	if len(spec.examples) > 0 {
+		fmt.Fprintf(w, "\nExamples:\n")
+		for _, example := range spec.examples {
+			fmt.Fprintf(w, "  %s %s\n", name, example)
+		}
+	}
 }
 
 // parseLogLevel converts string to LogLevel
@@ -119,8 +653,8 @@ func parseLogLevel(s string) types.LogLevel {
 }
 
 // ShowHelp displays help message and exits
-func ShowHelp() {
-	flag.Usage()
+func ShowHelp(args *Args) {
+	args.Usage()
 	os.Exit(0)
 }
 
@@ -143,6 +677,9 @@ func newStringFlag(defaultValue string) *stringFlag {
 }
 
 func (s *stringFlag) String() string {
+	if s == nil {
+		return ""
+	}
 	return s.value
 }
 
@@ -151,3 +688,30 @@ func (s *stringFlag) Set(val string) error {
 	s.set = true
 	return nil
 }
+
+// listFlag collects repeated flag values; with split set, comma-separated
+// values are expanded as well
+type listFlag struct {
+	values *[]string
+	split  bool
+}
+
+func (l *listFlag) String() string {
+	if l == nil || l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l *listFlag) Set(val string) error {
+	items := []string{val}
+	if l.split {
+		items = strings.Split(val, ",")
+	}
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			*l.values = append(*l.values, item)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/tis24dev/proxmox-backup/internal/types"
@@ -37,10 +39,8 @@ func TestParseLogLevel(t *testing.T) {
 	}
 }
 
-// Note: Due to limitations with the flag package, we cannot easily test Parse()
-// multiple times in the same test run. The flag package maintains global state
-// that cannot be easily reset. These tests verify the internal logic without
-// calling Parse() multiple times.
+// Note: Parse() reads os.Args and exits on error, so the tests below exercise
+// ParseArgs() which uses a dedicated FlagSet for every invocation.
 
 func TestArgs(t *testing.T) {
 	// Test Args struct creation
@@ -72,3 +72,296 @@ func TestArgs(t *testing.T) {
 		t.Error("ShowHelp should be false")
 	}
 }
+
+func TestParseArgsCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		argv     []string
+		command  Command
+		restore  bool
+		decrypt  bool
+		install  bool
+		location string
+		json     bool
+	}{
+		{"no args runs backup", nil, CommandBackup, false, false, false, LocationAll, false},
+		{"explicit backup", []string{"backup"}, CommandBackup, false, false, false, LocationAll, false},
+		{"legacy restore flag", []string{"--restore"}, CommandRestore, true, false, false, LocationAll, false},
+		{"legacy decrypt flag", []string{"--decrypt"}, CommandDecrypt, false, true, false, LocationAll, false},
+		{"legacy install flag", []string{"--install"}, CommandConfig, false, false, true, LocationAll, false},
+		{"restore command", []string{"restore"}, CommandRestore, true, false, false, LocationAll, false},
+		{"list with options", []string{"list", "--location", "cloud", "--json"}, CommandList, false, false, false, LocationCloud, true},
+		{"status json", []string{"status", "--json"}, CommandStatus, false, false, false, LocationAll, true},
+		{"prune primary", []string{"prune", "--location=primary"}, CommandPrune, false, false, false, LocationPrimary, false},
+		{"config install", []string{"config", "install"}, CommandConfig, false, false, true, LocationAll, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := ParseArgs(tt.argv, io.Discard)
+			if err != nil {
+				t.Fatalf("ParseArgs(%v) error: %v", tt.argv, err)
+			}
+			if args.Command != tt.command {
+				t.Errorf("Command = %q; want %q", args.Command, tt.command)
+			}
+			if args.Restore != tt.restore || args.Decrypt != tt.decrypt || args.Install != tt.install {
+				t.Errorf("Restore/Decrypt/Install = %v/%v/%v; want %v/%v/%v",
+					args.Restore, args.Decrypt, args.Install, tt.restore, tt.decrypt, tt.install)
+			}
+			if args.Location != tt.location {
+				t.Errorf("Location = %q; want %q", args.Location, tt.location)
+			}
+			if args.JSONOutput != tt.json {
+				t.Errorf("JSONOutput = %v; want %v", args.JSONOutput, tt.json)
+			}
+		})
+	}
+}
+
+func TestParseArgsGlobalFlagsAroundCommand(t *testing.T) {
+	args, err := ParseArgs([]string{"-c", "/etc/a.env", "--newkey", "backup", "--dry-run", "-l", "debug"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	if args.ConfigPath != "/etc/a.env" {
+		t.Errorf("ConfigPath = %q; want /etc/a.env", args.ConfigPath)
+	}
+	if args.ConfigPathSource != "specified via --config/-c flag" {
+		t.Errorf("ConfigPathSource = %q", args.ConfigPathSource)
+	}
+	if !args.DryRun {
+		t.Error("DryRun should be true when given after the command")
+	}
+	if !args.ForceNewKey {
+		t.Error("ForceNewKey given before the command should be preserved")
+	}
+	if args.LogLevel != types.LogLevelDebug {
+		t.Errorf("LogLevel = %v; want debug", args.LogLevel)
+	}
+}
+
+func TestParseArgsVerifyPositionals(t *testing.T) {
+	args, err := ParseArgs([]string{"verify", "--deep", "--identity", "/root/age.key", "a.tar.xz", "b.tar.xz"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	if len(args.Positional) != 2 || args.Positional[0] != "a.tar.xz" {
+		t.Errorf("Positional = %v", args.Positional)
+	}
+	if !args.VerifyDeep {
+		t.Error("VerifyDeep = false; want true")
+	}
+	if args.IdentityFile != "/root/age.key" {
+		t.Errorf("IdentityFile = %q; want /root/age.key", args.IdentityFile)
+	}
+}
+
+func TestParseArgsDrillOptions(t *testing.T) {
+	args, err := ParseArgs([]string{"drill", "--from", "cloud", "--identity", "/root/drill.key", "--keep", "--no-notify"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	if args.Command != CommandDrill || args.DrillStorage != LocationCloud || args.IdentityFile != "/root/drill.key" {
+		t.Errorf("unexpected drill options: %+v", args)
+	}
+	if !args.DrillKeep || !args.NoNotify {
+		t.Errorf("DrillKeep/NoNotify = %v/%v; want true/true", args.DrillKeep, args.NoNotify)
+	}
+	if _, err := ParseArgs([]string{"drill", "--from", "all"}, io.Discard); err == nil {
+		t.Error("expected error for --from all")
+	}
+}
+
+func TestParseArgsDiffOptions(t *testing.T) {
+	args, err := ParseArgs([]string{"diff", "--summary", "--category", "network,ssh", "--path", "/etc/pve", "monday.bundle.tar", "latest from cloud"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	if args.Command != CommandDiff || !args.DiffSummary {
+		t.Errorf("unexpected diff options: %+v", args)
+	}
+	if len(args.Positional) != 2 || args.Positional[1] != "latest from cloud" {
+		t.Errorf("Positional = %v", args.Positional)
+	}
+	if len(args.Categories) != 2 || len(args.Paths) != 1 {
+		t.Errorf("Categories/Paths = %v/%v", args.Categories, args.Paths)
+	}
+}
+
+func TestParseArgsSearchOptions(t *testing.T) {
+	args, err := ParseArgs([]string{"search", "--location", "cloud", "--content", "scsi1", "/etc/pve/qemu-server"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	if args.Command != CommandSearch || args.SearchContent != "scsi1" || args.Location != LocationCloud {
+		t.Errorf("unexpected search options: %+v", args)
+	}
+	if len(args.Positional) != 1 || args.Positional[0] != "/etc/pve/qemu-server" {
+		t.Errorf("Positional = %v", args.Positional)
+	}
+
+	args, err = ParseArgs([]string{"search", "--show", "latest", "/etc/hosts"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs(--show) error: %v", err)
+	}
+	if args.SearchShow != "latest" {
+		t.Errorf("SearchShow = %q", args.SearchShow)
+	}
+}
+
+func TestParseArgsRestoreOptions(t *testing.T) {
+	args, err := ParseArgs([]string{"restore", "--identity", "/root/age.key", "--target", "/tmp/r", "-y", "latest", "from", "secondary"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	if args.RestoreSource != "latest from secondary" {
+		t.Errorf("RestoreSource = %q", args.RestoreSource)
+	}
+	if args.IdentityFile != "/root/age.key" || args.TargetRoot != "/tmp/r" || !args.AssumeYes {
+		t.Errorf("unexpected restore options: %+v", args)
+	}
+
+	args, err = ParseArgs([]string{"restore"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	if args.RestoreSource != "" || args.TargetRoot != "/" || args.AssumeYes {
+		t.Errorf("interactive restore defaults changed: %+v", args)
+	}
+
+	if _, err := ParseArgs([]string{"restore", "--source", "latest", "latest"}, io.Discard); err == nil {
+		t.Error("expected error when source is given twice")
+	}
+}
+
+func TestParseArgsRestoreSelection(t *testing.T) {
+	args, err := ParseArgs([]string{"restore", "--path", "/etc/network/interfaces", "--path", "/etc/a,b.conf",
+		"--category", "network, ssh", "--category", "cron", "latest"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	wantPaths := []string{"/etc/network/interfaces", "/etc/a,b.conf"}
+	if strings.Join(args.Paths, "|") != strings.Join(wantPaths, "|") {
+		t.Errorf("Paths = %v; want %v", args.Paths, wantPaths)
+	}
+	wantCategories := []string{"network", "ssh", "cron"}
+	if strings.Join(args.Categories, "|") != strings.Join(wantCategories, "|") {
+		t.Errorf("Categories = %v; want %v", args.Categories, wantCategories)
+	}
+
+	args, err = ParseArgs([]string{"restore", "--target", "/tmp/staging", "--diff-file", "/tmp/r.diff", "latest"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	if !args.Diff || args.DiffFile != "/tmp/r.diff" {
+		t.Errorf("--diff-file should imply --diff: %+v", args)
+	}
+	args, err = ParseArgs([]string{"restore", "--dry-run", "--json", "latest"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	if !args.DryRun || !args.JSONOutput {
+		t.Errorf("restore plan flags not parsed: %+v", args)
+	}
+	args, err = ParseArgs([]string{"restore", "--rollback", "20250101-010203", "--yes"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	if args.RollbackID != "20250101-010203" || !args.AssumeYes {
+		t.Errorf("rollback options not parsed: %+v", args)
+	}
+	args, err = ParseArgs([]string{"restore", "--no-services", "--no-rollback", "latest"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	if !args.NoServices || !args.NoRollback {
+		t.Errorf("--no-services/--no-rollback not parsed: %+v", args)
+	}
+	args, err = ParseArgs([]string{"restore", "--pve-mode", "database", "latest"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	if args.PVEMode != "database" {
+		t.Errorf("PVEMode = %q", args.PVEMode)
+	}
+	if _, err := ParseArgs([]string{"restore", "--pve-mode", "memory", "latest"}, io.Discard); err == nil {
+		t.Error("expected error for an unknown --pve-mode")
+	}
+	if _, err := ParseArgs([]string{"restore", "--dry-run", "--json"}, io.Discard); err == nil {
+		t.Error("expected error for --json without a backup source")
+	}
+	if _, err := ParseArgs([]string{"restore", "--pve-mode", "database", "--no-services", "latest"}, io.Discard); err == nil {
+		t.Error("expected error for --pve-mode database with --no-services")
+	}
+	args, err = ParseArgs([]string{"restore", "--map-host", "pve2", "--map-ip", "10.0.0.1=10.0.0.2", "--map-ip", "fd00::1=fd00::2",
+		"--map-iface", "eno1=enp3s0", "latest"}, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	if args.MapHost != "pve2" || len(args.MapIPs) != 2 || len(args.MapInterfaces) != 1 {
+		t.Errorf("remapping flags not parsed: %+v", args)
+	}
+	if _, err := ParseArgs([]string{"restore", "--map-iface", "eno1", "latest"}, io.Discard); err == nil {
+		t.Error("expected error for a mapping without old=new")
+	}
+	if _, err := ParseArgs([]string{"restore", "--rollback", "latest", "latest"}, io.Discard); err == nil {
+		t.Error("expected error for --rollback combined with a backup source")
+	}
+	args, err = ParseArgs([]string{"restore", "--rollback", "all", "--delete"}, io.Discard)
+	if err != nil || args.RollbackID != "all" || !args.RollbackDelete {
+		t.Errorf("--rollback all --delete = %+v, %v", args, err)
+	}
+	if _, err := ParseArgs([]string{"restore", "--delete", "latest"}, io.Discard); err == nil {
+		t.Error("expected error for --delete without --rollback")
+	}
+	if _, err := ParseArgs([]string{"restore", "--rollback", "all"}, io.Discard); err == nil {
+		t.Error("expected error for --rollback all without --delete")
+	}
+	if _, err := ParseArgs([]string{"restore", "--diff", "latest"}, io.Discard); err == nil {
+		t.Error("expected error for --diff without a staging --target")
+	}
+}
+
+func TestParseArgsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		argv []string
+	}{
+		{"unknown command", []string{"explode"}},
+		{"unknown flag", []string{"list", "--bogus"}},
+		{"invalid location", []string{"list", "--location", "moon"}},
+		{"legacy flag with command", []string{"--restore", "list"}},
+		{"restore and decrypt", []string{"--restore", "--decrypt"}},
+		{"unexpected positional", []string{"status", "extra"}},
+		{"unknown config action", []string{"config", "reset"}},
+		{"flag not valid for command", []string{"status", "--location", "cloud"}},
+		{"diff with one backup", []string{"diff", "latest"}},
+		{"search without pattern", []string{"search"}},
+		{"search show without path", []string{"search", "--show", "latest"}},
+		{"search show with content", []string{"search", "--show", "latest", "--content", "x", "/etc/hosts"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseArgs(tt.argv, io.Discard); err == nil {
+				t.Errorf("ParseArgs(%v) expected error", tt.argv)
+			}
+		})
+	}
+}
+
+func TestCommandReadOnly(t *testing.T) {
+	readOnly := map[Command]bool{
+		CommandList:   true,
+		CommandStatus: true,
+		CommandVerify: true,
+		CommandDiff:   true,
+		CommandSearch: true,
+	}
+	for _, cmd := range Commands() {
+		if got := cmd.ReadOnly(); got != readOnly[cmd] {
+			t.Errorf("%s.ReadOnly() = %v; want %v", cmd, got, readOnly[cmd])
+		}
+	}
+}
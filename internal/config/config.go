@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -52,6 +53,13 @@ type Config struct {
 	ChunkThresholdMB       int
 	PrefilterMaxFileSizeMB int
 
+	// Incremental backups
+	BackupIncremental   bool
+	IncrementalMaxChain int // Incremental backups allowed after a full one
+
+	// Deduplicating repository (replaces archives)
+	BackupRepository bool
+
 	// Paths
 	BackupPath       string
 	LogPath          string
@@ -59,6 +67,14 @@ type Config struct {
 	CloudLogPath     string
 	LockPath         string
 	SecureAccount    string
+	RollbackPath     string
+	RollbackKeep     int // Pre-restore snapshots kept in RollbackPath (0 = keep all)
+
+	// Restore drill settings
+	RestoreDrillStorage       string
+	RestoreDrillIdentityFile  string
+	RestoreDrillWorkDir       string
+	RestoreDrillExpectedFiles []string
 
 	// Storage settings
 	SecondaryEnabled      bool
@@ -102,6 +118,7 @@ type Config struct {
 
 	// Bundle settings for associated files
 	BundleAssociatedFiles bool // Bundle .tar.xz + .sha256 + .metadata into single archive
+	ArchiveVolumeSizeMB   int  // Split larger archives into volumes of N MiB (0 = disabled)
 	EncryptArchive        bool
 	AgeRecipients         []string
 	AgeRecipientFile      string
@@ -305,7 +322,8 @@ func (c *Config) loadEnvOverrides() {
 		"COMPRESSION_TYPE", "COMPRESSION_LEVEL", "COMPRESSION_THREADS", "COMPRESSION_MODE",
 		"ENABLE_SMART_CHUNKING", "ENABLE_DEDUPLICATION", "ENABLE_PREFILTER",
 		"CHUNK_SIZE_MB", "CHUNK_THRESHOLD_MB", "PREFILTER_MAX_FILE_SIZE_MB",
-		"BACKUP_PATH", "LOG_PATH", "LOCK_PATH", "SECURE_ACCOUNT",
+		"BACKUP_INCREMENTAL", "INCREMENTAL_MAX_CHAIN", "BACKUP_REPOSITORY",
+		"BACKUP_PATH", "LOG_PATH", "LOCK_PATH", "SECURE_ACCOUNT", "ROLLBACK_PATH", "ROLLBACK_KEEP",
 		"SECONDARY_ENABLED", "SECONDARY_PATH", "SECONDARY_LOG_PATH",
 		"CLOUD_ENABLED", "CLOUD_REMOTE", "CLOUD_REMOTE_PATH", "CLOUD_LOG_PATH",
 		"CLOUD_UPLOAD_MODE", "CLOUD_PARALLEL_MAX_JOBS", "CLOUD_PARALLEL_VERIFICATION",
@@ -315,12 +333,13 @@ func (c *Config) loadEnvOverrides() {
 		"CLOUD_BATCH_SIZE", "CLOUD_BATCH_PAUSE",
 		"MAX_LOCAL_BACKUPS", "MAX_SECONDARY_BACKUPS", "MAX_CLOUD_BACKUPS",
 		"RETENTION_DAILY", "RETENTION_WEEKLY", "RETENTION_MONTHLY", "RETENTION_YEARLY",
-		"BUNDLE_ASSOCIATED_FILES", "ENCRYPT_ARCHIVE", "AGE_RECIPIENT", "AGE_RECIPIENT_FILE",
+		"BUNDLE_ASSOCIATED_FILES", "ARCHIVE_VOLUME_SIZE_MB", "ENCRYPT_ARCHIVE", "AGE_RECIPIENT", "AGE_RECIPIENT_FILE",
 		"TELEGRAM_ENABLED", "BOT_TELEGRAM_TYPE", "TELEGRAM_BOT_TOKEN", "TELEGRAM_CHAT_ID",
 		"EMAIL_ENABLED", "EMAIL_DELIVERY_METHOD", "EMAIL_FALLBACK_SENDMAIL",
 		"EMAIL_RECIPIENT", "EMAIL_FROM",
 		"WEBHOOK_ENABLED", "WEBHOOK_ENDPOINTS", "WEBHOOK_FORMAT", "WEBHOOK_TIMEOUT",
 		"WEBHOOK_MAX_RETRIES", "WEBHOOK_RETRY_DELAY",
+		"RESTORE_DRILL_STORAGE", "RESTORE_DRILL_IDENTITY_FILE", "RESTORE_DRILL_WORK_DIR", "RESTORE_DRILL_EXPECTED_FILES",
 		"METRICS_ENABLED", "METRICS_PATH",
 		"SECURITY_CHECK_ENABLED", "AUTO_UPDATE_HASHES", "AUTO_FIX_PERMISSIONS",
 		"CONTINUE_ON_SECURITY_ISSUES", "CHECK_NETWORK_SECURITY", "CHECK_FIREWALL",
@@ -383,6 +402,16 @@ func (c *Config) parse() error {
 		c.PrefilterMaxFileSizeMB = 8
 	}
 
+	// Incremental backups
+	c.BackupIncremental = c.getBool("BACKUP_INCREMENTAL", false)
+	c.IncrementalMaxChain = c.getInt("INCREMENTAL_MAX_CHAIN", 6)
+	if c.IncrementalMaxChain < 0 {
+		c.IncrementalMaxChain = 6
+	}
+
+	// Deduplicating repository
+	c.BackupRepository = c.getBool("BACKUP_REPOSITORY", false)
+
 	c.MinDiskPrimaryGB = sanitizeMinDisk(c.getFloat("MIN_DISK_SPACE_PRIMARY_GB", 10.0))
 	c.MinDiskSecondaryGB = sanitizeMinDisk(c.getFloat("MIN_DISK_SPACE_SECONDARY_GB", c.MinDiskPrimaryGB))
 	c.MinDiskCloudGB = sanitizeMinDisk(c.getFloat("MIN_DISK_SPACE_CLOUD_GB", c.MinDiskPrimaryGB))
@@ -451,6 +480,16 @@ func (c *Config) parse() error {
 	c.CloudLogPath = c.getString("CLOUD_LOG_PATH", "")
 	c.LockPath = c.getString("LOCK_PATH", filepath.Join(c.BaseDir, "lock"))
 	c.SecureAccount = c.getString("SECURE_ACCOUNT", filepath.Join(c.BaseDir, "secure_account"))
+	c.RollbackPath = c.getString("ROLLBACK_PATH", filepath.Join(c.BaseDir, "rollback"))
+	c.RollbackKeep = c.getInt("ROLLBACK_KEEP", 5)
+	if c.RollbackKeep < 0 {
+		c.RollbackKeep = 0
+	}
+
+	c.RestoreDrillStorage = strings.ToLower(strings.TrimSpace(c.getString("RESTORE_DRILL_STORAGE", "primary")))
+	c.RestoreDrillIdentityFile = strings.TrimSpace(c.getString("RESTORE_DRILL_IDENTITY_FILE", ""))
+	c.RestoreDrillWorkDir = strings.TrimSpace(c.getString("RESTORE_DRILL_WORK_DIR", ""))
+	c.RestoreDrillExpectedFiles = normalizeList(c.getStringSlice("RESTORE_DRILL_EXPECTED_FILES", nil))
 
 	// Storage: supporta ENABLE_SECONDARY_BACKUP o SECONDARY_ENABLED
 	c.SecondaryEnabled = c.getBoolWithFallback([]string{"ENABLE_SECONDARY_BACKUP", "SECONDARY_ENABLED"}, false)
@@ -508,6 +547,12 @@ func (c *Config) parse() error {
 	// Bundle associated files into single archive
 	c.BundleAssociatedFiles = c.getBool("BUNDLE_ASSOCIATED_FILES", true)
 
+	// Split archives into volumes for targets with a file size limit
+	c.ArchiveVolumeSizeMB = c.getInt("ARCHIVE_VOLUME_SIZE_MB", 0)
+	if c.ArchiveVolumeSizeMB < 0 {
+		c.ArchiveVolumeSizeMB = 0
+	}
+
 	c.SafetyFactor = 1.5
 
 	// Telegram Notifications
@@ -915,6 +960,16 @@ func (c *Config) Set(key, value string) {
 	c.raw[key] = value
 }
 
+// Keys restituisce le chiavi raw presenti nella configurazione, in ordine alfabetico
+func (c *Config) Keys() []string {
+	keys := make([]string, 0, len(c.raw))
+	for key := range c.raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func normalizeList(values []string) []string {
 	if len(values) == 0 {
 		return []string{}
@@ -429,6 +429,10 @@ func TestConfigDefaults(t *testing.T) {
 	if cfg.BaseDir != "/defaults/base" {
 		t.Errorf("Default BaseDir = %q; want %q", cfg.BaseDir, "/defaults/base")
 	}
+
+	if cfg.RestoreDrillStorage != "primary" || len(cfg.RestoreDrillExpectedFiles) != 0 {
+		t.Errorf("Default restore drill = %q %v; want primary and no expected files", cfg.RestoreDrillStorage, cfg.RestoreDrillExpectedFiles)
+	}
 }
 
 func TestEnableGoBackupFlag(t *testing.T) {
@@ -2,6 +2,7 @@ package logging
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
@@ -22,15 +23,33 @@ type BootstrapLogger struct {
 	entries  []bootstrapEntry
 	flushed  bool
 	minLevel types.LogLevel
+	output   io.Writer // banner and info lines; warnings and errors always go to stderr
 }
 
 // NewBootstrapLogger crea un nuovo bootstrap logger con livello INFO di default.
 func NewBootstrapLogger() *BootstrapLogger {
 	return &BootstrapLogger{
 		minLevel: types.LogLevelInfo,
+		output:   os.Stdout,
 	}
 }
 
+// SetOutput imposta il writer di banner e messaggi informativi (stdout se nil).
+func (b *BootstrapLogger) SetOutput(w io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if w == nil {
+		w = os.Stdout
+	}
+	b.output = w
+}
+
+func (b *BootstrapLogger) writer() io.Writer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.output
+}
+
 // SetLevel aggiorna il livello minimo che verrà usato al flush.
 func (b *BootstrapLogger) SetLevel(level types.LogLevel) {
 	b.mu.Lock()
@@ -40,21 +59,21 @@ func (b *BootstrapLogger) SetLevel(level types.LogLevel) {
 
 // Println registra una riga “raw” (usata per banner/testo senza header).
 func (b *BootstrapLogger) Println(message string) {
-	fmt.Println(message)
+	fmt.Fprintln(b.writer(), message)
 	b.recordRaw(message)
 }
 
 // Printf registra una riga formattata come raw.
 func (b *BootstrapLogger) Printf(format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
-	fmt.Println(msg)
+	fmt.Fprintln(b.writer(), msg)
 	b.recordRaw(msg)
 }
 
 // Info registra un messaggio informativo precoce.
 func (b *BootstrapLogger) Info(format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
-	fmt.Println(msg)
+	fmt.Fprintln(b.writer(), msg)
 	b.record(types.LogLevelInfo, msg)
 }
 
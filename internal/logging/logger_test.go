@@ -228,3 +228,17 @@ func TestPackageLevelFunctions(t *testing.T) {
 		}
 	}
 }
+
+func TestBootstrapSetOutput(t *testing.T) {
+	var buf bytes.Buffer
+	bootstrap := NewBootstrapLogger()
+	bootstrap.SetOutput(&buf)
+
+	bootstrap.Println("banner")
+	bootstrap.Printf("Version: %s", "1.0")
+	bootstrap.Info("loading")
+
+	if got := buf.String(); got != "banner\nVersion: 1.0\nloading\n" {
+		t.Errorf("bootstrap output = %q", got)
+	}
+}
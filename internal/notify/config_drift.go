@@ -0,0 +1,150 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Change kinds of a configuration drift report
+const (
+	DriftAdded    = "added"
+	DriftRemoved  = "removed"
+	DriftModified = "modified"
+)
+
+// maxDriftListed limits the changed files listed in a notification
+const maxDriftListed = 10
+
+// ConfigDriftReport lists the configuration files that changed since the
+// previous successful backup
+type ConfigDriftReport struct {
+	Previous        string              `json:"previous"` // archive compared with
+	PreviousCreated time.Time           `json:"previous_created"`
+	Changes         []ConfigDriftChange `json:"changes"`
+}
+
+// ConfigDriftChange is one added, removed or modified configuration file
+type ConfigDriftChange struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+}
+
+// Count returns the number of changes of a kind
+func (r *ConfigDriftReport) Count(status string) int {
+	n := 0
+	for _, c := range r.Changes {
+		if c.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Summary is the one-line outcome of the comparison
+func (r *ConfigDriftReport) Summary() string {
+	since := r.Previous
+	if !r.PreviousCreated.IsZero() {
+		since = fmt.Sprintf("%s (%s)", r.Previous, r.PreviousCreated.Format("2006-01-02 15:04"))
+	}
+	if len(r.Changes) == 0 {
+		return "No configuration changes since " + since
+	}
+	return fmt.Sprintf("%d configuration files changed since %s: %d added, %d removed, %d modified", len(r.Changes), since,
+		r.Count(DriftAdded), r.Count(DriftRemoved), r.Count(DriftModified))
+}
+
+// driftLines lists the first changes as "+ path", "- path" or "~ path"
+func driftLines(r *ConfigDriftReport) []string {
+	lines := make([]string, 0, maxDriftListed+1)
+	for i, c := range r.Changes {
+		if i == maxDriftListed {
+			lines = append(lines, fmt.Sprintf("... and %d more", len(r.Changes)-maxDriftListed))
+			break
+		}
+		mark := "~"
+		switch c.Status {
+		case DriftAdded:
+			mark = "+"
+		case DriftRemoved:
+			mark = "-"
+		}
+		lines = append(lines, mark+" "+c.Path)
+	}
+	return lines
+}
+
+func buildDriftPlainText(r *ConfigDriftReport) string {
+	var body strings.Builder
+	body.WriteString("CONFIGURATION DRIFT:\n")
+	fmt.Fprintf(&body, "  %s\n", r.Summary())
+	for _, line := range driftLines(r) {
+		fmt.Fprintf(&body, "  %s\n", line)
+	}
+	body.WriteString("\n")
+	return body.String()
+}
+
+func buildDriftHTML(r *ConfigDriftReport) string {
+	color := "#4CAF50" // Green: nothing changed
+	if len(r.Changes) > 0 {
+		color = "#2196F3"
+	}
+	var b strings.Builder
+	b.WriteString("            \n")
+	b.WriteString("            <div class=\"section\">\n")
+	b.WriteString("                <h2>Configuration Drift</h2>\n")
+	fmt.Fprintf(&b, "                <div style=\"padding:15px; background-color:#F5F5F5; border-radius:6px; border-left:4px solid %s;\">\n", color)
+	fmt.Fprintf(&b, "                    <p>%s</p>\n", escapeHTML(r.Summary()))
+	if len(r.Changes) > 0 {
+		b.WriteString("                    <ul>\n")
+		for _, line := range driftLines(r) {
+			fmt.Fprintf(&b, "                        <li><code>%s</code></li>\n", escapeHTML(line))
+		}
+		b.WriteString("                    </ul>\n")
+	}
+	b.WriteString("                </div>\n")
+	b.WriteString("            </div>\n")
+	return b.String()
+}
+
+func buildDriftTelegramText(r *ConfigDriftReport) string {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "🔧 %s\n", r.Summary())
+	for _, line := range driftLines(r) {
+		fmt.Fprintf(&msg, "  %s\n", line)
+	}
+	msg.WriteString("\n")
+	return msg.String()
+}
+
+// buildDriftReportData is the drift section of the relay and generic
+// webhook payloads
+func buildDriftReportData(r *ConfigDriftReport) map[string]interface{} {
+	changes := r.Changes
+	if changes == nil {
+		changes = []ConfigDriftChange{}
+	}
+	report := map[string]interface{}{
+		"previous": r.Previous,
+		"changes":  changes,
+		"added":    r.Count(DriftAdded),
+		"removed":  r.Count(DriftRemoved),
+		"modified": r.Count(DriftModified),
+		"summary":  r.Summary(),
+	}
+	if !r.PreviousCreated.IsZero() {
+		report["previous_date"] = r.PreviousCreated.Format("2006-01-02T15:04:05Z07:00")
+	}
+	return report
+}
+
+// driftFieldText is the summary followed by the changed files in a
+// Markdown code block (Discord and Slack fields)
+func driftFieldText(r *ConfigDriftReport) string {
+	lines := driftLines(r)
+	if len(lines) == 0 {
+		return r.Summary()
+	}
+	return fmt.Sprintf("%s\n```\n%s\n```", r.Summary(), strings.Join(lines, "\n"))
+}
@@ -0,0 +1,106 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+func createTestDriftReport() *ConfigDriftReport {
+	return &ConfigDriftReport{
+		Previous:        "pve1-backup-20251110-010000.tar.xz",
+		PreviousCreated: time.Date(2025, 11, 10, 1, 0, 0, 0, time.UTC),
+		Changes: []ConfigDriftChange{
+			{Path: "/etc/network/interfaces", Status: DriftModified},
+			{Path: "/etc/pve/qemu-server/113.conf", Status: DriftAdded},
+			{Path: "/etc/pve/qemu-server/999.conf", Status: DriftRemoved},
+		},
+	}
+}
+
+func TestConfigDriftSummary(t *testing.T) {
+	report := createTestDriftReport()
+	want := "3 configuration files changed since pve1-backup-20251110-010000.tar.xz (2025-11-10 01:00): 1 added, 1 removed, 1 modified"
+	if got := report.Summary(); got != want {
+		t.Errorf("Summary() = %q; want %q", got, want)
+	}
+
+	report.Changes = nil
+	if got := report.Summary(); !strings.HasPrefix(got, "No configuration changes since") {
+		t.Errorf("Summary() without changes = %q", got)
+	}
+
+	for i := 0; i < maxDriftListed+5; i++ {
+		report.Changes = append(report.Changes, ConfigDriftChange{Path: fmt.Sprintf("/etc/file%02d", i), Status: DriftAdded})
+	}
+	lines := driftLines(report)
+	if len(lines) != maxDriftListed+1 || lines[0] != "+ /etc/file00" || lines[maxDriftListed] != "... and 5 more" {
+		t.Errorf("driftLines() = %v", lines)
+	}
+}
+
+func TestConfigDriftTemplates(t *testing.T) {
+	data := createTestNotificationData()
+	data.ConfigDrift = createTestDriftReport()
+
+	text := BuildEmailPlainText(data)
+	for _, want := range []string{"CONFIGURATION DRIFT:", "~ /etc/network/interfaces", "- /etc/pve/qemu-server/999.conf"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("plain text missing %q:\n%s", want, text)
+		}
+	}
+	if html := BuildEmailHTML(data); !strings.Contains(html, "Configuration Drift") || !strings.Contains(html, "<code>+ /etc/pve/qemu-server/113.conf</code>") {
+		t.Errorf("HTML body missing drift section:\n%s", html)
+	}
+	if telegram := (&TelegramNotifier{}).buildMessage(data); !strings.Contains(telegram, "🔧 3 configuration files changed") {
+		t.Errorf("telegram message:\n%s", telegram)
+	}
+
+	// Without a report no section is added
+	data.ConfigDrift = nil
+	if text := BuildEmailPlainText(data); strings.Contains(text, "CONFIGURATION DRIFT") {
+		t.Errorf("unexpected drift section:\n%s", text)
+	}
+}
+
+func TestConfigDriftPayloads(t *testing.T) {
+	logger := logging.New(types.LogLevelDebug, false)
+	data := createTestNotificationData()
+	data.ConfigDrift = createTestDriftReport()
+
+	payload, err := buildGenericPayload(data, logger)
+	if err != nil {
+		t.Fatalf("buildGenericPayload() error: %v", err)
+	}
+	drift, ok := payload["config_drift"].(map[string]interface{})
+	if !ok {
+		t.Fatal("config_drift field should be a map")
+	}
+	if drift["added"] != 1 || drift["removed"] != 1 || drift["modified"] != 1 || drift["previous_date"] != "2025-11-10T01:00:00Z" {
+		t.Errorf("config_drift = %v", drift)
+	}
+
+	discord, err := buildDiscordPayload(data, logger)
+	if err != nil {
+		t.Fatalf("buildDiscordPayload() error: %v", err)
+	}
+	if !strings.Contains(fmt.Sprint(discord), "Configuration Drift") {
+		t.Errorf("discord payload missing drift field: %v", discord)
+	}
+	for name, build := range map[string]func(*NotificationData, *logging.Logger) (map[string]interface{}, error){
+		"slack": buildSlackPayload,
+		"teams": buildTeamsPayload,
+	} {
+		payload, err := build(data, logger)
+		if err != nil {
+			t.Fatalf("%s payload error: %v", name, err)
+		}
+		if !strings.Contains(fmt.Sprint(payload), "/etc/network/interfaces") {
+			t.Errorf("%s payload missing drift: %v", name, payload)
+		}
+	}
+}
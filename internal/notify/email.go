@@ -255,6 +255,13 @@ func (e *EmailNotifier) sendViaRelay(ctx context.Context, recipient, subject, ht
 		ScriptVersion: data.ScriptVersion,
 		ServerID:      data.ServerID,
 	}
+	if isRestoreDrill(data) {
+		// Backup reports keep the exact layout the relay signs
+		payload.Report["event"] = string(EventRestoreDrill)
+		payload.Report["restore_drill"] = buildDrillReportData(data)
+	} else if data.ConfigDrift != nil {
+		payload.Report["config_drift"] = buildDriftReportData(data.ConfigDrift)
+	}
 
 	// Send via cloud relay
 	return sendViaCloudRelay(ctx, e.config.CloudRelayConfig, payload, e.logger)
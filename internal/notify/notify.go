@@ -49,6 +49,9 @@ func StatusFromExitCode(exitCode int) NotificationStatus {
 
 // NotificationData contains all information to be sent in notifications
 type NotificationData struct {
+	// Event is what the notification reports; empty means EventBackup
+	Event NotificationEvent
+
 	// Overall status
 	Status        NotificationStatus
 	StatusMessage string
@@ -160,6 +163,13 @@ type NotificationData struct {
 
 	// Script metadata
 	ScriptVersion string
+
+	// Restore drill result (Event == EventRestoreDrill)
+	RestoreDrill *RestoreDrillReport
+
+	// Configuration changes since the previous backup; nil when there was
+	// no previous backup to compare with
+	ConfigDrift *ConfigDriftReport
 }
 
 // LogCategory represents a normalized log issue classification.
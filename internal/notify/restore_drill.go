@@ -0,0 +1,318 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+)
+
+// NotificationEvent identifies what a notification reports
+type NotificationEvent string
+
+const (
+	// EventBackup is the report of a backup run (the default)
+	EventBackup NotificationEvent = "backup"
+	// EventRestoreDrill is the result of a restore drill
+	EventRestoreDrill NotificationEvent = "restore-drill"
+)
+
+// RestoreDrillReport describes a restore drill: the newest backup of a
+// storage was decrypted and extracted into a throwaway directory and the
+// expected key files were looked up
+type RestoreDrillReport struct {
+	Storage      string // primary, secondary or cloud
+	Backup       string // archive name
+	Created      time.Time
+	Files        int // files extracted
+	IndexedFiles int // regular files listed in the content index (0: no index)
+	Duration     time.Duration
+	Checks       []RestoreDrillCheck
+	Error        string // why the drill could not complete
+}
+
+// RestoreDrillCheck is the lookup of one expected file
+type RestoreDrillCheck struct {
+	Path  string `json:"path"`
+	Found bool   `json:"found"`
+}
+
+// Missing returns the expected files the drill did not find
+func (r *RestoreDrillReport) Missing() []string {
+	var missing []string
+	for _, c := range r.Checks {
+		if !c.Found {
+			missing = append(missing, c.Path)
+		}
+	}
+	return missing
+}
+
+func isRestoreDrill(data *NotificationData) bool {
+	return data.Event == EventRestoreDrill && data.RestoreDrill != nil
+}
+
+// drillSummary is the one-line outcome of a drill
+func drillSummary(data *NotificationData) string {
+	drill := data.RestoreDrill
+	switch {
+	case drill.Error != "":
+		return "Restore drill failed: " + drill.Error
+	case len(drill.Missing()) > 0:
+		return fmt.Sprintf("Restore drill completed, %d of %d expected files missing", len(drill.Missing()), len(drill.Checks))
+	default:
+		return fmt.Sprintf("Restore drill completed, %d expected files found", len(drill.Checks))
+	}
+}
+
+// drillFilesLabel renders the extracted files, next to the files the content
+// index lists when the backup has one
+func drillFilesLabel(drill *RestoreDrillReport) string {
+	if drill.IndexedFiles == 0 {
+		return fmt.Sprintf("%d", drill.Files)
+	}
+	return fmt.Sprintf("%d (%d regular files in content index)", drill.Files, drill.IndexedFiles)
+}
+
+func drillBackupLabel(drill *RestoreDrillReport) string {
+	if drill.Backup == "" {
+		return "-"
+	}
+	if drill.Created.IsZero() {
+		return drill.Backup
+	}
+	return fmt.Sprintf("%s (%s)", drill.Backup, drill.Created.Format("2006-01-02 15:04"))
+}
+
+func buildDrillSubject(data *NotificationData) string {
+	return fmt.Sprintf("%s %s Restore drill on %s - %s", GetStatusEmoji(data.Status),
+		strings.ToUpper(data.ProxmoxType.String()), data.Hostname, data.BackupDate.Format("2006-01-02 15:04"))
+}
+
+func buildDrillPlainText(data *NotificationData) string {
+	drill := data.RestoreDrill
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s %s RESTORE DRILL - %s\n", GetStatusEmoji(data.Status),
+		strings.ToUpper(data.ProxmoxType.String()), strings.ToUpper(data.Status.String()))
+	fmt.Fprintf(&body, "Hostname: %s\n", data.Hostname)
+	fmt.Fprintf(&body, "Date: %s\n\n", data.BackupDate.Format("2006-01-02 15:04:05"))
+
+	fmt.Fprintf(&body, "%s\n\n", drillSummary(data))
+	body.WriteString("DRILL DETAILS:\n")
+	fmt.Fprintf(&body, "  Storage: %s\n", drill.Storage)
+	fmt.Fprintf(&body, "  Backup: %s\n", drillBackupLabel(drill))
+	fmt.Fprintf(&body, "  Extracted files: %s\n", drillFilesLabel(drill))
+	fmt.Fprintf(&body, "  Duration: %s\n\n", FormatDuration(drill.Duration))
+
+	if len(drill.Checks) > 0 {
+		body.WriteString("EXPECTED FILES:\n")
+		for _, c := range drill.Checks {
+			mark := "✓"
+			if !c.Found {
+				mark = "✗"
+			}
+			fmt.Fprintf(&body, "  %s %s\n", mark, c.Path)
+		}
+		body.WriteString("\n")
+	}
+
+	fmt.Fprintf(&body, "Exit Code: %d\n", data.ExitCode)
+	fmt.Fprintf(&body, "Script Version: %s\n", data.ScriptVersion)
+	return body.String()
+}
+
+func buildDrillHTML(data *NotificationData) string {
+	drill := data.RestoreDrill
+	proxmoxType := strings.ToUpper(data.ProxmoxType.String())
+
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n    <meta charset=\"UTF-8\">\n")
+	fmt.Fprintf(&b, "    <title>%s Restore Drill</title>\n", proxmoxType)
+	b.WriteString("    <style>\n")
+	b.WriteString(getEmbeddedCSS())
+	b.WriteString("    </style>\n</head>\n<body>\n    <div class=\"container\">\n")
+	fmt.Fprintf(&b, "        <div class=\"header\" style=\"background-color: %s;\">\n", getStatusColor(data.Status))
+	fmt.Fprintf(&b, "            <h1>%s Restore Drill - %s</h1>\n", proxmoxType, strings.ToUpper(data.Status.String()))
+	fmt.Fprintf(&b, "            <p>%s - %s</p>\n", escapeHTML(data.Hostname), data.BackupDate.Format("2006-01-02 15:04:05"))
+	b.WriteString("        </div>\n        <div class=\"content\">\n")
+	fmt.Fprintf(&b, "            <p>%s</p>\n", escapeHTML(drillSummary(data)))
+	b.WriteString("            <table class=\"info-table\">\n")
+	b.WriteString(buildInfoTableRow("Storage", drill.Storage))
+	b.WriteString(buildInfoTableRow("Backup", drillBackupLabel(drill)))
+	b.WriteString(buildInfoTableRow("Extracted files", drillFilesLabel(drill)))
+	b.WriteString(buildInfoTableRow("Duration", FormatDuration(drill.Duration)))
+	b.WriteString("            </table>\n")
+	if len(drill.Checks) > 0 {
+		b.WriteString("            <h3>Expected files</h3>\n            <ul>\n")
+		for _, c := range drill.Checks {
+			mark := "✅"
+			if !c.Found {
+				mark = "❌"
+			}
+			fmt.Fprintf(&b, "                <li>%s %s</li>\n", mark, escapeHTML(c.Path))
+		}
+		b.WriteString("            </ul>\n")
+	}
+	b.WriteString("        </div>\n")
+	b.WriteString("        <div class=\"footer\">\n")
+	fmt.Fprintf(&b, "            <p>Exit Code: %d - generated by backup script v%s</p>\n", data.ExitCode, escapeHTML(data.ScriptVersion))
+	b.WriteString("        </div>\n")
+	b.WriteString("    </div>\n</body>\n</html>\n")
+	return b.String()
+}
+
+func buildDrillTelegramMessage(data *NotificationData) string {
+	drill := data.RestoreDrill
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "%s Restore drill %s - %s\n\n", GetStatusEmoji(data.Status), data.ProxmoxType.String(), data.Hostname)
+	fmt.Fprintf(&msg, "%s\n\n", drillSummary(data))
+	fmt.Fprintf(&msg, "💾 Storage: %s\n", drill.Storage)
+	fmt.Fprintf(&msg, "📦 Backup: %s\n", drillBackupLabel(drill))
+	fmt.Fprintf(&msg, "📁 Extracted files: %s\n", drillFilesLabel(drill))
+	for _, c := range drill.Checks {
+		mark := "✅"
+		if !c.Found {
+			mark = "❌"
+		}
+		fmt.Fprintf(&msg, "%s %s\n", mark, c.Path)
+	}
+	fmt.Fprintf(&msg, "\n⏱️ Duration: %s\n\n", FormatDuration(drill.Duration))
+	fmt.Fprintf(&msg, "🔢 Exit code: %d", data.ExitCode)
+	return msg.String()
+}
+
+// buildDrillReportData is the restore drill section of the relay and
+// generic webhook payloads
+func buildDrillReportData(data *NotificationData) map[string]interface{} {
+	drill := data.RestoreDrill
+	checks := drill.Checks
+	if checks == nil {
+		checks = []RestoreDrillCheck{}
+	}
+	report := map[string]interface{}{
+		"storage":          drill.Storage,
+		"backup":           drill.Backup,
+		"files":            drill.Files,
+		"indexed_files":    drill.IndexedFiles,
+		"duration_seconds": drill.Duration.Seconds(),
+		"checks":           checks,
+		"missing":          len(drill.Missing()),
+		"summary":          drillSummary(data),
+	}
+	if !drill.Created.IsZero() {
+		report["backup_date"] = drill.Created.Format("2006-01-02T15:04:05Z07:00")
+	}
+	if drill.Error != "" {
+		report["error"] = drill.Error
+	}
+	return report
+}
+
+// buildDrillPayload builds the webhook payload of a restore drill in the
+// endpoint format
+func buildDrillPayload(format string, data *NotificationData, logger *logging.Logger) (map[string]interface{}, error) {
+	logger.Debug("buildDrillPayload() called with format=%s", format)
+	title := fmt.Sprintf("%s %s Restore Drill", GetStatusEmoji(data.Status), strings.ToUpper(data.ProxmoxType.String()))
+	summary := drillSummary(data)
+	drill := data.RestoreDrill
+
+	var checks strings.Builder
+	for _, c := range drill.Checks {
+		mark := "✅"
+		if !c.Found {
+			mark = "❌"
+		}
+		fmt.Fprintf(&checks, "%s %s\n", mark, c.Path)
+	}
+	facts := [][2]string{
+		{"Hostname", data.Hostname},
+		{"Storage", drill.Storage},
+		{"Backup", drillBackupLabel(drill)},
+		{"Extracted files", drillFilesLabel(drill)},
+		{"Duration", FormatDuration(drill.Duration)},
+	}
+	if checks.Len() > 0 {
+		facts = append(facts, [2]string{"Expected files", strings.TrimSpace(checks.String())})
+	}
+
+	switch strings.ToLower(format) {
+	case "discord":
+		color := 3066993 // Green
+		switch data.Status {
+		case StatusWarning:
+			color = 16753920 // Orange
+		case StatusFailure:
+			color = 15158332 // Red
+		}
+		fields := make([]map[string]interface{}, 0, len(facts))
+		for _, f := range facts {
+			fields = append(fields, map[string]interface{}{"name": f[0], "value": f[1], "inline": f[0] != "Expected files"})
+		}
+		embed := map[string]interface{}{
+			"title":       title,
+			"description": summary,
+			"color":       color,
+			"fields":      fields,
+			"footer": map[string]interface{}{
+				"text": fmt.Sprintf("Proxmox Backup Script v%s • Exit Code: %d", data.ScriptVersion, data.ExitCode),
+			},
+			"timestamp": data.BackupDate.Format("2006-01-02T15:04:05Z07:00"),
+		}
+		return map[string]interface{}{"embeds": []interface{}{embed}}, nil
+
+	case "slack":
+		fields := make([]interface{}, 0, len(facts))
+		for _, f := range facts {
+			fields = append(fields, map[string]interface{}{"type": "mrkdwn", "text": fmt.Sprintf("*%s:*\n%s", f[0], f[1])})
+		}
+		blocks := []interface{}{
+			map[string]interface{}{"type": "header", "text": map[string]interface{}{"type": "plain_text", "text": title}},
+			map[string]interface{}{"type": "section", "text": map[string]interface{}{"type": "mrkdwn", "text": summary}},
+			map[string]interface{}{"type": "section", "fields": fields},
+			map[string]interface{}{"type": "context", "elements": []interface{}{
+				map[string]interface{}{"type": "mrkdwn", "text": fmt.Sprintf("Proxmox Backup Script v%s", data.ScriptVersion)},
+			}},
+		}
+		return map[string]interface{}{"blocks": blocks}, nil
+
+	case "teams":
+		teamsFacts := make([]map[string]interface{}, 0, len(facts)+1)
+		for _, f := range facts {
+			teamsFacts = append(teamsFacts, map[string]interface{}{"title": f[0], "value": f[1]})
+		}
+		teamsFacts = append(teamsFacts, map[string]interface{}{"title": "Exit Code", "value": fmt.Sprintf("%d", data.ExitCode)})
+		card := map[string]interface{}{
+			"type":    "AdaptiveCard",
+			"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+			"version": "1.5",
+			"body": []interface{}{
+				map[string]interface{}{"type": "TextBlock", "text": title, "weight": "bolder", "size": "large"},
+				map[string]interface{}{"type": "TextBlock", "text": summary, "wrap": true},
+				map[string]interface{}{"type": "FactSet", "facts": teamsFacts},
+			},
+		}
+		return map[string]interface{}{
+			"type": "message",
+			"attachments": []interface{}{
+				map[string]interface{}{"contentType": "application/vnd.microsoft.card.adaptive", "content": card},
+			},
+		}, nil
+
+	default:
+		return map[string]interface{}{
+			"event":          string(EventRestoreDrill),
+			"status":         data.Status.String(),
+			"status_message": data.StatusMessage,
+			"status_emoji":   GetStatusEmoji(data.Status),
+			"exit_code":      data.ExitCode,
+			"hostname":       data.Hostname,
+			"proxmox_type":   data.ProxmoxType.String(),
+			"server_id":      data.ServerID,
+			"script_version": data.ScriptVersion,
+			"timestamp":      data.BackupDate.Unix(),
+			"timestamp_iso":  data.BackupDate.Format("2006-01-02T15:04:05Z07:00"),
+			"restore_drill":  buildDrillReportData(data),
+		}, nil
+	}
+}
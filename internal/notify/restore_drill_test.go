@@ -0,0 +1,89 @@
+package notify
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+func createTestDrillData() *NotificationData {
+	return &NotificationData{
+		Event:         EventRestoreDrill,
+		Status:        StatusFailure,
+		ExitCode:      types.ExitVerificationError.Int(),
+		Hostname:      "pve1",
+		ProxmoxType:   types.ProxmoxVE,
+		BackupDate:    time.Date(2025, 11, 11, 3, 0, 0, 0, time.UTC),
+		ScriptVersion: "0.2.0",
+		RestoreDrill: &RestoreDrillReport{
+			Storage:      "secondary",
+			Backup:       "pve1-backup-20251111.tar.xz.age",
+			Created:      time.Date(2025, 11, 11, 1, 0, 0, 0, time.UTC),
+			Files:        812,
+			IndexedFiles: 640,
+			Duration:     42 * time.Second,
+			Checks: []RestoreDrillCheck{
+				{Path: "/etc/pve/storage.cfg", Found: true},
+				{Path: "/etc/network/interfaces", Found: false},
+			},
+		},
+	}
+}
+
+func TestRestoreDrillTemplates(t *testing.T) {
+	data := createTestDrillData()
+
+	if subject := BuildEmailSubject(data); subject != "❌ PVE Restore drill on pve1 - 2025-11-11 03:00" {
+		t.Errorf("subject = %q", subject)
+	}
+	text := BuildEmailPlainText(data)
+	for _, want := range []string{"RESTORE DRILL - FAILURE", "1 of 2 expected files missing", "Storage: secondary", "Extracted files: 812 (640 regular files in content index)", "✗ /etc/network/interfaces"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("plain text missing %q:\n%s", want, text)
+		}
+	}
+	if html := BuildEmailHTML(data); !strings.Contains(html, "Restore Drill - FAILURE") || strings.Contains(html, "Local Storage") {
+		t.Errorf("HTML body is not the drill report:\n%s", html)
+	}
+
+	telegram := (&TelegramNotifier{}).buildMessage(data)
+	if !strings.Contains(telegram, "Restore drill pve - pve1") || !strings.Contains(telegram, "❌ /etc/network/interfaces") {
+		t.Errorf("telegram message:\n%s", telegram)
+	}
+
+	// Without the report the backup templates are used
+	data.Event = EventBackup
+	if subject := BuildEmailSubject(data); !strings.Contains(subject, "Backup on pve1") {
+		t.Errorf("backup subject = %q", subject)
+	}
+}
+
+func TestBuildDrillPayload(t *testing.T) {
+	logger := logging.New(types.LogLevelDebug, false)
+	data := createTestDrillData()
+
+	payload, err := buildDrillPayload("generic", data, logger)
+	if err != nil {
+		t.Fatalf("buildDrillPayload() error: %v", err)
+	}
+	if payload["event"] != "restore-drill" || payload["status"] != "failure" {
+		t.Errorf("payload = %v", payload)
+	}
+	drill, ok := payload["restore_drill"].(map[string]interface{})
+	if !ok {
+		t.Fatal("restore_drill field should be a map")
+	}
+	if drill["storage"] != "secondary" || drill["missing"] != 1 || drill["files"] != 812 || drill["indexed_files"] != 640 {
+		t.Errorf("restore_drill = %v", drill)
+	}
+
+	for _, format := range []string{"discord", "slack", "teams"} {
+		payload, err := buildDrillPayload(format, data, logger)
+		if err != nil || len(payload) == 0 {
+			t.Errorf("buildDrillPayload(%s) = %v, %v", format, payload, err)
+		}
+	}
+}
@@ -240,6 +240,9 @@ func (t *TelegramNotifier) fetchCentralizedCredentials(ctx context.Context) (str
 
 // buildMessage builds the Telegram message text
 func (t *TelegramNotifier) buildMessage(data *NotificationData) string {
+	if isRestoreDrill(data) {
+		return buildDrillTelegramMessage(data)
+	}
 	var msg strings.Builder
 
 	// Header with status and hostname
@@ -278,6 +281,11 @@ func (t *TelegramNotifier) buildMessage(data *NotificationData) string {
 	}
 	msg.WriteString("\n")
 
+	// Configuration drift
+	if data.ConfigDrift != nil {
+		msg.WriteString(buildDriftTelegramText(data.ConfigDrift))
+	}
+
 	// Disk space
 	msg.WriteString("💾 Available space:\n")
 	msg.WriteString(fmt.Sprintf("🔹 Local: %s\n", data.LocalFree))
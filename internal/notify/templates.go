@@ -8,6 +8,9 @@ import (
 
 // BuildEmailSubject builds the email subject line matching Bash output
 func BuildEmailSubject(data *NotificationData) string {
+	if isRestoreDrill(data) {
+		return buildDrillSubject(data)
+	}
 	statusEmoji := GetStatusEmoji(data.Status)
 
 	proxmoxType := strings.ToUpper(data.ProxmoxType.String())
@@ -17,6 +20,9 @@ func BuildEmailSubject(data *NotificationData) string {
 
 // BuildEmailPlainText builds a plain text email body
 func BuildEmailPlainText(data *NotificationData) string {
+	if isRestoreDrill(data) {
+		return buildDrillPlainText(data)
+	}
 	var body strings.Builder
 
 	statusEmoji := GetStatusEmoji(data.Status)
@@ -45,6 +51,10 @@ func BuildEmailPlainText(data *NotificationData) string {
 		data.CompressionType, data.CompressionLevel, data.CompressionRatio))
 	body.WriteString("\n")
 
+	if data.ConfigDrift != nil {
+		body.WriteString(buildDriftPlainText(data.ConfigDrift))
+	}
+
 	body.WriteString("ISSUES:\n")
 	body.WriteString(fmt.Sprintf("  Errors: %d\n", data.ErrorCount))
 	body.WriteString(fmt.Sprintf("  Warnings: %d\n", data.WarningCount))
@@ -73,6 +83,9 @@ func BuildEmailPlainText(data *NotificationData) string {
 
 // BuildEmailHTML builds an HTML email body matching Bash template exactly
 func BuildEmailHTML(data *NotificationData) string {
+	if isRestoreDrill(data) {
+		return buildDrillHTML(data)
+	}
 	// Determine status color
 	statusColor := getStatusColor(data.Status)
 	statusText := strings.ToUpper(data.Status.String())
@@ -206,6 +219,11 @@ func BuildEmailHTML(data *NotificationData) string {
 	html.WriteString("                </table>\n")
 	html.WriteString("            </div>\n")
 
+	// Configuration Drift Section
+	if data.ConfigDrift != nil {
+		html.WriteString(buildDriftHTML(data.ConfigDrift))
+	}
+
 	// Error/Warning Section
 	html.WriteString("            \n")
 	html.WriteString("            <div class=\"section\">\n")
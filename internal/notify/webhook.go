@@ -403,6 +403,9 @@ func (w *WebhookNotifier) sendToEndpoint(ctx context.Context, endpoint config.We
 // buildPayload builds the webhook payload based on format
 func (w *WebhookNotifier) buildPayload(format string, data *NotificationData) (interface{}, error) {
 	w.logger.Debug("buildPayload() called with format=%s", format)
+	if isRestoreDrill(data) {
+		return buildDrillPayload(format, data, w.logger)
+	}
 
 	switch strings.ToLower(format) {
 	case "discord":
@@ -114,6 +114,14 @@ func buildDiscordPayload(data *NotificationData, logger *logging.Logger) (map[st
 		"inline": false,
 	})
 
+	if data.ConfigDrift != nil {
+		fields = append(fields, map[string]interface{}{
+			"name":   "Configuration Drift",
+			"value":  driftFieldText(data.ConfigDrift),
+			"inline": false,
+		})
+	}
+
 	logger.Debug("Built %d fields for Discord embed", len(fields))
 
 	// Build embed
@@ -289,6 +297,16 @@ func buildSlackPayload(data *NotificationData, logger *logging.Logger) (map[stri
 		})
 	}
 
+	if data.ConfigDrift != nil {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "section",
+			"text": map[string]interface{}{
+				"type": "mrkdwn",
+				"text": "*Configuration Drift:*\n" + driftFieldText(data.ConfigDrift),
+			},
+		})
+	}
+
 	// Footer context
 	blocks = append(blocks, map[string]interface{}{
 		"type": "context",
@@ -405,6 +423,14 @@ func buildTeamsPayload(data *NotificationData, logger *logging.Logger) (map[stri
 		})
 	}
 
+	if data.ConfigDrift != nil {
+		body = append(body, map[string]interface{}{
+			"type": "TextBlock",
+			"text": "**Configuration Drift:**\n\n" + strings.Join(append([]string{data.ConfigDrift.Summary()}, driftLines(data.ConfigDrift)...), "\n\n"),
+			"wrap": true,
+		})
+	}
+
 	// Build Adaptive Card
 	adaptiveCard := map[string]interface{}{
 		"type":    "AdaptiveCard",
@@ -538,6 +564,11 @@ func buildGenericPayload(data *NotificationData, logger *logging.Logger) (map[st
 		logger.Debug("Added %d log categories to generic payload", len(categories))
 	}
 
+	if data.ConfigDrift != nil {
+		payload["config_drift"] = buildDriftReportData(data.ConfigDrift)
+		logger.Debug("Added configuration drift (%d changes) to generic payload", len(data.ConfigDrift.Changes))
+	}
+
 	logger.Debug("Generic payload built successfully with %d top-level keys", len(payload))
 	return payload, nil
 }
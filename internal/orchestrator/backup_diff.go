@@ -0,0 +1,481 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/config"
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+)
+
+// Status of a path when comparing two backups
+const (
+	BackupDiffAdded    = "added"
+	BackupDiffRemoved  = "removed"
+	BackupDiffModified = "modified"
+)
+
+// sensitivePathPatterns match archive paths whose content is never shown in
+// a backup diff. Patterns without a slash match the file name only.
+var sensitivePathPatterns = []string{
+	"etc/shadow*",
+	"etc/gshadow*",
+	"etc/pve/priv/*",
+	"etc/pve/priv/*/*",
+	"etc/pve/*.key",
+	"etc/pve/nodes/*/*.key",
+	"etc/proxmox-backup/*.key",
+	"etc/proxmox-backup/*.pem",
+	"etc/ssh/ssh_host_*_key",
+	"shadow.json",
+	"token.shadow",
+	"tape-encryption-keys.json",
+	"id_rsa",
+	"id_dsa",
+	"id_ecdsa",
+	"id_ed25519",
+	"*.key",
+}
+
+// BackupDiffOptions selects the two backups to compare
+type BackupDiffOptions struct {
+	// From and To accept the same selectors as restore: a bundle path, a
+	// backup name, remote:name or "latest [from <storage>]"
+	From string
+	To   string
+	// IdentityFile holds the AGE identity that decrypts encrypted backups
+	IdentityFile string
+	// Paths and Categories limit the comparison (see restore --path/--category)
+	Paths      []string
+	Categories []string
+	// Summary compares the content indexes only: nothing is downloaded or
+	// decrypted, and no text diffs are produced
+	Summary bool
+}
+
+// BackupDiffSide identifies one of the compared backups
+type BackupDiffSide struct {
+	Backup  string    `json:"backup"`
+	Created time.Time `json:"created"`
+}
+
+// BackupDiffEntry describes one path that differs between the backups
+type BackupDiffEntry struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Masked is set for sensitive files: their content is compared but
+	// never shown
+	Masked bool   `json:"masked,omitempty"`
+	Diff   string `json:"diff,omitempty"`
+}
+
+// BackupDiffReport lists the differences between two backups
+type BackupDiffReport struct {
+	From      BackupDiffSide    `json:"from"`
+	To        BackupDiffSide    `json:"to"`
+	Summary   bool              `json:"summary"`
+	Unchanged int               `json:"unchanged"`
+	Entries   []BackupDiffEntry `json:"entries"`
+}
+
+// Count returns the number of entries with the given status
+func (r *BackupDiffReport) Count(status string) int {
+	n := 0
+	for _, e := range r.Entries {
+		if e.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// DiffBackups compares two backups, which may live on different storages.
+// Files are compared after the archives were restored into temporary
+// directories, so optimizations (chunking, deduplication, prefilters) do not
+// show up as changes.
+func DiffBackups(ctx context.Context, cfg *config.Config, logger *logging.Logger, opts BackupDiffOptions) (*BackupDiffReport, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("configuration not available")
+	}
+	filter, err := newRestoreFilter(opts.Paths, opts.Categories)
+	if err != nil {
+		return nil, err
+	}
+
+	from, err := resolveRestoreSource(ctx, cfg, logger, opts.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := resolveRestoreSource(ctx, cfg, logger, opts.To)
+	if err != nil {
+		return nil, err
+	}
+	report := &BackupDiffReport{
+		From:    BackupDiffSide{Backup: from.DisplayBase, Created: from.Manifest.CreatedAt},
+		To:      BackupDiffSide{Backup: to.DisplayBase, Created: to.Manifest.CreatedAt},
+		Summary: opts.Summary,
+	}
+
+	if opts.Summary {
+		fromIndex, err := loadCandidateIndex(ctx, from)
+		if err == nil {
+			var toIndex *backup.ContentIndex
+			if toIndex, err = loadCandidateIndex(ctx, to); err == nil {
+				diffContentIndexes(report, fromIndex, toIndex, filter)
+				return report, nil
+			}
+		}
+		if errors.Is(err, backup.ErrNoContentIndex) {
+			return nil, fmt.Errorf("%w: run the diff without --summary", err)
+		}
+		return nil, err
+	}
+
+	var identities []age.Identity
+	if strings.TrimSpace(opts.IdentityFile) != "" {
+		if identities, err = loadIdentityFile(opts.IdentityFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, cand := range []*decryptCandidate{from, to} {
+		if strings.EqualFold(cand.Manifest.EncryptionMode, "age") && len(identities) == 0 {
+			return nil, fmt.Errorf("backup %s is encrypted: pass --identity, or --summary to compare the content indexes only", cand.DisplayBase)
+		}
+	}
+
+	workDir, err := os.MkdirTemp("", "backup-diff-*")
+	if err != nil {
+		return nil, fmt.Errorf("create diff directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	fromRoot := filepath.Join(workDir, "from")
+	toRoot := filepath.Join(workDir, "to")
+	if err := extractDiffSide(ctx, from, identities, fromRoot, filter, logger); err != nil {
+		return nil, err
+	}
+	if err := extractDiffSide(ctx, to, identities, toRoot, filter, logger); err != nil {
+		return nil, err
+	}
+	if err := diffRestoredTrees(report, fromRoot, toRoot); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// extractDiffSide restores a backup into root
+func extractDiffSide(ctx context.Context, cand *decryptCandidate, identities []age.Identity, root string, filter *restoreFilter, logger *logging.Logger) error {
+	source, err := prepareRestoreSource(ctx, nil, cand, identities, logger)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return fmt.Errorf("create diff directory: %w", err)
+	}
+	if err := extractPlainArchive(ctx, source, root, filter, nil, nil, logger); err != nil {
+		return fmt.Errorf("extract %s: %w", cand.DisplayBase, err)
+	}
+	return nil
+}
+
+// loadCandidateIndex reads the content index of a backup without touching
+// its archive
+func loadCandidateIndex(ctx context.Context, cand *decryptCandidate) (*backup.ContentIndex, error) {
+	var index *backup.ContentIndex
+	var err error
+	switch {
+	case cand.Cloud != nil:
+		name := cand.RemoteName
+		if cand.Source == sourceRaw {
+			name += backup.ContentIndexSuffix
+		}
+		var reader io.ReadCloser
+		if cand.Repository != nil {
+			reader, err = cand.Repository.OpenSnapshotFile(ctx, name)
+		} else {
+			reader, err = cand.Cloud.Open(ctx, name)
+		}
+		if err == nil {
+			if cand.Source == sourceBundle {
+				index, err = backup.ReadContentIndexFromBundle(reader)
+			} else {
+				index, err = backup.ReadContentIndex(reader)
+			}
+			reader.Close()
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			err = backup.ErrNoContentIndex
+		}
+	case cand.Source == sourceBundle:
+		var file *os.File
+		if file, err = os.Open(cand.BundlePath); err == nil {
+			index, err = backup.ReadContentIndexFromBundle(file)
+			file.Close()
+		}
+	default:
+		index, err = backup.LoadContentIndex(cand.RawArchivePath + backup.ContentIndexSuffix)
+	}
+	if errors.Is(err, backup.ErrNoContentIndex) {
+		return nil, fmt.Errorf("%s: %w", cand.DisplayBase, backup.ErrNoContentIndex)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read content index of %s: %w", cand.DisplayBase, err)
+	}
+	return index, nil
+}
+
+// diffContentIndexes compares the non-directory entries of two indexes
+func diffContentIndexes(report *BackupDiffReport, from, to *backup.ContentIndex, filter *restoreFilter) {
+	collect := func(index *backup.ContentIndex) map[string]backup.IndexEntry {
+		entries := make(map[string]backup.IndexEntry, len(index.Entries))
+		for _, entry := range index.Entries {
+			if entry.Type != backup.IndexTypeDir && filter.Match(strings.TrimPrefix(entry.Path, "/")) {
+				entries[entry.Path] = entry
+			}
+		}
+		return entries
+	}
+	fromEntries, toEntries := collect(from), collect(to)
+
+	for _, name := range unionKeys(fromEntries, toEntries) {
+		entry := BackupDiffEntry{Path: name, Masked: isSensitivePath(strings.TrimPrefix(name, "/"))}
+		a, inFrom := fromEntries[name]
+		b, inTo := toEntries[name]
+		switch {
+		case !inFrom:
+			entry.Status = BackupDiffAdded
+		case !inTo:
+			entry.Status = BackupDiffRemoved
+		case a.Type != b.Type:
+			entry.Status = BackupDiffModified
+			entry.Detail = fmt.Sprintf("type %s -> %s", a.Type, b.Type)
+		default:
+			var details []string
+			if a.Link != b.Link {
+				details = append(details, fmt.Sprintf("symlink target %s -> %s", a.Link, b.Link))
+			}
+			if a.SHA256 != b.SHA256 || a.Size != b.Size {
+				details = append(details, fmt.Sprintf("content differs (%d -> %d bytes)", a.Size, b.Size))
+			}
+			if a.Mode != b.Mode && a.Type != backup.IndexTypeSymlink {
+				details = append(details, fmt.Sprintf("mode %s -> %s", a.Mode, b.Mode))
+			}
+			if a.UID != b.UID || a.GID != b.GID {
+				details = append(details, fmt.Sprintf("owner %d:%d -> %d:%d", a.UID, a.GID, b.UID, b.GID))
+			}
+			if len(details) == 0 {
+				report.Unchanged++
+				continue
+			}
+			entry.Status = BackupDiffModified
+			entry.Detail = strings.Join(details, ", ")
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+}
+
+// diffRestoredTrees compares every file restored below fromRoot and toRoot
+func diffRestoredTrees(report *BackupDiffReport, fromRoot, toRoot string) error {
+	fromFiles, err := listRestoredFiles(fromRoot)
+	if err != nil {
+		return err
+	}
+	toFiles, err := listRestoredFiles(toRoot)
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range unionKeys(fromFiles, toFiles) {
+		entry := BackupDiffEntry{Path: "/" + rel, Masked: isSensitivePath(rel)}
+		fromInfo, inFrom := fromFiles[rel]
+		toInfo, inTo := toFiles[rel]
+		switch {
+		case !inFrom:
+			entry.Status = BackupDiffAdded
+		case !inTo:
+			entry.Status = BackupDiffRemoved
+		default:
+			changed, err := compareBackupFiles(&entry, filepath.Join(fromRoot, rel), filepath.Join(toRoot, rel), fromInfo, toInfo)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				report.Unchanged++
+				continue
+			}
+			entry.Status = BackupDiffModified
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+	return nil
+}
+
+// listRestoredFiles returns everything below root that is not a directory,
+// keyed by slash-separated relative path
+func listRestoredFiles(root string) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = info
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("inspect %s: %w", root, err)
+	}
+	return files, nil
+}
+
+// compareBackupFiles fills in entry.Detail and entry.Diff for a path present
+// in both backups and reports whether it changed
+func compareBackupFiles(entry *BackupDiffEntry, fromPath, toPath string, fromInfo, toInfo os.FileInfo) (bool, error) {
+	if fromInfo.Mode().Type() != toInfo.Mode().Type() {
+		entry.Detail = fmt.Sprintf("type %s -> %s", describeFileType(fromInfo), describeFileType(toInfo))
+		return true, nil
+	}
+
+	var details []string
+	switch {
+	case fromInfo.Mode()&os.ModeSymlink != 0:
+		fromTarget, err := os.Readlink(fromPath)
+		if err != nil {
+			return false, err
+		}
+		toTarget, err := os.Readlink(toPath)
+		if err != nil {
+			return false, err
+		}
+		if fromTarget != toTarget {
+			details = append(details, fmt.Sprintf("symlink target %s -> %s", fromTarget, toTarget))
+		}
+	case fromInfo.Mode().IsRegular():
+		fromData, toData, same, err := compareFileContent(fromPath, toPath, fromInfo.Size(), toInfo.Size())
+		if err != nil {
+			return false, err
+		}
+		if !same {
+			details = append(details, fmt.Sprintf("content differs (%d -> %d bytes)", fromInfo.Size(), toInfo.Size()))
+			if containsPrivateKey(fromData) || containsPrivateKey(toData) {
+				entry.Masked = true
+			}
+			if !entry.Masked && isConfigPath(entry.Path) && isTextContent(fromData) && isTextContent(toData) {
+				entry.Diff = unifiedDiff("a"+entry.Path, "b"+entry.Path,
+					splitLines(string(fromData)), splitLines(string(toData)), diffContextLines)
+			}
+		}
+	}
+
+	if fromInfo.Mode().Perm() != toInfo.Mode().Perm() && fromInfo.Mode()&os.ModeSymlink == 0 {
+		details = append(details, fmt.Sprintf("mode %04o -> %04o", fromInfo.Mode().Perm(), toInfo.Mode().Perm()))
+	}
+	// Ownership is only restored (and therefore only comparable) when running as root
+	if fst, ok := fromInfo.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+		if tst, ok := toInfo.Sys().(*syscall.Stat_t); ok && (fst.Uid != tst.Uid || fst.Gid != tst.Gid) {
+			details = append(details, fmt.Sprintf("owner %d:%d -> %d:%d", fst.Uid, fst.Gid, tst.Uid, tst.Gid))
+		}
+	}
+
+	entry.Detail = strings.Join(details, ", ")
+	return len(details) > 0, nil
+}
+
+// unionKeys returns the keys of both maps, sorted
+func unionKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// isSensitivePath reports whether the content of an archive path must not be shown
+func isSensitivePath(rel string) bool {
+	rel = strings.TrimPrefix(path.Clean("/"+rel), "/")
+	base := path.Base(rel)
+	for _, pattern := range sensitivePathPatterns {
+		target := rel
+		if !strings.Contains(pattern, "/") {
+			target = base
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// containsPrivateKey reports whether data holds a PEM/OpenSSH private key
+func containsPrivateKey(data []byte) bool {
+	return bytes.Contains(data, []byte("PRIVATE KEY-----"))
+}
+
+// isConfigPath reports whether a path gets a unified diff: files below /etc
+// (storage.cfg, interfaces, datastore.cfg, guest configs, ...) and other
+// .conf/.cfg files. Command output collected by the backup is not diffed.
+func isConfigPath(name string) bool {
+	return strings.HasPrefix(name, "/etc/") || strings.HasSuffix(name, ".conf") || strings.HasSuffix(name, ".cfg")
+}
+
+// WriteBackupDiffReport prints the per-file report followed by the diffs
+func WriteBackupDiffReport(w io.Writer, report *BackupDiffReport) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Backup diff: %s (%s) -> %s (%s)\n",
+		report.From.Backup, report.From.Created.Format("2006-01-02 15:04:05"),
+		report.To.Backup, report.To.Created.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&sb, "  added: %d, removed: %d, modified: %d, unchanged: %d\n",
+		report.Count(BackupDiffAdded), report.Count(BackupDiffRemoved), report.Count(BackupDiffModified), report.Unchanged)
+	if report.Summary {
+		sb.WriteString("  (content indexes only: no text diffs)\n")
+	}
+	sb.WriteString("\n")
+	for _, e := range report.Entries {
+		line := fmt.Sprintf("%-8s %s", e.Status, e.Path)
+		switch {
+		case e.Detail != "" && e.Masked:
+			line += fmt.Sprintf(" (%s; content masked)", e.Detail)
+		case e.Detail != "":
+			line += fmt.Sprintf(" (%s)", e.Detail)
+		case e.Masked:
+			line += " (content masked)"
+		}
+		sb.WriteString(line + "\n")
+	}
+	for _, e := range report.Entries {
+		if e.Diff != "" {
+			sb.WriteString("\n")
+			sb.WriteString(e.Diff)
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
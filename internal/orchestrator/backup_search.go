@@ -0,0 +1,514 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/config"
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+)
+
+const (
+	// maxSearchFileSize limits which files are scanned by a content search
+	maxSearchFileSize = 8 << 20
+	// maxSearchLines limits the matching lines reported per file version
+	maxSearchLines = 20
+)
+
+// BackupSearchOptions configures a search across stored backups
+type BackupSearchOptions struct {
+	// Pattern is a path glob. Patterns with a slash match the absolute path
+	// (directories match their whole subtree); others match the file name.
+	Pattern string
+	// Content is a regular expression matched against every line of the
+	// selected files. Searching content requires decrypting the backups.
+	Content string
+	// Location limits the search to one storage (primary, secondary, cloud)
+	Location string
+	// IdentityFile holds the AGE identity that decrypts encrypted backups
+	IdentityFile string
+}
+
+// BackupSearchMatch is one version of a file found in a backup
+type BackupSearchMatch struct {
+	Backup    string    `json:"backup"`
+	Locations []string  `json:"locations"`
+	Created   time.Time `json:"created"`
+	Path      string    `json:"path"`
+	Type      string    `json:"type"`
+	Size      int64     `json:"size"`
+	Mode      string    `json:"mode"`
+	ModTime   time.Time `json:"mtime"`
+	SHA256    string    `json:"sha256,omitempty"`
+	// Lines holds the matching lines of a content search; they are omitted
+	// (and Masked set) for sensitive files
+	Lines  []string `json:"lines,omitempty"`
+	Masked bool     `json:"masked,omitempty"`
+}
+
+// BackupSearchSkip records a backup that could not be searched
+type BackupSearchSkip struct {
+	Backup string `json:"backup"`
+	Reason string `json:"reason"`
+}
+
+// BackupSearchReport lists the file versions matching a search, oldest
+// backup first
+type BackupSearchReport struct {
+	Pattern  string              `json:"pattern,omitempty"`
+	Content  string              `json:"content,omitempty"`
+	Searched int                 `json:"searched"`
+	Matches  []BackupSearchMatch `json:"matches"`
+	Skipped  []BackupSearchSkip  `json:"skipped,omitempty"`
+}
+
+// Backups returns the number of backups with at least one match
+func (r *BackupSearchReport) Backups() int {
+	seen := make(map[string]bool)
+	for _, m := range r.Matches {
+		seen[m.Backup] = true
+	}
+	return len(seen)
+}
+
+// searchCandidate is a backup to search and the storages holding it
+type searchCandidate struct {
+	cand      *decryptCandidate
+	locations []string
+}
+
+// backupSearch holds the state shared by the backups of one search
+type backupSearch struct {
+	opts       BackupSearchOptions
+	content    *regexp.Regexp
+	identities []age.Identity
+	logger     *logging.Logger
+	// lines caches the content matches per SHA-256, so a file version shared
+	// by several backups is only extracted and scanned once
+	lines map[string][]string
+	// masked records the versions holding a private key
+	masked map[string]bool
+}
+
+// SearchBackups looks for files by path and/or content in every stored
+// backup. Backups are matched through their content index, so a path search
+// reads neither the archives nor any key; a content search only extracts the
+// file versions it has not scanned yet.
+func SearchBackups(ctx context.Context, cfg *config.Config, logger *logging.Logger, opts BackupSearchOptions) (*BackupSearchReport, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("configuration not available")
+	}
+	if strings.TrimSpace(opts.Pattern) == "" && opts.Content == "" {
+		return nil, fmt.Errorf("search needs a path pattern or a content pattern")
+	}
+	if strings.TrimSpace(opts.Pattern) == "" {
+		opts.Pattern = "*"
+	}
+	if _, err := path.Match(opts.Pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid path pattern %q: %w", opts.Pattern, err)
+	}
+
+	search := &backupSearch{opts: opts, logger: logger, lines: make(map[string][]string), masked: make(map[string]bool)}
+	if opts.Content != "" {
+		re, err := regexp.Compile(opts.Content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content pattern %q: %w", opts.Content, err)
+		}
+		search.content = re
+	}
+	if strings.TrimSpace(opts.IdentityFile) != "" {
+		identities, err := loadIdentityFile(opts.IdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		search.identities = identities
+	}
+
+	candidates, err := discoverSearchCandidates(ctx, cfg, logger, opts.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &BackupSearchReport{Pattern: opts.Pattern, Content: opts.Content}
+	for _, sc := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		matches, err := search.searchBackup(ctx, sc.cand)
+		if err != nil {
+			logger.Warning("Search: skipping %s: %v", sc.cand.DisplayBase, err)
+			report.Skipped = append(report.Skipped, BackupSearchSkip{Backup: sc.cand.DisplayBase, Reason: err.Error()})
+			continue
+		}
+		report.Searched++
+		for _, m := range matches {
+			m.Backup = sc.cand.DisplayBase
+			m.Locations = sc.locations
+			m.Created = sc.cand.Manifest.CreatedAt
+			report.Matches = append(report.Matches, m)
+		}
+	}
+	return report, nil
+}
+
+// discoverSearchCandidates lists the backups of the selected storages, oldest
+// first. A backup stored in several locations is searched once.
+func discoverSearchCandidates(ctx context.Context, cfg *config.Config, logger *logging.Logger, location string) ([]searchCandidate, error) {
+	if location == "all" {
+		location = ""
+	}
+	var result []searchCandidate
+	byName := make(map[string]int)
+	matched := false
+	for _, option := range buildDecryptPathOptions(cfg) {
+		if location != "" && option.Location != location {
+			continue
+		}
+		matched = true
+		var candidates []*decryptCandidate
+		var err error
+		if option.Remote {
+			candidates, err = discoverCloudCandidates(ctx, cfg, logger)
+		} else {
+			candidates, err = discoverBackupCandidates(logger, option.Path)
+		}
+		if err != nil {
+			logger.Warning("Failed to inspect %s: %v", option.Path, err)
+			continue
+		}
+		for _, cand := range candidates {
+			if i, ok := byName[cand.DisplayBase]; ok {
+				result[i].locations = append(result[i].locations, option.Location)
+				continue
+			}
+			byName[cand.DisplayBase] = len(result)
+			result = append(result, searchCandidate{cand: cand, locations: []string{option.Location}})
+		}
+	}
+	if !matched {
+		return nil, fmt.Errorf("storage %q is not configured", location)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].cand.Manifest.CreatedAt.Before(result[j].cand.Manifest.CreatedAt)
+	})
+	return result, nil
+}
+
+// searchBackup returns the matching file versions of one backup
+func (s *backupSearch) searchBackup(ctx context.Context, cand *decryptCandidate) ([]BackupSearchMatch, error) {
+	index, err := loadCandidateIndex(ctx, cand)
+	if errors.Is(err, backup.ErrNoContentIndex) {
+		s.logger.Debug("Search: %s has no content index, extracting the archive", cand.DisplayBase)
+		return s.searchArchive(ctx, cand)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []BackupSearchMatch
+	var pending []backup.IndexEntry
+	for _, entry := range index.Entries {
+		if entry.Type == backup.IndexTypeDir || !matchSearchPattern(s.opts.Pattern, entry.Path) {
+			continue
+		}
+		if s.content != nil {
+			if entry.Type != backup.IndexTypeFile {
+				continue
+			}
+			if _, scanned := s.lines[entry.SHA256]; !scanned {
+				pending = append(pending, entry)
+			}
+		}
+		matches = append(matches, BackupSearchMatch{
+			Path:    entry.Path,
+			Type:    entry.Type,
+			Size:    entry.Size,
+			Mode:    entry.Mode,
+			ModTime: entry.ModTime,
+			SHA256:  entry.SHA256,
+		})
+	}
+	if s.content == nil {
+		return matches, nil
+	}
+
+	if len(pending) > 0 {
+		paths := make([]string, 0, len(pending))
+		for _, entry := range pending {
+			paths = append(paths, entry.Path)
+		}
+		filter, err := newRestoreFilter(paths, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = s.withExtractedArchive(ctx, cand, filter, func(root string) error {
+			for _, entry := range pending {
+				// Keyed by the indexed hash, which is what later backups look up
+				if _, _, err := s.scanFile(filepath.Join(root, filepath.FromSlash(entry.Path)), entry.SHA256); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	found := matches[:0]
+	for _, m := range matches {
+		if lines := s.lines[m.SHA256]; len(lines) > 0 {
+			found = append(found, s.withLines(m, lines))
+		}
+	}
+	return found, nil
+}
+
+// searchArchive searches a backup without content index by extracting it
+func (s *backupSearch) searchArchive(ctx context.Context, cand *decryptCandidate) ([]BackupSearchMatch, error) {
+	var matches []BackupSearchMatch
+	err := s.withExtractedArchive(ctx, cand, nil, func(root string) error {
+		return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			name := "/" + filepath.ToSlash(rel)
+			if !matchSearchPattern(s.opts.Pattern, name) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			m := BackupSearchMatch{
+				Path:    name,
+				Type:    indexTypeOf(info),
+				Size:    info.Size(),
+				Mode:    fmt.Sprintf("%04o", info.Mode().Perm()),
+				ModTime: info.ModTime().UTC(),
+			}
+			if !info.Mode().IsRegular() {
+				m.Size = 0
+				if s.content == nil {
+					matches = append(matches, m)
+				}
+				return nil
+			}
+			sum, lines, err := s.scanFile(p, "")
+			if err != nil {
+				return err
+			}
+			m.SHA256 = sum
+			if s.content == nil {
+				matches = append(matches, m)
+			} else if len(lines) > 0 {
+				matches = append(matches, s.withLines(m, lines))
+			}
+			return nil
+		})
+	})
+	return matches, err
+}
+
+// withExtractedArchive restores the entries of a backup selected by filter
+// into a temporary directory and calls fn with it
+func (s *backupSearch) withExtractedArchive(ctx context.Context, cand *decryptCandidate, filter *restoreFilter, fn func(root string) error) error {
+	if strings.EqualFold(cand.Manifest.EncryptionMode, "age") && len(s.identities) == 0 {
+		return fmt.Errorf("backup is encrypted: pass --identity to search its content")
+	}
+	source, err := prepareRestoreSource(ctx, nil, cand, s.identities, s.logger)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	dir, err := os.MkdirTemp("", "backup-search-*")
+	if err != nil {
+		return fmt.Errorf("create search directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := extractPlainArchive(ctx, source, dir, filter, nil, nil, s.logger); err != nil {
+		return err
+	}
+	return fn(dir)
+}
+
+// scanFile hashes a restored file and returns the lines matching the
+// content pattern; the result is cached under digest (default: the hash of
+// the file). Binary and oversized files are hashed but not scanned.
+func (s *backupSearch) scanFile(name, digest string) (string, []string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if digest == "" {
+		sum := sha256.Sum256(data)
+		digest = hex.EncodeToString(sum[:])
+	}
+	if s.content == nil {
+		return digest, nil, nil
+	}
+	var lines []string
+	if len(data) <= maxSearchFileSize && isTextContent(data) {
+		for i, line := range splitLines(string(data)) {
+			if s.content.MatchString(line) {
+				lines = append(lines, fmt.Sprintf("%d: %s", i+1, line))
+				if len(lines) == maxSearchLines {
+					break
+				}
+			}
+		}
+	}
+	s.lines[digest] = lines
+	s.masked[digest] = containsPrivateKey(data)
+	return digest, lines, nil
+}
+
+// withLines attaches the matching lines to a match, masking sensitive files
+func (s *backupSearch) withLines(m BackupSearchMatch, lines []string) BackupSearchMatch {
+	if isSensitivePath(m.Path) || s.masked[m.SHA256] {
+		m.Masked = true
+		return m
+	}
+	m.Lines = lines
+	return m
+}
+
+// matchSearchPattern matches an absolute archive path against a search
+// pattern: the file name when the pattern has no slash, otherwise the path
+// or one of its parent directories
+func matchSearchPattern(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	return matchArchivePattern(normalizeArchivePath(pattern), normalizeArchivePath(name))
+}
+
+// indexTypeOf returns the content index type of a restored file
+func indexTypeOf(info os.FileInfo) string {
+	switch {
+	case info.Mode().IsRegular():
+		return backup.IndexTypeFile
+	case info.Mode()&os.ModeSymlink != 0:
+		return backup.IndexTypeSymlink
+	default:
+		return backup.IndexTypeOther
+	}
+}
+
+// WriteBackupFile prints one file of a backup, e.g. a historical version
+// found by SearchBackups
+func WriteBackupFile(ctx context.Context, cfg *config.Config, logger *logging.Logger, source, name, identityFile string, w io.Writer) error {
+	if cfg == nil {
+		return fmt.Errorf("configuration not available")
+	}
+	rel := normalizeArchivePath(name)
+	if rel == "" || strings.ContainsAny(rel, "*?[") {
+		return fmt.Errorf("invalid file path %q", name)
+	}
+	cand, err := resolveRestoreSource(ctx, cfg, logger, source)
+	if err != nil {
+		return err
+	}
+
+	search := &backupSearch{logger: logger}
+	if strings.TrimSpace(identityFile) != "" {
+		if search.identities, err = loadIdentityFile(identityFile); err != nil {
+			return err
+		}
+	}
+	filter, err := newRestoreFilter([]string{rel}, nil)
+	if err != nil {
+		return err
+	}
+	return search.withExtractedArchive(ctx, cand, filter, func(root string) error {
+		file, err := os.Open(filepath.Join(root, filepath.FromSlash(rel)))
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("/%s not found in %s", rel, cand.DisplayBase)
+		}
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if info, err := file.Stat(); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("/%s is not a regular file in %s", rel, cand.DisplayBase)
+		}
+		_, err = io.Copy(w, file)
+		return err
+	})
+}
+
+// WriteBackupSearchReport prints the matches grouped by path, one line per
+// backup holding a version of the file
+func WriteBackupSearchReport(w io.Writer, report *BackupSearchReport) error {
+	var sb strings.Builder
+	switch {
+	case report.Content != "":
+		fmt.Fprintf(&sb, "Search %q in files matching %s: ", report.Content, report.Pattern)
+	default:
+		fmt.Fprintf(&sb, "Search %s: ", report.Pattern)
+	}
+	fmt.Fprintf(&sb, "%d file versions in %d of %d backups\n", len(report.Matches), report.Backups(), report.Searched)
+
+	var paths []string
+	byPath := make(map[string][]BackupSearchMatch)
+	for _, m := range report.Matches {
+		if _, ok := byPath[m.Path]; !ok {
+			paths = append(paths, m.Path)
+		}
+		byPath[m.Path] = append(byPath[m.Path], m)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		fmt.Fprintf(&sb, "\n%s\n", p)
+		previous := ""
+		for _, m := range byPath[p] {
+			version := "-"
+			if m.SHA256 != "" {
+				version = m.SHA256[:12]
+			}
+			note := ""
+			if m.SHA256 != "" && m.SHA256 == previous {
+				note = "  (unchanged)"
+			}
+			previous = m.SHA256
+			fmt.Fprintf(&sb, "  %s  %-12s %8d  %s  %s [%s]%s\n", m.Created.Format("2006-01-02 15:04"), version, m.Size,
+				m.Mode, m.Backup, strings.Join(m.Locations, ","), note)
+			if m.Masked {
+				sb.WriteString("      (matching lines masked)\n")
+			}
+			for _, line := range m.Lines {
+				fmt.Fprintf(&sb, "      %s\n", line)
+			}
+		}
+	}
+	for _, skip := range report.Skipped {
+		fmt.Fprintf(&sb, "\nSkipped %s: %s", skip.Backup, skip.Reason)
+	}
+	if len(report.Skipped) > 0 {
+		sb.WriteString("\n")
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
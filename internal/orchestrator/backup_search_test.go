@@ -0,0 +1,232 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/config"
+)
+
+// addTestIndex rewrites a bundle created by writeTestBundle with a content
+// index describing files
+func addTestIndex(t *testing.T, bundlePath string, files map[string]string) {
+	t.Helper()
+
+	index := &backup.ContentIndex{Version: backup.ContentIndexVersion}
+	for name, body := range files {
+		sum := sha256.Sum256([]byte(body))
+		index.Entries = append(index.Entries, backup.IndexEntry{
+			Path:   "/" + name,
+			Type:   backup.IndexTypeFile,
+			Size:   int64(len(body)),
+			Mode:   "0640",
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+	sort.Slice(index.Entries, func(i, j int) bool { return index.Entries[i].Path < index.Entries[j].Path })
+	indexPath := filepath.Join(t.TempDir(), "index"+backup.ContentIndexSuffix)
+	if err := backup.WriteContentIndex(index, indexPath); err != nil {
+		t.Fatal(err)
+	}
+	indexData, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(data))
+	tw := tar.NewWriter(&out)
+	archiveName := ""
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if archiveName == "" {
+			archiveName = hdr.Name
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdr := &tar.Header{Name: archiveName + backup.ContentIndexSuffix, Mode: 0o640, Size: int64(len(indexData)), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(indexData); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bundlePath, out.Bytes(), 0o640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchBackups(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2025, 1, 6, 1, 0, 0, 0, time.UTC)
+
+	withDisk := map[string]string{
+		"etc/pve/qemu-server/112.conf": "cores: 2\nscsi1: ceph:vm-112-disk-1\n",
+		"etc/shadow":                   "root:$6$scsi1:19000::::::\n",
+	}
+	withoutDisk := map[string]string{
+		"etc/pve/qemu-server/112.conf": "cores: 2\n",
+		"etc/pve/qemu-server/113.conf": "cores: 1\n",
+	}
+	monday := writeTestBundle(t, dir, "pve1-backup-20250106-010000.tar", base, buildTestTar(t, withDisk), nil)
+	addTestIndex(t, monday, withDisk)
+	wednesday := writeTestBundle(t, dir, "pve1-backup-20250108-010000.tar", base.Add(48*time.Hour), buildTestTar(t, withDisk), nil)
+	addTestIndex(t, wednesday, withDisk)
+	// Created before content indexes existed: searched by extracting it
+	writeTestBundle(t, dir, "pve1-backup-20250110-010000.tar", base.Add(96*time.Hour), buildTestTar(t, withoutDisk), nil)
+
+	cfg := &config.Config{BackupPath: dir}
+	ctx := context.Background()
+
+	report, err := SearchBackups(ctx, cfg, newTestLogger(), BackupSearchOptions{Pattern: "112.conf"})
+	if err != nil {
+		t.Fatalf("SearchBackups() error: %v", err)
+	}
+	if report.Searched != 3 || len(report.Matches) != 3 || len(report.Skipped) != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+	if report.Matches[0].Backup != "pve1-backup-20250106-010000.tar" || report.Matches[0].Locations[0] != "primary" {
+		t.Errorf("first match = %+v", report.Matches[0])
+	}
+	if report.Matches[0].SHA256 != report.Matches[1].SHA256 || report.Matches[1].SHA256 == report.Matches[2].SHA256 {
+		t.Errorf("versions = %+v", report.Matches)
+	}
+
+	report, err = SearchBackups(ctx, cfg, newTestLogger(), BackupSearchOptions{Pattern: "/etc/pve/qemu-server", Content: `^scsi\d+: ceph:`})
+	if err != nil {
+		t.Fatalf("SearchBackups(content) error: %v", err)
+	}
+	if report.Backups() != 2 || len(report.Matches) != 2 {
+		t.Fatalf("content matches = %+v", report.Matches)
+	}
+	if lines := report.Matches[1].Lines; len(lines) != 1 || lines[0] != "2: scsi1: ceph:vm-112-disk-1" {
+		t.Errorf("lines = %v", lines)
+	}
+
+	var out bytes.Buffer
+	if err := WriteBackupSearchReport(&out, report); err != nil {
+		t.Fatal(err)
+	}
+	if text := out.String(); !strings.Contains(text, "in 2 of 3 backups") || !strings.Contains(text, "(unchanged)") {
+		t.Errorf("report:\n%s", text)
+	}
+
+	report, err = SearchBackups(ctx, cfg, newTestLogger(), BackupSearchOptions{Content: "scsi1"})
+	if err != nil {
+		t.Fatalf("SearchBackups(content only) error: %v", err)
+	}
+	for _, m := range report.Matches {
+		if m.Path == "/etc/shadow" && (!m.Masked || len(m.Lines) != 0) {
+			t.Errorf("shadow match not masked: %+v", m)
+		}
+	}
+
+	out.Reset()
+	if err := WriteBackupFile(ctx, cfg, newTestLogger(), "pve1-backup-20250106-010000", "/etc/pve/qemu-server/112.conf", "", &out); err != nil {
+		t.Fatalf("WriteBackupFile() error: %v", err)
+	}
+	if out.String() != withDisk["etc/pve/qemu-server/112.conf"] {
+		t.Errorf("historical version = %q", out.String())
+	}
+	if err := WriteBackupFile(ctx, cfg, newTestLogger(), "latest", "/etc/shadow", "", io.Discard); err == nil {
+		t.Error("expected error for a file missing from the backup")
+	}
+
+	if _, err := SearchBackups(ctx, cfg, newTestLogger(), BackupSearchOptions{}); err == nil {
+		t.Error("expected error without patterns")
+	}
+}
+
+func TestSearchBackupsEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"etc/network/interfaces": "iface vmbr0 inet static\n"}
+	bundle := writeTestBundle(t, dir, "pve1-backup-20250106-010000.tar", time.Date(2025, 1, 6, 1, 0, 0, 0, time.UTC),
+		buildTestTar(t, files), identity.Recipient())
+	addTestIndex(t, bundle, files)
+
+	cfg := &config.Config{BackupPath: dir}
+	ctx := context.Background()
+
+	// The content index is not encrypted: path searches need no key
+	report, err := SearchBackups(ctx, cfg, newTestLogger(), BackupSearchOptions{Pattern: "/etc/network/*"})
+	if err != nil {
+		t.Fatalf("SearchBackups() error: %v", err)
+	}
+	if len(report.Matches) != 1 || report.Matches[0].Path != "/etc/network/interfaces" {
+		t.Errorf("matches = %+v", report.Matches)
+	}
+
+	report, err = SearchBackups(ctx, cfg, newTestLogger(), BackupSearchOptions{Content: "vmbr0"})
+	if err != nil {
+		t.Fatalf("SearchBackups(content) error: %v", err)
+	}
+	if len(report.Skipped) != 1 || !strings.Contains(report.Skipped[0].Reason, "--identity") {
+		t.Errorf("skipped = %+v", report.Skipped)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "age.key")
+	if err := os.WriteFile(keyFile, []byte(identity.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	report, err = SearchBackups(ctx, cfg, newTestLogger(), BackupSearchOptions{Content: "vmbr0", IdentityFile: keyFile})
+	if err != nil {
+		t.Fatalf("SearchBackups(identity) error: %v", err)
+	}
+	if len(report.Matches) != 1 || len(report.Matches[0].Lines) != 1 {
+		t.Errorf("matches = %+v", report.Matches)
+	}
+}
+
+func TestMatchSearchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"112.conf", "/etc/pve/qemu-server/112.conf", true},
+		{"*.conf", "/etc/pve/qemu-server/112.conf", true},
+		{"/etc/pve/qemu-server/*.conf", "/etc/pve/qemu-server/112.conf", true},
+		{"/etc/pve", "/etc/pve/qemu-server/112.conf", true},
+		{"etc/pve/*.cfg", "/etc/pve/qemu-server/112.conf", false},
+		{"interfaces", "/etc/network/interfaces.d/vlan", false},
+	}
+	for _, tt := range tests {
+		if got := matchSearchPattern(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchSearchPattern(%q, %q) = %v; want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/tis24dev/proxmox-backup/internal/checks"
 	"github.com/tis24dev/proxmox-backup/internal/config"
 	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/notify"
 	"github.com/tis24dev/proxmox-backup/internal/types"
 )
 
@@ -302,6 +303,15 @@ type BackupStats struct {
 	ScriptVersion  string
 	TelegramStatus string
 	EmailStatus    string
+
+	// Configuration changes since the previous backup (nil when unknown)
+	ConfigDrift *notify.ConfigDriftReport
+	// Archive an incremental backup is based on (empty for full backups)
+	IncrementalParent string
+
+	// Snapshot each storage target writes to its repository instead of
+	// storing ArchivePath (BACKUP_REPOSITORY)
+	repository *repositorySnapshot
 }
 
 // Orchestrator coordinates the backup process using both Go and Bash components
@@ -771,7 +781,24 @@ func (o *Orchestrator) RunGoBackup(ctx context.Context, pType types.ProxmoxType,
 		}
 	}
 
-	if o.optimizationCfg.Enabled() {
+	incremental, err := o.prepareIncremental(ctx, tempDir, hostname)
+	if err != nil {
+		return nil, &BackupError{
+			Phase: "archive",
+			Err:   fmt.Errorf("incremental backup: %w", err),
+			Code:  types.ExitArchiveError,
+		}
+	}
+	if incremental != nil {
+		stats.IncrementalParent = incremental.parent.DisplayBase
+		o.logger.Info("Incremental backup against %s: %d new or changed files, %d deleted, %d unchanged files skipped",
+			incremental.parent.DisplayBase, incremental.result.Changed, len(incremental.result.State.Deleted), incremental.result.Unchanged)
+	}
+
+	repositoryMode := o.cfg != nil && o.cfg.BackupRepository
+	if repositoryMode {
+		o.logger.Debug("Skipping optimization step (repository mode stores every file once)")
+	} else if o.optimizationCfg.Enabled() {
 		fmt.Println()
 		o.logger.Step("Backup optimizations on collected data")
 		if err := backup.ApplyOptimizations(ctx, o.logger, tempDir, o.optimizationCfg); err != nil {
@@ -781,6 +808,13 @@ func (o *Orchestrator) RunGoBackup(ctx context.Context, pType types.ProxmoxType,
 		o.logger.Debug("Skipping optimization step (all features disabled)")
 	}
 
+	if repositoryMode {
+		if err := o.prepareRepositorySnapshot(ctx, stats, tempDir, fmt.Sprintf("%s-backup-%s", hostname, timestampStr), collector.Sections()); err != nil {
+			return nil, err
+		}
+		return o.finishGoBackup(ctx, stats)
+	}
+
 	// Step 2: Create archive
 	fmt.Println()
 	o.logStep(3, "Creation of compressed archive")
@@ -790,6 +824,9 @@ func (o *Orchestrator) RunGoBackup(ctx context.Context, pType types.ProxmoxType,
 
 	// Generate archive filename
 	archiveBasename := fmt.Sprintf("%s-backup-%s", hostname, timestampStr)
+	if incremental != nil {
+		archiveBasename += backup.IncrementalNameMarker
+	}
 
 	ageRecipients, err := o.prepareAgeRecipients(ctx)
 	if err != nil {
@@ -890,6 +927,53 @@ func (o *Orchestrator) RunGoBackup(ctx context.Context, pType types.ProxmoxType,
 			o.logger.Debug("Checksum file written to %s", checksumPath)
 		}
 
+		// Per-file index, readable without decrypting or decompressing the archive
+		contentIndexName := ""
+		if index := archiver.ContentIndex(); index != nil {
+			index.Archive = filepath.Base(archivePath)
+			if file, err := os.Open(filepath.Join(tempDir, backup.OptimizationManifestName)); err == nil {
+				if optimizations, err := backup.LoadOptimizationManifest(file); err == nil {
+					index.ApplyOptimizations(optimizations)
+				} else {
+					o.logger.Warning("Content index describes optimized files: %v", err)
+				}
+				file.Close()
+			}
+			if incremental != nil {
+				index.ApplyIncremental(&incremental.result.State, incremental.index)
+			}
+			index.AssignSections(collector.Sections())
+			if stats.ConfigDrift = o.configDrift(ctx, index, archivePath, stats.Hostname); stats.ConfigDrift != nil {
+				o.logger.Info("Config drift: %s", stats.ConfigDrift.Summary())
+			}
+			indexPath := archivePath + backup.ContentIndexSuffix
+			if err := backup.WriteContentIndex(index, indexPath); err != nil {
+				o.logger.Warning("Failed to write content index %s: %v", indexPath, err)
+			} else {
+				contentIndexName = filepath.Base(indexPath)
+				o.logger.Debug("Content index written to %s (%d entries)", indexPath, len(index.Entries))
+			}
+		}
+
+		// Split the archive for storage targets with a per-file size limit
+		var volumes []backup.ArchiveVolume
+		if o.cfg != nil && o.cfg.ArchiveVolumeSizeMB > 0 {
+			volumeSize := int64(o.cfg.ArchiveVolumeSizeMB) << 20
+			if stats.ArchiveSize > volumeSize {
+				volumes, err = backup.SplitArchive(ctx, o.logger, archivePath, volumeSize)
+				if err != nil {
+					return nil, &BackupError{
+						Phase: "archive",
+						Err:   fmt.Errorf("archive split failed: %w", err),
+						Code:  types.ExitArchiveError,
+					}
+				}
+				o.logger.Info("Archive split into %d volumes of up to %s", len(volumes), backup.FormatBytes(volumeSize))
+			} else {
+				o.logger.Debug("Archive fits in a single volume of %s: not split", backup.FormatBytes(volumeSize))
+			}
+		}
+
 		manifestPath := archivePath + ".manifest.json"
 		manifestCreatedAt := stats.Timestamp
 		encryptionMode := "none"
@@ -914,6 +998,13 @@ func (o *Orchestrator) RunGoBackup(ctx context.Context, pType types.ProxmoxType,
 			Hostname:         stats.Hostname,
 			ScriptVersion:    stats.ScriptVersion,
 			EncryptionMode:   encryptionMode,
+			ContentIndex:     contentIndexName,
+			Volumes:          volumes,
+		}
+		if incremental != nil {
+			manifest.Parent = incremental.parent.DisplayBase
+			manifest.ParentSHA256 = incremental.parent.Manifest.SHA256
+			manifest.ChainDepth = incremental.parent.Manifest.ChainDepth + 1
 		}
 
 		if err := backup.CreateManifest(ctx, o.logger, manifest, manifestPath); err != nil {
@@ -935,7 +1026,11 @@ func (o *Orchestrator) RunGoBackup(ctx context.Context, pType types.ProxmoxType,
 
 		// Create bundle (if requested) before dispatching to other storage targets
 		bundleEnabled := o.cfg != nil && o.cfg.BundleAssociatedFiles
-		if bundleEnabled {
+		if bundleEnabled && len(volumes) > 0 {
+			// A bundle would hold the volumes in a single file again
+			fmt.Println()
+			o.logger.Skip("Bundling skipped despite BUNDLE_ASSOCIATED_FILES=true: archive split into %d volumes (ARCHIVE_VOLUME_SIZE_MB=%d), stored without bundle", len(volumes), o.cfg.ArchiveVolumeSizeMB)
+		} else if bundleEnabled {
 			fmt.Println()
 			o.logStep(5, "Bundling of archive, checksum and metadata")
 			o.logger.Debug("Bundling enabled: creating bundle from %s", filepath.Base(archivePath))
@@ -979,6 +1074,12 @@ func (o *Orchestrator) RunGoBackup(ctx context.Context, pType types.ProxmoxType,
 		stats.EndTime = time.Now()
 	}
 
+	return o.finishGoBackup(ctx, stats)
+}
+
+// finishGoBackup computes the exit code of a completed backup and dispatches
+// it to the storage targets
+func (o *Orchestrator) finishGoBackup(ctx context.Context, stats *BackupStats) (*BackupStats, error) {
 	stats.Duration = stats.EndTime.Sub(stats.StartTime)
 
 	// Parse log file to populate error/warning counts before dispatch
@@ -1091,9 +1192,10 @@ func createBundle(ctx context.Context, logger *logging.Logger, archivePath strin
 		base + ".metadata",
 	}
 
-	metaChecksum := base + ".metadata.sha256"
-	if _, err := os.Stat(filepath.Join(dir, metaChecksum)); err == nil {
-		associated = append(associated, metaChecksum)
+	for _, optional := range []string{base + ".metadata.sha256", base + backup.ContentIndexSuffix} {
+		if _, err := os.Stat(filepath.Join(dir, optional)); err == nil {
+			associated = append(associated, optional)
+		}
 	}
 
 	for _, file := range associated[:3] {
@@ -1127,6 +1229,7 @@ func removeAssociatedFiles(logger *logging.Logger, archivePath string) error {
 		archivePath + ".metadata",
 		archivePath + ".metadata.sha256",
 		archivePath + ".manifest.json",
+		archivePath + backup.ContentIndexSuffix,
 	}
 
 	for _, f := range files {
@@ -1193,32 +1296,34 @@ func (o *Orchestrator) SaveStatsReport(stats *BackupStats) error {
 	}
 
 	payload := struct {
-		Hostname           string                `json:"hostname"`
-		ProxmoxType        types.ProxmoxType     `json:"proxmox_type"`
-		Timestamp          string                `json:"timestamp"`
-		StartTime          time.Time             `json:"start_time"`
-		EndTime            time.Time             `json:"end_time"`
-		DurationSeconds    float64               `json:"duration_seconds"`
-		DurationHuman      string                `json:"duration_human"`
-		FilesCollected     int                   `json:"files_collected"`
-		FilesFailed        int                   `json:"files_failed"`
-		DirsCreated        int                   `json:"directories_created"`
-		BytesCollected     int64                 `json:"bytes_collected"`
-		BytesCollectedStr  string                `json:"bytes_collected_human"`
-		ArchivePath        string                `json:"archive_path"`
-		ArchiveSize        int64                 `json:"archive_size"`
-		ArchiveSizeStr     string                `json:"archive_size_human"`
-		RequestedComp      types.CompressionType `json:"requested_compression"`
-		RequestedCompMode  string                `json:"requested_compression_mode"`
-		Compression        types.CompressionType `json:"compression"`
-		CompressionLevel   int                   `json:"compression_level"`
-		CompressionMode    string                `json:"compression_mode"`
-		CompressionThreads int                   `json:"compression_threads"`
-		CompressionRatio   float64               `json:"compression_ratio"`
-		CompressionPct     float64               `json:"compression_ratio_percent"`
-		CompressionSavings float64               `json:"compression_savings_percent"`
-		Checksum           string                `json:"checksum"`
-		ManifestPath       string                `json:"manifest_path"`
+		Hostname           string                    `json:"hostname"`
+		ProxmoxType        types.ProxmoxType         `json:"proxmox_type"`
+		Timestamp          string                    `json:"timestamp"`
+		StartTime          time.Time                 `json:"start_time"`
+		EndTime            time.Time                 `json:"end_time"`
+		DurationSeconds    float64                   `json:"duration_seconds"`
+		DurationHuman      string                    `json:"duration_human"`
+		FilesCollected     int                       `json:"files_collected"`
+		FilesFailed        int                       `json:"files_failed"`
+		DirsCreated        int                       `json:"directories_created"`
+		BytesCollected     int64                     `json:"bytes_collected"`
+		BytesCollectedStr  string                    `json:"bytes_collected_human"`
+		ArchivePath        string                    `json:"archive_path"`
+		ArchiveSize        int64                     `json:"archive_size"`
+		ArchiveSizeStr     string                    `json:"archive_size_human"`
+		RequestedComp      types.CompressionType     `json:"requested_compression"`
+		RequestedCompMode  string                    `json:"requested_compression_mode"`
+		Compression        types.CompressionType     `json:"compression"`
+		CompressionLevel   int                       `json:"compression_level"`
+		CompressionMode    string                    `json:"compression_mode"`
+		CompressionThreads int                       `json:"compression_threads"`
+		CompressionRatio   float64                   `json:"compression_ratio"`
+		CompressionPct     float64                   `json:"compression_ratio_percent"`
+		CompressionSavings float64                   `json:"compression_savings_percent"`
+		Checksum           string                    `json:"checksum"`
+		ManifestPath       string                    `json:"manifest_path"`
+		ConfigDrift        *notify.ConfigDriftReport `json:"config_drift,omitempty"`
+		IncrementalParent  string                    `json:"incremental_parent,omitempty"`
 	}{
 		Hostname:           stats.Hostname,
 		ProxmoxType:        stats.ProxmoxType,
@@ -1246,6 +1351,8 @@ func (o *Orchestrator) SaveStatsReport(stats *BackupStats) error {
 		CompressionSavings: compressionSavingsPercent,
 		Checksum:           stats.Checksum,
 		ManifestPath:       stats.ManifestPath,
+		ConfigDrift:        stats.ConfigDrift,
+		IncrementalParent:  stats.IncrementalParent,
 	}
 
 	encoder := json.NewEncoder(file)
@@ -0,0 +1,93 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/notify"
+)
+
+// configDriftRoots are the archive paths whose changes are reported as
+// configuration drift
+var configDriftRoots = []string{"etc", "var/spool/cron"}
+
+// configDriftIgnored match files below configDriftRoots that change on every
+// run without anybody touching the configuration
+var configDriftIgnored = []string{
+	"etc/pve/.*", // pmxcfs status files (.version, .members, .vmlist, ...)
+	"etc/adjtime",
+	"etc/mtab",
+	"etc/ld.so.cache",
+}
+
+// configDrift compares the content index of the backup being created with the
+// one of the newest backup in the primary storage. It returns nil when there
+// is nothing to compare with.
+func (o *Orchestrator) configDrift(ctx context.Context, current *backup.ContentIndex, archivePath, hostname string) *notify.ConfigDriftReport {
+	previous, index, err := o.previousBackup(ctx, hostname, archivePath)
+	switch {
+	case errors.Is(err, backup.ErrNoContentIndex):
+		o.logger.Info("Config drift: previous backup %s has no content index, nothing to compare", previous.DisplayBase)
+		return nil
+	case err != nil:
+		o.logger.Warning("Config drift: %v", err)
+		return nil
+	case previous == nil:
+		o.logger.Debug("Config drift: no previous backup to compare with")
+		return nil
+	}
+	return &notify.ConfigDriftReport{
+		Previous:        previous.DisplayBase,
+		PreviousCreated: previous.Manifest.CreatedAt,
+		Changes:         compareConfigIndexes(index, current),
+	}
+}
+
+// compareConfigIndexes lists the configuration files that were added,
+// removed or changed (content, type, symlink target, mode or owner)
+func compareConfigIndexes(previous, current *backup.ContentIndex) []notify.ConfigDriftChange {
+	collect := func(index *backup.ContentIndex) map[string]backup.IndexEntry {
+		entries := make(map[string]backup.IndexEntry)
+		for _, entry := range index.Entries {
+			if entry.Type != backup.IndexTypeDir && isConfigDriftPath(entry.Path) {
+				entries[entry.Path] = entry
+			}
+		}
+		return entries
+	}
+	before, after := collect(previous), collect(current)
+
+	var changes []notify.ConfigDriftChange
+	for _, name := range unionKeys(before, after) {
+		a, inBefore := before[name]
+		b, inAfter := after[name]
+		switch {
+		case !inBefore:
+			changes = append(changes, notify.ConfigDriftChange{Path: name, Status: notify.DriftAdded})
+		case !inAfter:
+			changes = append(changes, notify.ConfigDriftChange{Path: name, Status: notify.DriftRemoved})
+		case a.Type != b.Type || a.SHA256 != b.SHA256 || a.Link != b.Link || a.Mode != b.Mode || a.UID != b.UID || a.GID != b.GID:
+			changes = append(changes, notify.ConfigDriftChange{Path: name, Status: notify.DriftModified})
+		}
+	}
+	return changes
+}
+
+// isConfigDriftPath reports whether an absolute archive path is configuration
+func isConfigDriftPath(name string) bool {
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+	for _, pattern := range configDriftIgnored {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return false
+		}
+	}
+	for _, root := range configDriftRoots {
+		if rel == root || strings.HasPrefix(rel, root+"/") {
+			return true
+		}
+	}
+	return false
+}
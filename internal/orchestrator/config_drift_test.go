@@ -0,0 +1,88 @@
+package orchestrator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/config"
+	"github.com/tis24dev/proxmox-backup/internal/notify"
+)
+
+func TestCompareConfigIndexes(t *testing.T) {
+	previous := &backup.ContentIndex{Entries: []backup.IndexEntry{
+		{Path: "/etc", Type: backup.IndexTypeDir, Mode: "0755"},
+		{Path: "/etc/network/interfaces", Type: backup.IndexTypeFile, SHA256: "a", Mode: "0644"},
+		{Path: "/etc/pve/.version", Type: backup.IndexTypeFile, SHA256: "v1"},
+		{Path: "/etc/pve/qemu-server/999.conf", Type: backup.IndexTypeFile, SHA256: "q"},
+		{Path: "/etc/hosts", Type: backup.IndexTypeFile, SHA256: "h", Mode: "0644"},
+		{Path: "/var/lib/proxmox-backup-info/uptime.txt", Type: backup.IndexTypeFile, SHA256: "u1"},
+	}}
+	current := &backup.ContentIndex{Entries: []backup.IndexEntry{
+		{Path: "/etc", Type: backup.IndexTypeDir, Mode: "0700"},
+		{Path: "/etc/network/interfaces", Type: backup.IndexTypeFile, SHA256: "b", Mode: "0644"},
+		{Path: "/etc/pve/.version", Type: backup.IndexTypeFile, SHA256: "v2"},
+		{Path: "/etc/pve/qemu-server/113.conf", Type: backup.IndexTypeFile, SHA256: "q"},
+		{Path: "/etc/hosts", Type: backup.IndexTypeFile, SHA256: "h", Mode: "0600"},
+		{Path: "/var/lib/proxmox-backup-info/uptime.txt", Type: backup.IndexTypeFile, SHA256: "u2"},
+		{Path: "/var/spool/cron/crontabs/root", Type: backup.IndexTypeFile, SHA256: "c"},
+	}}
+
+	got := compareConfigIndexes(previous, current)
+	want := []notify.ConfigDriftChange{
+		{Path: "/etc/hosts", Status: notify.DriftModified},
+		{Path: "/etc/network/interfaces", Status: notify.DriftModified},
+		{Path: "/etc/pve/qemu-server/113.conf", Status: notify.DriftAdded},
+		{Path: "/etc/pve/qemu-server/999.conf", Status: notify.DriftRemoved},
+		{Path: "/var/spool/cron/crontabs/root", Status: notify.DriftAdded},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("changes = %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("change %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestOrchestratorConfigDrift(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2025, 1, 6, 1, 0, 0, 0, time.UTC)
+	files := map[string]string{"etc/hostname": "pve1\n", "etc/hosts": "127.0.0.1 localhost\n"}
+
+	o := New(newTestLogger(), "", false)
+	o.SetConfig(&config.Config{BackupPath: dir})
+	current := &backup.ContentIndex{Entries: []backup.IndexEntry{
+		{Path: "/etc/hostname", Type: backup.IndexTypeFile, SHA256: "x"},
+	}}
+
+	// Nothing to compare with yet
+	if report := o.configDrift(context.Background(), current, dir+"/pve1-backup-20250107-010000.tar", "testhost"); report != nil {
+		t.Fatalf("report without previous backup = %+v", report)
+	}
+
+	// Created before content indexes existed
+	previous := writeTestBundle(t, dir, "pve1-backup-20250106-010000.tar", base, buildTestTar(t, files), nil)
+	if report := o.configDrift(context.Background(), current, dir+"/pve1-backup-20250107-010000.tar", "testhost"); report != nil {
+		t.Fatalf("report without previous index = %+v", report)
+	}
+
+	addTestIndex(t, previous, files)
+	report := o.configDrift(context.Background(), current, dir+"/pve1-backup-20250107-010000.tar", "testhost")
+	if report == nil {
+		t.Fatal("expected a drift report")
+	}
+	if report.Previous != "pve1-backup-20250106-010000.tar" || !report.PreviousCreated.Equal(base) {
+		t.Errorf("previous = %s (%s)", report.Previous, report.PreviousCreated)
+	}
+	if report.Count(notify.DriftModified) != 1 || report.Count(notify.DriftRemoved) != 1 || len(report.Changes) != 2 {
+		t.Errorf("changes = %+v", report.Changes)
+	}
+
+	// Backups of other hosts are not compared
+	if report := o.configDrift(context.Background(), current, dir+"/pve2-backup-20250107-010000.tar", "pve2"); report != nil {
+		t.Errorf("report against another host = %+v", report)
+	}
+}
@@ -19,13 +19,16 @@ import (
 	"github.com/tis24dev/proxmox-backup/internal/backup"
 	"github.com/tis24dev/proxmox-backup/internal/config"
 	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/storage"
 )
 
 var ErrDecryptAborted = errors.New("decrypt workflow aborted by user")
 
 type decryptPathOption struct {
-	Label string
-	Path  string
+	Label    string
+	Path     string
+	Location string
+	Remote   bool // Path is an rclone remote, browsed with CloudStorage.List
 }
 
 type decryptSourceType int
@@ -43,19 +46,31 @@ type decryptCandidate struct {
 	RawMetadataPath string
 	RawChecksumPath string
 	DisplayBase     string
+	// Cloud is set for backups that only exist on the rclone remote; they are
+	// downloaded before the archive is read. RemoteName is the listed file name.
+	Cloud      *storage.CloudStorage
+	RemoteName string
+	// Checksummed requests verification of the archive against its .sha256
+	Checksummed bool
+	// Repository is set for repository snapshots: the archive is the
+	// snapshot and the file contents are read from its blobs
+	Repository *backup.Repository
 }
 
 type stagedFiles struct {
 	ArchivePath  string
 	MetadataPath string
 	ChecksumPath string
+	IndexPath    string
 }
 
 type preparedBundle struct {
 	ArchivePath string
 	Manifest    backup.Manifest
 	Checksum    string
-	cleanup     func()
+	// IndexPath is the content index of the backup, empty when it has none
+	IndexPath string
+	cleanup   func()
 }
 
 func (p *preparedBundle) Cleanup() {
@@ -99,6 +114,15 @@ func RunDecryptWorkflow(ctx context.Context, cfg *config.Config, logger *logging
 
 	manifestCopy := prepared.Manifest
 	manifestCopy.ArchivePath = destArchivePath
+	manifestCopy.ContentIndex = ""
+	if prepared.IndexPath != "" {
+		indexPath := destArchivePath + backup.ContentIndexSuffix
+		if err := copyFile(prepared.IndexPath, indexPath); err != nil {
+			logger.Warning("Failed to carry content index into the decrypted bundle: %v", err)
+		} else {
+			manifestCopy.ContentIndex = filepath.Base(indexPath)
+		}
+	}
 
 	metadataPath := destArchivePath + ".metadata"
 	if err := backup.CreateManifest(ctx, logger, &manifestCopy, metadataPath); err != nil {
@@ -139,24 +163,38 @@ func buildDecryptPathOptions(cfg *config.Config) []decryptPathOption {
 
 	if clean := strings.TrimSpace(cfg.BackupPath); clean != "" {
 		options = append(options, decryptPathOption{
-			Label: "Local backups",
-			Path:  clean,
+			Label:    "Local backups",
+			Path:     clean,
+			Location: "primary",
 		})
 	}
 
 	if cfg.SecondaryEnabled {
 		if clean := strings.TrimSpace(cfg.SecondaryPath); clean != "" {
 			options = append(options, decryptPathOption{
-				Label: "Secondary backups",
-				Path:  clean,
+				Label:    "Secondary backups",
+				Path:     clean,
+				Location: "secondary",
 			})
 		}
 	}
 
 	if cfg.CloudEnabled && isLocalFilesystemPath(cfg.CloudRemote) {
 		options = append(options, decryptPathOption{
-			Label: "Cloud backups",
-			Path:  strings.TrimSpace(cfg.CloudRemote),
+			Label:    "Cloud backups",
+			Path:     strings.TrimSpace(cfg.CloudRemote),
+			Location: "cloud",
+		})
+	} else if cfg.CloudEnabled && strings.TrimSpace(cfg.CloudRemote) != "" {
+		label := strings.TrimSpace(cfg.CloudRemote)
+		if cloud, err := storage.NewCloudStorage(cfg, nil); err == nil {
+			label = cloud.RemoteLabel()
+		}
+		options = append(options, decryptPathOption{
+			Label:    "Cloud backups (rclone)",
+			Path:     label,
+			Location: "cloud",
+			Remote:   true,
 		})
 	}
 
@@ -179,13 +217,16 @@ func selectDecryptCandidate(ctx context.Context, reader *bufio.Reader, cfg *conf
 		}
 
 		logger.Info("Scanning %s for backup bundles...", option.Path)
-		info, err := os.Stat(option.Path)
-		if err != nil || !info.IsDir() {
-			logger.Warning("Path %s is not accessible (%v)", option.Path, err)
-			continue
+		if option.Remote {
+			candidates, err = discoverCloudCandidates(ctx, cfg, logger)
+		} else {
+			info, statErr := os.Stat(option.Path)
+			if statErr != nil || !info.IsDir() {
+				logger.Warning("Path %s is not accessible (%v)", option.Path, statErr)
+				continue
+			}
+			candidates, err = discoverBackupCandidates(logger, option.Path)
 		}
-
-		candidates, err = discoverBackupCandidates(logger, option.Path)
 		if err != nil {
 			logger.Warning("Failed to inspect %s: %v", option.Path, err)
 			continue
@@ -267,7 +308,10 @@ func discoverBackupCandidates(logger *logging.Logger, root string) ([]*decryptCa
 			}
 			archivePath := filepath.Join(root, baseName)
 			if _, err := os.Stat(archivePath); err != nil {
-				continue
+				// Split archives are stored as volumes only
+				if _, err := os.Stat(backup.VolumeName(archivePath, 1)); err != nil {
+					continue
+				}
 			}
 			checksumPath := archivePath + ".sha256"
 			if _, err := os.Stat(checksumPath); err != nil {
@@ -278,6 +322,10 @@ func discoverBackupCandidates(logger *logging.Logger, root string) ([]*decryptCa
 				logger.Warning("Skipping metadata %s: %v", name, err)
 				continue
 			}
+			if err := checkArchiveStored(archivePath, manifest); err != nil {
+				logger.Warning("Skipping metadata %s: %v", name, err)
+				continue
+			}
 			rawBases[baseName] = struct{}{}
 			candidates = append(candidates, &decryptCandidate{
 				Manifest:        manifest,
@@ -290,6 +338,12 @@ func discoverBackupCandidates(logger *logging.Logger, root string) ([]*decryptCa
 		}
 	}
 
+	snapshots, err := repositoryCandidates(logger, root)
+	if err != nil {
+		logger.Warning("Skipping repository in %s: %v", root, err)
+	}
+	candidates = append(candidates, snapshots...)
+
 	sort.SliceStable(candidates, func(i, j int) bool {
 		return candidates[i].Manifest.CreatedAt.After(candidates[j].Manifest.CreatedAt)
 	})
@@ -297,6 +351,148 @@ func discoverBackupCandidates(logger *logging.Logger, root string) ([]*decryptCa
 	return candidates, nil
 }
 
+// discoverCloudCandidates lists the backups stored on the rclone remote.
+// Only the listing is fetched: the manifest fields are derived from the
+// file names and replaced by the real manifest once the backup is downloaded.
+func discoverCloudCandidates(ctx context.Context, cfg *config.Config, logger *logging.Logger) ([]*decryptCandidate, error) {
+	cloud, err := storage.NewCloudStorage(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	return cloudCandidates(ctx, cloud, logger)
+}
+
+// cloudCandidates builds a candidate for every backup listed on the remote,
+// repository snapshots included
+func cloudCandidates(ctx context.Context, cloud *storage.CloudStorage, logger *logging.Logger) ([]*decryptCandidate, error) {
+	backups, err := cloud.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bundled := make(map[string]bool)
+	for _, b := range backups {
+		if archive, ok := strings.CutSuffix(b.BackupFile, ".bundle.tar"); ok {
+			bundled[archive] = true
+		}
+	}
+
+	candidates := make([]*decryptCandidate, 0, len(backups))
+	for _, b := range backups {
+		archive, isBundle := strings.CutSuffix(b.BackupFile, ".bundle.tar")
+		if !isBundle && bundled[archive] {
+			continue
+		}
+		encryption := "none"
+		if strings.HasSuffix(archive, ".age") {
+			encryption = "age"
+		}
+		source := sourceRaw
+		if isBundle {
+			source = sourceBundle
+		}
+		candidates = append(candidates, &decryptCandidate{
+			Manifest: &backup.Manifest{
+				ArchivePath:    archive,
+				ArchiveSize:    b.Size,
+				CreatedAt:      b.Timestamp,
+				EncryptionMode: encryption,
+			},
+			Source:      source,
+			DisplayBase: archive,
+			Cloud:       cloud,
+			RemoteName:  b.BackupFile,
+		})
+	}
+
+	// The archives stay usable when the repository cannot be listed
+	snapshots, err := cloudRepositoryCandidates(ctx, cloud, logger)
+	if err != nil {
+		logger.Warning("Cannot list repository snapshots on %s: %v", cloud.RemoteLabel(), err)
+	}
+	return append(candidates, snapshots...), nil
+}
+
+// downloadCloudCandidate fetches a remote backup (bundle, or archive with
+// its .metadata and .sha256) into dir and returns the equivalent local candidate
+func downloadCloudCandidate(ctx context.Context, cand *decryptCandidate, dir string, logger *logging.Logger) (*decryptCandidate, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create download directory: %w", err)
+	}
+
+	if cand.Repository != nil {
+		if err := downloadSnapshotFiles(ctx, cand, dir, logger); err != nil {
+			return nil, err
+		}
+	} else if err := downloadCloudArchive(ctx, cand, dir, logger); err != nil {
+		return nil, err
+	}
+
+	local, err := candidateFromPath(filepath.Join(dir, cand.RemoteName))
+	if err != nil {
+		return nil, fmt.Errorf("inspect downloaded backup: %w", err)
+	}
+	local.Checksummed = true
+	local.Repository = cand.Repository
+	return local, nil
+}
+
+// downloadCloudArchive fetches a bundle, or a raw archive with its
+// .metadata and .sha256. The manifest is fetched first: a split archive is
+// downloaded volume by volume.
+func downloadCloudArchive(ctx context.Context, cand *decryptCandidate, dir string, logger *logging.Logger) error {
+	download := func(names ...string) error {
+		for _, name := range names {
+			logger.Info("Downloading %s from %s", name, cand.Cloud.RemoteLabel())
+			if err := cand.Cloud.Download(ctx, name, filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if cand.Source != sourceRaw {
+		return download(cand.RemoteName)
+	}
+
+	if err := download(cand.RemoteName+".metadata", cand.RemoteName+".sha256"); err != nil {
+		return err
+	}
+	manifest, err := backup.LoadManifest(filepath.Join(dir, cand.RemoteName+".metadata"))
+	if err != nil {
+		return fmt.Errorf("inspect downloaded backup: %w", err)
+	}
+	if len(manifest.Volumes) == 0 {
+		return download(cand.RemoteName)
+	}
+	for _, volume := range manifest.Volumes {
+		if err := download(filepath.Base(volume.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyStagedChecksum checks the staged archive against its .sha256 file
+func verifyStagedChecksum(ctx context.Context, staged stagedFiles, logger *logging.Logger) error {
+	data, err := os.ReadFile(staged.ChecksumPath)
+	if err != nil {
+		return fmt.Errorf("read checksum file: %w", err)
+	}
+	expected, err := parseChecksumFile(data, filepath.Base(staged.ArchivePath))
+	if err != nil {
+		return err
+	}
+	actual, err := backup.GenerateChecksum(ctx, logger, staged.ArchivePath)
+	if err != nil {
+		return fmt.Errorf("generate checksum: %w", err)
+	}
+	if !strings.EqualFold(expected, actual) {
+		return fmt.Errorf("archive %s does not match its checksum (expected %s, got %s)", filepath.Base(staged.ArchivePath), expected, actual)
+	}
+	logger.Info("Archive checksum verified: %s", actual)
+	return nil
+}
+
 func inspectBundleManifest(bundlePath string) (*backup.Manifest, error) {
 	file, err := os.Open(bundlePath)
 	if err != nil {
@@ -341,6 +537,10 @@ func promptCandidateSelection(ctx context.Context, reader *bufio.Reader, candida
 			if toolVersion == "" {
 				toolVersion = "unknown"
 			}
+			if cand.Cloud != nil {
+				fmt.Printf("  [%d] %s • %s • %s • %s (rclone)\n", idx+1, created, enc, cand.RemoteName, formatBytes(cand.Manifest.ArchiveSize))
+				continue
+			}
 			targetSummary := formatTargetSummary(cand.Manifest)
 			fmt.Printf("  [%d] %s • %s • Tool v%s • %s\n", idx+1, created, enc, toolVersion, targetSummary)
 		}
@@ -381,7 +581,13 @@ func promptDestinationDir(ctx context.Context, reader *bufio.Reader) (string, er
 	return filepath.Clean(trimmed), nil
 }
 
-func preparePlainBundle(ctx context.Context, reader *bufio.Reader, cand *decryptCandidate, version string, logger *logging.Logger) (*preparedBundle, error) {
+// preparePlainBundle stages the candidate in a temp dir and decrypts it. When
+// identities is empty the key/passphrase is requested interactively.
+func preparePlainBundle(ctx context.Context, reader *bufio.Reader, cand *decryptCandidate, identities []age.Identity, version string, logger *logging.Logger) (*preparedBundle, error) {
+	if cand.Repository != nil {
+		return prepareSnapshotBundle(ctx, cand, identities, version, logger)
+	}
+
 	workDir, err := os.MkdirTemp("", "proxmox-decrypt-*")
 	if err != nil {
 		return nil, fmt.Errorf("create temp dir: %w", err)
@@ -390,6 +596,19 @@ func preparePlainBundle(ctx context.Context, reader *bufio.Reader, cand *decrypt
 		_ = os.RemoveAll(workDir)
 	}
 
+	if cand.Cloud != nil {
+		downloadDir := filepath.Join(workDir, "download")
+		local, err := downloadCloudCandidate(ctx, cand, downloadDir, logger)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		// Callers keep the listing-based candidate: give them the real manifest
+		cand.Manifest = local.Manifest
+		defer os.RemoveAll(downloadDir)
+		cand = local
+	}
+
 	var staged stagedFiles
 	switch cand.Source {
 	case sourceBundle:
@@ -405,6 +624,12 @@ func preparePlainBundle(ctx context.Context, reader *bufio.Reader, cand *decrypt
 		cleanup()
 		return nil, err
 	}
+	if cand.Checksummed {
+		if err := verifyStagedChecksum(ctx, staged, logger); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
 
 	manifestCopy := *cand.Manifest
 	currentEncryption := strings.ToLower(manifestCopy.EncryptionMode)
@@ -417,12 +642,19 @@ func preparePlainBundle(ctx context.Context, reader *bufio.Reader, cand *decrypt
 	}
 	plainArchivePath := filepath.Join(workDir, plainArchiveName)
 
-	if currentEncryption == "age" {
+	if currentEncryption == "age" && len(identities) > 0 {
+		if err := decryptWithIdentity(staged.ArchivePath, plainArchivePath, identities...); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("decrypt archive: %w", err)
+		}
+	} else if currentEncryption == "age" {
 		if err := decryptArchiveWithPrompts(ctx, reader, staged.ArchivePath, plainArchivePath, logger); err != nil {
 			cleanup()
 			return nil, err
 		}
-	} else {
+	} else if staged.ArchivePath != plainArchivePath {
+		// Plain archives staged in workDir already sit at plainArchivePath;
+		// copying a file onto itself would truncate it.
 		if err := copyFile(staged.ArchivePath, plainArchivePath); err != nil {
 			cleanup()
 			return nil, fmt.Errorf("copy archive: %w", err)
@@ -453,6 +685,7 @@ func preparePlainBundle(ctx context.Context, reader *bufio.Reader, cand *decrypt
 		ArchivePath: plainArchivePath,
 		Manifest:    manifestCopy,
 		Checksum:    checksum,
+		IndexPath:   staged.IndexPath,
 		cleanup:     cleanup,
 	}, nil
 }
@@ -463,7 +696,7 @@ func prepareDecryptedBackup(ctx context.Context, reader *bufio.Reader, cfg *conf
 		return nil, nil, err
 	}
 
-	prepared, err := preparePlainBundle(ctx, reader, candidate, version, logger)
+	prepared, err := preparePlainBundle(ctx, reader, candidate, nil, version, logger)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -504,6 +737,8 @@ func extractBundleToWorkdir(bundlePath, workDir string) (stagedFiles, error) {
 		out.Close()
 
 		switch {
+		case strings.HasSuffix(target, backup.ContentIndexSuffix):
+			staged.IndexPath = target
 		case strings.HasSuffix(target, ".metadata"):
 			staged.MetadataPath = target
 		case strings.HasSuffix(target, ".sha256"):
@@ -521,7 +756,7 @@ func extractBundleToWorkdir(bundlePath, workDir string) (stagedFiles, error) {
 
 func copyRawArtifactsToWorkdir(cand *decryptCandidate, workDir string) (stagedFiles, error) {
 	archiveDest := filepath.Join(workDir, filepath.Base(cand.RawArchivePath))
-	if err := copyFile(cand.RawArchivePath, archiveDest); err != nil {
+	if err := copyRawArchive(cand, archiveDest); err != nil {
 		return stagedFiles{}, fmt.Errorf("copy archive: %w", err)
 	}
 	metadataDest := filepath.Join(workDir, filepath.Base(cand.RawMetadataPath))
@@ -532,20 +767,59 @@ func copyRawArtifactsToWorkdir(cand *decryptCandidate, workDir string) (stagedFi
 	if err := copyFile(cand.RawChecksumPath, checksumDest); err != nil {
 		return stagedFiles{}, fmt.Errorf("copy checksum: %w", err)
 	}
-	return stagedFiles{
+	staged := stagedFiles{
 		ArchivePath:  archiveDest,
 		MetadataPath: metadataDest,
 		ChecksumPath: checksumDest,
-	}, nil
+	}
+	indexPath := cand.RawArchivePath + backup.ContentIndexSuffix
+	if _, err := os.Stat(indexPath); err == nil {
+		staged.IndexPath = filepath.Join(workDir, filepath.Base(indexPath))
+		if err := copyFile(indexPath, staged.IndexPath); err != nil {
+			return stagedFiles{}, fmt.Errorf("copy content index: %w", err)
+		}
+	}
+	return staged, nil
+}
+
+// copyRawArchive copies the archive of a raw candidate to dest, joining
+// the volumes of a split archive
+func copyRawArchive(cand *decryptCandidate, dest string) error {
+	if len(cand.Manifest.Volumes) == 0 {
+		return copyFile(cand.RawArchivePath, dest)
+	}
+	src := &restoreSource{path: cand.RawArchivePath, volumes: cand.Manifest.Volumes}
+	raw, err := src.openRaw()
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, raw); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
 }
 
 func decryptArchiveWithPrompts(ctx context.Context, reader *bufio.Reader, encryptedPath, outputPath string, logger *logging.Logger) error {
+	_, err := promptDecryptIdentity(ctx, logger, func(identity age.Identity) error {
+		return decryptWithIdentity(encryptedPath, outputPath, identity)
+	})
+	return err
+}
+
+// promptDecryptIdentity asks for a key or passphrase until check accepts it
+func promptDecryptIdentity(ctx context.Context, logger *logging.Logger, check func(age.Identity) error) (age.Identity, error) {
 	for {
 		fmt.Print("Enter decryption key or passphrase (0 = exit): ")
 		inputBytes, err := readPasswordWithContext(ctx)
 		fmt.Println()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		trimmed := bytes.TrimSpace(inputBytes)
 		if len(trimmed) == 0 {
@@ -557,7 +831,7 @@ func decryptArchiveWithPrompts(ctx context.Context, reader *bufio.Reader, encryp
 		zeroBytes(trimmed)
 		zeroBytes(inputBytes)
 		if input == "0" {
-			return ErrDecryptAborted
+			return nil, ErrDecryptAborted
 		}
 
 		identity, err := parseIdentityInput(input)
@@ -567,15 +841,15 @@ func decryptArchiveWithPrompts(ctx context.Context, reader *bufio.Reader, encryp
 			continue
 		}
 
-		if err := decryptWithIdentity(encryptedPath, outputPath, identity); err != nil {
+		if err := check(identity); err != nil {
 			var noMatch *age.NoIdentityMatchError
 			if errors.Is(err, age.ErrIncorrectIdentity) || errors.As(err, &noMatch) {
 				logger.Warning("Provided key or passphrase does not match this archive. Try again or press 0 to exit.")
 				continue
 			}
-			return err
+			return nil, err
 		}
-		return nil
+		return identity, nil
 	}
 }
 
@@ -586,7 +860,40 @@ func parseIdentityInput(input string) (age.Identity, error) {
 	return deriveDeterministicIdentityFromPassphrase(input)
 }
 
-func decryptWithIdentity(src, dst string, identity age.Identity) error {
+// loadIdentityFile reads AGE identities from path. Besides the standard
+// AGE-SECRET-KEY format, a file containing a single non-comment line is treated
+// as the deterministic passphrase used at encryption time.
+func loadIdentityFile(path string) ([]age.Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read identity file: %w", err)
+	}
+	defer zeroBytes(data)
+
+	if identities, err := age.ParseIdentities(bytes.NewReader(data)); err == nil && len(identities) > 0 {
+		return identities, nil
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		lines = append(lines, trimmed)
+	}
+	if len(lines) != 1 {
+		return nil, fmt.Errorf("identity file %s contains no valid AGE identity", path)
+	}
+	identity, err := parseIdentityInput(lines[0])
+	resetString(&lines[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse identity file %s: %w", path, err)
+	}
+	return []age.Identity{identity}, nil
+}
+
+func decryptWithIdentity(src, dst string, identities ...age.Identity) error {
 	in, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("open encrypted archive: %w", err)
@@ -599,7 +906,7 @@ func decryptWithIdentity(src, dst string, identity age.Identity) error {
 	}
 	defer out.Close()
 
-	reader, err := age.Decrypt(in, identity)
+	reader, err := age.Decrypt(in, identities...)
 	if err != nil {
 		return err
 	}
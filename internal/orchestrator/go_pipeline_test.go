@@ -3,9 +3,7 @@ package orchestrator
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -145,7 +143,7 @@ func TestRunGoBackupEndToEnd(t *testing.T) {
 	}
 }
 
-func TestRunGoBackupFallbackCompression(t *testing.T) {
+func TestRunGoBackupCompressesWithoutTools(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping end-to-end backup test in short mode")
 	}
@@ -175,16 +173,11 @@ func TestRunGoBackupFallbackCompression(t *testing.T) {
 	checker := checks.NewChecker(logger, checkerConfig)
 	orch.SetChecker(checker)
 
-	restore := backup.WithLookPathOverride(func(binary string) (string, error) {
-		if binary == "xz" {
-			return "", errors.New("xz unavailable")
-		}
-		return exec.LookPath(binary)
-	})
-	t.Cleanup(restore)
+	// Compression runs in-process: xz works without any binary in PATH
+	t.Setenv("PATH", t.TempDir())
 
 	ctx := context.Background()
-	stats, err := orch.RunGoBackup(ctx, types.ProxmoxUnknown, "fallback-host")
+	stats, err := orch.RunGoBackup(ctx, types.ProxmoxUnknown, "no-tools-host")
 	if err != nil {
 		t.Fatalf("RunGoBackup failed: %v", err)
 	}
@@ -192,10 +185,10 @@ func TestRunGoBackupFallbackCompression(t *testing.T) {
 	if stats.RequestedCompression != types.CompressionXZ {
 		t.Errorf("Requested compression mismatch: got %s want %s", stats.RequestedCompression, types.CompressionXZ)
 	}
-	if stats.Compression != types.CompressionGzip {
-		t.Errorf("Expected fallback to gzip, got %s", stats.Compression)
+	if stats.Compression != types.CompressionXZ {
+		t.Errorf("Expected xz compression without the xz binary, got %s", stats.Compression)
 	}
-	if !strings.HasSuffix(stats.ArchivePath, ".tar.gz") {
-		t.Errorf("ArchivePath should have .tar.gz suffix, got %s", stats.ArchivePath)
+	if !strings.HasSuffix(stats.ArchivePath, ".tar.xz") {
+		t.Errorf("ArchivePath should have .tar.xz suffix, got %s", stats.ArchivePath)
 	}
 }
@@ -0,0 +1,81 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+)
+
+// incrementalBase is the parent backup an incremental backup is created
+// against
+type incrementalBase struct {
+	parent *decryptCandidate
+	index  *backup.ContentIndex
+	result *backup.IncrementalResult
+}
+
+// previousBackup returns the newest backup of hostname in the primary
+// storage, other than archivePath, with its content index. The candidate is
+// nil when there is none; the error wraps backup.ErrNoContentIndex when the
+// backup predates content indexes.
+func (o *Orchestrator) previousBackup(ctx context.Context, hostname, archivePath string) (*decryptCandidate, *backup.ContentIndex, error) {
+	if o.cfg == nil || strings.TrimSpace(o.cfg.BackupPath) == "" {
+		return nil, nil, nil
+	}
+	candidates, err := discoverBackupCandidates(o.logger, o.cfg.BackupPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot list previous backups: %w", err)
+	}
+	for _, cand := range candidates {
+		if archivePath != "" && filepath.Base(cand.Manifest.ArchivePath) == filepath.Base(archivePath) {
+			continue
+		}
+		if hostname != "" && cand.Manifest.Hostname != "" && !strings.EqualFold(cand.Manifest.Hostname, hostname) {
+			continue
+		}
+		index, err := loadCandidateIndex(ctx, cand)
+		return cand, index, err
+	}
+	return nil, nil, nil
+}
+
+// prepareIncremental reduces the collected tree to the changes since the
+// previous backup when BACKUP_INCREMENTAL is enabled. It returns nil, with
+// the tree untouched, when this run has to create a full backup.
+func (o *Orchestrator) prepareIncremental(ctx context.Context, tempDir, hostname string) (*incrementalBase, error) {
+	if o.cfg == nil || !o.cfg.BackupIncremental || o.cfg.BackupRepository || o.dryRun {
+		return nil, nil
+	}
+
+	parent, index, err := o.previousBackup(ctx, hostname, "")
+	switch {
+	case errors.Is(err, backup.ErrNoContentIndex):
+		o.logger.Info("Incremental backup: previous backup %s has no content index, creating a full backup", parent.DisplayBase)
+		return nil, nil
+	case err != nil:
+		o.logger.Warning("Incremental backup: %v; creating a full backup", err)
+		return nil, nil
+	case parent == nil:
+		o.logger.Info("Incremental backup: no previous backup in %s, creating a full backup", o.cfg.BackupPath)
+		return nil, nil
+	}
+	if parent.Repository != nil {
+		o.logger.Info("Incremental backup: previous backup %s is a repository snapshot, creating a full backup", parent.DisplayBase)
+		return nil, nil
+	}
+	if parent.Manifest.ChainDepth >= o.cfg.IncrementalMaxChain {
+		o.logger.Info("Incremental backup: the chain of %s reached INCREMENTAL_MAX_CHAIN=%d, creating a full backup",
+			parent.DisplayBase, o.cfg.IncrementalMaxChain)
+		return nil, nil
+	}
+
+	result, err := backup.PrepareIncremental(ctx, o.logger, tempDir, index, parent.DisplayBase)
+	if err != nil {
+		return nil, err
+	}
+	return &incrementalBase{parent: parent, index: index, result: result}, nil
+}
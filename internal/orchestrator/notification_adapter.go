@@ -287,6 +287,8 @@ func (n *NotificationAdapter) convertBackupStatsToNotificationData(stats *Backup
 		LogCategories: logCategories,
 
 		ScriptVersion: stats.ScriptVersion,
+
+		ConfigDrift: stats.ConfigDrift,
 	}
 }
 
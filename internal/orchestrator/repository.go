@@ -0,0 +1,305 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/storage"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+// repositorySnapshot is the backup every storage target writes to its
+// repository when BACKUP_REPOSITORY is enabled
+type repositorySnapshot struct {
+	root       string // collected tree the blobs are read from
+	name       string // host-backup-timestamp
+	index      *backup.ContentIndex
+	manifest   backup.Manifest
+	recipients []age.Recipient
+	blobKey    []byte // names the encrypted blobs
+}
+
+// prepareRepositorySnapshot indexes the collected tree in place of creating
+// an archive. Nothing is written here: each storage target stores the
+// snapshot and the blobs its repository lacks (see StorageAdapter.Sync).
+func (o *Orchestrator) prepareRepositorySnapshot(ctx context.Context, stats *BackupStats, tempDir, name string, sections map[string]string) error {
+	fmt.Println()
+	o.logStep(3, "Indexing of collected files for the repository")
+
+	recipients, err := o.prepareAgeRecipients(ctx)
+	if err != nil {
+		return &BackupError{Phase: "config", Err: err, Code: types.ExitConfigError}
+	}
+	var blobKey []byte
+	if len(recipients) > 0 && !o.dryRun {
+		if blobKey, err = loadRepositoryKey(o.repositoryKeyFile()); err != nil {
+			return &BackupError{Phase: "config", Err: err, Code: types.ExitConfigError}
+		}
+	}
+	index, err := backup.IndexTree(ctx, tempDir)
+	if err != nil {
+		return &BackupError{Phase: "archive", Err: err, Code: types.ExitArchiveError}
+	}
+	index.CreatedAt = stats.Timestamp.UTC()
+	index.AssignSections(sections)
+
+	file := backup.SnapshotFile(name, len(recipients) > 0)
+	archivePath := filepath.Join(o.backupPath, backup.RepositoryDirName, backup.RepositorySnapshotDir, file)
+	if stats.ConfigDrift = o.configDrift(ctx, index, archivePath, stats.Hostname); stats.ConfigDrift != nil {
+		o.logger.Info("Config drift: %s", stats.ConfigDrift.Summary())
+	}
+
+	encryptionMode := "none"
+	if len(recipients) > 0 {
+		encryptionMode = "age"
+	}
+	targets := make([]string, 0, 1)
+	if stats.ProxmoxType != "" {
+		targets = append(targets, string(stats.ProxmoxType))
+	}
+	stats.Compression = types.CompressionGzip
+	stats.ArchivePath = archivePath
+	stats.repository = &repositorySnapshot{
+		root:  tempDir,
+		name:  name,
+		index: index,
+		manifest: backup.Manifest{
+			CreatedAt:       stats.Timestamp,
+			CompressionType: string(types.CompressionGzip),
+			ProxmoxType:     string(stats.ProxmoxType),
+			ProxmoxTargets:  targets,
+			ProxmoxVersion:  stats.ProxmoxVersion,
+			Hostname:        stats.Hostname,
+			ScriptVersion:   stats.ScriptVersion,
+			EncryptionMode:  encryptionMode,
+		},
+		recipients: recipients,
+		blobKey:    blobKey,
+	}
+
+	if o.dryRun {
+		o.logger.Info("[DRY RUN] Would store snapshot %s (%d files)", file, index.Files())
+	} else {
+		o.logger.Info("Snapshot %s: %d entries, %d files (%s)", file, len(index.Entries), index.Files(), backup.FormatBytes(stats.BytesCollected))
+	}
+	stats.EndTime = time.Now()
+	return nil
+}
+
+// repositoryKeyFile keeps the blob key of the encrypted repositories, next
+// to the AGE recipient file
+func (o *Orchestrator) repositoryKeyFile() string {
+	if o.cfg == nil || o.cfg.BaseDir == "" {
+		return ""
+	}
+	return filepath.Join(o.cfg.BaseDir, "identity", "age", "repository.key")
+}
+
+// loadRepositoryKey reads the blob key kept in path, creating a new key the
+// first time. Every repository of this host shares the key, so a lost key
+// only costs storing every content once more under the new one.
+func loadRepositoryKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("BASE_DIR is not set: cannot keep the repository key")
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != backup.BlobKeySize {
+			return nil, fmt.Errorf("invalid repository key %s", path)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read repository key: %w", err)
+	}
+
+	key, err := backup.NewBlobKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("create repository key directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("create repository key: %w", err)
+	}
+	if _, err := fmt.Fprintln(file, hex.EncodeToString(key)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write repository key: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("write repository key: %w", err)
+	}
+	return key, nil
+}
+
+// repositoryCandidates lists the snapshots of the repository kept in the
+// backup directory root; it is empty when there is no repository
+func repositoryCandidates(logger *logging.Logger, root string) ([]*decryptCandidate, error) {
+	repoRoot := filepath.Join(root, backup.RepositoryDirName)
+	dir := filepath.Join(repoRoot, backup.RepositorySnapshotDir)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, nil
+	}
+	candidates, err := discoverBackupCandidates(logger, dir)
+	if err != nil {
+		return nil, err
+	}
+	repo := backup.NewRepository(backup.NewDirRepositoryStore(repoRoot), logger)
+	for _, cand := range candidates {
+		cand.Repository = repo
+	}
+	return candidates, nil
+}
+
+// cloudRepositoryCandidates lists the snapshots of the repository on the
+// rclone remote. Like the other cloud candidates, the manifest is derived
+// from the name until the snapshot is downloaded.
+func cloudRepositoryCandidates(ctx context.Context, cloud *storage.CloudStorage, logger *logging.Logger) ([]*decryptCandidate, error) {
+	repo := backup.NewRepository(cloud.RepositoryStore(), logger)
+	snapshots, err := storage.RepositorySnapshots(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]*decryptCandidate, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		encryption := "none"
+		if strings.HasSuffix(snapshot.BackupFile, ".age") {
+			encryption = "age"
+		}
+		candidates = append(candidates, &decryptCandidate{
+			Manifest: &backup.Manifest{
+				ArchivePath:    snapshot.BackupFile,
+				CreatedAt:      snapshot.Timestamp,
+				EncryptionMode: encryption,
+			},
+			Source:      sourceRaw,
+			DisplayBase: snapshot.BackupFile,
+			Cloud:       cloud,
+			RemoteName:  snapshot.BackupFile,
+			Repository:  repo,
+		})
+	}
+	return candidates, nil
+}
+
+// downloadSnapshotFiles fetches a snapshot with its .metadata and .sha256
+// from the repository into dir
+func downloadSnapshotFiles(ctx context.Context, cand *decryptCandidate, dir string, logger *logging.Logger) error {
+	for _, name := range []string{cand.RemoteName, cand.RemoteName + ".metadata", cand.RemoteName + ".sha256"} {
+		logger.Info("Downloading %s from %s", name, cand.Repository)
+		if err := downloadSnapshotFile(ctx, cand.Repository, name, filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("download %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func downloadSnapshotFile(ctx context.Context, repo *backup.Repository, name, localPath string) error {
+	reader, err := repo.OpenSnapshotFile(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	out, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, &contextReader{ctx: ctx, r: reader}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// openSnapshot returns the tar stream of a repository snapshot: the
+// decrypted snapshot is read and every file streamed from its blob
+func (s *restoreSource) openSnapshot(plain io.Reader, raw io.Closer) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.repository.WriteTar(s.ctx, plain, s.identities, pw))
+	}()
+	return &sourceStream{Reader: pr, layers: []io.Closer{pr, raw}}
+}
+
+// prepareSnapshotBundle writes the tree of a repository snapshot as a plain
+// tar archive, for the decrypt workflow
+func prepareSnapshotBundle(ctx context.Context, cand *decryptCandidate, identities []age.Identity, version string, logger *logging.Logger) (*preparedBundle, error) {
+	src, err := prepareArchiveSource(ctx, cand, identities, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	workDir, err := os.MkdirTemp("", "proxmox-decrypt-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	cleanup := func() {
+		_ = os.RemoveAll(workDir)
+	}
+
+	name := strings.TrimSuffix(src.Name, backup.SnapshotExtension)
+	archivePath := filepath.Join(workDir, name+".tar")
+	if err := writeSourceArchive(src, archivePath); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("write archive of snapshot %s: %w", cand.DisplayBase, err)
+	}
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("stat decrypted archive: %w", err)
+	}
+	checksum, err := backup.GenerateChecksum(ctx, logger, archivePath)
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("generate checksum: %w", err)
+	}
+
+	manifest := *cand.Manifest
+	manifest.ArchivePath = archivePath
+	manifest.ArchiveSize = info.Size()
+	manifest.SHA256 = checksum
+	manifest.CompressionType = string(types.CompressionNone)
+	manifest.EncryptionMode = "none"
+	manifest.ContentIndex = ""
+	if version != "" {
+		manifest.ScriptVersion = version
+	}
+	return &preparedBundle{
+		ArchivePath: archivePath,
+		Manifest:    manifest,
+		Checksum:    checksum,
+		cleanup:     cleanup,
+	}, nil
+}
+
+// writeSourceArchive copies the tar stream of a source to archivePath
+func writeSourceArchive(src *restoreSource, archivePath string) error {
+	stream, err := src.Open()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	out, err := os.OpenFile(archivePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, stream); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,150 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/config"
+	"github.com/tis24dev/proxmox-backup/internal/storage"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+func TestRepositoryBackupAndRestore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		BaseDir:          t.TempDir(),
+		BackupPath:       dir,
+		BackupRepository: true,
+		EncryptArchive:   true,
+		AgeRecipients:    []string{identity.Recipient().String()},
+	}
+	logger := newTestLogger()
+	orch := New(logger, "", false)
+	orch.SetConfig(cfg)
+	orch.backupPath = dir
+
+	local, err := storage.NewLocalStorage(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter := NewStorageAdapter(local, logger, cfg)
+	adapter.SetFilesystemInfo(&storage.FilesystemInfo{Path: dir, Type: storage.FilesystemExt4})
+
+	base := time.Date(2025, 1, 1, 1, 0, 0, 0, time.Local)
+	var stats *BackupStats
+	for day, hostname := range []string{"pve1\n", "pve2\n"} {
+		tree := t.TempDir()
+		for name, body := range map[string]string{
+			"etc/hostname":      hostname,
+			"etc/hosts":         "127.0.0.1 localhost\n",
+			"etc/pve/nodes.cfg": "nodes\n",
+		} {
+			target := filepath.Join(tree, name)
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(target, []byte(body), 0o640); err != nil {
+				t.Fatal(err)
+			}
+		}
+		created := base.Add(time.Duration(day) * 24 * time.Hour)
+		stats = &BackupStats{Hostname: "pve1", Timestamp: created, StartTime: created}
+		name := fmt.Sprintf("pve1-backup-%s", created.Format("20060102-150405"))
+		if err := orch.prepareRepositorySnapshot(ctx, stats, tree, name, nil); err != nil {
+			t.Fatalf("prepareRepositorySnapshot: %v", err)
+		}
+		if err := adapter.Sync(ctx, stats); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+	}
+
+	if stats.LocalBackups != 2 {
+		t.Errorf("local backups = %d, want 2 snapshots", stats.LocalBackups)
+	}
+	if stats.ConfigDrift == nil || len(stats.ConfigDrift.Changes) != 1 || stats.ConfigDrift.Changes[0].Path != "/etc/hostname" {
+		t.Errorf("config drift = %+v", stats.ConfigDrift)
+	}
+	if want := filepath.Join(dir, backup.RepositoryDirName, backup.RepositorySnapshotDir, "pve1-backup-20250102-010000.snapshot.age"); stats.ArchivePath != want {
+		t.Errorf("archive path = %s, want %s", stats.ArchivePath, want)
+	}
+	blobs, err := filepath.Glob(filepath.Join(dir, backup.RepositoryDirName, "blobs", "*", "*"))
+	if err != nil || len(blobs) != 4 {
+		t.Errorf("blobs = %v (%v), want 4", blobs, err)
+	}
+	keyFile := filepath.Join(cfg.BaseDir, "identity", "age", "repository.key")
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("repository key %s: %v (%v), want mode 0600", keyFile, info, err)
+	}
+	if keys, _ := filepath.Glob(filepath.Join(dir, backup.RepositoryDirName, "keys", "*.age")); len(keys) != 1 {
+		t.Errorf("stored keys = %v, want 1", keys)
+	}
+
+	cand, err := findBackupByName(ctx, cfg, logger, "pve1-backup-20250101-010000")
+	if err != nil {
+		t.Fatalf("find snapshot: %v", err)
+	}
+	if cand.Repository == nil {
+		t.Fatalf("candidate %s is not a repository snapshot", cand.DisplayBase)
+	}
+	src, err := prepareRestoreSource(ctx, nil, cand, []age.Identity{identity}, logger)
+	if err != nil {
+		t.Fatalf("prepareRestoreSource: %v", err)
+	}
+	defer src.Close()
+
+	dest := t.TempDir()
+	if err := extractPlainArchive(ctx, src, dest, nil, nil, nil, logger); err != nil {
+		t.Fatalf("extract snapshot: %v", err)
+	}
+	for name, want := range map[string]string{
+		"etc/hostname":      "pve1\n",
+		"etc/hosts":         "127.0.0.1 localhost\n",
+		"etc/pve/nodes.cfg": "nodes\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q (%v), want %q", name, got, err, want)
+		}
+	}
+
+	// verify re-hashes every blob of a snapshot when it can decrypt them
+	identityFile := filepath.Join(t.TempDir(), "age.key")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	repo := backup.NewRepository(local.RepositoryStore(), logger)
+	meta := &types.BackupMetadata{BackupFile: "pve1-backup-20250102-010000.snapshot.age"}
+	result := VerifyRepositorySnapshot(ctx, repo, storage.LocationPrimary, meta, VerifyOptions{IdentityFile: identityFile})
+	if result.Status != VerifyOK || result.Stream != "ok (3 re-hashed)" {
+		t.Errorf("verify with identity = %+v", result)
+	}
+	result = VerifyRepositorySnapshot(ctx, repo, storage.LocationPrimary, meta, VerifyOptions{})
+	if result.Status != VerifyOK || !strings.HasPrefix(result.Stream, "not re-hashed") {
+		t.Errorf("verify without identity = %+v", result)
+	}
+	if err := os.WriteFile(blobs[0], []byte("damaged"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	corrupted := 0
+	for _, file := range []string{"pve1-backup-20250101-010000.snapshot.age", meta.BackupFile} {
+		result := VerifyRepositorySnapshot(ctx, repo, storage.LocationPrimary, &types.BackupMetadata{BackupFile: file}, VerifyOptions{IdentityFile: identityFile})
+		if result.Status == VerifyCorrupted {
+			corrupted++
+		}
+	}
+	if corrupted == 0 {
+		t.Error("verify did not report the damaged blob")
+	}
+}
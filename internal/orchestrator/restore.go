@@ -3,61 +3,313 @@ package orchestrator
 import (
 	"archive/tar"
 	"bufio"
-	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
 	"syscall"
 
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/backup"
 	"github.com/tis24dev/proxmox-backup/internal/config"
 	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/types"
 )
 
 var ErrRestoreAborted = errors.New("restore workflow aborted by user")
 
-func RunRestoreWorkflow(ctx context.Context, cfg *config.Config, logger *logging.Logger, version string) error {
+// RestoreOptions configures a restore run. The zero value keeps the fully
+// interactive workflow (menus, key prompt, typed confirmation, target "/").
+type RestoreOptions struct {
+	// Source is a bundle/archive path or a selector such as "latest" or
+	// "latest from secondary". Empty means interactive selection.
+	Source string
+	// IdentityFile holds the AGE identity (or deterministic passphrase) used to
+	// decrypt encrypted archives without prompting.
+	IdentityFile string
+	// TargetRoot is the directory files are restored into (default "/").
+	TargetRoot string
+	// AssumeYes skips the typed RESTORE confirmation.
+	AssumeYes bool
+	// Paths limits the restore to these files or directories (e.g.
+	// "/etc/network/interfaces"). Empty means the whole archive.
+	Paths []string
+	// Categories limits the restore to collector sections such as "network"
+	// or "ssh" (see RestoreCategoryNames).
+	Categories []string
+	// Diff compares the restored files with the live system once extraction
+	// completes. It requires a TargetRoot other than "/".
+	Diff bool
+	// DiffFile receives the diff report; empty prints it on stdout.
+	DiffFile string
+	// LiveRoot is the live system the diff compares against (default "/").
+	LiveRoot string
+	// DryRun prints the restore plan and stops before extracting anything.
+	DryRun bool
+	// PlanJSON prints the restore plan as JSON instead of text.
+	PlanJSON bool
+	// Output receives the restore plan (default stdout).
+	Output io.Writer
+	// NoRollback skips the pre-restore rollback snapshot.
+	NoRollback bool
+	// NoServiceActions skips stopping, starting and reloading the services
+	// whose files are restored. Service actions only run when restoring to /.
+	NoServiceActions bool
+	// PVEMode selects how /etc/pve is restored to /: PVERestoreFiles (default)
+	// writes configs through the mounted cluster filesystem, PVERestoreDatabase
+	// restores config.db offline on a standalone node.
+	PVEMode string
+	// MapHost restores a backup onto another node: "old=new" renames the
+	// source node, "new" takes the old name from the backup manifest.
+	MapHost string
+	// MapIPs and MapInterfaces ("old=new") replace the source addresses and
+	// network interface names in the restored configs.
+	MapIPs        []string
+	MapInterfaces []string
+}
+
+func RunRestoreWorkflow(ctx context.Context, cfg *config.Config, logger *logging.Logger, version string, opts RestoreOptions) error {
 	if cfg == nil {
 		return fmt.Errorf("configuration not available")
 	}
 
 	reader := bufio.NewReader(os.Stdin)
-	candidate, prepared, err := prepareDecryptedBackup(ctx, reader, cfg, logger, version)
+
+	filter, err := newRestoreFilter(opts.Paths, opts.Categories)
+	if err != nil {
+		return err
+	}
+	remap, err := newRestoreRemap(opts.MapHost, opts.MapIPs, opts.MapInterfaces)
+	if err != nil {
+		return err
+	}
+
+	var identities []age.Identity
+	if strings.TrimSpace(opts.IdentityFile) != "" {
+		loaded, err := loadIdentityFile(opts.IdentityFile)
+		if err != nil {
+			return err
+		}
+		identities = loaded
+	}
+
+	var candidate *decryptCandidate
+	if strings.TrimSpace(opts.Source) != "" {
+		candidate, err = resolveRestoreSource(ctx, cfg, logger, opts.Source)
+	} else {
+		candidate, err = selectDecryptCandidate(ctx, reader, cfg, logger)
+	}
 	if err != nil {
 		return err
 	}
-	defer prepared.Cleanup()
+
+	if strings.EqualFold(candidate.Manifest.EncryptionMode, "age") && len(identities) == 0 && (opts.AssumeYes || opts.PlanJSON) {
+		return fmt.Errorf("backup %s is encrypted: an identity file is required for unattended restore", candidate.DisplayBase)
+	}
+
+	source, err := prepareRestoreSource(ctx, reader, candidate, identities, logger)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	if err := remap.resolveSourceHost(candidate.Manifest.Hostname); err != nil {
+		return err
+	}
 
 	destRoot := "/"
-	logger.Info("Restore target: system root (/) — files will be written back to their original paths")
+	if clean := strings.TrimSpace(opts.TargetRoot); clean != "" {
+		abs, err := filepath.Abs(clean)
+		if err != nil {
+			return fmt.Errorf("resolve target root %s: %w", clean, err)
+		}
+		destRoot = abs
+	}
+	if opts.Diff && destRoot == "/" {
+		return fmt.Errorf("a restore diff requires a target directory other than /")
+	}
+	if destRoot == "/" {
+		logger.Info("Restore target: system root (/) — files will be written back to their original paths")
+	} else {
+		logger.Info("Restore target: %s — original paths are recreated below this directory", destRoot)
+	}
+	if filter != nil {
+		logger.Info("Selective restore: %s", filter)
+	}
+
+	var pve *pveRestore
+	if destRoot == "/" {
+		if pve, err = newPVERestore(ctx, opts.PVEMode, destRoot, logger); err != nil {
+			return err
+		}
+	}
+
+	// The plan reads the whole stream, so a damaged or tampered archive
+	// fails here, before anything is written
+	plan, err := buildRestorePlan(ctx, source, destRoot, filter, pve, remap)
+	if err != nil {
+		return fmt.Errorf("build restore plan: %w", err)
+	}
+	// A selection that matches nothing fails before the confirmation and
+	// before anything on the system is touched
+	if err := filter.checkMatched(); err != nil {
+		return err
+	}
+	plan.Backup = candidate.DisplayBase
+	if destRoot == "/" && !opts.NoServiceActions {
+		plan.Services = planServiceSteps(plan)
+	}
+	if err := pve.check(plan); err != nil {
+		return err
+	}
+	logger.Info("Restore plan: %d entries (%d create, %d overwrite, %d replace symlink, %d replace directory, %d permissions, %d unchanged)",
+		len(plan.Entries), plan.Summary[planCreate], plan.Summary[planOverwrite], plan.Summary[planReplaceSymlink],
+		plan.Summary[planReplaceDirectory], plan.Summary[planMetadata], plan.Summary[planUnchanged])
+
+	output := opts.Output
+	if output == nil {
+		output = os.Stdout
+	}
+	// The confirmation prompt must not end up in the JSON plan
+	var prompt io.Writer = os.Stdout
+	if opts.PlanJSON {
+		prompt = os.Stderr
+	}
+	if opts.PlanJSON {
+		if err := writeRestorePlanJSON(output, plan); err != nil {
+			return fmt.Errorf("write restore plan: %w", err)
+		}
+	} else if opts.DryRun || !opts.AssumeYes {
+		if err := writeRestorePlan(output, plan); err != nil {
+			return fmt.Errorf("write restore plan: %w", err)
+		}
+	}
+
+	if opts.DryRun {
+		for _, label := range filter.Unmatched() {
+			logger.Warning("Selection %s did not match any file in the archive", label)
+		}
+		logger.Info("[DRY RUN] Restore plan only: no files were written")
+		return nil
+	}
 
-	if err := confirmRestoreAction(ctx, reader, candidate, destRoot); err != nil {
+	if opts.AssumeYes {
+		logger.Info("Confirmation skipped (--yes)")
+	} else if err := confirmRestoreAction(ctx, reader, prompt, candidate, destRoot, filter); err != nil {
 		return err
 	}
 
-	if err := extractPlainArchive(ctx, prepared.ArchivePath, destRoot, logger); err != nil {
+	if opts.NoRollback {
+		logger.Info("Rollback snapshot disabled (--no-rollback)")
+	} else if snapshotNeeded(plan) {
+		if strings.TrimSpace(cfg.RollbackPath) == "" {
+			logger.Warning("ROLLBACK_PATH is not configured: no rollback snapshot taken")
+		} else {
+			settings, err := newRollbackSettings(cfg)
+			if err != nil {
+				return fmt.Errorf("create rollback snapshot: %w", err)
+			}
+			snapshot, err := createRollbackSnapshot(ctx, plan, settings, logger)
+			if err != nil {
+				return fmt.Errorf("create rollback snapshot: %w", err)
+			}
+			logger.Info("Rollback snapshot %s saved in %s (%d paths saved); undo with: restore --rollback %s",
+				snapshot.ID, cfg.RollbackPath, len(snapshot.Saved), snapshot.ID)
+		}
+	}
+
+	if opts.NoServiceActions {
+		logger.Info("Service actions disabled (--no-services)")
+	}
+	if err := stopRestoreServices(ctx, plan.Services, logger); err != nil {
+		applyRestoreServices(ctx, plan.Services, logger)
 		return err
 	}
+	pve.prepareDatabase(plan)
+	extractErr := extractPlainArchive(ctx, source, destRoot, filter, pve, remap, logger)
+	if extractErr == nil {
+		extractErr = remap.apply(plan, destRoot, logger)
+	}
+	if extractErr != nil {
+		skipServiceReloads(plan.Services, "extraction failed")
+	}
+	if len(plan.Services) > 0 {
+		failed := applyRestoreServices(ctx, plan.Services, logger)
+		if !opts.PlanJSON {
+			if err := writeServiceReport(output, plan.Services); err != nil {
+				logger.Warning("Failed to write service report: %v", err)
+			}
+		}
+		if extractErr == nil && failed > 0 {
+			extractErr = fmt.Errorf("files restored, but %d service actions failed", failed)
+		}
+	}
+	if extractErr != nil {
+		return extractErr
+	}
+
+	if opts.Diff {
+		if err := reportRestoreDiff(destRoot, opts, filter, logger); err != nil {
+			return err
+		}
+	}
 
 	logger.Info("Restore completed successfully.")
-	logger.Info("Temporary decrypted bundle removed.")
 	return nil
 }
 
-func confirmRestoreAction(ctx context.Context, reader *bufio.Reader, cand *decryptCandidate, dest string) error {
+// reportRestoreDiff compares the staged restore with the live system and
+// writes the report to opts.DiffFile or stdout
+func reportRestoreDiff(destRoot string, opts RestoreOptions, filter *restoreFilter, logger *logging.Logger) error {
+	liveRoot := "/"
+	if clean := strings.TrimSpace(opts.LiveRoot); clean != "" {
+		liveRoot = filepath.Clean(clean)
+	}
+
+	logger.Info("Comparing restored files in %s with %s", destRoot, liveRoot)
+	report, err := buildRestoreDiff(destRoot, liveRoot, filter)
+	if err != nil {
+		return err
+	}
+	logger.Info("Restore diff: %d changed, %d identical, %d missing on live system, %d added on live system",
+		report.Count(diffChanged), report.Count(diffIdentical), report.Count(diffMissing), report.Count(diffAdded))
+
+	if strings.TrimSpace(opts.DiffFile) == "" {
+		return writeRestoreDiffReport(os.Stdout, report)
+	}
+	f, err := os.OpenFile(opts.DiffFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("create diff report: %w", err)
+	}
+	if err := writeRestoreDiffReport(f, report); err != nil {
+		f.Close()
+		return fmt.Errorf("write diff report: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write diff report: %w", err)
+	}
+	logger.Info("Restore diff report written to %s", opts.DiffFile)
+	return nil
+}
+
+func confirmRestoreAction(ctx context.Context, reader *bufio.Reader, out io.Writer, cand *decryptCandidate, dest string, filter *restoreFilter) error {
 	manifest := cand.Manifest
-	fmt.Println()
-	fmt.Printf("Selected backup: %s (%s)\n", cand.DisplayBase, manifest.CreatedAt.Format("2006-01-02 15:04:05"))
-	fmt.Println("Restore destination: / (system root; original paths will be preserved)")
-	fmt.Println("WARNING: This operation will overwrite configuration files on this system.")
-	fmt.Println("Type RESTORE to proceed or 0 to cancel.")
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "Selected backup: %s (%s)\n", cand.DisplayBase, manifest.CreatedAt.Format("2006-01-02 15:04:05"))
+	if dest == "/" {
+		fmt.Fprintln(out, "Restore destination: / (system root; original paths will be preserved)")
+	} else {
+		fmt.Fprintf(out, "Restore destination: %s (original paths recreated below it)\n", dest)
+	}
+	fmt.Fprintf(out, "Restore selection: %s\n", filter)
+	fmt.Fprintln(out, "WARNING: This operation will overwrite configuration files on this system.")
+	fmt.Fprintln(out, "Type RESTORE to proceed or 0 to cancel.")
 
 	for {
-		fmt.Print("Confirmation: ")
+		fmt.Fprint(out, "Confirmation: ")
 		input, err := readLineWithContext(ctx, reader)
 		if err != nil {
 			return err
@@ -68,12 +320,192 @@ func confirmRestoreAction(ctx context.Context, reader *bufio.Reader, cand *decry
 		case "0":
 			return ErrRestoreAborted
 		default:
-			fmt.Println("Please type RESTORE to confirm or 0 to cancel.")
+			fmt.Fprintln(out, "Please type RESTORE to confirm or 0 to cancel.")
+		}
+	}
+}
+
+// resolveRestoreSource maps a bundle/archive path, an rclone reference to a
+// backup on the cloud remote or a selector ("latest", "latest from
+// <primary|secondary|cloud>") to a restore candidate.
+func resolveRestoreSource(ctx context.Context, cfg *config.Config, logger *logging.Logger, source string) (*decryptCandidate, error) {
+	source = strings.TrimSpace(source)
+
+	if info, err := os.Stat(source); err == nil && !info.IsDir() {
+		return candidateFromPath(source)
+	}
+
+	if remote, _, ok := strings.Cut(source, ":"); ok && remote != "" && !strings.Contains(remote, "/") {
+		return resolveCloudSource(ctx, cfg, logger, source)
+	}
+
+	fields := strings.Fields(strings.ToLower(source))
+	if len(fields) == 1 && fields[0] != "latest" {
+		return findBackupByName(ctx, cfg, logger, source)
+	}
+	if len(fields) == 0 || fields[0] != "latest" {
+		return nil, fmt.Errorf("backup %q not found (use a bundle path, a backup name, \"latest\" or \"latest from <primary|secondary|cloud>\")", source)
+	}
+	location := ""
+	switch {
+	case len(fields) == 1:
+	case len(fields) == 3 && fields[1] == "from":
+		location = fields[2]
+	case len(fields) == 2:
+		location = fields[1]
+	default:
+		return nil, fmt.Errorf("invalid backup selector %q", source)
+	}
+	if location == "local" {
+		location = "primary"
+	}
+
+	var newest *decryptCandidate
+	matched := false
+	for _, option := range buildDecryptPathOptions(cfg) {
+		if location != "" && option.Location != location {
+			continue
+		}
+		matched = true
+		var candidates []*decryptCandidate
+		var err error
+		if option.Remote {
+			candidates, err = discoverCloudCandidates(ctx, cfg, logger)
+		} else {
+			candidates, err = discoverBackupCandidates(logger, option.Path)
+		}
+		if err != nil {
+			logger.Warning("Failed to inspect %s: %v", option.Path, err)
+			continue
+		}
+		if len(candidates) > 0 && (newest == nil || candidates[0].Manifest.CreatedAt.After(newest.Manifest.CreatedAt)) {
+			newest = candidates[0]
+		}
+	}
+	if !matched {
+		return nil, fmt.Errorf("storage %q is not configured", location)
+	}
+	if newest == nil {
+		return nil, fmt.Errorf("no backups found for selector %q", source)
+	}
+	logger.Info("Selected backup %s (%s)", newest.DisplayBase, newest.Manifest.CreatedAt.Format("2006-01-02 15:04:05"))
+	return newest, nil
+}
+
+// findBackupByName looks for a backup by file name (bundle, archive or
+// archive stem such as host-backup-20250101-010000) on every configured storage
+func findBackupByName(ctx context.Context, cfg *config.Config, logger *logging.Logger, name string) (*decryptCandidate, error) {
+	name = filepath.Base(name)
+	for _, option := range buildDecryptPathOptions(cfg) {
+		var candidates []*decryptCandidate
+		var err error
+		if option.Remote {
+			candidates, err = discoverCloudCandidates(ctx, cfg, logger)
+		} else {
+			candidates, err = discoverBackupCandidates(logger, option.Path)
+		}
+		if err != nil {
+			logger.Warning("Failed to inspect %s: %v", option.Path, err)
+			continue
+		}
+		for _, cand := range candidates {
+			if candidateHasName(cand, name) {
+				logger.Info("Selected backup %s from %s storage (%s)", cand.DisplayBase, option.Location, cand.Manifest.CreatedAt.Format("2006-01-02 15:04:05"))
+				return cand, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("backup %q not found (use a bundle path, a backup name, \"latest\" or \"latest from <primary|secondary|cloud>\")", name)
+}
+
+// candidateHasName reports whether name is one of the file names of a backup
+func candidateHasName(cand *decryptCandidate, name string) bool {
+	for _, candidate := range []string{cand.DisplayBase, cand.RemoteName, cand.BundlePath, cand.RawArchivePath} {
+		if candidate != "" && filepath.Base(candidate) == name {
+			return true
 		}
 	}
+	return strings.HasPrefix(cand.DisplayBase, name+".tar") ||
+		strings.HasPrefix(cand.DisplayBase, name+backup.IncrementalNameMarker+".tar") ||
+		strings.HasPrefix(cand.DisplayBase, name+backup.SnapshotExtension)
 }
 
-func extractPlainArchive(ctx context.Context, archivePath, destRoot string, logger *logging.Logger) error {
+// resolveCloudSource finds the backup named by an rclone reference
+// (remote:path/name) among the backups listed on the configured cloud remote.
+// Only that remote is listed, so a reference to another remote is refused.
+func resolveCloudSource(ctx context.Context, cfg *config.Config, logger *logging.Logger, ref string) (*decryptCandidate, error) {
+	if !cfg.CloudEnabled || strings.TrimSpace(cfg.CloudRemote) == "" || isLocalFilesystemPath(cfg.CloudRemote) {
+		return nil, fmt.Errorf("backup %q not found locally and no rclone cloud remote is configured", ref)
+	}
+	remote, rel, _ := strings.Cut(strings.TrimSpace(ref), ":")
+	configured, _, _ := strings.Cut(strings.TrimSpace(cfg.CloudRemote), ":")
+	if remote != configured {
+		return nil, fmt.Errorf("rclone remote %q is not the configured cloud remote %q (CLOUD_REMOTE)", remote, configured)
+	}
+	name := path.Base(rel)
+	candidates, err := discoverCloudCandidates(ctx, cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	for _, cand := range candidates {
+		if cand.RemoteName == name || cand.DisplayBase == name {
+			logger.Info("Selected cloud backup %s (%s)", cand.RemoteName, cand.Manifest.CreatedAt.Format("2006-01-02 15:04:05"))
+			return cand, nil
+		}
+	}
+	return nil, fmt.Errorf("backup %s not found on the cloud remote", name)
+}
+
+// candidateFromPath builds a restore candidate from a bundle or a raw archive
+// (or any volume of a split archive) with its .metadata and .sha256 sidecars.
+func candidateFromPath(path string) (*decryptCandidate, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(abs, ".bundle.tar") {
+		manifest, err := inspectBundleManifest(abs)
+		if err != nil {
+			return nil, err
+		}
+		return &decryptCandidate{
+			Manifest:    manifest,
+			Source:      sourceBundle,
+			BundlePath:  abs,
+			DisplayBase: filepath.Base(manifest.ArchivePath),
+		}, nil
+	}
+
+	archivePath := strings.TrimSuffix(strings.TrimSuffix(abs, ".metadata"), ".sha256")
+	// Any volume of a split archive stands for the whole archive
+	if archive, _, ok := backup.ParseVolumeName(filepath.Base(archivePath)); ok {
+		archivePath = filepath.Join(filepath.Dir(archivePath), archive)
+	}
+	metadataPath := archivePath + ".metadata"
+	checksumPath := archivePath + ".sha256"
+	for _, required := range []string{metadataPath, checksumPath} {
+		if _, err := os.Stat(required); err != nil {
+			return nil, fmt.Errorf("backup artifact missing: %w", err)
+		}
+	}
+	manifest, err := backup.LoadManifest(metadataPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArchiveStored(archivePath, manifest); err != nil {
+		return nil, fmt.Errorf("backup artifact missing: %w", err)
+	}
+	return &decryptCandidate{
+		Manifest:        manifest,
+		Source:          sourceRaw,
+		RawArchivePath:  archivePath,
+		RawMetadataPath: metadataPath,
+		RawChecksumPath: checksumPath,
+		DisplayBase:     filepath.Base(manifest.ArchivePath),
+	}, nil
+}
+
+func extractPlainArchive(ctx context.Context, src *restoreSource, destRoot string, filter *restoreFilter, pve *pveRestore, remap *restoreRemap, logger *logging.Logger) error {
 	if err := os.MkdirAll(destRoot, 0o755); err != nil {
 		return fmt.Errorf("create destination directory: %w", err)
 	}
@@ -82,39 +514,98 @@ func extractPlainArchive(ctx context.Context, archivePath, destRoot string, logg
 		return fmt.Errorf("restore to %s requires root privileges", destRoot)
 	}
 
-	logger.Info("Extracting archive %s into %s", filepath.Base(archivePath), destRoot)
+	logger.Info("Extracting archive %s into %s", src.Name, destRoot)
 
 	// Use native Go extraction to preserve atime/ctime from PAX headers
-	if err := extractArchiveNative(ctx, archivePath, destRoot, logger); err != nil {
+	if err := extractArchiveNative(ctx, src, destRoot, filter, pve, remap, logger); err != nil {
 		return fmt.Errorf("archive extraction failed: %w", err)
 	}
 
 	return nil
 }
 
-// extractArchiveNative extracts TAR archives natively in Go, preserving all timestamps
-func extractArchiveNative(ctx context.Context, archivePath, destRoot string, logger *logging.Logger) error {
-	// Open the archive file
-	file, err := os.Open(archivePath)
-	if err != nil {
-		return fmt.Errorf("open archive: %w", err)
+// extractFailedError reports the archive entries that could not be written.
+// Extraction goes on past a failed entry, so every other entry is restored.
+type extractFailedError struct {
+	failed int
+	first  error
+}
+
+func (e *extractFailedError) Error() string {
+	return fmt.Sprintf("%d archive entries could not be extracted (first: %v)", e.failed, e.first)
+}
+
+// extractArchiveNative extracts TAR archives natively in Go, preserving all timestamps.
+// When filter is not nil only the selected entries are written; pve
+// routes /etc/pve and the cluster database through the PVE config restore;
+// remap moves the files of the source node to the node directory of the new one.
+// Entries that cannot be written are logged and reported together as an
+// *extractFailedError once the whole archive was read.
+func extractArchiveNative(ctx context.Context, src *restoreSource, destRoot string, filter *restoreFilter, pve *pveRestore, remap *restoreRemap, logger *logging.Logger) error {
+	stats := &extractStats{logger: logger}
+	filter.resetHits()
+	for _, pass := range src.passes(filter) {
+		if err := extractArchivePass(ctx, pass.src, destRoot, pass.filter, pve, remap, stats); err != nil {
+			return err
+		}
+	}
+	pve.report()
+
+	if filter != nil {
+		for _, label := range filter.Unmatched() {
+			logger.Warning("Selection %s did not match any file in the archive", label)
+		}
+		if err := filter.checkMatched(); err != nil {
+			return err
+		}
+		logger.Info("Skipped %d entries outside the selection", stats.skipped)
+	}
+
+	if stats.failed != nil {
+		logger.Warning("Extracted %d files/directories, %d failed", stats.extracted, stats.failed.failed)
+		return stats.failed
+	}
+	logger.Info("Successfully extracted %d files/directories", stats.extracted)
+	return nil
+}
+
+// extractStats counts the entries of an extraction across its passes
+type extractStats struct {
+	logger    *logging.Logger
+	extracted int
+	skipped   int
+	failed    *extractFailedError
+}
+
+func (s *extractStats) entryFailed(name string, err error) {
+	s.logger.Warning("Failed to extract %s: %v", name, err)
+	if s.failed == nil {
+		s.failed = &extractFailedError{first: fmt.Errorf("%s: %w", name, err)}
 	}
-	defer file.Close()
+	s.failed.failed++
+}
 
-	// Create decompression reader based on file extension
-	reader, err := createDecompressionReader(file, archivePath)
+// extractArchivePass extracts the entries of one archive that filter selects
+func extractArchivePass(ctx context.Context, src *restoreSource, destRoot string, filter *restoreFilter, pve *pveRestore, remap *restoreRemap, stats *extractStats) error {
+	logger := stats.logger
+	// Open the decrypted and decompressed stream
+	reader, err := src.Open()
 	if err != nil {
-		return fmt.Errorf("create decompression reader: %w", err)
+		return err
 	}
-	if closer, ok := reader.(io.Closer); ok {
-		defer closer.Close()
+	defer reader.Close()
+
+	manifest, err := readOptimizationManifest(ctx, src)
+	if err != nil {
+		return fmt.Errorf("read optimization manifest: %w", err)
 	}
+	optimized := newOptimizationRestorer(manifest, destRoot, filter, remap, logger)
+	defer optimized.Close()
 
 	// Create TAR reader
 	tarReader := tar.NewReader(reader)
 
 	// Extract all files
-	filesExtracted := 0
 	for {
 		select {
 		case <-ctx.Done():
@@ -130,107 +621,77 @@ func extractArchiveNative(ctx context.Context, archivePath, destRoot string, log
 			return fmt.Errorf("read tar header: %w", err)
 		}
 
-		if err := extractTarEntry(tarReader, header, destRoot, logger); err != nil {
-			logger.Warning("Failed to extract %s: %v", header.Name, err)
+		if handled, err := optimized.intercept(tarReader, header); handled || err != nil {
+			if err != nil {
+				stats.entryFailed(header.Name, err)
+			}
 			continue
 		}
 
-		filesExtracted++
-		if filesExtracted%100 == 0 {
-			logger.Debug("Extracted %d files...", filesExtracted)
+		if !filter.restores(normalizeArchivePath(header.Name)) {
+			continue // restored from another archive of the chain
+		}
+		if !filter.Match(header.Name) {
+			stats.skipped++
+			continue
+		}
+		header = remap.rename(header)
+		if pve.exclude(header) {
+			stats.skipped++
+			continue
 		}
-	}
-
-	logger.Info("Successfully extracted %d files/directories", filesExtracted)
-	return nil
-}
-
-// createDecompressionReader creates appropriate decompression reader based on file extension
-func createDecompressionReader(file *os.File, archivePath string) (io.Reader, error) {
-	switch {
-	case strings.HasSuffix(archivePath, ".tar.gz") || strings.HasSuffix(archivePath, ".tgz"):
-		return gzip.NewReader(file)
-	case strings.HasSuffix(archivePath, ".tar.xz"):
-		return createXZReader(file)
-	case strings.HasSuffix(archivePath, ".tar.zst") || strings.HasSuffix(archivePath, ".tar.zstd"):
-		return createZstdReader(file)
-	case strings.HasSuffix(archivePath, ".tar.bz2"):
-		return createBzip2Reader(file)
-	case strings.HasSuffix(archivePath, ".tar.lzma"):
-		return createLzmaReader(file)
-	case strings.HasSuffix(archivePath, ".tar"):
-		return file, nil
-	default:
-		return nil, fmt.Errorf("unsupported archive format: %s", filepath.Base(archivePath))
-	}
-}
 
-// createXZReader creates an XZ decompression reader using external xz command
-func createXZReader(file *os.File) (io.Reader, error) {
-	cmd := exec.Command("xz", "-d", "-c")
-	cmd.Stdin = file
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, fmt.Errorf("create xz pipe: %w", err)
-	}
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("start xz: %w", err)
-	}
-	return stdout, nil
-}
+		if pve.writesThrough(header.Name) {
+			var target string
+			if target, err = restoreTargetPath(destRoot, header.Name); err == nil {
+				err = pve.extractEntry(tarReader, header, target)
+			}
+		} else {
+			err = extractTarEntry(tarReader, header, destRoot, logger)
+		}
+		if err != nil {
+			stats.entryFailed(header.Name, err)
+			continue
+		}
 
-// createZstdReader creates a Zstd decompression reader using external zstd command
-func createZstdReader(file *os.File) (io.Reader, error) {
-	cmd := exec.Command("zstd", "-d", "-c")
-	cmd.Stdin = file
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, fmt.Errorf("create zstd pipe: %w", err)
-	}
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("start zstd: %w", err)
+		stats.extracted++
+		if stats.extracted%100 == 0 {
+			logger.Debug("Extracted %d files...", stats.extracted)
+		}
 	}
-	return stdout, nil
-}
 
-// createBzip2Reader creates a Bzip2 decompression reader using external bzip2 command
-func createBzip2Reader(file *os.File) (io.Reader, error) {
-	cmd := exec.Command("bzip2", "-d", "-c")
-	cmd.Stdin = file
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, fmt.Errorf("create bzip2 pipe: %w", err)
-	}
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("start bzip2: %w", err)
-	}
-	return stdout, nil
+	return optimized.finalize()
 }
 
-// createLzmaReader creates an LZMA decompression reader using external lzma command
-func createLzmaReader(file *os.File) (io.Reader, error) {
-	cmd := exec.Command("lzma", "-d", "-c")
-	cmd.Stdin = file
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, fmt.Errorf("create lzma pipe: %w", err)
-	}
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("start lzma: %w", err)
+// createDecompressionReader creates appropriate decompression reader based on the archive name.
+// The formats are decoded in-process (see backup.NewDecompressor), so a
+// restore does not depend on the xz/zstd/bzip2/lzma binaries.
+func createDecompressionReader(r io.Reader, archiveName string) (io.ReadCloser, error) {
+	var compression types.CompressionType
+	switch {
+	case strings.HasSuffix(archiveName, ".tar.gz") || strings.HasSuffix(archiveName, ".tgz"):
+		compression = types.CompressionGzip
+	case strings.HasSuffix(archiveName, ".tar.xz"):
+		compression = types.CompressionXZ
+	case strings.HasSuffix(archiveName, ".tar.zst") || strings.HasSuffix(archiveName, ".tar.zstd"):
+		compression = types.CompressionZstd
+	case strings.HasSuffix(archiveName, ".tar.bz2"):
+		compression = types.CompressionBzip2
+	case strings.HasSuffix(archiveName, ".tar.lzma"):
+		compression = types.CompressionLZMA
+	case strings.HasSuffix(archiveName, ".tar"):
+		compression = types.CompressionNone
+	default:
+		return nil, fmt.Errorf("unsupported archive format: %s", filepath.Base(archiveName))
 	}
-	return stdout, nil
+	return backup.NewDecompressor(r, compression)
 }
 
 // extractTarEntry extracts a single TAR entry, preserving all attributes including atime/ctime
 func extractTarEntry(tarReader *tar.Reader, header *tar.Header, destRoot string, logger *logging.Logger) error {
-	// Clean the target path
-	target := filepath.Join(destRoot, header.Name)
-	target = filepath.Clean(target)
-
-	// Security check: prevent path traversal
-	if !strings.HasPrefix(target, filepath.Clean(destRoot)+string(os.PathSeparator)) &&
-		target != filepath.Clean(destRoot) {
-		return fmt.Errorf("illegal path: %s", header.Name)
+	target, err := restoreTargetPath(destRoot, header.Name)
+	if err != nil {
+		return err
 	}
 
 	// Create parent directories
@@ -253,6 +714,21 @@ func extractTarEntry(tarReader *tar.Reader, header *tar.Header, destRoot string,
 	}
 }
 
+// restoreTargetPath maps an archive entry name below destRoot, rejecting
+// names that would escape it
+func restoreTargetPath(destRoot, name string) (string, error) {
+	root := filepath.Clean(destRoot)
+	target := filepath.Join(root, name)
+
+	// Security check: prevent path traversal. Comparing relative paths also
+	// works when root is "/", which a prefix check against root+"/" misses.
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return "", fmt.Errorf("illegal path: %s", name)
+	}
+	return target, nil
+}
+
 // extractDirectory creates a directory with proper permissions and timestamps
 func extractDirectory(target string, header *tar.Header, logger *logging.Logger) error {
 	if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
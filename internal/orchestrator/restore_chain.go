@@ -0,0 +1,216 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+)
+
+// maxRestoreChain stops the parent lookup of a damaged or looping chain
+const maxRestoreChain = 100
+
+// prepareChainSource merges the incremental backup prepared in leaf with
+// its parents, read from the storage the candidate was found in, into a
+// source restoring the complete tree. The sources of the chain are closed
+// with the returned source, or on error.
+func prepareChainSource(ctx context.Context, leaf *restoreSource, cand *decryptCandidate, identities []age.Identity, logger *logging.Logger) (*restoreSource, error) {
+	chain := []*restoreSource{leaf}
+	defer func() {
+		for _, src := range chain {
+			src.Close()
+		}
+	}()
+
+	siblings, err := chainCandidates(ctx, cand, logger)
+	if err != nil {
+		return nil, fmt.Errorf("list parents of incremental backup %s: %w", cand.DisplayBase, err)
+	}
+	if len(leaf.identities) > 0 {
+		identities = leaf.identities
+	}
+
+	child := cand
+	for child.Manifest.Parent != "" {
+		if len(chain) > maxRestoreChain {
+			return nil, fmt.Errorf("incremental chain of %s is longer than %d backups", cand.DisplayBase, maxRestoreChain)
+		}
+		parent := findChainParent(siblings, child.Manifest.Parent)
+		if parent == nil {
+			return nil, fmt.Errorf("backup %s is incremental and its parent %s is missing", child.DisplayBase, child.Manifest.Parent)
+		}
+		logger.Info("Backup %s is incremental: reading parent %s", child.DisplayBase, parent.DisplayBase)
+		src, err := prepareArchiveSource(ctx, parent, identities, logger)
+		if err != nil {
+			return nil, fmt.Errorf("prepare parent backup %s: %w", parent.DisplayBase, err)
+		}
+		chain = append(chain, src)
+		if len(src.identities) > 0 {
+			identities = src.identities
+		}
+		if child.Manifest.ParentSHA256 != "" && parent.Manifest.SHA256 != "" &&
+			!strings.EqualFold(child.Manifest.ParentSHA256, parent.Manifest.SHA256) {
+			return nil, fmt.Errorf("parent backup %s is not the archive %s was created from (checksum mismatch)", parent.DisplayBase, child.DisplayBase)
+		}
+		child = parent
+	}
+
+	merged, err := mergeBackupChain(ctx, chain, logger)
+	if err == nil {
+		chain = nil // closed with merged
+	}
+	return merged, err
+}
+
+// chainCandidates lists the backups stored next to cand
+func chainCandidates(ctx context.Context, cand *decryptCandidate, logger *logging.Logger) ([]*decryptCandidate, error) {
+	if cand.Cloud != nil {
+		return cloudCandidates(ctx, cand.Cloud, logger)
+	}
+	stored := cand.BundlePath
+	if cand.Source == sourceRaw {
+		stored = cand.RawArchivePath
+	}
+	return discoverBackupCandidates(logger, filepath.Dir(stored))
+}
+
+// findChainParent returns the candidate whose archive is named name
+func findChainParent(candidates []*decryptCandidate, name string) *decryptCandidate {
+	for _, cand := range candidates {
+		if cand.DisplayBase == name || filepath.Base(cand.Manifest.ArchivePath) == name {
+			return cand
+		}
+	}
+	return nil
+}
+
+// chainLayer is one archive of an incremental chain, with the entries it
+// holds by their original path (chunked and deduplicated files included)
+type chainLayer struct {
+	src     *restoreSource
+	entries []string
+	state   *backup.IncrementalState // nil for the full backup
+}
+
+// mergeBackupChain turns the chain, from the newest archive to the full
+// backup, into one source. Nothing is extracted here: the headers of every
+// archive are read to work out which archive restores each path (the newest
+// one holding it, unless a later increment deletes it), and extraction then
+// reads every archive in turn and writes only the entries it owns, so the
+// plaintext only ever goes to the restore destination.
+func mergeBackupChain(ctx context.Context, chain []*restoreSource, logger *logging.Logger) (*restoreSource, error) {
+	layers := make([]*chainLayer, 0, len(chain))
+	for i := len(chain) - 1; i >= 0; i-- {
+		layer, err := scanChainLayer(ctx, chain[i], i < len(chain)-1)
+		if err != nil {
+			return nil, fmt.Errorf("read incremental archive %s: %w", chain[i].Name, err)
+		}
+		layers = append(layers, layer)
+	}
+
+	owners := make(map[string]int)
+	for i, layer := range layers {
+		if layer.state != nil {
+			for _, deleted := range layer.state.Deleted {
+				removeChainPath(owners, normalizeArchivePath(deleted))
+			}
+		}
+		for _, name := range layer.entries {
+			owners[name] = i
+		}
+	}
+
+	merged := &restoreSource{Name: chain[0].Name, optimizationsRead: true}
+	for i, layer := range layers {
+		merged.layers = append(merged.layers, restoreLayer{
+			src: layer.src,
+			owns: func(name string) bool {
+				owner, ok := owners[name]
+				return ok && owner == i
+			},
+		})
+	}
+	sources := append([]*restoreSource(nil), chain...)
+	merged.cleanup = func() {
+		for _, src := range sources {
+			src.Close()
+		}
+	}
+	logger.Info("Restoring %d incremental archives on top of the full backup %s", len(chain)-1, chain[len(chain)-1].Name)
+	return merged, nil
+}
+
+// scanChainLayer lists the entries of one archive of the chain and reads the
+// state of an incremental archive. Only tar headers and the state entry are
+// read.
+func scanChainLayer(ctx context.Context, src *restoreSource, incremental bool) (*chainLayer, error) {
+	manifest, err := readOptimizationManifest(ctx, src)
+	if err != nil {
+		return nil, fmt.Errorf("read optimization manifest: %w", err)
+	}
+	chunked := make(map[string]bool)
+	if manifest != nil {
+		for _, rec := range manifest.Chunked {
+			chunked[rec.Path] = true
+		}
+	}
+
+	reader, err := src.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	layer := &chainLayer{src: src}
+	tarReader := tar.NewReader(reader)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read tar header: %w", err)
+		}
+		name := normalizeArchivePath(header.Name)
+		switch {
+		case name == "" || name == backup.OptimizationManifestName || isChunkStorePath(name):
+			continue
+		case name == backup.IncrementalStateName && incremental:
+			if layer.state, err = backup.ReadIncrementalState(tarReader); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if orig, ok := strings.CutSuffix(name, backup.ChunkMarkerSuffix); ok && chunked[orig] {
+			name = orig
+		}
+		layer.entries = append(layer.entries, name)
+	}
+	if incremental && layer.state == nil {
+		return nil, fmt.Errorf("incremental archive has no %s", backup.IncrementalStateName)
+	}
+	return layer, nil
+}
+
+// removeChainPath drops name and everything below it from the owners
+func removeChainPath(owners map[string]int, name string) {
+	if name == "" {
+		return
+	}
+	delete(owners, name)
+	prefix := name + "/"
+	for p := range owners {
+		if strings.HasPrefix(p, prefix) {
+			delete(owners, p)
+		}
+	}
+}
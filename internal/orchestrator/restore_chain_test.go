@@ -0,0 +1,239 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/config"
+)
+
+// writeTestIncremental writes an incremental bundle based on the backup in
+// parentBundle: the archive holds files and the incremental state deleting
+// deleted
+func writeTestIncremental(t *testing.T, dir, archiveName string, createdAt time.Time, parentBundle string, files map[string]string, deleted []string, recipient age.Recipient) string {
+	t.Helper()
+	parent, err := inspectBundleManifest(parentBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := json.Marshal(backup.IncrementalState{Parent: filepath.Base(parent.ArchivePath), Deleted: deleted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := map[string]string{backup.IncrementalStateName: string(state)}
+	for name, body := range files {
+		content[name] = body
+	}
+	bundlePath := writeTestBundle(t, dir, archiveName, createdAt, buildTestTar(t, content), recipient)
+	rewriteTestManifest(t, bundlePath, func(m *backup.Manifest) {
+		m.Parent = filepath.Base(parent.ArchivePath)
+		m.ParentSHA256 = parent.SHA256
+		m.ChainDepth = parent.ChainDepth + 1
+	})
+	return bundlePath
+}
+
+// rewriteTestManifest changes the .metadata member of a bundle
+func rewriteTestManifest(t *testing.T, bundlePath string, change func(*backup.Manifest)) {
+	t.Helper()
+	data, err := os.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(data))
+	tw := tar.NewWriter(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(hdr.Name, ".metadata") {
+			var manifest backup.Manifest
+			if err := json.Unmarshal(body, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			change(&manifest)
+			if body, err = json.Marshal(&manifest); err != nil {
+				t.Fatal(err)
+			}
+			hdr.Size = int64(len(body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bundlePath, out.Bytes(), 0o640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreIncrementalChain(t *testing.T) {
+	dir := t.TempDir()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2025, 1, 1, 1, 0, 0, 0, time.UTC)
+	full := writeTestBundle(t, dir, "testhost-backup-20250101-010000.tar", base, buildTestTar(t, map[string]string{
+		"etc/hostname":   "pve1\n",
+		"etc/hosts":      "127.0.0.1 localhost\n",
+		"etc/old/a.conf": "a\n",
+	}), identity.Recipient())
+	first := writeTestIncremental(t, dir, "testhost-backup-20250102-010000.incr.tar", base.Add(24*time.Hour), full,
+		map[string]string{"etc/hosts": "127.0.0.1 localhost pve1\n", "etc/new.conf": "new\n"},
+		[]string{"/etc/old"}, identity.Recipient())
+	writeTestIncremental(t, dir, "testhost-backup-20250103-010000.incr.tar", base.Add(48*time.Hour), first,
+		map[string]string{"etc/hostname": "pve2\n"},
+		[]string{"/etc/new.conf"}, identity.Recipient())
+
+	// Nothing of the chain may be written outside the restore destination
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	logger := newTestLogger()
+	cfg := &config.Config{BackupPath: dir}
+	cand, err := findBackupByName(context.Background(), cfg, logger, "testhost-backup-20250103-010000")
+	if err != nil {
+		t.Fatalf("find incremental backup: %v", err)
+	}
+	src, err := prepareRestoreSource(context.Background(), nil, cand, []age.Identity{identity}, logger)
+	if err != nil {
+		t.Fatalf("prepareRestoreSource: %v", err)
+	}
+	defer src.Close()
+	if src.Name != "testhost-backup-20250103-010000.incr.tar" {
+		t.Errorf("merged archive name = %s", src.Name)
+	}
+
+	dest := t.TempDir()
+	if err := extractPlainArchive(context.Background(), src, dest, nil, nil, nil, logger); err != nil {
+		t.Fatalf("extract merged archive: %v", err)
+	}
+	for name, want := range map[string]string{
+		"etc/hostname": "pve2\n",
+		"etc/hosts":    "127.0.0.1 localhost pve1\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q (%v), want %q", name, got, err, want)
+		}
+	}
+	for _, gone := range []string{"etc/old", "etc/new.conf", backup.IncrementalStateName} {
+		if _, err := os.Lstat(filepath.Join(dest, gone)); !os.IsNotExist(err) {
+			t.Errorf("%s restored (%v)", gone, err)
+		}
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("chain restore wrote to the temporary directory: %v", entries)
+	}
+
+	// The plan and a selective restore see every path once, from the
+	// archive that restores it
+	filter, err := newRestoreFilter([]string{"/etc/hosts", "/etc/old"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := buildRestorePlan(context.Background(), src, t.TempDir(), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("buildRestorePlan: %v", err)
+	}
+	if len(plan.Entries) != 2 || plan.Summary[planCreate] != 2 {
+		t.Errorf("plan = %+v, want etc/hostname and etc/hosts", plan.Entries)
+	}
+	selective := t.TempDir()
+	if err := extractPlainArchive(context.Background(), src, selective, filter, nil, nil, logger); err != nil {
+		t.Fatalf("selective extract: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(selective, "etc/hosts")); err != nil || string(got) != "127.0.0.1 localhost pve1\n" {
+		t.Errorf("selected etc/hosts = %q (%v)", got, err)
+	}
+	if _, err := os.Lstat(filepath.Join(selective, "etc/hostname")); !os.IsNotExist(err) {
+		t.Errorf("unselected etc/hostname restored (%v)", err)
+	}
+	if missing := filter.Unmatched(); len(missing) != 1 || missing[0] != "/etc/old" {
+		t.Errorf("unmatched = %v, want the deleted /etc/old", missing)
+	}
+
+	// A chain with a missing full backup cannot be restored
+	if err := os.Remove(full); err != nil {
+		t.Fatal(err)
+	}
+	cand, err = findBackupByName(context.Background(), cfg, logger, "testhost-backup-20250103-010000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prepareRestoreSource(context.Background(), nil, cand, []age.Identity{identity}, logger); err == nil || !strings.Contains(err.Error(), "parent testhost-backup-20250101-010000.tar.age is missing") {
+		t.Errorf("restore without full backup: %v", err)
+	}
+}
+
+func TestRestoreIncrementalChainOptimized(t *testing.T) {
+	dir := t.TempDir()
+	large := bytes.Repeat([]byte("proxmox backup chunk\n"), 200)
+	dup := []byte("ssh-ed25519 AAAA root@pve1\n")
+	base := time.Date(2025, 1, 1, 1, 0, 0, 0, time.UTC)
+	full := writeTestBundle(t, dir, "testhost-backup-20250101-010000.tar", base, buildOptimizedArchive(t, map[string][]byte{
+		"var/lib/pve-cluster/config.db": large,
+		"root/.ssh/authorized_keys":     dup,
+		"etc/pve/priv/authorized_keys":  dup,
+	}, backup.OptimizationConfig{
+		EnableChunking:      true,
+		EnableDeduplication: true,
+		ChunkSizeBytes:      700,
+		ChunkThresholdBytes: 1000,
+	}), nil)
+	// The deduplication target changes: the copy restored from the full
+	// backup still gets the old content of its target from there
+	changed := "ssh-ed25519 BBBB root@pve1\n"
+	writeTestIncremental(t, dir, "testhost-backup-20250102-010000.incr.tar", base.Add(24*time.Hour), full,
+		map[string]string{"etc/pve/priv/authorized_keys": changed}, nil, nil)
+
+	logger := newTestLogger()
+	cand, err := findBackupByName(context.Background(), &config.Config{BackupPath: dir}, logger, "testhost-backup-20250102-010000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := prepareRestoreSource(context.Background(), nil, cand, nil, logger)
+	if err != nil {
+		t.Fatalf("prepareRestoreSource: %v", err)
+	}
+	defer src.Close()
+
+	dest := t.TempDir()
+	if err := extractPlainArchive(context.Background(), src, dest, nil, nil, nil, logger); err != nil {
+		t.Fatalf("extract chain: %v", err)
+	}
+	for name, want := range map[string]string{
+		"var/lib/pve-cluster/config.db": string(large),
+		"root/.ssh/authorized_keys":     string(dup),
+		"etc/pve/priv/authorized_keys":  changed,
+	} {
+		if got := readTestFile(t, filepath.Join(dest, name)); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
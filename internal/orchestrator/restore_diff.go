@@ -0,0 +1,432 @@
+package orchestrator
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+)
+
+// restoreDiffStatus classifies a path when comparing a staged restore with the live system
+type restoreDiffStatus string
+
+const (
+	// diffAdded: present on the live system but not in the backup
+	diffAdded restoreDiffStatus = "added"
+	// diffChanged: present on both sides with different content, type or metadata
+	diffChanged restoreDiffStatus = "changed"
+	// diffIdentical: present on both sides and equal
+	diffIdentical restoreDiffStatus = "identical"
+	// diffMissing: present in the backup but missing on the live system
+	diffMissing restoreDiffStatus = "missing"
+)
+
+const (
+	// maxDiffFileSize limits which files get a unified diff
+	maxDiffFileSize = 1 << 20
+	// maxDiffCells bounds the LCS table (lines(a) * lines(b))
+	maxDiffCells     = 4_000_000
+	diffContextLines = 3
+)
+
+type restoreDiffEntry struct {
+	Path   string
+	Status restoreDiffStatus
+	Detail string
+	Diff   string
+}
+
+type restoreDiffReport struct {
+	StagingRoot string
+	LiveRoot    string
+	Entries     []restoreDiffEntry
+}
+
+// Count returns the number of entries with the given status
+func (r *restoreDiffReport) Count(status restoreDiffStatus) int {
+	n := 0
+	for _, e := range r.Entries {
+		if e.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// buildRestoreDiff compares every path restored below stagingRoot with the
+// same path below liveRoot. Directories only appear when missing or of a
+// different type; live entries absent from the backup are reported as added
+// for directories that were captured without subdirectories (e.g.
+// etc/cron.d, etc/pve/qemu-server), where the backup holds the whole content.
+// Live entries outside filter are ignored.
+func buildRestoreDiff(stagingRoot, liveRoot string, filter *restoreFilter) (*restoreDiffReport, error) {
+	report := &restoreDiffReport{StagingRoot: stagingRoot, LiveRoot: liveRoot}
+	hasSubdirs := make(map[string]bool)
+
+	err := filepath.WalkDir(stagingRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(stagingRoot, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if d.IsDir() {
+			if _, ok := hasSubdirs[rel]; !ok {
+				hasSubdirs[rel] = false
+			}
+			if parent := filepath.Dir(rel); parent != "." {
+				hasSubdirs[parent] = true
+			}
+		}
+		entry, err := compareRestoredPath(path, filepath.Join(liveRoot, rel), rel)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			report.Entries = append(report.Entries, *entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("compare %s with %s: %w", stagingRoot, liveRoot, err)
+	}
+
+	for dir, subdirs := range hasSubdirs {
+		if subdirs {
+			continue
+		}
+		liveEntries, err := os.ReadDir(filepath.Join(liveRoot, dir))
+		if err != nil {
+			continue
+		}
+		for _, live := range liveEntries {
+			rel := filepath.Join(dir, live.Name())
+			if !filter.Match(filepath.ToSlash(rel)) {
+				continue
+			}
+			if _, err := os.Lstat(filepath.Join(stagingRoot, rel)); os.IsNotExist(err) {
+				report.Entries = append(report.Entries, restoreDiffEntry{Path: "/" + rel, Status: diffAdded})
+			}
+		}
+	}
+
+	sort.Slice(report.Entries, func(i, j int) bool { return report.Entries[i].Path < report.Entries[j].Path })
+	return report, nil
+}
+
+// compareRestoredPath compares one staged path with its live counterpart.
+// It returns nil for directories present on both sides.
+func compareRestoredPath(stagedPath, livePath, rel string) (*restoreDiffEntry, error) {
+	entry := &restoreDiffEntry{Path: "/" + rel}
+
+	staged, err := os.Lstat(stagedPath)
+	if err != nil {
+		return nil, err
+	}
+	live, err := os.Lstat(livePath)
+	if os.IsNotExist(err) {
+		entry.Status = diffMissing
+		return entry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if staged.Mode().Type() != live.Mode().Type() {
+		entry.Status = diffChanged
+		entry.Detail = fmt.Sprintf("type %s on live system, %s in backup", describeFileType(live), describeFileType(staged))
+		return entry, nil
+	}
+
+	var details []string
+	switch {
+	case staged.IsDir():
+		return nil, nil
+	case staged.Mode()&os.ModeSymlink != 0:
+		stagedTarget, err := os.Readlink(stagedPath)
+		if err != nil {
+			return nil, err
+		}
+		liveTarget, err := os.Readlink(livePath)
+		if err != nil {
+			return nil, err
+		}
+		if stagedTarget != liveTarget {
+			details = append(details, fmt.Sprintf("symlink target %s -> %s", liveTarget, stagedTarget))
+		}
+	case staged.Mode().IsRegular():
+		stagedData, liveData, same, err := compareFileContent(stagedPath, livePath, staged.Size(), live.Size())
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			details = append(details, fmt.Sprintf("content differs (%d -> %d bytes)", live.Size(), staged.Size()))
+			if isTextContent(liveData) && isTextContent(stagedData) {
+				entry.Diff = unifiedDiff(entry.Path+" (live)", entry.Path+" (backup)",
+					splitLines(string(liveData)), splitLines(string(stagedData)), diffContextLines)
+			}
+		}
+	}
+
+	if staged.Mode().Perm() != live.Mode().Perm() && staged.Mode()&os.ModeSymlink == 0 {
+		details = append(details, fmt.Sprintf("mode %04o -> %04o", live.Mode().Perm(), staged.Mode().Perm()))
+	}
+	// Ownership is only restored (and therefore only comparable) when running as root
+	if ss, ok := staged.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+		if ls, ok := live.Sys().(*syscall.Stat_t); ok && (ss.Uid != ls.Uid || ss.Gid != ls.Gid) {
+			details = append(details, fmt.Sprintf("owner %d:%d -> %d:%d", ls.Uid, ls.Gid, ss.Uid, ss.Gid))
+		}
+	}
+
+	if len(details) == 0 {
+		entry.Status = diffIdentical
+	} else {
+		entry.Status = diffChanged
+		entry.Detail = strings.Join(details, ", ")
+	}
+	return entry, nil
+}
+
+// compareFileContent reports whether two files are equal. File contents are
+// returned only when both are small enough to be diffed.
+func compareFileContent(stagedPath, livePath string, stagedSize, liveSize int64) ([]byte, []byte, bool, error) {
+	if stagedSize <= maxDiffFileSize && liveSize <= maxDiffFileSize {
+		stagedData, err := os.ReadFile(stagedPath)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		liveData, err := os.ReadFile(livePath)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		return stagedData, liveData, bytes.Equal(stagedData, liveData), nil
+	}
+	if stagedSize != liveSize {
+		return nil, nil, false, nil
+	}
+	same, err := sameFileContent(stagedPath, livePath)
+	return nil, nil, same, err
+}
+
+func sameFileContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, 64*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+func describeFileType(info os.FileInfo) string {
+	switch {
+	case info.IsDir():
+		return "directory"
+	case info.Mode()&os.ModeSymlink != 0:
+		return "symlink"
+	case info.Mode().IsRegular():
+		return "file"
+	default:
+		return "special file"
+	}
+}
+
+func isTextContent(data []byte) bool {
+	sample := data
+	if len(sample) > 8192 {
+		sample = sample[:8192]
+	}
+	return !bytes.Contains(sample, []byte{0}) && utf8.Valid(data)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.Split(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	text string
+}
+
+// diffLines computes a line edit script turning a into b (LCS based)
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, n+m)
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < m; j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+// unifiedDiff renders a unified diff between a and b. It returns an empty
+// string when the inputs are equal.
+func unifiedDiff(fromName, toName string, a, b []string, context int) string {
+	if len(a)*len(b) > maxDiffCells {
+		return fmt.Sprintf("--- %s\n+++ %s\n(diff omitted: %d and %d lines)\n", fromName, toName, len(a), len(b))
+	}
+	ops := diffLines(a, b)
+
+	// aPos/bPos hold the number of a/b lines preceding each op
+	aPos := make([]int, len(ops)+1)
+	bPos := make([]int, len(ops)+1)
+	changed := false
+	for i, op := range ops {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if op.kind != '+' {
+			aPos[i+1]++
+		}
+		if op.kind != '-' {
+			bPos[i+1]++
+		}
+		if op.kind != ' ' {
+			changed = true
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+	for i := 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		start := max(i-context, 0)
+		end := i + 1
+		for j := i + 1; j < len(ops); {
+			if ops[j].kind != ' ' {
+				j++
+				end = j
+				continue
+			}
+			k := j
+			for k < len(ops) && ops[k].kind == ' ' {
+				k++
+			}
+			if k == len(ops) || k-j > 2*context {
+				break
+			}
+			j = k
+		}
+		stop := min(end+context, len(ops))
+
+		aCount := aPos[stop] - aPos[start]
+		bCount := bPos[stop] - bPos[start]
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aPos[start], aCount), hunkRange(bPos[start], bCount))
+		for _, op := range ops[start:stop] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.text)
+			sb.WriteByte('\n')
+		}
+		i = stop
+	}
+	return sb.String()
+}
+
+func hunkRange(pos, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", pos)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", pos+1)
+	}
+	return fmt.Sprintf("%d,%d", pos+1, count)
+}
+
+// writeRestoreDiffReport prints the per-file report followed by the diffs
+func writeRestoreDiffReport(w io.Writer, report *restoreDiffReport) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Restore diff: %s (backup) vs %s (live)\n", report.StagingRoot, report.LiveRoot)
+	fmt.Fprintf(&sb, "  changed: %d, identical: %d, missing on live system: %d, added on live system: %d\n\n",
+		report.Count(diffChanged), report.Count(diffIdentical), report.Count(diffMissing), report.Count(diffAdded))
+	for _, e := range report.Entries {
+		if e.Detail != "" {
+			fmt.Fprintf(&sb, "%-9s %s (%s)\n", e.Status, e.Path, e.Detail)
+		} else {
+			fmt.Fprintf(&sb, "%-9s %s\n", e.Status, e.Path)
+		}
+	}
+	for _, e := range report.Entries {
+		if e.Diff != "" {
+			sb.WriteString("\n")
+			sb.WriteString(e.Diff)
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
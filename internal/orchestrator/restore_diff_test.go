@@ -0,0 +1,126 @@
+package orchestrator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := []string{"auto lo", "iface lo inet loopback", "", "auto vmbr0", "iface vmbr0 inet static", "    address 10.0.0.2/24", "    gateway 10.0.0.1", "    bridge-ports eno1", "    bridge-stp off", "    bridge-fd 0"}
+	b := []string{"auto lo", "iface lo inet loopback", "", "auto vmbr0", "iface vmbr0 inet static", "    address 10.0.0.5/24", "    gateway 10.0.0.1", "    bridge-ports eno1", "    bridge-stp off", "    bridge-fd 0", "    mtu 9000"}
+
+	got := unifiedDiff("live", "backup", a, b, 3)
+	want := strings.Join([]string{
+		"--- live",
+		"+++ backup",
+		"@@ -3,8 +3,9 @@",
+		" ",
+		" auto vmbr0",
+		" iface vmbr0 inet static",
+		"-    address 10.0.0.2/24",
+		"+    address 10.0.0.5/24",
+		"     gateway 10.0.0.1",
+		"     bridge-ports eno1",
+		"     bridge-stp off",
+		"     bridge-fd 0",
+		"+    mtu 9000",
+		"",
+	}, "\n")
+	if got != want {
+		t.Errorf("unifiedDiff mismatch\n got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if diff := unifiedDiff("a", "b", a, a, 3); diff != "" {
+		t.Errorf("unifiedDiff of equal input = %q; want empty", diff)
+	}
+
+	got = unifiedDiff("a", "b", nil, []string{"x"}, 3)
+	if !strings.Contains(got, "@@ -0,0 +1 @@\n+x\n") {
+		t.Errorf("unifiedDiff from empty = %q", got)
+	}
+}
+
+func TestBuildRestoreDiff(t *testing.T) {
+	staging := t.TempDir()
+	live := t.TempDir()
+
+	write := func(root, rel, content string, mode os.FileMode) {
+		t.Helper()
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(staging, "etc/hosts", "127.0.0.1 localhost\n", 0o644)
+	write(live, "etc/hosts", "127.0.0.1 localhost\n", 0o644)
+	write(staging, "etc/network/interfaces", "auto vmbr0\n", 0o644)
+	write(live, "etc/network/interfaces", "auto vmbr1\n", 0o644)
+	write(staging, "etc/pve/qemu-server/100.conf", "cores: 2\n", 0o640)
+	write(live, "etc/pve/qemu-server/100.conf", "cores: 2\n", 0o600)
+	write(live, "etc/pve/qemu-server/101.conf", "cores: 4\n", 0o640)
+	write(staging, "etc/cron.d/backup", "0 1 * * * root true\n", 0o644)
+	// Not a captured leaf directory: live extras in etc/ are not reported
+	write(live, "etc/passwd", "root:x:0:0::/root:/bin/bash\n", 0o644)
+
+	report, err := buildRestoreDiff(staging, live, nil)
+	if err != nil {
+		t.Fatalf("buildRestoreDiff: %v", err)
+	}
+
+	got := make(map[string]restoreDiffEntry)
+	for _, e := range report.Entries {
+		got[e.Path] = e
+	}
+	expect := map[string]restoreDiffStatus{
+		"/etc/hosts":                    diffIdentical,
+		"/etc/network/interfaces":       diffChanged,
+		"/etc/pve/qemu-server/100.conf": diffChanged,
+		"/etc/pve/qemu-server/101.conf": diffAdded,
+		"/etc/cron.d":                   diffMissing,
+		"/etc/cron.d/backup":            diffMissing,
+	}
+	for path, status := range expect {
+		if got[path].Status != status {
+			t.Errorf("%s: status %q; want %q", path, got[path].Status, status)
+		}
+	}
+	if _, ok := got["/etc/passwd"]; ok {
+		t.Error("/etc/passwd reported although etc/ was not captured as a whole")
+	}
+	if !strings.Contains(got["/etc/network/interfaces"].Diff, "-auto vmbr1\n+auto vmbr0\n") {
+		t.Errorf("missing unified diff for interfaces: %q", got["/etc/network/interfaces"].Diff)
+	}
+	if !strings.Contains(got["/etc/pve/qemu-server/100.conf"].Detail, "mode 0600 -> 0640") {
+		t.Errorf("unexpected detail for 100.conf: %q", got["/etc/pve/qemu-server/100.conf"].Detail)
+	}
+
+	var out strings.Builder
+	if err := writeRestoreDiffReport(&out, report); err != nil {
+		t.Fatalf("writeRestoreDiffReport: %v", err)
+	}
+	if !strings.Contains(out.String(), "changed: 2, identical: 1, missing on live system: 2, added on live system: 1") {
+		t.Errorf("unexpected report summary:\n%s", out.String())
+	}
+
+	// A selective restore must not report unselected siblings as added
+	filter, err := newRestoreFilter([]string{"/etc/pve/qemu-server/100.conf"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = buildRestoreDiff(staging, live, filter)
+	if err != nil {
+		t.Fatalf("buildRestoreDiff: %v", err)
+	}
+	if report.Count(diffAdded) != 0 {
+		t.Errorf("selective diff reported %d added entries; want 0", report.Count(diffAdded))
+	}
+}
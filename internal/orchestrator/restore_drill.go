@@ -0,0 +1,179 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/config"
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/notify"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+// Files a restore drill expects in every backup of a Proxmox type
+var restoreDrillDefaultFiles = map[types.ProxmoxType][]string{
+	types.ProxmoxVE: {"/etc/pve/storage.cfg", "/etc/network/interfaces"},
+	types.ProxmoxBS: {"/etc/proxmox-backup/datastore.cfg", "/etc/network/interfaces"},
+}
+
+// RestoreDrillOptions configures a restore drill
+type RestoreDrillOptions struct {
+	// Storage is where the newest backup is taken from: primary (default),
+	// secondary or cloud
+	Storage string
+	// IdentityFile holds the test AGE identity that decrypts the backup
+	IdentityFile string
+	// WorkDir is where the throwaway directory is created (default: the
+	// system temporary directory)
+	WorkDir string
+	// ExpectedFiles must exist in the restored backup. Empty uses the key
+	// configuration files of the Proxmox type recorded in the manifest.
+	ExpectedFiles []string
+	// Keep leaves the restored files in place instead of removing them
+	Keep bool
+}
+
+// RunRestoreDrill restores the newest backup of a storage into a throwaway
+// directory and checks that the expected files were restored. Nothing on the
+// live system is touched. The report is always returned; its Error field is
+// set when the drill could not restore the backup.
+func RunRestoreDrill(ctx context.Context, cfg *config.Config, logger *logging.Logger, opts RestoreDrillOptions) *notify.RestoreDrillReport {
+	start := time.Now()
+	report := &notify.RestoreDrillReport{Storage: strings.ToLower(strings.TrimSpace(opts.Storage))}
+	if report.Storage == "" {
+		report.Storage = "primary"
+	}
+	if err := runRestoreDrill(ctx, cfg, logger, opts, report); err != nil {
+		report.Error = err.Error()
+	}
+	report.Duration = time.Since(start)
+	return report
+}
+
+func runRestoreDrill(ctx context.Context, cfg *config.Config, logger *logging.Logger, opts RestoreDrillOptions, report *notify.RestoreDrillReport) error {
+	if cfg == nil {
+		return fmt.Errorf("configuration not available")
+	}
+
+	var identities []age.Identity
+	if strings.TrimSpace(opts.IdentityFile) != "" {
+		loaded, err := loadIdentityFile(opts.IdentityFile)
+		if err != nil {
+			return err
+		}
+		identities = loaded
+	}
+
+	candidate, err := resolveRestoreSource(ctx, cfg, logger, "latest from "+report.Storage)
+	if err != nil {
+		return err
+	}
+	report.Backup = candidate.DisplayBase
+	report.Created = candidate.Manifest.CreatedAt
+	if strings.EqualFold(candidate.Manifest.EncryptionMode, "age") && len(identities) == 0 {
+		return fmt.Errorf("backup %s is encrypted and no test identity is configured (RESTORE_DRILL_IDENTITY_FILE)", candidate.DisplayBase)
+	}
+
+	source, err := prepareRestoreSource(ctx, nil, candidate, identities, logger)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if strings.TrimSpace(opts.WorkDir) != "" {
+		if err := os.MkdirAll(opts.WorkDir, 0o700); err != nil {
+			return fmt.Errorf("create drill work directory: %w", err)
+		}
+	}
+	dir, err := os.MkdirTemp(opts.WorkDir, "restore-drill-*")
+	if err != nil {
+		return fmt.Errorf("create drill directory: %w", err)
+	}
+	if opts.Keep {
+		logger.Info("Restore drill files kept in %s", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	if err := extractPlainArchive(ctx, source, dir, nil, nil, nil, logger); err != nil {
+		return err
+	}
+	if report.Files, err = countRestoredFiles(dir); err != nil {
+		return fmt.Errorf("inspect drill directory: %w", err)
+	}
+	if err := checkDrillContentIndex(ctx, candidate, dir, report, logger); err != nil {
+		return err
+	}
+
+	expected := opts.ExpectedFiles
+	if len(expected) == 0 {
+		expected = restoreDrillDefaultFiles[types.ProxmoxType(strings.ToLower(candidate.Manifest.ProxmoxType))]
+	}
+	for _, name := range expected {
+		clean := filepath.Clean("/" + strings.TrimSpace(name))
+		_, err := os.Lstat(filepath.Join(dir, clean))
+		report.Checks = append(report.Checks, notify.RestoreDrillCheck{Path: clean, Found: err == nil})
+		if err != nil {
+			logger.Warning("Restore drill: %s missing from %s", clean, candidate.DisplayBase)
+		}
+	}
+	return nil
+}
+
+// checkDrillContentIndex compares the restored files with the content index
+// of the backup: every regular file it lists must have been restored. Backups
+// written without an index are only counted.
+func checkDrillContentIndex(ctx context.Context, candidate *decryptCandidate, dir string, report *notify.RestoreDrillReport, logger *logging.Logger) error {
+	index, err := loadCandidateIndex(ctx, candidate)
+	if errors.Is(err, backup.ErrNoContentIndex) {
+		logger.Debug("Restore drill: %s has no content index, restored files not cross-checked", candidate.DisplayBase)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	report.IndexedFiles = index.Files()
+	missing := 0
+	first := ""
+	for _, entry := range index.Entries {
+		if entry.Type != backup.IndexTypeFile {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(entry.Path)))
+		if err == nil && info.Mode().IsRegular() {
+			continue
+		}
+		if missing == 0 {
+			first = entry.Path
+		}
+		missing++
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d of %d files listed in the content index were not restored (first: %s)", missing, report.IndexedFiles, first)
+	}
+	return nil
+}
+
+// countRestoredFiles counts everything below dir that is not a directory
+func countRestoredFiles(dir string) (int, error) {
+	count := 0
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,115 @@
+package orchestrator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+
+	"github.com/tis24dev/proxmox-backup/internal/config"
+)
+
+func TestRunRestoreDrill(t *testing.T) {
+	backups := t.TempDir()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "drill.key")
+	if err := os.WriteFile(keyFile, []byte(identity.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	archive := buildTestTar(t, map[string]string{
+		"etc/pve/storage.cfg":     "dir: local\n",
+		"etc/network/interfaces":  "auto lo\n",
+		"etc/pve/qemu-server/100": "cores: 2\n",
+	})
+	writeTestBundle(t, backups, "host-backup-20250101-010000.tar", time.Date(2025, 1, 1, 1, 0, 0, 0, time.UTC), archive, identity.Recipient())
+
+	cfg := &config.Config{BackupPath: backups}
+	workDir := t.TempDir()
+	ctx := context.Background()
+
+	report := RunRestoreDrill(ctx, cfg, newTestLogger(), RestoreDrillOptions{IdentityFile: keyFile, WorkDir: workDir})
+	if report.Error != "" {
+		t.Fatalf("drill failed: %s", report.Error)
+	}
+	if report.Storage != "primary" || report.Backup != "host-backup-20250101-010000.tar.age" || report.Files != 3 || report.IndexedFiles != 0 {
+		t.Errorf("report = %+v", report)
+	}
+	if len(report.Checks) != 2 || len(report.Missing()) != 0 {
+		t.Errorf("checks = %+v", report.Checks)
+	}
+	if entries, _ := os.ReadDir(workDir); len(entries) != 0 {
+		t.Errorf("drill directory was not removed: %v", entries)
+	}
+
+	report = RunRestoreDrill(ctx, cfg, newTestLogger(), RestoreDrillOptions{
+		IdentityFile:  keyFile,
+		WorkDir:       workDir,
+		ExpectedFiles: []string{"etc/network/interfaces", "/etc/proxmox-backup/datastore.cfg"},
+	})
+	if report.Error != "" {
+		t.Fatalf("drill failed: %s", report.Error)
+	}
+	if missing := report.Missing(); len(missing) != 1 || missing[0] != "/etc/proxmox-backup/datastore.cfg" {
+		t.Errorf("missing = %v", missing)
+	}
+
+	report = RunRestoreDrill(ctx, cfg, newTestLogger(), RestoreDrillOptions{WorkDir: workDir})
+	if !strings.Contains(report.Error, "no test identity") {
+		t.Errorf("encrypted backup without identity: error = %q", report.Error)
+	}
+
+	report = RunRestoreDrill(ctx, cfg, newTestLogger(), RestoreDrillOptions{Storage: "secondary"})
+	if report.Error == "" || report.Storage != "secondary" {
+		t.Errorf("unconfigured storage: %+v", report)
+	}
+}
+
+func TestRunRestoreDrillFailsOnIncompleteRestore(t *testing.T) {
+	ctx := context.Background()
+	files := map[string]string{
+		"etc/pve/storage.cfg":    "dir: local\n",
+		"etc/network/interfaces": "auto lo\n",
+	}
+
+	// Every file of the content index was restored
+	complete := t.TempDir()
+	bundle := writeTestBundle(t, complete, "host-backup-20250101-010000.tar", time.Date(2025, 1, 1, 1, 0, 0, 0, time.UTC), buildTestTar(t, files), nil)
+	addTestIndex(t, bundle, files)
+	report := RunRestoreDrill(ctx, &config.Config{BackupPath: complete}, newTestLogger(), RestoreDrillOptions{WorkDir: t.TempDir()})
+	if report.Error != "" || report.Files != 2 || report.IndexedFiles != 2 {
+		t.Errorf("complete backup: %+v", report)
+	}
+
+	// The index lists a file the archive does not hold
+	truncated := t.TempDir()
+	bundle = writeTestBundle(t, truncated, "host-backup-20250101-010000.tar", time.Date(2025, 1, 1, 1, 0, 0, 0, time.UTC), buildTestTar(t, files), nil)
+	addTestIndex(t, bundle, map[string]string{
+		"etc/pve/storage.cfg":     "dir: local\n",
+		"etc/network/interfaces":  "auto lo\n",
+		"etc/pve/qemu-server/100": "cores: 2\n",
+	})
+	report = RunRestoreDrill(ctx, &config.Config{BackupPath: truncated}, newTestLogger(), RestoreDrillOptions{WorkDir: t.TempDir()})
+	if !strings.Contains(report.Error, "1 of 3 files listed in the content index were not restored (first: /etc/pve/qemu-server/100)") {
+		t.Errorf("truncated backup: error = %q", report.Error)
+	}
+
+	// An entry that cannot be extracted fails the drill even though the
+	// expected files are there
+	broken := t.TempDir()
+	writeTestBundle(t, broken, "host-backup-20250101-010000.tar", time.Date(2025, 1, 1, 1, 0, 0, 0, time.UTC), buildTestTarEntries(t, []testArchiveEntry{
+		{Name: "etc/network/interfaces", Body: "auto lo\n"},
+		{Name: "etc/pve/storage.cfg", Body: "dir: local\n"},
+		{Name: "etc/pve/storage.cfg/nested", Body: "x"},
+	}), nil)
+	report = RunRestoreDrill(ctx, &config.Config{BackupPath: broken}, newTestLogger(), RestoreDrillOptions{WorkDir: t.TempDir()})
+	if !strings.Contains(report.Error, "1 archive entries could not be extracted") {
+		t.Errorf("broken archive: error = %q", report.Error)
+	}
+}
@@ -0,0 +1,272 @@
+package orchestrator
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// restoreCategory groups the archive paths written by one collector section
+type restoreCategory struct {
+	Name        string
+	Description string
+	// Patterns are archive-relative paths (directories match recursively)
+	// or path.Match globs when they contain wildcard characters.
+	Patterns []string
+}
+
+var restoreCategories = []restoreCategory{
+	{
+		Name:        "network",
+		Description: "Network interfaces, hostname, hosts and DNS resolver",
+		Patterns: []string{
+			"etc/network",
+			"etc/hostname",
+			"etc/hosts",
+			"etc/resolv.conf",
+		},
+	},
+	{
+		Name:        "pve-firewall",
+		Description: "Proxmox VE cluster, host and guest firewall rules",
+		Patterns: []string{
+			"etc/pve/firewall",
+			"etc/pve/nodes/*/host.fw",
+		},
+	},
+	{
+		Name:        "pbs-datastore",
+		Description: "Proxmox Backup Server datastore configuration",
+		Patterns: []string{
+			"etc/proxmox-backup/datastore.cfg",
+			"etc/proxmox-backup/prune.cfg",
+		},
+	},
+	{
+		Name:        "cron",
+		Description: "System and per-user cron definitions",
+		Patterns: []string{
+			"etc/crontab",
+			"etc/cron.d",
+			"etc/cron.daily",
+			"etc/cron.hourly",
+			"etc/cron.weekly",
+			"etc/cron.monthly",
+			"var/spool/cron/crontabs",
+		},
+	},
+	{
+		Name:        "ssh",
+		Description: "SSH daemon configuration, host keys and user keys",
+		Patterns: []string{
+			"etc/ssh",
+			"root/.ssh",
+			"home/*/.ssh",
+		},
+	},
+}
+
+// RestoreCategoryNames returns the category names accepted by selective restore
+func RestoreCategoryNames() []string {
+	names := make([]string, 0, len(restoreCategories))
+	for _, cat := range restoreCategories {
+		names = append(names, cat.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func findRestoreCategory(name string) (restoreCategory, bool) {
+	for _, cat := range restoreCategories {
+		if strings.EqualFold(cat.Name, name) {
+			return cat, true
+		}
+	}
+	return restoreCategory{}, false
+}
+
+// restoreFilter selects which archive entries are extracted. A nil filter
+// selects everything.
+type restoreFilter struct {
+	rules []restoreRule
+	// owns limits the filter to the entries one archive of an incremental
+	// chain restores
+	owns func(name string) bool
+}
+
+// restoreRule is one user selection (a path or a category) and its patterns
+type restoreRule struct {
+	label    string
+	patterns []string
+	hits     int
+}
+
+// newRestoreFilter builds a filter from absolute/relative paths and category
+// names. It returns nil when no selection was requested.
+func newRestoreFilter(paths, categories []string) (*restoreFilter, error) {
+	filter := &restoreFilter{}
+	for _, p := range paths {
+		clean := normalizeArchivePath(p)
+		if clean == "" {
+			return nil, fmt.Errorf("invalid restore path %q", p)
+		}
+		filter.rules = append(filter.rules, restoreRule{label: "/" + clean, patterns: []string{clean}})
+	}
+	for _, name := range categories {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		cat, ok := findRestoreCategory(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown restore category %q (valid: %s)", name, strings.Join(RestoreCategoryNames(), ", "))
+		}
+		filter.rules = append(filter.rules, restoreRule{label: "category " + cat.Name, patterns: cat.Patterns})
+	}
+	if len(filter.rules) == 0 {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+// Match reports whether the archive entry name is selected
+func (f *restoreFilter) Match(name string) bool {
+	if f == nil {
+		return true
+	}
+	clean := normalizeArchivePath(name)
+	if clean == "" || !f.restores(clean) {
+		return false
+	}
+	if len(f.rules) == 0 {
+		return true
+	}
+	matched := false
+	for i := range f.rules {
+		for _, pattern := range f.rules[i].patterns {
+			if matchArchivePattern(pattern, clean) {
+				f.rules[i].hits++
+				matched = true
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// Selects reports whether the archive entry name is selected without
+// counting it as a match
+func (f *restoreFilter) Selects(name string) bool {
+	if f == nil {
+		return true
+	}
+	clean := normalizeArchivePath(name)
+	if clean == "" || !f.restores(clean) {
+		return false
+	}
+	if len(f.rules) == 0 {
+		return true
+	}
+	for _, rule := range f.rules {
+		for _, pattern := range rule.patterns {
+			if matchArchivePattern(pattern, clean) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restores reports whether the archive the filter reads restores the
+// normalized entry name
+func (f *restoreFilter) restores(clean string) bool {
+	return f == nil || f.owns == nil || f.owns(clean)
+}
+
+// within restricts the filter to the entries owns accepts. The selection
+// matches are counted on f.
+func (f *restoreFilter) within(owns func(name string) bool) *restoreFilter {
+	if f == nil {
+		return &restoreFilter{owns: owns}
+	}
+	return &restoreFilter{rules: f.rules, owns: owns}
+}
+
+// Unmatched returns the selections that did not match any archive entry
+func (f *restoreFilter) Unmatched() []string {
+	if f == nil {
+		return nil
+	}
+	var missing []string
+	for _, rule := range f.rules {
+		if rule.hits == 0 {
+			missing = append(missing, rule.label)
+		}
+	}
+	return missing
+}
+
+// resetHits forgets the matches counted so far, so that every pass over
+// the archive counts them again from zero
+func (f *restoreFilter) resetHits() {
+	if f == nil {
+		return
+	}
+	for i := range f.rules {
+		f.rules[i].hits = 0
+	}
+}
+
+// checkMatched returns an error when no selection matched any archive entry
+func (f *restoreFilter) checkMatched() error {
+	if f != nil && len(f.rules) > 0 && len(f.Unmatched()) == len(f.rules) {
+		return fmt.Errorf("no archive entries matched the selection (%s)", f)
+	}
+	return nil
+}
+
+// String returns a human readable description of the selection
+func (f *restoreFilter) String() string {
+	if f == nil {
+		return "entire archive"
+	}
+	labels := make([]string, 0, len(f.rules))
+	for _, rule := range f.rules {
+		labels = append(labels, rule.label)
+	}
+	return strings.Join(labels, ", ")
+}
+
+// matchArchivePattern matches name against pattern or any of its parent
+// directories, so selecting a directory restores its whole subtree.
+func matchArchivePattern(pattern, name string) bool {
+	hasGlob := strings.ContainsAny(pattern, "*?[")
+	for candidate := name; candidate != "." && candidate != ""; candidate = path.Dir(candidate) {
+		if hasGlob {
+			if ok, _ := path.Match(pattern, candidate); ok {
+				return true
+			}
+		} else if candidate == pattern {
+			return true
+		}
+		if !strings.Contains(candidate, "/") {
+			break
+		}
+	}
+	return false
+}
+
+// normalizeArchivePath converts "/etc/x", "./etc/x" and "etc/x/" to "etc/x"
+func normalizeArchivePath(p string) string {
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return ""
+	}
+	clean := path.Clean("/" + p)
+	clean = strings.TrimPrefix(clean, "/")
+	if clean == "" || clean == "." {
+		return ""
+	}
+	return clean
+}
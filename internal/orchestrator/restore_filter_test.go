@@ -0,0 +1,101 @@
+package orchestrator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRestoreFilterMatch(t *testing.T) {
+	filter, err := newRestoreFilter(
+		[]string{"/etc/network/interfaces", "etc/pve/qemu-server/105.conf/", "/root/scripts"},
+		[]string{"SSH", "pve-firewall"},
+	)
+	if err != nil {
+		t.Fatalf("newRestoreFilter: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"etc/network/interfaces", true},
+		{"./etc/network/interfaces", true},
+		{"etc/network/interfaces.d/vmbr1", false},
+		{"etc/pve/qemu-server/105.conf", true},
+		{"etc/pve/qemu-server/1050.conf", false},
+		{"root/scripts/", true},
+		{"root/scripts/sync.sh", true},
+		{"root/scripts-old/sync.sh", false},
+		{"etc/ssh/sshd_config", true},
+		{"home/alice/.ssh/authorized_keys", true},
+		{"home/alice/.bashrc", false},
+		{"etc/pve/firewall/cluster.fw", true},
+		{"etc/pve/nodes/pve1/host.fw", true},
+		{"etc/pve/nodes/pve1/qemu-server/100.conf", false},
+		{"etc", false},
+		{"etc/hostname", false},
+	}
+	for _, tt := range tests {
+		if got := filter.Match(tt.name); got != tt.want {
+			t.Errorf("Match(%q) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if missing := filter.Unmatched(); len(missing) != 0 {
+		t.Errorf("Unmatched() = %v; want none", missing)
+	}
+}
+
+func TestRestoreFilterSelection(t *testing.T) {
+	filter, err := newRestoreFilter(nil, []string{"", " "})
+	if err != nil || filter != nil {
+		t.Fatalf("empty selection = %v, %v; want nil filter", filter, err)
+	}
+	if !filter.Match("etc/anything") {
+		t.Error("nil filter must select every entry")
+	}
+
+	if _, err := newRestoreFilter(nil, []string{"kernel"}); err == nil || !strings.Contains(err.Error(), "network") {
+		t.Errorf("unknown category error = %v; want list of valid categories", err)
+	}
+	if _, err := newRestoreFilter([]string{"/"}, nil); err == nil {
+		t.Error("expected error for root path selection")
+	}
+
+	filter, err = newRestoreFilter([]string{"/etc/missing.conf"}, []string{"cron"})
+	if err != nil {
+		t.Fatalf("newRestoreFilter: %v", err)
+	}
+	filter.Match("etc/cron.d/backup")
+	missing := filter.Unmatched()
+	if len(missing) != 1 || missing[0] != "/etc/missing.conf" {
+		t.Errorf("Unmatched() = %v; want [/etc/missing.conf]", missing)
+	}
+}
+
+func TestRestoreFilterResetHits(t *testing.T) {
+	filter, err := newRestoreFilter([]string{"/etc/hostname"}, nil)
+	if err != nil {
+		t.Fatalf("newRestoreFilter: %v", err)
+	}
+	filter.Match("etc/hostname")
+	filter.Match("etc/hostname")
+	if filter.rules[0].hits != 2 {
+		t.Fatalf("hits = %d; want 2", filter.rules[0].hits)
+	}
+
+	// A second pass over the archive counts from zero
+	filter.resetHits()
+	if err := filter.checkMatched(); err == nil {
+		t.Error("expected error when no selection matched after reset")
+	}
+	filter.Match("etc/hostname")
+	if filter.rules[0].hits != 1 || filter.checkMatched() != nil {
+		t.Errorf("hits = %d, checkMatched = %v; want 1, nil", filter.rules[0].hits, filter.checkMatched())
+	}
+	var none *restoreFilter
+	none.resetHits()
+	if err := none.checkMatched(); err != nil {
+		t.Errorf("nil filter checkMatched = %v", err)
+	}
+}
@@ -0,0 +1,705 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+)
+
+var chunkEntryPattern = regexp.MustCompile(`^(.+)\.(\d{3,})\.chunk$`)
+
+// readOptimizationManifest returns the optimization manifest stored in the
+// archive, or nil for backups taken without chunking/deduplication. The
+// archiver writes entries in lexical order, so the scan stops at the first
+// top-level entry sorting after the manifest. The result is kept on src, as
+// every pass over an encrypted source decrypts it again.
+func readOptimizationManifest(ctx context.Context, src *restoreSource) (*backup.OptimizationManifest, error) {
+	if src.optimizationsRead {
+		return src.optimizations, nil
+	}
+	reader, err := src.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	tarReader := tar.NewReader(reader)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read tar header: %w", err)
+		}
+		name := normalizeArchivePath(header.Name)
+		if name == backup.OptimizationManifestName {
+			manifest, err := backup.LoadOptimizationManifest(tarReader)
+			if err != nil {
+				return nil, err
+			}
+			src.optimizations = manifest
+			break
+		}
+		if top, _, _ := strings.Cut(name, "/"); top > backup.OptimizationManifestName {
+			break
+		}
+	}
+	src.optimizationsRead = true
+	return src.optimizations, nil
+}
+
+// chunkEntryOriginal maps "chunked_files/<path>.NNN.chunk" to <path> and the chunk index
+func chunkEntryOriginal(name string) (string, int, bool) {
+	rest, ok := strings.CutPrefix(name, backup.ChunkDirName+"/")
+	if !ok {
+		return "", 0, false
+	}
+	m := chunkEntryPattern.FindStringSubmatch(rest)
+	if m == nil {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(m[2])
+	if err != nil || index < 1 {
+		return "", 0, false
+	}
+	return m[1], index, true
+}
+
+// chunkedRestore tracks the reassembly of one chunked file
+type chunkedRestore struct {
+	path      string
+	record    *backup.OptimizedFile // nil for backups without manifest
+	marker    *tar.Header
+	selected  bool
+	output    string     // restore target, when selected
+	files     []*os.File // restore target and selected deduplicated copies
+	chunkSize int64      // size of the first chunk; every chunk but the last has it
+	received  map[int]bool
+}
+
+// optimizationRestorer undoes backup.ApplyOptimizations during extraction:
+// chunks are written into the original file as they are read, deduplicated
+// symlinks are replaced by a copy of their target, prefiltered files are
+// reversed, and every rebuilt file is verified against the manifest.
+// Content is only ever written to restore targets, never to a work directory.
+type optimizationRestorer struct {
+	destRoot     string
+	filter       *restoreFilter
+	remap        *restoreRemap
+	manifest     *backup.OptimizationManifest
+	logger       *logging.Logger
+	chunked      map[string]*chunkedRestore
+	duplicates   map[string]backup.OptimizedFile
+	prefiltered  map[string]backup.PrefilteredFile
+	dupsByTarget map[string][]string // dedup target -> selected copies
+	targets      map[string]string   // selected dedup target -> restored file
+	filled       map[string]bool     // copies written while their target was read
+	failures     int
+	differing    []string // restored files that differ from the original (prefilter not reversible)
+}
+
+func newOptimizationRestorer(manifest *backup.OptimizationManifest, destRoot string, filter *restoreFilter, remap *restoreRemap, logger *logging.Logger) *optimizationRestorer {
+	r := &optimizationRestorer{
+		destRoot:     destRoot,
+		filter:       filter,
+		remap:        remap,
+		manifest:     manifest,
+		logger:       logger,
+		chunked:      make(map[string]*chunkedRestore),
+		duplicates:   make(map[string]backup.OptimizedFile),
+		prefiltered:  make(map[string]backup.PrefilteredFile),
+		dupsByTarget: make(map[string][]string),
+		targets:      make(map[string]string),
+		filled:       make(map[string]bool),
+	}
+	if manifest == nil {
+		return r
+	}
+	for _, rec := range manifest.Prefiltered {
+		if filter.Selects(rec.Path) {
+			r.prefiltered[rec.Path] = rec
+		}
+	}
+	for _, rec := range manifest.Deduplicated {
+		if filter.Selects(rec.Path) {
+			r.duplicates[rec.Path] = rec
+			r.dupsByTarget[rec.Target] = append(r.dupsByTarget[rec.Target], rec.Path)
+		}
+	}
+	for i := range manifest.Chunked {
+		rec := &manifest.Chunked[i]
+		r.chunked[rec.Path] = &chunkedRestore{path: rec.Path, record: rec, selected: filter.Selects(rec.Path)}
+	}
+	return r
+}
+
+// chunk returns the reassembly state of path, creating it for backups
+// without manifest
+func (r *optimizationRestorer) chunk(path string) *chunkedRestore {
+	c, ok := r.chunked[path]
+	if !ok && r.manifest == nil {
+		c = &chunkedRestore{path: path, selected: r.filter.Selects(path)}
+		r.chunked[path] = c
+	}
+	return c
+}
+
+// needed reports whether selected deduplicated copies take their content from path
+func (r *optimizationRestorer) needed(path string) bool {
+	return len(r.dupsByTarget[path]) > 0
+}
+
+// intercept handles the archive entries created by the optimizations and
+// reports whether the entry was consumed
+func (r *optimizationRestorer) intercept(tarReader *tar.Reader, header *tar.Header) (bool, error) {
+	name := normalizeArchivePath(header.Name)
+
+	if name == backup.OptimizationManifestName {
+		return true, nil
+	}
+
+	if isChunkStorePath(name) {
+		orig, index, ok := chunkEntryOriginal(name)
+		if !ok || header.Typeflag != tar.TypeReg {
+			return true, nil
+		}
+		c := r.chunk(orig)
+		if c == nil {
+			r.logger.Warning("Chunk %s has no entry in the optimization manifest", name)
+			return true, nil
+		}
+		if !c.selected && !r.needed(orig) {
+			return true, nil
+		}
+		return true, r.addChunk(c, index, header.Size, tarReader)
+	}
+
+	if orig, ok := strings.CutSuffix(name, backup.ChunkMarkerSuffix); ok && header.Typeflag == tar.TypeReg && header.Size == 0 {
+		if c := r.chunk(orig); c != nil {
+			if r.filter.Match(orig) {
+				c.selected = true
+			}
+			c.marker = header
+			return true, nil
+		}
+	}
+
+	if _, ok := r.duplicates[name]; ok && header.Typeflag == tar.TypeSymlink {
+		r.filter.Match(name)
+		return true, nil
+	}
+
+	if r.needed(name) && header.Typeflag == tar.TypeReg {
+		if r.filter.Selects(name) {
+			target, err := r.targetPath(name)
+			if err != nil {
+				return false, err
+			}
+			r.targets[name] = target
+			return false, nil
+		}
+		// Not restored itself: its content goes straight into the copies
+		if err := r.fillDuplicates(name, tarReader); err != nil {
+			return true, fmt.Errorf("copy %s: %w", name, err)
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// fillDuplicates writes the content of a deduplication target that is not
+// restored into its selected copies
+func (r *optimizationRestorer) fillDuplicates(target string, src io.Reader) error {
+	files, err := r.openDuplicates(target)
+	if err != nil {
+		return err
+	}
+	writers := make([]io.Writer, len(files))
+	for i, f := range files {
+		writers[i] = f
+	}
+	_, err = io.Copy(io.MultiWriter(writers...), src)
+	for _, f := range files {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// openDuplicates creates the selected copies of target for writing
+func (r *optimizationRestorer) openDuplicates(target string) ([]*os.File, error) {
+	var files []*os.File
+	for _, dup := range r.dupsByTarget[target] {
+		f, err := r.createFile(dup)
+		if err != nil {
+			for _, opened := range files {
+				opened.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+		r.filled[dup] = true
+	}
+	return files, nil
+}
+
+// targetPath returns where the archive entry name is restored
+func (r *optimizationRestorer) targetPath(name string) (string, error) {
+	return restoreTargetPath(r.destRoot, r.remap.path(name))
+}
+
+// createFile replaces the restore target of name with an empty file
+func (r *optimizationRestorer) createFile(name string) (*os.File, error) {
+	target, err := r.targetPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return nil, fmt.Errorf("create parent directory: %w", err)
+	}
+	_ = os.Remove(target)
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("create %s: %w", name, err)
+	}
+	return f, nil
+}
+
+// addChunk writes the chunk at its offset in the output files. The first
+// chunk always sorts first in the archive and gives the chunk size; later
+// chunks may arrive out of order (index 1000 sorts before 101).
+func (r *optimizationRestorer) addChunk(c *chunkedRestore, index int, size int64, src io.Reader) error {
+	if c.files == nil {
+		if err := r.openChunkOutput(c); err != nil {
+			return err
+		}
+	}
+	switch {
+	case index == 1:
+		c.chunkSize = size
+	case c.chunkSize == 0:
+		return fmt.Errorf("chunk %d of %s precedes the first chunk", index, c.path)
+	case size > c.chunkSize:
+		return fmt.Errorf("chunk %d of %s is larger than the first chunk", index, c.path)
+	}
+
+	offset := int64(index-1) * c.chunkSize
+	writers := make([]io.Writer, len(c.files))
+	for i, f := range c.files {
+		writers[i] = io.NewOffsetWriter(f, offset)
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), src); err != nil {
+		return fmt.Errorf("write chunk %d of %s: %w", index, c.path, err)
+	}
+	if c.received == nil {
+		c.received = make(map[int]bool)
+	}
+	c.received[index] = true
+	return nil
+}
+
+// missingChunk returns the first chunk index not received, or 0
+func (c *chunkedRestore) missingChunk() int {
+	for i := 1; i <= len(c.received); i++ {
+		if !c.received[i] {
+			return i
+		}
+	}
+	return 0
+}
+
+// openChunkOutput opens the files the chunks are written to: the restore
+// target when selected, and the selected deduplicated copies of the file
+func (r *optimizationRestorer) openChunkOutput(c *chunkedRestore) error {
+	if c.selected {
+		f, err := r.createFile(c.path)
+		if err != nil {
+			return err
+		}
+		c.output = f.Name()
+		c.files = append(c.files, f)
+	}
+	dups, err := r.openDuplicates(c.path)
+	if err != nil {
+		return err
+	}
+	c.files = append(c.files, dups...)
+	return nil
+}
+
+// finalize completes the chunked files, materializes deduplicated copies
+// and verifies them. It returns an error when a file could not be rebuilt
+// identical to the original.
+func (r *optimizationRestorer) finalize() error {
+	paths := make([]string, 0, len(r.chunked))
+	for p := range r.chunked {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := r.finishChunked(r.chunked[p]); err != nil {
+			r.logger.Error("Failed to rebuild chunked file /%s: %v", p, err)
+			r.failures++
+		}
+	}
+
+	dups := make([]string, 0, len(r.duplicates))
+	for p := range r.duplicates {
+		dups = append(dups, p)
+	}
+	sort.Strings(dups)
+	for _, p := range dups {
+		if err := r.finishDuplicate(r.duplicates[p]); err != nil {
+			r.logger.Error("Failed to rebuild deduplicated file /%s: %v", p, err)
+			r.failures++
+		}
+	}
+
+	// Prefilter ran first at backup time, so it is undone last
+	filtered := make([]string, 0, len(r.prefiltered))
+	for p := range r.prefiltered {
+		filtered = append(filtered, p)
+	}
+	sort.Strings(filtered)
+	for _, p := range filtered {
+		if err := r.finishPrefiltered(r.prefiltered[p]); err != nil {
+			r.logger.Error("Failed to reverse prefilter on /%s: %v", p, err)
+			r.failures++
+		}
+	}
+	if len(r.differing) > 0 {
+		r.logger.Warning("%d restored files differ from the originals because their prefilter cannot be reversed: %s",
+			len(r.differing), strings.Join(r.differing, ", "))
+	}
+
+	if r.failures > 0 {
+		return fmt.Errorf("%d optimized files could not be restored identical to the original", r.failures)
+	}
+	return nil
+}
+
+// finishPrefiltered rewrites a restored prefiltered file with its original
+// content, or records it as differing when the transformation is lossy
+func (r *optimizationRestorer) finishPrefiltered(rec backup.PrefilteredFile) error {
+	target, err := r.targetPath(rec.Path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		return err
+	}
+	if !rec.Reversible {
+		r.differing = append(r.differing, fmt.Sprintf("/%s (%s)", rec.Path, rec.Transform))
+		return nil
+	}
+	original, err := backup.ReversePrefilter(data, rec)
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(target)
+	if err := os.WriteFile(target, original, 0o600); err != nil {
+		return err
+	}
+	applyOptimizedMetadata(target, rec.Mode, rec.UID, rec.GID, rec.ModTime, r.logger)
+	r.logger.Debug("Reversed %s on /%s (sha256 verified)", rec.Transform, rec.Path)
+	return nil
+}
+
+func (r *optimizationRestorer) finishChunked(c *chunkedRestore) error {
+	if c.files == nil {
+		switch {
+		case !c.selected && !r.needed(c.path):
+			return nil
+		case c.record == nil && c.marker != nil:
+			// No chunks and no manifest: an ordinary file named *.chunked
+			return r.restoreMarkerAsFile(c.marker)
+		case c.record == nil:
+			return nil
+		default:
+			return fmt.Errorf("no chunks found in the archive")
+		}
+	}
+	var closeErr error
+	for _, f := range c.files {
+		if err := f.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	c.files = nil
+	if closeErr != nil {
+		return closeErr
+	}
+	if missing := c.missingChunk(); missing > 0 {
+		return fmt.Errorf("chunk %d is missing", missing)
+	}
+	// Deduplicated copies are verified by finishDuplicate
+	if !c.selected {
+		return nil
+	}
+
+	if c.record == nil {
+		r.logger.Warning("Reassembled /%s from %d chunks (backup without optimization manifest: content not verified)", c.path, len(c.received))
+		if c.marker != nil {
+			applyOptimizedMetadata(c.output, uint32(c.marker.Mode), c.marker.Uid, c.marker.Gid, c.marker.ModTime, r.logger)
+		}
+		return nil
+	}
+	size, sum, err := fileSHA256(c.output)
+	if err != nil {
+		return err
+	}
+	if err := verifyOptimizedFile(*c.record, size, sum); err != nil {
+		return err
+	}
+	applyOptimizedMetadata(c.output, c.record.Mode, c.record.UID, c.record.GID, c.record.ModTime, r.logger)
+	r.logger.Debug("Reassembled /%s from %d chunks (%s, sha256 verified)", c.path, len(c.received), formatBytes(size))
+	return nil
+}
+
+func (r *optimizationRestorer) restoreMarkerAsFile(header *tar.Header) error {
+	target, err := r.targetPath(header.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(target, nil, os.FileMode(header.Mode).Perm()); err != nil {
+		return err
+	}
+	applyOptimizedMetadata(target, uint32(header.Mode), header.Uid, header.Gid, header.ModTime, r.logger)
+	return nil
+}
+
+func (r *optimizationRestorer) finishDuplicate(rec backup.OptimizedFile) error {
+	target, err := r.targetPath(rec.Path)
+	if err != nil {
+		return err
+	}
+	if r.filled[rec.Path] {
+		size, sum, err := fileSHA256(target)
+		if err != nil {
+			return err
+		}
+		if err := verifyOptimizedFile(rec, size, sum); err != nil {
+			return err
+		}
+		applyOptimizedMetadata(target, rec.Mode, rec.UID, rec.GID, rec.ModTime, r.logger)
+		r.logger.Debug("Restored /%s from deduplicated copy of /%s", rec.Path, rec.Target)
+		return nil
+	}
+
+	source := r.targets[rec.Target]
+	if source == "" {
+		return fmt.Errorf("content of /%s not found in the archive", rec.Target)
+	}
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := r.createFile(rec.Path)
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(out, hasher), in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := verifyOptimizedFile(rec, written, fmt.Sprintf("%x", hasher.Sum(nil))); err != nil {
+		return err
+	}
+	applyOptimizedMetadata(target, rec.Mode, rec.UID, rec.GID, rec.ModTime, r.logger)
+	r.logger.Debug("Restored /%s from deduplicated copy of /%s", rec.Path, rec.Target)
+	return nil
+}
+
+// Close releases the chunk outputs left open by a failed extraction
+func (r *optimizationRestorer) Close() {
+	for _, c := range r.chunked {
+		for _, f := range c.files {
+			f.Close()
+		}
+	}
+}
+
+// fileSHA256 returns the size and sha256 of a file
+func fileSHA256(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+func verifyOptimizedFile(rec backup.OptimizedFile, size int64, sum string) error {
+	if size != rec.Size {
+		return fmt.Errorf("size mismatch: rebuilt %d bytes, original %d bytes", size, rec.Size)
+	}
+	if sum != rec.SHA256 {
+		return fmt.Errorf("sha256 mismatch: rebuilt %s, original %s", sum, rec.SHA256)
+	}
+	return nil
+}
+
+func applyOptimizedMetadata(target string, mode uint32, uid, gid int, modTime time.Time, logger *logging.Logger) {
+	if err := os.Chown(target, uid, gid); err != nil {
+		logger.Debug("Failed to chown file %s: %v", target, err)
+	}
+	if err := os.Chmod(target, os.FileMode(mode).Perm()); err != nil {
+		logger.Debug("Failed to chmod file %s: %v", target, err)
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(target, modTime, modTime); err != nil {
+			logger.Debug("Failed to set timestamps on file %s: %v", target, err)
+		}
+	}
+}
+
+// optimizedPlanEntry describes an archive entry created by the optimizations
+// in terms of the original file, for the restore plan
+type optimizedPlanEntry struct {
+	name        string
+	record      *backup.OptimizedFile
+	size        int64
+	header      *tar.Header
+	passthrough bool   // the tar entry is restored as is
+	differs     string // prefilter transform that cannot be reversed
+}
+
+// optimizedPlanIndex maps optimization entries to the original files
+type optimizedPlanIndex struct {
+	manifest    *backup.OptimizationManifest
+	chunked     map[string]*backup.OptimizedFile
+	duplicates  map[string]*backup.OptimizedFile
+	prefiltered map[string]*backup.PrefilteredFile
+	chunkSizes  map[string]int64
+}
+
+func newOptimizedPlanIndex(manifest *backup.OptimizationManifest) *optimizedPlanIndex {
+	idx := &optimizedPlanIndex{
+		manifest:    manifest,
+		chunked:     make(map[string]*backup.OptimizedFile),
+		duplicates:  make(map[string]*backup.OptimizedFile),
+		prefiltered: make(map[string]*backup.PrefilteredFile),
+		chunkSizes:  make(map[string]int64),
+	}
+	if manifest != nil {
+		for i := range manifest.Chunked {
+			idx.chunked[manifest.Chunked[i].Path] = &manifest.Chunked[i]
+		}
+		for i := range manifest.Deduplicated {
+			idx.duplicates[manifest.Deduplicated[i].Path] = &manifest.Deduplicated[i]
+		}
+		for i := range manifest.Prefiltered {
+			idx.prefiltered[manifest.Prefiltered[i].Path] = &manifest.Prefiltered[i]
+		}
+	}
+	return idx
+}
+
+// resolve returns the original file an entry stands for. skip reports
+// entries that produce no file of their own.
+func (idx *optimizedPlanIndex) resolve(header *tar.Header) (entry *optimizedPlanEntry, skip bool) {
+	name := normalizeArchivePath(header.Name)
+	if name == backup.OptimizationManifestName {
+		return nil, true
+	}
+	if isChunkStorePath(name) {
+		if orig, _, ok := chunkEntryOriginal(name); ok && header.Typeflag == tar.TypeReg {
+			idx.chunkSizes[orig] += header.Size
+		}
+		return nil, true
+	}
+	if orig, ok := strings.CutSuffix(name, backup.ChunkMarkerSuffix); ok && header.Typeflag == tar.TypeReg && header.Size == 0 {
+		if rec, ok := idx.chunked[orig]; ok {
+			return idx.withPrefilter(&optimizedPlanEntry{name: orig, record: rec, size: rec.Size}), false
+		}
+		if size, ok := idx.chunkSizes[orig]; ok && idx.manifest == nil {
+			return &optimizedPlanEntry{name: orig, size: size, header: header}, false
+		}
+	}
+	if rec, ok := idx.duplicates[name]; ok && header.Typeflag == tar.TypeSymlink {
+		return idx.withPrefilter(&optimizedPlanEntry{name: name, record: rec, size: rec.Size}), false
+	}
+	if _, ok := idx.prefiltered[name]; ok && header.Typeflag == tar.TypeReg {
+		return idx.withPrefilter(&optimizedPlanEntry{name: name, passthrough: true}), false
+	}
+	return nil, false
+}
+
+// withPrefilter describes a prefiltered file by its original content when
+// restore can reverse the prefilter, or flags it as differing otherwise
+func (idx *optimizedPlanIndex) withPrefilter(entry *optimizedPlanEntry) *optimizedPlanEntry {
+	pf, ok := idx.prefiltered[entry.name]
+	if !ok {
+		return entry
+	}
+	if !pf.Reversible {
+		entry.differs = pf.Transform
+		return entry
+	}
+	return &optimizedPlanEntry{name: entry.name, record: &pf.OptimizedFile, size: pf.Size}
+}
+
+// planHeader returns a regular file header describing the original file
+func (e *optimizedPlanEntry) planHeader() *tar.Header {
+	h := &tar.Header{Name: e.name, Typeflag: tar.TypeReg, Size: e.size}
+	if e.record != nil {
+		h.Mode = int64(e.record.Mode)
+		h.Uid = e.record.UID
+		h.Gid = e.record.GID
+	} else if e.header != nil {
+		h.Mode = e.header.Mode
+		h.Uid = e.header.Uid
+		h.Gid = e.header.Gid
+	}
+	return h
+}
+
+// sameContent compares the original content with target using the
+// manifest hash; without manifest the content is assumed to differ
+func (e *optimizedPlanEntry) sameContent(target string) (bool, error) {
+	if e.record == nil {
+		return false, nil
+	}
+	_, sum, err := fileSHA256(target)
+	if err != nil {
+		return false, err
+	}
+	return sum == e.record.SHA256, nil
+}
+
+// isChunkStorePath reports whether the normalized name is inside the chunk directory
+func isChunkStorePath(name string) bool {
+	return name == backup.ChunkDirName || strings.HasPrefix(name, backup.ChunkDirName+"/")
+}
@@ -0,0 +1,192 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/config"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+// buildOptimizedArchive runs the backup optimizations on files and returns
+// the tar archive the archiver produces from the result
+func buildOptimizedArchive(t *testing.T, files map[string][]byte, cfg backup.OptimizationConfig) []byte {
+	t.Helper()
+	source := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(source, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := backup.ApplyOptimizations(context.Background(), newTestLogger(), source, cfg); err != nil {
+		t.Fatalf("ApplyOptimizations: %v", err)
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "backup.tar")
+	archiver := backup.NewArchiver(newTestLogger(), &backup.ArchiverConfig{Compression: types.CompressionNone})
+	if err := archiver.CreateArchive(context.Background(), source, archivePath); err != nil {
+		t.Fatalf("CreateArchive: %v", err)
+	}
+	data, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRestoreRebuildsOptimizedFiles(t *testing.T) {
+	large := bytes.Repeat([]byte("proxmox backup chunk\n"), 200)
+	dup := []byte("ssh-ed25519 AAAA root@pve1\n")
+	files := map[string][]byte{
+		"var/lib/pve-cluster/config.db": large,
+		"root/.ssh/authorized_keys":     dup,
+		"etc/pve/priv/authorized_keys":  dup,
+		"etc/hostname":                  []byte("pve1\n"),
+	}
+	archive := buildOptimizedArchive(t, files, backup.OptimizationConfig{
+		EnableChunking:      true,
+		EnableDeduplication: true,
+		ChunkSizeBytes:      700,
+		ChunkThresholdBytes: 1000,
+	})
+
+	backupDir := t.TempDir()
+	writeTestBundle(t, backupDir, "pve1-backup-20250101-010000.tar", time.Now(), archive, nil)
+	cfg := &config.Config{BackupPath: backupDir}
+
+	target := t.TempDir()
+	var plan bytes.Buffer
+	opts := RestoreOptions{Source: "latest", TargetRoot: target, AssumeYes: true, DryRun: true, PlanJSON: true, Output: &plan}
+	if err := RunRestoreWorkflow(context.Background(), cfg, newTestLogger(), "test", opts); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	for _, want := range []string{`"path": "/var/lib/pve-cluster/config.db"`, `"size": 4200`} {
+		if !strings.Contains(plan.String(), want) {
+			t.Errorf("plan lacks %s:\n%s", want, plan.String())
+		}
+	}
+	for _, unwanted := range []string{backup.ChunkDirName, backup.ChunkMarkerSuffix, backup.OptimizationManifestName} {
+		if strings.Contains(plan.String(), unwanted) {
+			t.Errorf("plan exposes optimization entry %q", unwanted)
+		}
+	}
+
+	opts = RestoreOptions{Source: "latest", TargetRoot: target, AssumeYes: true}
+	if err := RunRestoreWorkflow(context.Background(), cfg, newTestLogger(), "test", opts); err != nil {
+		t.Fatalf("RunRestoreWorkflow: %v", err)
+	}
+	for name, data := range files {
+		path := filepath.Join(target, name)
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm() != 0o600 {
+			t.Errorf("%s restored as %v; want regular file 0600", name, info.Mode())
+		}
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+			t.Errorf("%s differs from the original", name)
+		}
+	}
+	for _, leftover := range []string{backup.ChunkDirName, backup.OptimizationManifestName, "var/lib/pve-cluster/config.db" + backup.ChunkMarkerSuffix} {
+		if _, err := os.Lstat(filepath.Join(target, leftover)); !os.IsNotExist(err) {
+			t.Errorf("%s left in the restore target (err=%v)", leftover, err)
+		}
+	}
+
+	// Selecting only the duplicate still needs the content of its unselected target
+	selective := t.TempDir()
+	opts = RestoreOptions{Source: "latest", TargetRoot: selective, AssumeYes: true, Paths: []string{"/root/.ssh/authorized_keys"}}
+	if err := RunRestoreWorkflow(context.Background(), cfg, newTestLogger(), "test", opts); err != nil {
+		t.Fatalf("selective restore: %v", err)
+	}
+	if got := readTestFile(t, filepath.Join(selective, "root/.ssh/authorized_keys")); got != string(dup) {
+		t.Errorf("selected duplicate = %q", got)
+	}
+	if _, err := os.Lstat(filepath.Join(selective, "etc")); !os.IsNotExist(err) {
+		t.Errorf("unselected dedup target restored (err=%v)", err)
+	}
+}
+
+func TestRestoreRejectsCorruptedChunks(t *testing.T) {
+	manifest := `{"chunked":[{"path":"var/lib/big.db","size":6,"sha256":"` + strings.Repeat("0", 64) + `","mode":384,"uid":0,"gid":0,"mod_time":"2025-01-01T00:00:00Z"}]}`
+	archive := buildTestTarEntries(t, []testArchiveEntry{
+		{Name: "./" + backup.OptimizationManifestName, Body: manifest},
+		{Name: "./chunked_files/var/lib/big.db.001.chunk", Body: "abc"},
+		{Name: "./chunked_files/var/lib/big.db.002.chunk", Body: "def"},
+		{Name: "./var/", Type: tar.TypeDir, Mode: 0o755},
+		{Name: "./var/lib/", Type: tar.TypeDir, Mode: 0o755},
+		{Name: "./var/lib/big.db.chunked"},
+	})
+	archivePath := filepath.Join(t.TempDir(), "backup.tar")
+	if err := os.WriteFile(archivePath, archive, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := extractArchiveNative(context.Background(), localArchiveSource(archivePath), t.TempDir(), nil, nil, nil, newTestLogger())
+	if err == nil || !strings.Contains(err.Error(), "could not be restored identical") {
+		t.Fatalf("extractArchiveNative error = %v; want verification failure", err)
+	}
+}
+
+func TestRestoreReversesPrefilter(t *testing.T) {
+	conf := "# storage defaults\n  tmpdir: /var/tmp\nbwlimit: 0\n"
+	jsonDoc := "{\n  \"version\": 1\n}\n"
+	files := map[string][]byte{
+		"etc/vzdump.conf":         []byte(conf),
+		"etc/pve/local/copy.conf": []byte(conf),
+		"etc/pve/.members.json":   []byte(jsonDoc),
+	}
+	archive := buildOptimizedArchive(t, files, backup.OptimizationConfig{EnablePrefilter: true, EnableDeduplication: true})
+
+	backupDir := t.TempDir()
+	writeTestBundle(t, backupDir, "pve1-backup-20250101-010000.tar", time.Now(), archive, nil)
+	cfg := &config.Config{BackupPath: backupDir}
+	target := t.TempDir()
+
+	var plan bytes.Buffer
+	opts := RestoreOptions{Source: "latest", TargetRoot: target, DryRun: true, Output: &plan}
+	if err := RunRestoreWorkflow(context.Background(), cfg, newTestLogger(), "test", opts); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if !strings.Contains(plan.String(), "1 files will differ from the originals") ||
+		!strings.Contains(plan.String(), "/etc/pve/.members.json (minify-json)") {
+		t.Errorf("plan does not report the irreversible prefilter:\n%s", plan.String())
+	}
+
+	opts = RestoreOptions{Source: "latest", TargetRoot: target, AssumeYes: true}
+	if err := RunRestoreWorkflow(context.Background(), cfg, newTestLogger(), "test", opts); err != nil {
+		t.Fatalf("RunRestoreWorkflow: %v", err)
+	}
+	for _, name := range []string{"etc/vzdump.conf", "etc/pve/local/copy.conf"} {
+		if got := readTestFile(t, filepath.Join(target, name)); got != conf {
+			t.Errorf("%s = %q; want the original %q", name, got, conf)
+		}
+	}
+	if got := readTestFile(t, filepath.Join(target, "etc/pve/.members.json")); got != `{"version":1}` {
+		t.Errorf(".members.json = %q; want the minified content", got)
+	}
+
+	// Planning against the restored originals finds nothing to change
+	plan.Reset()
+	opts = RestoreOptions{Source: "latest", TargetRoot: target, DryRun: true, PlanJSON: true, Output: &plan}
+	if err := RunRestoreWorkflow(context.Background(), cfg, newTestLogger(), "test", opts); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if strings.Contains(plan.String(), `"action": "overwrite"`) {
+		t.Errorf("restored prefiltered files planned for overwrite:\n%s", plan.String())
+	}
+}
@@ -0,0 +1,407 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// restorePlanAction describes what extracting an entry does to the destination
+type restorePlanAction string
+
+const (
+	planCreate           restorePlanAction = "create"
+	planOverwrite        restorePlanAction = "overwrite"
+	planReplaceSymlink   restorePlanAction = "replace-symlink"
+	planReplaceDirectory restorePlanAction = "replace-directory"
+	planMetadata         restorePlanAction = "permissions"
+	planUnchanged        restorePlanAction = "unchanged"
+)
+
+// restorePlanActions lists the actions in report order
+var restorePlanActions = []restorePlanAction{
+	planCreate,
+	planOverwrite,
+	planReplaceSymlink,
+	planReplaceDirectory,
+	planMetadata,
+	planUnchanged,
+}
+
+type restorePlanEntry struct {
+	Path         string            `json:"path"`
+	Action       restorePlanAction `json:"action"`
+	Type         string            `json:"type"`
+	Size         int64             `json:"size"`
+	CurrentSize  *int64            `json:"current_size,omitempty"`
+	Mode         string            `json:"mode"`
+	CurrentMode  string            `json:"current_mode,omitempty"`
+	Owner        string            `json:"owner"`
+	CurrentOwner string            `json:"current_owner,omitempty"`
+	CurrentType  string            `json:"current_type,omitempty"`
+	LinkTarget   string            `json:"link_target,omitempty"`
+	// DiffersFromOriginal names the backup prefilter that altered the content irreversibly
+	DiffersFromOriginal string `json:"differs_from_original,omitempty"`
+	// Source is the path in the backup when a cross-host restore renames the entry
+	Source string `json:"source,omitempty"`
+	// Remapped is set when the content is rewritten for the new host
+	Remapped bool `json:"remapped,omitempty"`
+}
+
+type restorePlan struct {
+	Backup    string                    `json:"backup"`
+	Target    string                    `json:"target"`
+	Selection string                    `json:"selection"`
+	Summary   map[restorePlanAction]int `json:"summary"`
+	Differing int                       `json:"differing"`
+	Entries   []restorePlanEntry        `json:"entries"`
+	// Services are the service actions run around the extraction
+	Services []serviceStep `json:"services,omitempty"`
+	// Excluded counts the selected entries the PVE config restore leaves
+	// out, by reason
+	Excluded map[string]int `json:"excluded,omitempty"`
+	// Remap lists the hostname, address and interface mappings of a
+	// cross-host restore
+	Remap []string `json:"remap,omitempty"`
+}
+
+// buildRestorePlan reads the archive and classifies every entry that
+// extraction into destRoot would write, without touching the destination.
+// pve is nil unless /etc/pve is restored on the live system; remap is nil
+// unless the backup is restored onto another host.
+func buildRestorePlan(ctx context.Context, src *restoreSource, destRoot string, filter *restoreFilter, pve *pveRestore, remap *restoreRemap) (*restorePlan, error) {
+	plan := &restorePlan{
+		Target:    destRoot,
+		Selection: filter.String(),
+		Summary:   make(map[restorePlanAction]int),
+		Entries:   []restorePlanEntry{},
+		Excluded:  make(map[string]int),
+		Remap:     remap.describe(),
+	}
+	filter.resetHits()
+	for _, pass := range src.passes(filter) {
+		if err := planArchivePass(ctx, pass.src, plan, destRoot, pass.filter, pve, remap); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// planArchivePass adds the entries of one archive that filter selects to plan
+func planArchivePass(ctx context.Context, src *restoreSource, plan *restorePlan, destRoot string, filter *restoreFilter, pve *pveRestore, remap *restoreRemap) error {
+	reader, err := src.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	compareOwner := os.Geteuid() == 0
+
+	manifest, err := readOptimizationManifest(ctx, src)
+	if err != nil {
+		return fmt.Errorf("read optimization manifest: %w", err)
+	}
+	optimized := newOptimizedPlanIndex(manifest)
+
+	tarReader := tar.NewReader(reader)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read tar header: %w", err)
+		}
+		sameContent := sameContentAsFile
+		original, skip := optimized.resolve(header)
+		if skip {
+			continue
+		}
+		if original != nil && !original.passthrough {
+			header = original.planHeader()
+			sameContent = func(_ io.Reader, target string) (bool, error) { return original.sameContent(target) }
+		}
+		if !filter.Match(header.Name) {
+			continue
+		}
+		archiveName := header.Name
+		header = remap.rename(header)
+		if reason := pve.planEntry(header); reason != "" {
+			plan.Excluded[reason]++
+			continue
+		}
+		entryType := tarEntryType(header.Typeflag)
+		if entryType == "" {
+			continue
+		}
+		target, err := restoreTargetPath(destRoot, header.Name)
+		if err != nil {
+			return fmt.Errorf("plan %s: %w", header.Name, err)
+		}
+
+		var content io.Reader = tarReader
+		remapped := false
+		if (original == nil || original.passthrough) && header.Typeflag == tar.TypeReg &&
+			remap.rewrites(header.Name) && header.Size <= remapMaxFileSize {
+			data, err := io.ReadAll(tarReader)
+			if err != nil {
+				return fmt.Errorf("read %s: %w", header.Name, err)
+			}
+			rewritten, n := remap.rewrite(header.Name, data)
+			if n > 0 {
+				remapped = true
+				resized := *header
+				resized.Size = int64(len(rewritten))
+				header = &resized
+			}
+			content = bytes.NewReader(rewritten)
+		}
+
+		entry, err := planTarEntry(content, header, target, entryType, compareOwner, sameContent)
+		if err != nil {
+			return fmt.Errorf("plan %s: %w", header.Name, err)
+		}
+		entry.Source = remapSourcePath(archiveName, header.Name)
+		entry.Remapped = remapped
+		if rel, err := filepath.Rel(destRoot, target); err == nil {
+			entry.Path = filepath.Join("/", rel)
+		}
+		if original != nil && original.differs != "" {
+			entry.DiffersFromOriginal = original.differs
+			plan.Differing++
+		}
+		plan.Summary[entry.Action]++
+		plan.Entries = append(plan.Entries, entry)
+	}
+
+	// Read past the tar trailer so decryption and decompression check the
+	// integrity of the whole stream
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return fmt.Errorf("read archive: %w", err)
+	}
+	return nil
+}
+
+// planTarEntry compares one tar entry with the current state of target.
+// sameContent compares the entry content with an existing regular file.
+func planTarEntry(tarReader io.Reader, header *tar.Header, target, entryType string, compareOwner bool, sameContent func(io.Reader, string) (bool, error)) (restorePlanEntry, error) {
+	entry := restorePlanEntry{
+		Type:       entryType,
+		Size:       header.Size,
+		Mode:       fmt.Sprintf("%04o", os.FileMode(header.Mode).Perm()),
+		Owner:      fmt.Sprintf("%d:%d", header.Uid, header.Gid),
+		LinkTarget: header.Linkname,
+	}
+
+	current, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		entry.Action = planCreate
+		return entry, nil
+	}
+	if err != nil {
+		return entry, err
+	}
+
+	currentSize := current.Size()
+	entry.CurrentSize = &currentSize
+	entry.CurrentType = describeFileType(current)
+	if current.Mode()&os.ModeSymlink == 0 {
+		entry.CurrentMode = fmt.Sprintf("%04o", current.Mode().Perm())
+	}
+	if st, ok := current.Sys().(*syscall.Stat_t); ok && compareOwner {
+		entry.CurrentOwner = fmt.Sprintf("%d:%d", st.Uid, st.Gid)
+	}
+	metadataDiffers := entry.CurrentMode != entry.Mode || (entry.CurrentOwner != "" && entry.CurrentOwner != entry.Owner)
+
+	switch {
+	case current.Mode()&os.ModeSymlink != 0:
+		entry.Action = planReplaceSymlink
+		if header.Typeflag == tar.TypeSymlink {
+			if link, err := os.Readlink(target); err == nil && link == header.Linkname {
+				entry.Action = planUnchanged
+			}
+		}
+	case current.IsDir() && header.Typeflag != tar.TypeDir:
+		entry.Action = planReplaceDirectory
+	case header.Typeflag == tar.TypeDir:
+		entry.Action = planUnchanged
+		if !current.IsDir() {
+			entry.Action = planOverwrite
+		} else if metadataDiffers {
+			entry.Action = planMetadata
+		}
+	case header.Typeflag == tar.TypeReg && current.Mode().IsRegular():
+		same := false
+		if current.Size() == header.Size {
+			same, err = sameContent(tarReader, target)
+			if err != nil {
+				return entry, err
+			}
+		}
+		switch {
+		case !same:
+			entry.Action = planOverwrite
+		case metadataDiffers:
+			entry.Action = planMetadata
+		default:
+			entry.Action = planUnchanged
+		}
+	default:
+		entry.Action = planOverwrite
+	}
+	return entry, nil
+}
+
+// sameContentAsFile compares the tar entry content with an existing file
+func sameContentAsFile(r io.Reader, path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	entryHash := sha256.New()
+	if _, err := io.Copy(entryHash, r); err != nil {
+		return false, err
+	}
+	fileHash := sha256.New()
+	if _, err := io.Copy(fileHash, f); err != nil {
+		return false, err
+	}
+	return string(entryHash.Sum(nil)) == string(fileHash.Sum(nil)), nil
+}
+
+// tarEntryType returns the plan type for the entry kinds extraction supports
+func tarEntryType(flag byte) string {
+	switch flag {
+	case tar.TypeDir:
+		return "directory"
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	default:
+		return ""
+	}
+}
+
+// writeRestorePlan prints the plan grouped by action
+func writeRestorePlan(w io.Writer, plan *restorePlan) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Restore plan for %s into %s (%s): %d entries\n", plan.Backup, plan.Target, plan.Selection, len(plan.Entries))
+	var counts []string
+	for _, action := range restorePlanActions {
+		if n := plan.Summary[action]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%s: %d", action, n))
+		}
+	}
+	if len(counts) > 0 {
+		fmt.Fprintf(&sb, "  %s\n", strings.Join(counts, ", "))
+	}
+	if plan.Differing > 0 {
+		fmt.Fprintf(&sb, "  %d files will differ from the originals (backup prefilter not reversible):\n", plan.Differing)
+		for _, e := range plan.Entries {
+			if e.DiffersFromOriginal != "" {
+				fmt.Fprintf(&sb, "    %s (%s)\n", e.Path, e.DiffersFromOriginal)
+			}
+		}
+	}
+
+	if len(plan.Remap) > 0 {
+		renamed, rewritten := 0, 0
+		for _, e := range plan.Entries {
+			if e.Source != "" {
+				renamed++
+			}
+			if e.Remapped {
+				rewritten++
+			}
+		}
+		fmt.Fprintf(&sb, "  Cross-host restore (%s): %d paths renamed, %d files rewritten\n",
+			strings.Join(plan.Remap, ", "), renamed, rewritten)
+	}
+
+	if len(plan.Excluded) > 0 {
+		reasons := make([]string, 0, len(plan.Excluded))
+		for reason := range plan.Excluded {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		sb.WriteString("  Entries left out by the PVE config restore:\n")
+		for _, reason := range reasons {
+			fmt.Fprintf(&sb, "    %d: %s\n", plan.Excluded[reason], reason)
+		}
+	}
+
+	for _, action := range restorePlanActions {
+		if plan.Summary[action] == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "\n%s (%d):\n", action, plan.Summary[action])
+		for _, e := range plan.Entries {
+			if e.Action == action {
+				fmt.Fprintf(&sb, "  %s\n", describePlanEntry(e))
+			}
+		}
+	}
+	if len(plan.Services) > 0 {
+		writeServicePlan(&sb, plan.Services)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func describePlanEntry(e restorePlanEntry) string {
+	parts := []string{e.Path, e.Type}
+	if e.Type == "symlink" || e.Type == "hardlink" {
+		parts = append(parts, "-> "+e.LinkTarget)
+	}
+	if e.Type == "file" {
+		if e.CurrentSize != nil && *e.CurrentSize != e.Size && e.CurrentType == "file" {
+			parts = append(parts, fmt.Sprintf("size %s -> %s", formatBytes(*e.CurrentSize), formatBytes(e.Size)))
+		} else {
+			parts = append(parts, formatBytes(e.Size))
+		}
+	}
+	if e.CurrentMode != "" && e.CurrentMode != e.Mode {
+		parts = append(parts, fmt.Sprintf("mode %s -> %s", e.CurrentMode, e.Mode))
+	} else {
+		parts = append(parts, "mode "+e.Mode)
+	}
+	if e.CurrentOwner != "" && e.CurrentOwner != e.Owner {
+		parts = append(parts, fmt.Sprintf("owner %s -> %s", e.CurrentOwner, e.Owner))
+	}
+	if e.CurrentType != "" && e.CurrentType != e.Type && !(e.Type == "hardlink" && e.CurrentType == "file") {
+		parts = append(parts, "replaces "+e.CurrentType)
+	}
+	if e.DiffersFromOriginal != "" {
+		parts = append(parts, "differs from original ("+e.DiffersFromOriginal+")")
+	}
+	if e.Source != "" {
+		parts = append(parts, "from "+e.Source)
+	}
+	if e.Remapped {
+		parts = append(parts, "remapped for new host")
+	}
+	return strings.Join(parts, "  ")
+}
+
+func writeRestorePlanJSON(w io.Writer, plan *restorePlan) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plan)
+}
@@ -0,0 +1,141 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildRestorePlan(t *testing.T) {
+	dest := t.TempDir()
+	archivePath := filepath.Join(t.TempDir(), "backup.tar")
+	archive := buildTestTarEntries(t, []testArchiveEntry{
+		{Name: "etc/", Type: tar.TypeDir},
+		{Name: "etc/new.conf", Body: "new\n"},
+		{Name: "etc/hosts", Body: "127.0.0.1 pve1\n", Mode: 0o644},
+		{Name: "etc/same.conf", Body: "same\n", Mode: 0o644},
+		{Name: "etc/mode.conf", Body: "mode\n", Mode: 0o600},
+		{Name: "etc/link.conf", Body: "was a link\n", Mode: 0o644},
+		{Name: "etc/dir.conf", Body: "was a dir\n", Mode: 0o644},
+		{Name: "etc/localtime", Type: tar.TypeSymlink, Linkname: "/usr/share/zoneinfo/UTC"},
+	})
+	if err := os.WriteFile(archivePath, archive, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	etc := filepath.Join(dest, "etc")
+	mustWrite := func(name, content string, mode os.FileMode) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(etc, name), []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(filepath.Join(etc, name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(etc, "dir.conf"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(etc, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mustWrite("hosts", "127.0.0.1 localhost\n", 0o644)
+	mustWrite("same.conf", "same\n", 0o644)
+	mustWrite("mode.conf", "mode\n", 0o644)
+	if err := os.Symlink("hosts", filepath.Join(etc, "link.conf")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/usr/share/zoneinfo/UTC", filepath.Join(etc, "localtime")); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := buildRestorePlan(context.Background(), localArchiveSource(archivePath), dest, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("buildRestorePlan: %v", err)
+	}
+
+	got := make(map[string]restorePlanEntry)
+	for _, e := range plan.Entries {
+		got[e.Path] = e
+	}
+	expect := map[string]restorePlanAction{
+		"/etc":           planUnchanged,
+		"/etc/new.conf":  planCreate,
+		"/etc/hosts":     planOverwrite,
+		"/etc/same.conf": planUnchanged,
+		"/etc/mode.conf": planMetadata,
+		"/etc/link.conf": planReplaceSymlink,
+		"/etc/dir.conf":  planReplaceDirectory,
+		"/etc/localtime": planUnchanged,
+	}
+	if len(plan.Entries) != len(expect) {
+		t.Errorf("plan has %d entries; want %d", len(plan.Entries), len(expect))
+	}
+	for path, action := range expect {
+		if got[path].Action != action {
+			t.Errorf("%s: action %q; want %q", path, got[path].Action, action)
+		}
+	}
+
+	if e := got["/etc/mode.conf"]; e.CurrentMode != "0644" || e.Mode != "0600" {
+		t.Errorf("mode change not recorded: %+v", e)
+	}
+	if e := got["/etc/hosts"]; e.CurrentSize == nil || *e.CurrentSize != int64(len("127.0.0.1 localhost\n")) {
+		t.Errorf("current size not recorded: %+v", e)
+	}
+
+	var out strings.Builder
+	if err := writeRestorePlan(&out, plan); err != nil {
+		t.Fatalf("writeRestorePlan: %v", err)
+	}
+	for _, want := range []string{"create (1):", "replace-symlink (1):", "/etc/mode.conf  file  5 B  mode 0644 -> 0600", "size 20 B -> 15 B"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("plan output lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	// The destination must not be modified by planning
+	if data, _ := os.ReadFile(filepath.Join(etc, "hosts")); string(data) != "127.0.0.1 localhost\n" {
+		t.Errorf("planning modified destination: %q", data)
+	}
+}
+
+func TestBuildRestorePlanAtRoot(t *testing.T) {
+	// Planning only reads the destination, so the live root can be used
+	archivePath := filepath.Join(t.TempDir(), "backup.tar")
+	archive := buildTestTarEntries(t, []testArchiveEntry{
+		{Name: "./etc/", Type: tar.TypeDir},
+		{Name: "./etc/proxmox-backup-plan-test.conf", Body: "new\n"},
+	})
+	if err := os.WriteFile(archivePath, archive, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := buildRestorePlan(context.Background(), localArchiveSource(archivePath), "/", nil, nil, nil)
+	if err != nil {
+		t.Fatalf("buildRestorePlan: %v", err)
+	}
+	if len(plan.Entries) != 2 {
+		t.Fatalf("plan at / has %d entries; want 2: %+v", len(plan.Entries), plan.Entries)
+	}
+	if e := plan.Entries[1]; e.Path != "/etc/proxmox-backup-plan-test.conf" || e.Action != planCreate {
+		t.Errorf("entry = %+v; want create of /etc/proxmox-backup-plan-test.conf", e)
+	}
+}
+
+func TestBuildRestorePlanRejectsEscapingEntries(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "backup.tar")
+	archive := buildTestTarEntries(t, []testArchiveEntry{
+		{Name: "etc/hosts", Body: "127.0.0.1 localhost\n"},
+		{Name: "../escape.conf", Body: "x\n"},
+	})
+	if err := os.WriteFile(archivePath, archive, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := buildRestorePlan(context.Background(), localArchiveSource(archivePath), t.TempDir(), nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "illegal path") {
+		t.Errorf("buildRestorePlan err = %v; want illegal path", err)
+	}
+}
@@ -0,0 +1,375 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+)
+
+// PVE config restore modes (restore --pve-mode)
+const (
+	// PVERestoreFiles writes guest, storage and cluster-wide configs through
+	// the mounted /etc/pve while the cluster filesystem is running
+	PVERestoreFiles = "files"
+	// PVERestoreDatabase writes config.db back with pve-cluster stopped
+	PVERestoreDatabase = "database"
+)
+
+const (
+	pveConfigDir   = "etc/pve"
+	pveClusterDir  = "var/lib/pve-cluster"
+	pveDatabase    = "var/lib/pve-cluster/config.db"
+	pveVersionFile = "etc/pve/.version" // only exists while pmxcfs is mounted
+)
+
+// pveIdentityFiles tie a node to its cluster and are never written through
+// /etc/pve: restoring them from another point in time breaks corosync
+// authentication or the cluster certificates
+var pveIdentityFiles = []string{
+	"etc/pve/corosync.conf",
+	"etc/pve/authkey.pub",
+	"etc/pve/authkey.pub.old",
+	"etc/pve/priv/authkey.key",
+	"etc/pve/pve-root-ca.pem",
+	"etc/pve/priv/pve-root-ca.key",
+	"etc/pve/priv/pve-root-ca.srl",
+	"etc/pve/nodes/*/pve-ssl.pem",
+	"etc/pve/nodes/*/pve-ssl.key",
+}
+
+// RestorePVEModes returns the accepted --pve-mode values
+func RestorePVEModes() []string {
+	return []string{PVERestoreFiles, PVERestoreDatabase}
+}
+
+// clusterState describes the cluster membership of the live node
+type clusterState struct {
+	Clustered bool
+	Name      string
+	Nodes     int
+	Quorate   bool
+	LocalNode string
+	// Running is set while pve-cluster (pmxcfs) is active
+	Running bool
+	// Members are the node directories below /etc/pve/nodes
+	Members []string
+	// err is set when membership or quorum could not be determined
+	err error
+}
+
+// detectClusterState reads the cluster membership of the node rooted at root
+func detectClusterState(ctx context.Context, root string) clusterState {
+	var state clusterState
+	for _, conf := range []string{"etc/corosync/corosync.conf", "etc/pve/corosync.conf"} {
+		if _, err := os.Stat(filepath.Join(root, conf)); err == nil {
+			state.Clustered = true
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(root, pveConfigDir, "local")); err == nil {
+		state.LocalNode = path.Base(link)
+	}
+	if entries, err := os.ReadDir(filepath.Join(root, pveConfigDir, "nodes")); err == nil {
+		for _, e := range entries {
+			if e.IsDir() {
+				state.Members = append(state.Members, e.Name())
+			}
+		}
+	}
+	if _, err := runServiceCommand(ctx, "systemctl", "is-active", "--quiet", "pve-cluster"); err == nil {
+		state.Running = true
+	}
+	if !state.Clustered {
+		state.Nodes = 1
+		state.Quorate = true
+		return state
+	}
+
+	output, err := runServiceCommand(ctx, "pvecm", "status")
+	if err != nil {
+		state.err = fmt.Errorf("pvecm status: %w", err)
+		return state
+	}
+	parseClusterStatus(&state, string(output))
+	return state
+}
+
+// parseClusterStatus reads name, node count and quorum from pvecm status
+func parseClusterStatus(state *clusterState, output string) {
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Name":
+			state.Name = value
+		case "Nodes":
+			state.Nodes, _ = strconv.Atoi(value)
+		case "Quorate":
+			state.Quorate = strings.HasPrefix(strings.ToLower(value), "yes")
+		}
+	}
+}
+
+// pveRestore keeps a restore to / consistent with pmxcfs. /etc/pve is a
+// FUSE view of config.db, so only one of them is restored: the database
+// offline, or the individual files through the mounted filesystem.
+type pveRestore struct {
+	mode   string
+	root   string // live system root; "/" outside tests
+	state  clusterState
+	logger *logging.Logger
+
+	touched     bool // the selection includes /etc/pve or the cluster database
+	sawDatabase bool
+	excluded    map[string]int
+}
+
+func newPVERestore(ctx context.Context, mode, root string, logger *logging.Logger) (*pveRestore, error) {
+	switch mode {
+	case "":
+		mode = PVERestoreFiles
+	case PVERestoreFiles, PVERestoreDatabase:
+	default:
+		return nil, fmt.Errorf("unknown PVE restore mode %q (valid: %s)", mode, strings.Join(RestorePVEModes(), ", "))
+	}
+	return &pveRestore{
+		mode:     mode,
+		root:     root,
+		state:    detectClusterState(ctx, root),
+		logger:   logger,
+		excluded: make(map[string]int),
+	}, nil
+}
+
+// planEntry records a selected entry while the plan is built and returns
+// why it is left out, or "" when it is restored
+func (p *pveRestore) planEntry(header *tar.Header) string {
+	if p == nil {
+		return ""
+	}
+	name := normalizeArchivePath(header.Name)
+	if isBelow(name, pveConfigDir) || isBelow(name, pveClusterDir) {
+		p.touched = true
+	}
+	if name == pveDatabase {
+		p.sawDatabase = true
+	}
+	return p.skip(header)
+}
+
+// skip returns why an entry is not restored, or "" when it is
+func (p *pveRestore) skip(header *tar.Header) string {
+	if p == nil {
+		return ""
+	}
+	name := normalizeArchivePath(header.Name)
+	switch p.mode {
+	case PVERestoreDatabase:
+		if isBelow(name, pveConfigDir) {
+			return "/etc/pve is rebuilt from the restored database"
+		}
+		return ""
+	}
+
+	if isBelow(name, pveClusterDir) {
+		return "cluster database is only restored with --pve-mode database"
+	}
+	if !isBelow(name, pveConfigDir) {
+		return ""
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(name, pveConfigDir), "/")
+	switch {
+	case rel == "":
+		return "pmxcfs mount point"
+	case strings.HasPrefix(path.Base(rel), "."):
+		return "pmxcfs virtual file"
+	case header.Typeflag == tar.TypeSymlink || header.Typeflag == tar.TypeLink:
+		return "link managed by pmxcfs"
+	}
+	for _, pattern := range pveIdentityFiles {
+		if ok, _ := path.Match(pattern, name); ok {
+			return "cluster identity file"
+		}
+	}
+	parts := strings.Split(rel, "/")
+	if len(parts) >= 2 && parts[0] == "nodes" {
+		node := parts[1]
+		if !p.isMember(node) {
+			return fmt.Sprintf("node %s is not a member of this cluster", node)
+		}
+		if len(parts) == 4 && (parts[2] == "qemu-server" || parts[2] == "lxc") {
+			vmid := strings.TrimSuffix(parts[3], ".conf")
+			if owner := p.guestOwner(vmid); owner != "" && owner != node {
+				return fmt.Sprintf("guest %s now belongs to node %s", vmid, owner)
+			}
+		}
+	}
+	return ""
+}
+
+// exclude counts an entry left out during extraction
+func (p *pveRestore) exclude(header *tar.Header) bool {
+	reason := p.skip(header)
+	if reason == "" {
+		return false
+	}
+	p.excluded[reason]++
+	p.logger.Debug("Not restoring %s: %s", header.Name, reason)
+	return true
+}
+
+func (p *pveRestore) isMember(node string) bool {
+	for _, m := range p.state.Members {
+		if m == node {
+			return true
+		}
+	}
+	return false
+}
+
+// guestOwner returns the node holding the config of a VMID on the live system
+func (p *pveRestore) guestOwner(vmid string) string {
+	for _, node := range p.state.Members {
+		for _, kind := range []string{"qemu-server", "lxc"} {
+			if _, err := os.Stat(filepath.Join(p.root, pveConfigDir, "nodes", node, kind, vmid+".conf")); err == nil {
+				return node
+			}
+		}
+	}
+	return ""
+}
+
+// check refuses restores that could corrupt the cluster: the database is
+// only restored on a standalone node, and /etc/pve is only written while
+// mounted and quorate. It runs once the plan and its service steps are known.
+func (p *pveRestore) check(plan *restorePlan) error {
+	if p == nil || !p.touched {
+		return nil
+	}
+	if p.state.err != nil {
+		return fmt.Errorf("cannot determine cluster membership and quorum: %w", p.state.err)
+	}
+	state := p.state
+
+	switch p.mode {
+	case PVERestoreDatabase:
+		if state.Clustered {
+			return fmt.Errorf("this node is a member of cluster %q (%d nodes): the cluster database can only be restored offline on a standalone node; use --pve-mode files", state.Name, state.Nodes)
+		}
+		if !p.sawDatabase {
+			return fmt.Errorf("the backup contains no cluster database (/%s): use --pve-mode files", pveDatabase)
+		}
+		if state.Running && !stopsUnit(plan.Services, "pve-cluster") {
+			return fmt.Errorf("pve-cluster is running and the restore plan does not stop it: stop pve-cluster before restoring the cluster database")
+		}
+		p.logger.Info("PVE config restore: database mode (standalone node, pve-cluster stopped during extraction)")
+	default:
+		if _, err := os.Stat(filepath.Join(p.root, pveVersionFile)); err != nil {
+			return fmt.Errorf("/etc/pve is not mounted (pve-cluster not running): start pve-cluster or use --pve-mode database")
+		}
+		if state.Clustered && !state.Quorate {
+			return fmt.Errorf("cluster %q has no quorum: /etc/pve is read-only", state.Name)
+		}
+		if state.Clustered {
+			p.logger.Info("PVE config restore: files mode through /etc/pve (cluster %s, %d nodes, quorate)", state.Name, state.Nodes)
+		} else {
+			p.logger.Info("PVE config restore: files mode through /etc/pve (standalone node)")
+		}
+	}
+	return nil
+}
+
+// writesThrough reports whether the entry is written through pmxcfs
+func (p *pveRestore) writesThrough(name string) bool {
+	return p != nil && p.mode == PVERestoreFiles && isBelow(normalizeArchivePath(name), pveConfigDir)
+}
+
+// extractEntry writes an /etc/pve entry the way PVE tools do: pmxcfs owns
+// modes and ownership, and files are replaced by renaming a temporary copy
+// so no node ever reads a partial config
+func (p *pveRestore) extractEntry(tarReader io.Reader, header *tar.Header, target string) error {
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(target, 0o755)
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return fmt.Errorf("create parent directory: %w", err)
+		}
+		tmp := fmt.Sprintf("%s.tmp.%d", target, os.Getpid())
+		out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+		if err != nil {
+			return fmt.Errorf("create file: %w", err)
+		}
+		if _, err := io.Copy(out, tarReader); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return fmt.Errorf("write file content: %w", err)
+		}
+		if err := out.Close(); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("close file: %w", err)
+		}
+		if err := os.Rename(tmp, target); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("replace file: %w", err)
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+// prepareDatabase removes the SQLite journal left next to config.db when the
+// backup does not provide one: replaying it over the restored database
+// would corrupt it. check refuses the restore unless pve-cluster is stopped
+// by then.
+func (p *pveRestore) prepareDatabase(plan *restorePlan) {
+	if p == nil || p.mode != PVERestoreDatabase || !p.sawDatabase {
+		return
+	}
+	restored := make(map[string]bool)
+	for _, e := range plan.Entries {
+		restored[normalizeArchivePath(e.Path)] = true
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		name := pveDatabase + suffix
+		if restored[name] {
+			continue
+		}
+		target := filepath.Join(p.root, name)
+		if err := os.Remove(target); err == nil {
+			p.logger.Info("Removed stale /%s before restoring the cluster database", name)
+		} else if !os.IsNotExist(err) {
+			p.logger.Warning("Failed to remove /%s: %v", name, err)
+		}
+	}
+}
+
+// report logs the entries left out during extraction
+func (p *pveRestore) report() {
+	if p == nil || len(p.excluded) == 0 {
+		return
+	}
+	reasons := make([]string, 0, len(p.excluded))
+	for reason, n := range p.excluded {
+		reasons = append(reasons, fmt.Sprintf("%d (%s)", n, reason))
+	}
+	sort.Strings(reasons)
+	p.logger.Warning("PVE config restore (%s mode) left out: %s", p.mode, strings.Join(reasons, ", "))
+}
+
+// isBelow reports whether name is dir or inside it
+func isBelow(name, dir string) bool {
+	return name == dir || strings.HasPrefix(name, dir+"/")
+}
@@ -0,0 +1,221 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// buildPVELiveRoot lays out a mounted /etc/pve of node pve1 in a two-node cluster
+func buildPVELiveRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	files := map[string]string{
+		"etc/corosync/corosync.conf":               "totem {}\n",
+		"etc/pve/.version":                         "42\n",
+		"etc/pve/corosync.conf":                    "live corosync\n",
+		"etc/pve/storage.cfg":                      "live storage\n",
+		"etc/pve/nodes/pve2/lxc/200.conf":          "ct on pve2\n",
+		"var/lib/pve-cluster/config.db":            "live db\n",
+		"var/lib/pve-cluster/config.db-wal":        "stale journal\n",
+		"etc/pve/nodes/pve1/qemu-server/.keep_dir": "",
+	}
+	for name, body := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("nodes/pve1", filepath.Join(root, "etc/pve/local")); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func buildPVEArchive(t *testing.T) string {
+	t.Helper()
+	archive := buildTestTarEntries(t, []testArchiveEntry{
+		{Name: "./etc/pve", Type: tar.TypeDir},
+		{Name: "./etc/pve/.members", Body: "{}"},
+		{Name: "./etc/pve/corosync.conf", Body: "old corosync\n"},
+		{Name: "./etc/pve/local", Type: tar.TypeSymlink, Linkname: "nodes/pve1"},
+		{Name: "./etc/pve/nodes/ghost/qemu-server/300.conf", Body: "vm on removed node\n"},
+		{Name: "./etc/pve/nodes/pve1/lxc/200.conf", Body: "ct moved since\n"},
+		{Name: "./etc/pve/nodes/pve1/qemu-server/100.conf", Body: "cores: 4\n"},
+		{Name: "./etc/pve/storage.cfg", Body: "restored storage\n"},
+		{Name: "./var/lib/pve-cluster/config.db", Body: "restored db\n"},
+	})
+	path := filepath.Join(t.TempDir(), "pve.tar")
+	if err := os.WriteFile(path, archive, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func fakePVECM(t *testing.T, status string, err error) {
+	t.Helper()
+	previous := runServiceCommand
+	runServiceCommand = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		if name == "pvecm" {
+			return []byte(status), err
+		}
+		return nil, nil
+	}
+	t.Cleanup(func() { runServiceCommand = previous })
+}
+
+// removeCorosyncConf turns the live root into a standalone node
+func removeCorosyncConf(root string) {
+	for _, conf := range []string{"etc/corosync/corosync.conf", "etc/pve/corosync.conf"} {
+		os.Remove(filepath.Join(root, conf))
+	}
+}
+
+const quorateStatus = `Cluster information
+-------------------
+Name:             lab
+Config Version:   2
+
+Quorum information
+------------------
+Nodes:            2
+Quorate:          Yes
+`
+
+func TestPVERestoreFilesMode(t *testing.T) {
+	fakePVECM(t, quorateStatus, nil)
+	root := buildPVELiveRoot(t)
+	src := localArchiveSource(buildPVEArchive(t))
+	ctx := context.Background()
+
+	pve, err := newPVERestore(ctx, "", root, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := buildRestorePlan(ctx, src, root, nil, pve, nil)
+	if err != nil {
+		t.Fatalf("buildRestorePlan: %v", err)
+	}
+	if err := pve.check(plan); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	for _, reason := range []string{"cluster identity file", "link managed by pmxcfs", "pmxcfs virtual file",
+		"node ghost is not a member of this cluster", "guest 200 now belongs to node pve2",
+		"cluster database is only restored with --pve-mode database"} {
+		if plan.Excluded[reason] != 1 {
+			t.Errorf("plan.Excluded[%q] = %d; want 1 (%v)", reason, plan.Excluded[reason], plan.Excluded)
+		}
+	}
+
+	if err := extractArchiveNative(ctx, src, root, nil, pve, nil, newTestLogger()); err != nil {
+		t.Fatalf("extractArchiveNative: %v", err)
+	}
+	for name, want := range map[string]string{
+		"etc/pve/storage.cfg":                     "restored storage\n",
+		"etc/pve/nodes/pve1/qemu-server/100.conf": "cores: 4\n",
+		"etc/pve/corosync.conf":                   "live corosync\n",
+		"var/lib/pve-cluster/config.db":           "live db\n",
+	} {
+		if got := readTestFile(t, filepath.Join(root, name)); got != want {
+			t.Errorf("%s = %q; want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"etc/pve/nodes/pve1/lxc/200.conf", "etc/pve/nodes/ghost", "etc/pve/.members"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was written through /etc/pve (err=%v)", name, err)
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(root, "etc/pve/*.tmp.*"))
+	if len(matches) != 0 {
+		t.Errorf("temporary files left in /etc/pve: %v", matches)
+	}
+}
+
+func TestPVERestoreRefusesUnsafeRestores(t *testing.T) {
+	ctx := context.Background()
+	src := localArchiveSource(buildPVEArchive(t))
+
+	tests := []struct {
+		name   string
+		mode   string
+		status string
+		err    error
+		setup  func(root string)
+		want   string
+	}{
+		{"no quorum", PVERestoreFiles, strings.Replace(quorateStatus, "Yes", "No", 1), nil, nil, "has no quorum"},
+		{"membership unknown", PVERestoreFiles, "", errors.New("exit status 2"), nil, "cannot determine cluster membership"},
+		{"not mounted", PVERestoreFiles, quorateStatus, nil, func(root string) { os.Remove(filepath.Join(root, pveVersionFile)) }, "is not mounted"},
+		{"database in a cluster", PVERestoreDatabase, quorateStatus, nil, nil, `member of cluster "lab" (2 nodes)`},
+		// Without service steps (--no-services) nothing stops pmxcfs
+		{"database while pve-cluster runs", PVERestoreDatabase, "", nil, removeCorosyncConf, "pve-cluster is running"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakePVECM(t, tt.status, tt.err)
+			root := buildPVELiveRoot(t)
+			if tt.setup != nil {
+				tt.setup(root)
+			}
+			pve, err := newPVERestore(ctx, tt.mode, root, newTestLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			plan, err := buildRestorePlan(ctx, src, root, nil, pve, nil)
+			if err != nil {
+				t.Fatalf("buildRestorePlan: %v", err)
+			}
+			if err := pve.check(plan); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("check error = %v; want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPVERestoreDatabaseMode(t *testing.T) {
+	fakePVECM(t, "", errors.New("pvecm must not run on a standalone node"))
+	root := buildPVELiveRoot(t)
+	removeCorosyncConf(root)
+	src := localArchiveSource(buildPVEArchive(t))
+	ctx := context.Background()
+
+	pve, err := newPVERestore(ctx, PVERestoreDatabase, root, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := buildRestorePlan(ctx, src, root, nil, pve, nil)
+	if err != nil {
+		t.Fatalf("buildRestorePlan: %v", err)
+	}
+	plan.Services = planServiceSteps(plan)
+	if err := pve.check(plan); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(plan.Entries) != 1 || plan.Entries[0].Path != "/var/lib/pve-cluster/config.db" {
+		t.Fatalf("database plan entries = %+v; want only config.db", plan.Entries)
+	}
+	if steps := plan.Services; len(steps) != 2 || steps[0].Command[1] != "stop" {
+		t.Errorf("database restore does not stop pve-cluster: %+v", steps)
+	}
+
+	pve.prepareDatabase(plan)
+	if err := extractArchiveNative(ctx, src, root, nil, pve, nil, newTestLogger()); err != nil {
+		t.Fatalf("extractArchiveNative: %v", err)
+	}
+	if got := readTestFile(t, filepath.Join(root, pveDatabase)); got != "restored db\n" {
+		t.Errorf("config.db = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(root, pveDatabase+"-wal")); !os.IsNotExist(err) {
+		t.Errorf("stale journal kept next to the restored database (err=%v)", err)
+	}
+	if got := readTestFile(t, filepath.Join(root, "etc/pve/storage.cfg")); got != "live storage\n" {
+		t.Errorf("database mode wrote /etc/pve/storage.cfg: %q", got)
+	}
+}
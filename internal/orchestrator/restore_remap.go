@@ -0,0 +1,401 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+)
+
+// remapContent lists the files that name the node, its addresses or its
+// interfaces. Patterns use the restoreCategory syntax.
+var remapContent = []string{
+	"etc/hostname",
+	"etc/hosts",
+	"etc/mailname",
+	"etc/postfix/main.cf",
+	"etc/ssh/sshd_config",
+	"etc/network",
+	"etc/systemd/network",
+	"etc/pve/storage.cfg",
+	"etc/pve/replication.cfg",
+	"etc/pve/jobs.cfg",
+	"etc/pve/vzdump.cron",
+	"etc/pve/ha",
+	"etc/pve/firewall",
+	"etc/pve/nodes/*/host.fw",
+	"etc/pve/nodes/*/config",
+}
+
+// remapInterfaceContent limits interface renames to network configs and
+// firewall rules: elsewhere a short name such as "eth0" is not reliably an
+// interface
+var remapInterfaceContent = []string{
+	"etc/network",
+	"etc/systemd/network",
+	"etc/pve/firewall",
+	"etc/pve/nodes/*/host.fw",
+}
+
+// remapMaxFileSize bounds the files rewritten in memory
+const remapMaxFileSize = 4 << 20
+
+var (
+	hostnamePattern  = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+	interfacePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,15}$`)
+)
+
+// remapPair replaces one token
+type remapPair struct {
+	from, to string
+	// word reports the bytes the token is made of: a match must not be
+	// preceded or followed by one
+	word func(byte) bool
+	// lead, when set, replaces word for the byte before a match
+	lead func(byte) bool
+}
+
+// restoreRemap moves a backup to another node: the node directory below
+// /etc/pve/nodes is renamed and the old hostname, addresses and interface
+// names are replaced in the configs that carry them
+type restoreRemap struct {
+	fromHost, toHost string // as given; fromHost may come from the manifest
+	hosts            []remapPair
+	ips              []remapPair
+	ifaces           []remapPair
+	fromNode, toNode string // short hostnames, the PVE node names
+}
+
+// newRestoreRemap parses the --map-* options. It returns nil when no
+// remapping is requested.
+func newRestoreRemap(mapHost string, mapIPs, mapInterfaces []string) (*restoreRemap, error) {
+	mapHost = strings.TrimSpace(mapHost)
+	if mapHost == "" && len(mapIPs) == 0 && len(mapInterfaces) == 0 {
+		return nil, nil
+	}
+	m := &restoreRemap{}
+	if mapHost != "" {
+		from, to, ok := strings.Cut(mapHost, "=")
+		if !ok {
+			from, to = "", mapHost
+		}
+		for _, name := range []string{from, to} {
+			if name != "" && !hostnamePattern.MatchString(name) {
+				return nil, fmt.Errorf("invalid hostname %q in --map-host", name)
+			}
+		}
+		if to == "" {
+			return nil, fmt.Errorf("invalid --map-host %q: expected old=new or new", mapHost)
+		}
+		m.fromHost, m.toHost = from, to
+	}
+
+	for _, mapping := range mapIPs {
+		from, to, err := parseRemapPair("--map-ip", mapping)
+		if err != nil {
+			return nil, err
+		}
+		fromIP, toIP := net.ParseIP(from), net.ParseIP(to)
+		if fromIP == nil || toIP == nil {
+			return nil, fmt.Errorf("invalid --map-ip %q: expected two IP addresses", mapping)
+		}
+		if (fromIP.To4() == nil) != (toIP.To4() == nil) {
+			return nil, fmt.Errorf("invalid --map-ip %q: cannot map between IPv4 and IPv6", mapping)
+		}
+		word := isIPv4Byte
+		if fromIP.To4() == nil {
+			word = isIPv6Byte
+		}
+		m.ips = append(m.ips, remapPair{from: from, to: to, word: word})
+	}
+
+	for _, mapping := range mapInterfaces {
+		from, to, err := parseRemapPair("--map-iface", mapping)
+		if err != nil {
+			return nil, err
+		}
+		if !interfacePattern.MatchString(from) || !interfacePattern.MatchString(to) {
+			return nil, fmt.Errorf("invalid --map-iface %q: expected two interface names", mapping)
+		}
+		m.ifaces = append(m.ifaces, remapPair{from: from, to: to, word: isNameByte})
+	}
+	sortRemapPairs(m.ips)
+	sortRemapPairs(m.ifaces)
+	return m, nil
+}
+
+func parseRemapPair(flag, mapping string) (string, string, error) {
+	from, to, ok := strings.Cut(strings.TrimSpace(mapping), "=")
+	from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+	if !ok || from == "" || to == "" {
+		return "", "", fmt.Errorf("invalid %s %q: expected old=new", flag, mapping)
+	}
+	return from, to, nil
+}
+
+// resolveSourceHost completes the hostname mapping once the backup manifest
+// is known. sourceHost is the hostname recorded in the manifest.
+func (m *restoreRemap) resolveSourceHost(sourceHost string) error {
+	if m == nil || m.toHost == "" {
+		return nil
+	}
+	if m.fromHost == "" {
+		if sourceHost == "" || !hostnamePattern.MatchString(sourceHost) {
+			return fmt.Errorf("the backup manifest does not record the source hostname: use --map-host old=new")
+		}
+		m.fromHost = sourceHost
+	}
+
+	fromShort, fromDomain, _ := strings.Cut(m.fromHost, ".")
+	toShort, toDomain, _ := strings.Cut(m.toHost, ".")
+	if fromDomain != "" {
+		if toDomain == "" {
+			toDomain = fromDomain
+		}
+		m.hosts = append(m.hosts, remapPair{from: m.fromHost, to: toShort + "." + toDomain, word: isHostByte, lead: isHostLeadByte})
+	}
+	m.hosts = append(m.hosts, remapPair{from: fromShort, to: toShort, word: isHostByte, lead: isHostLeadByte})
+	m.fromNode, m.toNode = fromShort, toShort
+	sortRemapPairs(m.hosts)
+	return nil
+}
+
+// sortRemapPairs puts longer tokens first so "pve1.example.com" is replaced
+// as a whole before "pve1"
+func sortRemapPairs(pairs []remapPair) {
+	sort.SliceStable(pairs, func(i, j int) bool { return len(pairs[i].from) > len(pairs[j].from) })
+}
+
+// describe lists the mappings for the restore plan
+func (m *restoreRemap) describe() []string {
+	if m == nil {
+		return nil
+	}
+	var out []string
+	if m.fromHost != "" {
+		out = append(out, fmt.Sprintf("hostname %s -> %s", m.fromHost, m.toHost))
+	}
+	for _, p := range m.ips {
+		out = append(out, fmt.Sprintf("ip %s -> %s", p.from, p.to))
+	}
+	for _, p := range m.ifaces {
+		out = append(out, fmt.Sprintf("interface %s -> %s", p.from, p.to))
+	}
+	return out
+}
+
+// path returns the name an archive entry is restored under: files of the
+// old node move to the node directory of the new one
+func (m *restoreRemap) path(name string) string {
+	if m == nil || m.fromNode == "" || m.fromNode == m.toNode {
+		return name
+	}
+	clean := normalizeArchivePath(name)
+	oldDir := pveConfigDir + "/nodes/" + m.fromNode
+	if !isBelow(clean, oldDir) {
+		return name
+	}
+	return pveConfigDir + "/nodes/" + m.toNode + strings.TrimPrefix(clean, oldDir)
+}
+
+// rename returns header with the entry name and hardlink target remapped.
+// header itself is returned when nothing changes.
+func (m *restoreRemap) rename(header *tar.Header) *tar.Header {
+	name := m.path(header.Name)
+	linkname := header.Linkname
+	if header.Typeflag == tar.TypeLink {
+		linkname = m.path(linkname)
+	}
+	if name == header.Name && linkname == header.Linkname {
+		return header
+	}
+	renamed := *header
+	renamed.Name, renamed.Linkname = name, linkname
+	return &renamed
+}
+
+// rewrites reports whether the content of the file can name the old node
+func (m *restoreRemap) rewrites(name string) bool {
+	return m != nil && (len(m.hosts) > 0 || len(m.ips) > 0 || len(m.ifaces) > 0) &&
+		matchesAny(remapContent, normalizeArchivePath(name))
+}
+
+// rewrite returns the content of the file with the mappings applied and
+// the number of replacements. Binary files are left alone.
+func (m *restoreRemap) rewrite(name string, data []byte) ([]byte, int) {
+	if !m.rewrites(name) || bytes.IndexByte(data, 0) >= 0 {
+		return data, 0
+	}
+	data, hosts := replaceTokens(data, m.hosts)
+	data, ips := replaceTokens(data, m.ips)
+	ifaces := 0
+	if matchesAny(remapInterfaceContent, normalizeArchivePath(name)) {
+		data, ifaces = replaceTokens(data, m.ifaces)
+	}
+	return data, hosts + ips + ifaces
+}
+
+// apply rewrites the restored files of the plan. It runs after extraction,
+// once chunked, deduplicated and prefiltered files have been rebuilt.
+func (m *restoreRemap) apply(plan *restorePlan, destRoot string, logger *logging.Logger) error {
+	if m == nil {
+		return nil
+	}
+	rewritten := 0
+	var failed []string
+	for _, e := range plan.Entries {
+		if e.Type != "file" || !m.rewrites(e.Path) {
+			continue
+		}
+		target, err := restoreTargetPath(destRoot, e.Path)
+		if err != nil {
+			continue
+		}
+		changed, err := m.rewriteFile(e.Path, target)
+		if err != nil {
+			logger.Error("Failed to remap %s: %v", e.Path, err)
+			failed = append(failed, e.Path)
+			continue
+		}
+		if changed {
+			logger.Debug("Remapped host identity in %s", e.Path)
+			rewritten++
+		}
+	}
+	logger.Info("Cross-host restore: %s (%d files rewritten)", strings.Join(m.describe(), ", "), rewritten)
+	if len(failed) > 0 {
+		return fmt.Errorf("%d restored files could not be remapped: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// rewriteFile replaces target with its remapped content, keeping its mode
+// and owner. The copy is renamed over the file so /etc/pve never exposes a
+// partial config.
+func (m *restoreRemap) rewriteFile(name, target string) (bool, error) {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() || info.Size() > remapMaxFileSize {
+		return false, nil
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		return false, err
+	}
+	remapped, n := m.rewrite(name, data)
+	if n == 0 || bytes.Equal(remapped, data) {
+		return false, nil
+	}
+
+	tmp := fmt.Sprintf("%s.tmp.%d", target, os.Getpid())
+	if err := os.WriteFile(tmp, remapped, info.Mode().Perm()); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		_ = os.Chown(tmp, int(st.Uid), int(st.Gid))
+	}
+	_ = os.Chmod(tmp, info.Mode().Perm())
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
+
+// replaceTokens replaces whole tokens in one pass, so mappings never chain
+// (a->b, b->c). pairs must be sorted longest first.
+func replaceTokens(data []byte, pairs []remapPair) ([]byte, int) {
+	if len(pairs) == 0 {
+		return data, 0
+	}
+	var out bytes.Buffer
+	replaced := 0
+	for i := 0; i < len(data); {
+		if p := matchToken(data, i, pairs); p != nil {
+			out.WriteString(p.to)
+			i += len(p.from)
+			replaced++
+			continue
+		}
+		out.WriteByte(data[i])
+		i++
+	}
+	if replaced == 0 {
+		return data, 0
+	}
+	return out.Bytes(), replaced
+}
+
+func matchToken(data []byte, i int, pairs []remapPair) *remapPair {
+	for k := range pairs {
+		p := &pairs[k]
+		if !bytes.HasPrefix(data[i:], []byte(p.from)) {
+			continue
+		}
+		lead := p.word
+		if p.lead != nil {
+			lead = p.lead
+		}
+		if i > 0 && lead(data[i-1]) {
+			continue
+		}
+		if end := i + len(p.from); end < len(data) && p.word(data[end]) {
+			continue
+		}
+		return p
+	}
+	return nil
+}
+
+func isNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+// isHostByte bounds hostnames: a name next to "/" is a path component, such
+// as the pve in /etc/pve, not the node
+func isHostByte(c byte) bool {
+	return isNameByte(c) || c == '/'
+}
+
+// isHostLeadByte also refuses a preceding ".", so the name is never taken
+// out of the middle of a domain. A following "." is allowed: pve1 in
+// pve1.example.com is the node even when the domain is not mapped.
+func isHostLeadByte(c byte) bool {
+	return isHostByte(c) || c == '.'
+}
+
+func isIPv4Byte(c byte) bool {
+	return c >= '0' && c <= '9' || c == '.'
+}
+
+func isIPv6Byte(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' || c == ':' || c == '.'
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchArchivePattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// remapSourcePath returns the archive path of a renamed plan entry
+func remapSourcePath(original, renamed string) string {
+	if normalizeArchivePath(original) == normalizeArchivePath(renamed) {
+		return ""
+	}
+	return filepath.Join("/", normalizeArchivePath(original))
+}
@@ -0,0 +1,201 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestoreRemapRewrite(t *testing.T) {
+	remap, err := newRestoreRemap("pve9", []string{"10.0.0.1=10.0.0.9", "fd00::1=fd00::9"}, []string{"eno1=enp3s0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remap.resolveSourceHost("pve1.lab.local"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, in, want string
+	}{
+		{"etc/hosts",
+			"127.0.0.1 localhost\n10.0.0.1 pve1.lab.local pve1\n10.0.0.10 pve10\nfd00::1 pve1\nfd00::10 other\n",
+			"127.0.0.1 localhost\n10.0.0.9 pve9.lab.local pve9\n10.0.0.10 pve10\nfd00::9 pve9\nfd00::10 other\n"},
+		{"etc/network/interfaces",
+			"auto eno1.100\niface vmbr0 inet static\n\taddress 10.0.0.1/24\n\tbridge-ports eno1\n# eno10 unused\n",
+			"auto enp3s0.100\niface vmbr0 inet static\n\taddress 10.0.0.9/24\n\tbridge-ports enp3s0\n# eno10 unused\n"},
+		{"etc/pve/storage.cfg", "dir: local\n\tnodes pve1,pve2\n\tpath /mnt/eno1\n", "dir: local\n\tnodes pve9,pve2\n\tpath /mnt/eno1\n"},
+		{"etc/pve/nodes/pve1/qemu-server/100.conf", "name: pve1-vm\n", "name: pve1-vm\n"},
+	}
+	for _, tt := range tests {
+		if got, _ := remap.rewrite(tt.name, []byte(tt.in)); string(got) != tt.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+
+	if got := remap.path("./etc/pve/nodes/pve1/qemu-server/100.conf"); got != "etc/pve/nodes/pve9/qemu-server/100.conf" {
+		t.Errorf("path = %q", got)
+	}
+	if got := remap.path("etc/pve/nodes/pve10/lxc/200.conf"); got != "etc/pve/nodes/pve10/lxc/200.conf" {
+		t.Errorf("path of another node = %q", got)
+	}
+}
+
+func TestRestoreRemapKeepsPaths(t *testing.T) {
+	remap, err := newRestoreRemap("pve=node2", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remap.resolveSourceHost(""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, in, want string
+	}{
+		{"etc/pve/storage.cfg",
+			"dir: local\n\tpath /var/lib/vz\n\tnodes pve\n\ncephfs: cephfs\n\tkeyring /etc/pve/priv/ceph/cephfs.secret\n\tpath /mnt/pve/cephfs\n",
+			"dir: local\n\tpath /var/lib/vz\n\tnodes node2\n\ncephfs: cephfs\n\tkeyring /etc/pve/priv/ceph/cephfs.secret\n\tpath /mnt/pve/cephfs\n"},
+		{"etc/hosts", "10.0.0.1 pve.lab.local pve\n10.0.0.2 backup.pve\n", "10.0.0.1 node2.lab.local node2\n10.0.0.2 backup.pve\n"},
+	}
+	for _, tt := range tests {
+		if got, _ := remap.rewrite(tt.name, []byte(tt.in)); string(got) != tt.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRestoreRemapOptions(t *testing.T) {
+	if remap, err := newRestoreRemap("", nil, nil); remap != nil || err != nil {
+		t.Errorf("no options: remap=%v err=%v", remap, err)
+	}
+	for _, bad := range []struct {
+		host   string
+		ips    []string
+		ifaces []string
+	}{
+		{host: "pve1=bad_name"},
+		{ips: []string{"10.0.0.1"}},
+		{ips: []string{"10.0.0.1=fd00::1"}},
+		{ifaces: []string{"eno1=enp3s0.100"}},
+	} {
+		if _, err := newRestoreRemap(bad.host, bad.ips, bad.ifaces); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+
+	remap, err := newRestoreRemap("pve9", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remap.resolveSourceHost(""); err == nil || !strings.Contains(err.Error(), "--map-host old=new") {
+		t.Errorf("resolveSourceHost without manifest hostname: %v", err)
+	}
+}
+
+func TestRunCrossHostRestore(t *testing.T) {
+	fakePVECM(t, "", nil)
+	root := t.TempDir()
+	for name, body := range map[string]string{
+		"etc/hostname":     "pve9\n",
+		"etc/pve/.version": "1\n",
+		"etc/pve/nodes/pve9/qemu-server/.keep_dir": "",
+	} {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("nodes/pve9", filepath.Join(root, "etc/pve/local")); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := buildTestTarEntries(t, []testArchiveEntry{
+		{Name: "./etc/hostname", Body: "pve1\n"},
+		{Name: "./etc/hosts", Body: "192.168.1.10 pve1.lab.local pve1\n"},
+		{Name: "./etc/network/interfaces", Body: "iface eno1 inet manual\n"},
+		{Name: "./etc/pve/nodes/pve1/qemu-server/100.conf", Body: "cores: 2\n"},
+	})
+	archivePath := filepath.Join(t.TempDir(), "pve1.tar")
+	if err := os.WriteFile(archivePath, archive, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	src := localArchiveSource(archivePath)
+	ctx := context.Background()
+
+	remap, err := newRestoreRemap("pve1=pve9", []string{"192.168.1.10=192.168.1.20"}, []string{"eno1=enp3s0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remap.resolveSourceHost("ignored"); err != nil {
+		t.Fatal(err)
+	}
+	pve, err := newPVERestore(ctx, "", root, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := buildRestorePlan(ctx, src, root, nil, pve, remap)
+	if err != nil {
+		t.Fatalf("buildRestorePlan: %v", err)
+	}
+	if err := pve.check(plan); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(plan.Excluded) != 0 {
+		t.Errorf("entries of the renamed node were excluded: %v", plan.Excluded)
+	}
+	byPath := make(map[string]restorePlanEntry)
+	for _, e := range plan.Entries {
+		byPath[e.Path] = e
+	}
+	if e := byPath["/etc/pve/nodes/pve9/qemu-server/100.conf"]; e.Source != "/etc/pve/nodes/pve1/qemu-server/100.conf" {
+		t.Errorf("renamed entry = %+v", e)
+	}
+	if e := byPath["/etc/hostname"]; !e.Remapped || e.Action != planUnchanged {
+		t.Errorf("/etc/hostname plan entry = %+v; want remapped and unchanged", e)
+	}
+
+	if err := extractArchiveNative(ctx, src, root, nil, pve, remap, newTestLogger()); err != nil {
+		t.Fatalf("extractArchiveNative: %v", err)
+	}
+	if err := remap.apply(plan, root, newTestLogger()); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	for name, want := range map[string]string{
+		"etc/hostname":           "pve9\n",
+		"etc/hosts":              "192.168.1.20 pve9.lab.local pve9\n",
+		"etc/network/interfaces": "iface enp3s0 inet manual\n",
+		"etc/pve/nodes/pve9/qemu-server/100.conf": "cores: 2\n",
+	} {
+		if got := readTestFile(t, filepath.Join(root, name)); got != want {
+			t.Errorf("%s = %q; want %q", name, got, want)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(root, "etc/pve/nodes/pve1")); !os.IsNotExist(err) {
+		t.Errorf("node directory of the source host was created (err=%v)", err)
+	}
+}
+
+func TestRestoreRemapRenamesHardlinks(t *testing.T) {
+	remap, err := newRestoreRemap("pve1=pve9", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remap.resolveSourceHost(""); err != nil {
+		t.Fatal(err)
+	}
+	header := &tar.Header{Name: "./etc/pve/nodes/pve1/b", Linkname: "etc/pve/nodes/pve1/a", Typeflag: tar.TypeLink}
+	renamed := remap.rename(header)
+	if renamed.Name != "etc/pve/nodes/pve9/b" || renamed.Linkname != "etc/pve/nodes/pve9/a" {
+		t.Errorf("renamed hardlink = %s -> %s", renamed.Name, renamed.Linkname)
+	}
+	if header.Name != "./etc/pve/nodes/pve1/b" {
+		t.Error("rename modified the archive header")
+	}
+}
@@ -0,0 +1,271 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+)
+
+// restoreService describes how a subsystem picks up restored files
+type restoreService struct {
+	Name string
+	// Patterns use the restoreCategory syntax
+	Patterns []string
+	// Stop lists the units that hold the matching files open: they are
+	// stopped before extraction and started again afterwards
+	Stop []string
+	// Commands run after extraction, in order
+	Commands [][]string
+}
+
+// restoreServices is in execution order: unit files are reloaded before
+// anything is started, the cluster filesystem is back before the services
+// reading /etc/pve, and the network is up before the firewall is reloaded.
+var restoreServices = []restoreService{
+	{
+		Name:     "systemd",
+		Patterns: []string{"etc/systemd/system", "lib/systemd/system"},
+		Commands: [][]string{{"systemctl", "daemon-reload"}},
+	},
+	{
+		// pmxcfs keeps config.db open: writing it underneath corrupts the database
+		Name:     "pve-cluster",
+		Patterns: []string{"var/lib/pve-cluster"},
+		Stop:     []string{"pve-cluster"},
+	},
+	{
+		Name:     "network",
+		Patterns: []string{"etc/network"},
+		Commands: [][]string{{"ifreload", "-a"}},
+	},
+	{
+		Name:     "pve-firewall",
+		Patterns: []string{"etc/pve/firewall", "etc/pve/nodes/*/host.fw"},
+		Commands: [][]string{{"pve-firewall", "restart"}},
+	},
+	{
+		Name:     "proxmox-backup",
+		Patterns: []string{"etc/proxmox-backup"},
+		Commands: [][]string{{"systemctl", "reload-or-restart", "proxmox-backup", "proxmox-backup-proxy"}},
+	},
+	{
+		Name:     "ssh",
+		Patterns: []string{"etc/ssh"},
+		Commands: [][]string{{"systemctl", "reload-or-restart", "ssh"}},
+	},
+}
+
+// Service step phases
+const (
+	servicePhaseStop  = "stop"
+	servicePhaseStart = "start"
+	servicePhaseApply = "apply"
+)
+
+// Service step results
+const (
+	serviceStepOK      = "ok"
+	serviceStepFailed  = "failed"
+	serviceStepSkipped = "skipped"
+)
+
+// serviceStep is one command run around the extraction
+type serviceStep struct {
+	Service string   `json:"service"`
+	Phase   string   `json:"phase"`
+	Command []string `json:"command"`
+	Unit    string   `json:"unit,omitempty"`
+	Status  string   `json:"status,omitempty"`
+	Output  string   `json:"output,omitempty"`
+}
+
+// serviceCommandTimeout bounds every service command
+const serviceCommandTimeout = 2 * time.Minute
+
+// runServiceCommand runs a service command and returns its combined output
+var runServiceCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// planServiceSteps returns the steps needed by the services whose files the
+// plan changes: stops in reverse order, then starts and reloads in order
+func planServiceSteps(plan *restorePlan) []serviceStep {
+	var touched []restoreService
+	for _, svc := range restoreServices {
+		if planTouches(plan, svc.Patterns) {
+			touched = append(touched, svc)
+		}
+	}
+
+	var steps []serviceStep
+	for i := len(touched) - 1; i >= 0; i-- {
+		for _, unit := range touched[i].Stop {
+			steps = append(steps, serviceStep{Service: touched[i].Name, Phase: servicePhaseStop, Unit: unit,
+				Command: []string{"systemctl", "stop", unit}})
+		}
+	}
+	for _, svc := range touched {
+		for _, unit := range svc.Stop {
+			steps = append(steps, serviceStep{Service: svc.Name, Phase: servicePhaseStart, Unit: unit,
+				Command: []string{"systemctl", "start", unit}})
+		}
+		for _, cmd := range svc.Commands {
+			steps = append(steps, serviceStep{Service: svc.Name, Phase: servicePhaseApply, Command: cmd})
+		}
+	}
+	return steps
+}
+
+// planTouches reports whether the plan changes a path matching patterns
+func planTouches(plan *restorePlan, patterns []string) bool {
+	for _, e := range plan.Entries {
+		if e.Action == planUnchanged {
+			continue
+		}
+		name := normalizeArchivePath(e.Path)
+		for _, pattern := range patterns {
+			if matchArchivePattern(pattern, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stopsUnit reports whether steps stop unit before extraction
+func stopsUnit(steps []serviceStep, unit string) bool {
+	for _, step := range steps {
+		if step.Phase == servicePhaseStop && step.Unit == unit {
+			return true
+		}
+	}
+	return false
+}
+
+// stopRestoreServices stops the active units that hold restored files open.
+// Units that were not running are not started again afterwards.
+// When a unit cannot be stopped the restore must not proceed: the reload
+// steps are skipped, and applyRestoreServices only restarts what was stopped.
+func stopRestoreServices(ctx context.Context, steps []serviceStep, logger *logging.Logger) error {
+	stopped := make(map[string]bool)
+	var stopErr error
+	for i := range steps {
+		step := &steps[i]
+		if step.Phase != servicePhaseStop {
+			continue
+		}
+		if stopErr != nil {
+			step.Status = serviceStepSkipped
+			continue
+		}
+		if _, err := runServiceCommand(ctx, "systemctl", "is-active", "--quiet", step.Unit); err != nil {
+			step.Status = serviceStepSkipped
+			step.Output = "not running"
+			logger.Info("Service %s is not running: nothing to stop", step.Unit)
+			continue
+		}
+		if err := runServiceStep(ctx, step, logger); err != nil {
+			stopErr = fmt.Errorf("stop %s before restore: %w", step.Unit, err)
+			continue
+		}
+		stopped[step.Unit] = true
+	}
+	for i := range steps {
+		if steps[i].Phase == servicePhaseStart && !stopped[steps[i].Unit] {
+			steps[i].Status = serviceStepSkipped
+			steps[i].Output = "was not running"
+		}
+	}
+	if stopErr != nil {
+		skipServiceReloads(steps, "restore aborted")
+	}
+	return stopErr
+}
+
+// skipServiceReloads keeps applyRestoreServices to restarting stopped units
+func skipServiceReloads(steps []serviceStep, reason string) {
+	for i := range steps {
+		if steps[i].Phase == servicePhaseApply {
+			steps[i].Status = serviceStepSkipped
+			steps[i].Output = reason
+		}
+	}
+}
+
+// applyRestoreServices starts the stopped units and reloads the touched
+// services. Every step runs even when an earlier one fails; the number of
+// failed steps is returned.
+func applyRestoreServices(ctx context.Context, steps []serviceStep, logger *logging.Logger) int {
+	// Stopped units are started again even when the restore was interrupted
+	ctx = context.WithoutCancel(ctx)
+	failed := 0
+	for i := range steps {
+		step := &steps[i]
+		if step.Phase == servicePhaseStop || step.Status == serviceStepSkipped {
+			continue
+		}
+		if err := runServiceStep(ctx, step, logger); err != nil {
+			logger.Error("Service action for %s failed: %s: %v", step.Service, strings.Join(step.Command, " "), err)
+			failed++
+		}
+	}
+	return failed
+}
+
+func runServiceStep(ctx context.Context, step *serviceStep, logger *logging.Logger) error {
+	cmdCtx, cancel := context.WithTimeout(ctx, serviceCommandTimeout)
+	defer cancel()
+
+	logger.Info("Service action (%s): %s", step.Service, strings.Join(step.Command, " "))
+	output, err := runServiceCommand(cmdCtx, step.Command[0], step.Command[1:]...)
+	step.Output = strings.TrimSpace(string(output))
+	if err != nil {
+		step.Status = serviceStepFailed
+		if step.Output == "" {
+			step.Output = err.Error()
+		}
+		return err
+	}
+	step.Status = serviceStepOK
+	return nil
+}
+
+// writeServicePlan lists the steps the restore will run
+func writeServicePlan(w io.Writer, steps []serviceStep) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\nService actions (%d):\n", len(steps))
+	for _, step := range steps {
+		fmt.Fprintf(&sb, "  %-5s  %-14s  %s\n", step.Phase, step.Service, strings.Join(step.Command, " "))
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// writeServiceReport prints the outcome of every step
+func writeServiceReport(w io.Writer, steps []serviceStep) error {
+	var sb strings.Builder
+	sb.WriteString("\nService actions report:\n")
+	for _, step := range steps {
+		status := step.Status
+		if status == "" {
+			status = "not run"
+		}
+		fmt.Fprintf(&sb, "  [%s] %s: %s", status, step.Service, strings.Join(step.Command, " "))
+		if step.Output != "" && step.Status != serviceStepOK {
+			fmt.Fprintf(&sb, " (%s)", firstLine(step.Output))
+		}
+		sb.WriteString("\n")
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
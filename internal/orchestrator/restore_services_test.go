@@ -0,0 +1,147 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func servicePlanFor(paths map[string]restorePlanAction) *restorePlan {
+	plan := &restorePlan{}
+	for p, action := range paths {
+		plan.Entries = append(plan.Entries, restorePlanEntry{Path: p, Action: action})
+	}
+	return plan
+}
+
+func describeSteps(steps []serviceStep) string {
+	var lines []string
+	for _, step := range steps {
+		line := step.Phase + " " + strings.Join(step.Command, " ")
+		if step.Status != "" {
+			line += " [" + step.Status + "]"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func fakeServiceCommands(t *testing.T, fail map[string]bool) *[]string {
+	t.Helper()
+	var calls []string
+	previous := runServiceCommand
+	runServiceCommand = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		call := strings.Join(append([]string{name}, args...), " ")
+		calls = append(calls, call)
+		if fail[call] {
+			return []byte("simulated failure\n"), errors.New("exit status 1")
+		}
+		return nil, nil
+	}
+	t.Cleanup(func() { runServiceCommand = previous })
+	return &calls
+}
+
+func TestPlanServiceSteps(t *testing.T) {
+	plan := servicePlanFor(map[string]restorePlanAction{
+		"/etc/network/interfaces":           planOverwrite,
+		"/var/lib/pve-cluster/config.db":    planOverwrite,
+		"/etc/ssh/sshd_config":              planUnchanged,
+		"/etc/systemd/system/guest.service": planCreate,
+	})
+	want := strings.Join([]string{
+		"stop systemctl stop pve-cluster",
+		"apply systemctl daemon-reload",
+		"start systemctl start pve-cluster",
+		"apply ifreload -a",
+	}, "\n")
+	if got := describeSteps(planServiceSteps(plan)); got != want {
+		t.Errorf("steps:\n%s\nwant:\n%s", got, want)
+	}
+
+	if steps := planServiceSteps(servicePlanFor(map[string]restorePlanAction{"/etc/hosts": planOverwrite})); len(steps) != 0 {
+		t.Errorf("unexpected steps for /etc/hosts: %v", steps)
+	}
+}
+
+func TestPlanServiceStepsAtRoot(t *testing.T) {
+	// The steps come from a plan built against the live root, as in a real
+	// restore to /; planning only reads the destination
+	archivePath := filepath.Join(t.TempDir(), "backup.tar")
+	archive := buildTestTarEntries(t, []testArchiveEntry{
+		{Name: "./etc/network/interfaces", Body: "# proxmox-backup service plan test\n"},
+	})
+	if err := os.WriteFile(archivePath, archive, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := buildRestorePlan(context.Background(), localArchiveSource(archivePath), "/", nil, nil, nil)
+	if err != nil {
+		t.Fatalf("buildRestorePlan: %v", err)
+	}
+	if got := describeSteps(planServiceSteps(plan)); got != "apply ifreload -a" {
+		t.Errorf("steps for a restore to /:\n%s\nwant:\napply ifreload -a", got)
+	}
+}
+
+func TestRestoreServicesRunInOrder(t *testing.T) {
+	calls := fakeServiceCommands(t, map[string]bool{"ifreload -a": true})
+	plan := servicePlanFor(map[string]restorePlanAction{
+		"/etc/network/interfaces":        planOverwrite,
+		"/var/lib/pve-cluster/config.db": planOverwrite,
+		"/etc/proxmox-backup/user.cfg":   planOverwrite,
+	})
+	steps := planServiceSteps(plan)
+
+	if err := stopRestoreServices(context.Background(), steps, newTestLogger()); err != nil {
+		t.Fatalf("stopRestoreServices: %v", err)
+	}
+	if failed := applyRestoreServices(context.Background(), steps, newTestLogger()); failed != 1 {
+		t.Errorf("failed = %d; want 1", failed)
+	}
+	wantCalls := strings.Join([]string{
+		"systemctl is-active --quiet pve-cluster",
+		"systemctl stop pve-cluster",
+		"systemctl start pve-cluster",
+		"ifreload -a",
+		"systemctl reload-or-restart proxmox-backup proxmox-backup-proxy",
+	}, "\n")
+	if got := strings.Join(*calls, "\n"); got != wantCalls {
+		t.Errorf("calls:\n%s\nwant:\n%s", got, wantCalls)
+	}
+
+	var report bytes.Buffer
+	if err := writeServiceReport(&report, steps); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(report.String(), "[failed] network: ifreload -a (simulated failure)") {
+		t.Errorf("report lacks the failed step:\n%s", report.String())
+	}
+}
+
+func TestRestoreServicesStopFailureAbortsReloads(t *testing.T) {
+	calls := fakeServiceCommands(t, map[string]bool{"systemctl stop pve-cluster": true})
+	steps := planServiceSteps(servicePlanFor(map[string]restorePlanAction{
+		"/var/lib/pve-cluster/config.db": planOverwrite,
+		"/etc/ssh/sshd_config":           planOverwrite,
+	}))
+
+	if err := stopRestoreServices(context.Background(), steps, newTestLogger()); err == nil {
+		t.Fatal("expected error when a unit cannot be stopped")
+	}
+	applyRestoreServices(context.Background(), steps, newTestLogger())
+	if got := (*calls)[len(*calls)-1]; got != "systemctl stop pve-cluster" {
+		t.Errorf("service commands ran after the failed stop: %v", *calls)
+	}
+	want := strings.Join([]string{
+		"stop systemctl stop pve-cluster [failed]",
+		"start systemctl start pve-cluster [skipped]",
+		"apply systemctl reload-or-restart ssh [skipped]",
+	}, "\n")
+	if got := describeSteps(steps); got != want {
+		t.Errorf("steps:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,402 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+)
+
+// restoreSource is the archive a restore reads. Every pass over it opens the
+// stored file again and streams it through age decryption and decompression,
+// so no plaintext copy of the archive is ever written to disk.
+type restoreSource struct {
+	// Name is the archive name without .age; it selects the decompressor
+	Name       string
+	path       string // bundle or archive file as stored
+	member     string // archive entry inside the bundle; empty for raw archives
+	identities []age.Identity
+
+	// volumes is set when the archive is split: path names the archive and
+	// the volumes are stored next to it
+	volumes []backup.ArchiveVolume
+
+	optimizations     *backup.OptimizationManifest
+	optimizationsRead bool
+	cleanup           func()
+
+	// repository is set when the archive is a repository snapshot; ctx
+	// bounds the reads of its blobs
+	repository *backup.Repository
+	ctx        context.Context
+
+	// layers is set for an incremental backup merged with its parents: the
+	// archives of the chain from the full backup to the newest increment,
+	// read in turn instead of one stream (see mergeBackupChain)
+	layers []restoreLayer
+}
+
+// restoreLayer is one archive of a merged incremental chain and the
+// archive entries it restores
+type restoreLayer struct {
+	src  *restoreSource
+	owns func(name string) bool
+}
+
+// archivePass is one archive a restore pass reads and the filter selecting
+// the entries written from it
+type archivePass struct {
+	src    *restoreSource
+	filter *restoreFilter
+}
+
+// passes returns the archives a restore pass reads in turn, each with
+// filter restricted to the entries it restores
+func (s *restoreSource) passes(filter *restoreFilter) []archivePass {
+	if len(s.layers) == 0 {
+		return []archivePass{{src: s, filter: filter}}
+	}
+	passes := make([]archivePass, 0, len(s.layers))
+	for _, layer := range s.layers {
+		passes = append(passes, archivePass{src: layer.src, filter: filter.within(layer.owns)})
+	}
+	return passes
+}
+
+// localArchiveSource reads an unencrypted archive file
+func localArchiveSource(path string) *restoreSource {
+	return &restoreSource{Name: filepath.Base(path), path: path}
+}
+
+// Open returns the decrypted and decompressed tar stream
+func (s *restoreSource) Open() (io.ReadCloser, error) {
+	if len(s.layers) > 0 {
+		return nil, fmt.Errorf("incremental backup %s is read one archive of its chain at a time", s.Name)
+	}
+	raw, err := s.openRaw()
+	if err != nil {
+		return nil, err
+	}
+	var plain io.Reader = raw
+	if len(s.identities) > 0 {
+		if plain, err = age.Decrypt(raw, s.identities...); err != nil {
+			raw.Close()
+			return nil, fmt.Errorf("decrypt archive: %w", err)
+		}
+	}
+	if s.repository != nil {
+		return s.openSnapshot(plain, raw), nil
+	}
+	reader, err := createDecompressionReader(plain, s.Name)
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("create decompression reader: %w", err)
+	}
+	return &sourceStream{Reader: reader, layers: []io.Closer{reader, raw}}, nil
+}
+
+// openRaw returns the archive as stored, still encrypted. The volumes of a
+// split archive are read in sequence and checked against their checksums.
+func (s *restoreSource) openRaw() (io.ReadCloser, error) {
+	if len(s.volumes) > 0 {
+		dir := filepath.Dir(s.path)
+		return backup.OpenVolumes(s.volumes, func(name string) (io.ReadCloser, error) {
+			return os.Open(filepath.Join(dir, filepath.Base(name)))
+		}), nil
+	}
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("open archive: %w", err)
+	}
+	if s.member == "" {
+		return file, nil
+	}
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			file.Close()
+			return nil, fmt.Errorf("archive %s not found in bundle %s", s.member, filepath.Base(s.path))
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read bundle: %w", err)
+		}
+		if hdr.Name == s.member {
+			return &sourceStream{Reader: tr, layers: []io.Closer{file}}, nil
+		}
+	}
+}
+
+// checkIdentities reports whether identities decrypt the archive. Only the
+// age header is read.
+func (s *restoreSource) checkIdentities(identities ...age.Identity) error {
+	raw, err := s.openRaw()
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+	_, err = age.Decrypt(raw, identities...)
+	return err
+}
+
+// verifyChecksum hashes the stored archive and compares it with the
+// content of its .sha256 file
+func (s *restoreSource) verifyChecksum(ctx context.Context, checksumData []byte, logger *logging.Logger) error {
+	expected, err := parseChecksumFile(checksumData, s.Name)
+	if err != nil {
+		return err
+	}
+	raw, err := s.openRaw()
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, &contextReader{ctx: ctx, r: raw}); err != nil {
+		return fmt.Errorf("generate checksum: %w", err)
+	}
+	actual := fmt.Sprintf("%x", hasher.Sum(nil))
+	if !strings.EqualFold(expected, actual) {
+		return fmt.Errorf("archive %s does not match its checksum (expected %s, got %s)", s.Name, expected, actual)
+	}
+	logger.Info("Archive checksum verified: %s", actual)
+	return nil
+}
+
+// Close removes the downloaded copy of a cloud backup
+func (s *restoreSource) Close() {
+	if s != nil && s.cleanup != nil {
+		s.cleanup()
+	}
+}
+
+// prepareRestoreSource locates the archive of the candidate and the
+// identities that decrypt it, without decrypting anything. Backups that only
+// exist on the cloud remote are downloaded encrypted. When identities is
+// empty the key/passphrase is requested interactively. Incremental backups
+// are merged with their parents (see mergeBackupChain).
+func prepareRestoreSource(ctx context.Context, reader *bufio.Reader, cand *decryptCandidate, identities []age.Identity, logger *logging.Logger) (*restoreSource, error) {
+	src, err := prepareArchiveSource(ctx, cand, identities, logger)
+	if err != nil || cand.Manifest.Parent == "" {
+		return src, err
+	}
+	return prepareChainSource(ctx, src, cand, identities, logger)
+}
+
+// prepareArchiveSource prepares the archive of a single backup
+func prepareArchiveSource(ctx context.Context, cand *decryptCandidate, identities []age.Identity, logger *logging.Logger) (*restoreSource, error) {
+	src := &restoreSource{}
+	if cand.Cloud != nil {
+		dir, err := os.MkdirTemp("", "proxmox-restore-*")
+		if err != nil {
+			return nil, fmt.Errorf("create temp dir: %w", err)
+		}
+		src.cleanup = func() { _ = os.RemoveAll(dir) }
+		local, err := downloadCloudCandidate(ctx, cand, dir, logger)
+		if err != nil {
+			src.Close()
+			return nil, err
+		}
+		// Callers keep the listing-based candidate: give them the real manifest
+		cand.Manifest = local.Manifest
+		cand = local
+	}
+
+	if err := src.locate(cand); err != nil {
+		src.Close()
+		return nil, err
+	}
+	if cand.Repository != nil {
+		// Snapshots carry no optimizations: every file is stored as is
+		src.repository, src.ctx = cand.Repository, ctx
+		src.optimizationsRead = true
+	}
+	if cand.Checksummed {
+		data, err := readCandidateChecksum(cand)
+		if err == nil {
+			err = src.verifyChecksum(ctx, data, logger)
+		}
+		if err != nil {
+			src.Close()
+			return nil, err
+		}
+	}
+
+	logger.Info("Preparing archive %s for streaming restore (mode: %s)", cand.Manifest.ArchivePath, statusFromManifest(cand.Manifest))
+	if !strings.EqualFold(cand.Manifest.EncryptionMode, "age") {
+		return src, nil
+	}
+
+	if len(identities) > 0 {
+		if err := src.checkIdentities(identities...); err != nil {
+			src.Close()
+			return nil, fmt.Errorf("decrypt archive: %w", err)
+		}
+		src.identities = identities
+		return src, nil
+	}
+	identity, err := promptDecryptIdentity(ctx, logger, func(identity age.Identity) error {
+		return src.checkIdentities(identity)
+	})
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	src.identities = []age.Identity{identity}
+	return src, nil
+}
+
+// locate points the source at the archive of a local candidate
+func (s *restoreSource) locate(cand *decryptCandidate) error {
+	switch cand.Source {
+	case sourceBundle:
+		member, err := bundleArchiveMember(cand.BundlePath)
+		if err != nil {
+			return err
+		}
+		s.path, s.member = cand.BundlePath, member
+	case sourceRaw:
+		s.path = cand.RawArchivePath
+		s.volumes = cand.Manifest.Volumes
+	default:
+		return fmt.Errorf("unsupported candidate source")
+	}
+	s.Name = strings.TrimSuffix(filepath.Base(s.path), ".bundle.tar")
+	if s.member != "" {
+		s.Name = filepath.Base(s.member)
+	}
+	s.Name = strings.TrimSuffix(s.Name, ".age")
+	return nil
+}
+
+// bundleArchiveMember returns the name of the archive entry of a bundle
+func bundleArchiveMember(bundlePath string) (string, error) {
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		return "", fmt.Errorf("open bundle: %w", err)
+	}
+	defer file.Close()
+
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return "", fmt.Errorf("bundle missing required files")
+		}
+		if err != nil {
+			return "", fmt.Errorf("read bundle: %w", err)
+		}
+		if hdr.FileInfo().IsDir() || isBundleSidecar(hdr.Name) {
+			continue
+		}
+		return hdr.Name, nil
+	}
+}
+
+// checkArchiveStored reports an error unless the archive of a raw backup
+// is stored at archivePath or, for a split archive, every volume listed by
+// its manifest is stored next to it
+func checkArchiveStored(archivePath string, manifest *backup.Manifest) error {
+	if len(manifest.Volumes) == 0 {
+		_, err := os.Stat(archivePath)
+		return err
+	}
+	for _, volume := range manifest.Volumes {
+		name := filepath.Base(volume.Name)
+		if _, err := os.Stat(filepath.Join(filepath.Dir(archivePath), name)); err != nil {
+			return fmt.Errorf("volume %s of %s: %w", name, filepath.Base(archivePath), err)
+		}
+	}
+	return nil
+}
+
+func isBundleSidecar(name string) bool {
+	for _, suffix := range []string{".sha256", ".metadata", ".manifest.json", backup.ContentIndexSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readCandidateChecksum returns the .sha256 file of the candidate archive
+func readCandidateChecksum(cand *decryptCandidate) ([]byte, error) {
+	if cand.Source == sourceRaw {
+		data, err := os.ReadFile(cand.RawChecksumPath)
+		if err != nil {
+			return nil, fmt.Errorf("read checksum file: %w", err)
+		}
+		return data, nil
+	}
+
+	file, err := os.Open(cand.BundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("open bundle: %w", err)
+	}
+	defer file.Close()
+	member, err := bundleArchiveMember(cand.BundlePath)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("checksum file %s.sha256 not found in bundle", filepath.Base(member))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read bundle: %w", err)
+		}
+		if hdr.Name == member+".sha256" {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// parseChecksumFile returns the hash of a "<sha256>  <name>" checksum file
+func parseChecksumFile(data []byte, name string) (string, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("checksum file %s.sha256 is empty", name)
+	}
+	return fields[0], nil
+}
+
+// sourceStream reads the innermost layer of a stream and closes every layer
+type sourceStream struct {
+	io.Reader
+	layers []io.Closer
+}
+
+func (s *sourceStream) Close() error {
+	var first error
+	for _, c := range s.layers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// contextReader stops a long copy when ctx is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,619 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/config"
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+)
+
+var ErrRollbackAborted = errors.New("rollback aborted by user")
+
+const (
+	rollbackFilePrefix  = "rollback-"
+	rollbackArchiveExt  = ".tar.gz"
+	rollbackManifestExt = ".json"
+	rollbackAgeExt      = ".age"
+)
+
+// rollbackManifest is stored next to each rollback archive. Saved paths are
+// inside the archive; Created paths did not exist before the restore and are
+// removed by a rollback. Paths are relative to Target.
+type rollbackManifest struct {
+	ID           string     `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Backup       string     `json:"backup"`
+	Target       string     `json:"target"`
+	Saved        []string   `json:"saved"`
+	Created      []string   `json:"created"`
+	RolledBackAt *time.Time `json:"rolled_back_at,omitempty"`
+	// Encrypted snapshots are age-encrypted to the AGE recipients of the
+	// backups (rollback-<id>.tar.gz.age)
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+func rollbackArchivePath(dir, id string, encrypted bool) string {
+	path := filepath.Join(dir, rollbackFilePrefix+id+rollbackArchiveExt)
+	if encrypted {
+		path += rollbackAgeExt
+	}
+	return path
+}
+
+func rollbackManifestPath(dir, id string) string {
+	return filepath.Join(dir, rollbackFilePrefix+id+rollbackManifestExt)
+}
+
+// snapshotNeeded reports whether the plan changes anything that a rollback
+// would have to undo. Restores into / are always snapshotted.
+func snapshotNeeded(plan *restorePlan) bool {
+	if plan.Target == "/" {
+		return len(plan.Entries) > 0
+	}
+	for _, e := range plan.Entries {
+		if e.Action != planCreate && e.Action != planUnchanged {
+			return true
+		}
+	}
+	return false
+}
+
+// rollbackSettings configures where and how rollback snapshots are stored
+type rollbackSettings struct {
+	dir string
+	// keep is the number of snapshots kept; older ones are removed when a
+	// new snapshot is taken (0 keeps all)
+	keep int
+	// recipients encrypt the snapshot; nil stores it unencrypted
+	recipients []age.Recipient
+}
+
+// newRollbackSettings reads ROLLBACK_PATH and ROLLBACK_KEEP. With
+// ENCRYPT_ARCHIVE the snapshots are encrypted to the configured AGE
+// recipients; the interactive recipient setup never runs during a restore.
+func newRollbackSettings(cfg *config.Config) (rollbackSettings, error) {
+	settings := rollbackSettings{dir: cfg.RollbackPath, keep: cfg.RollbackKeep}
+	if !cfg.EncryptArchive {
+		return settings, nil
+	}
+	recipients, _, err := (&Orchestrator{cfg: cfg}).collectRecipientStrings()
+	if err != nil {
+		return settings, err
+	}
+	if len(recipients) == 0 {
+		return settings, fmt.Errorf("ENCRYPT_ARCHIVE is enabled but no AGE recipients are configured to encrypt the rollback snapshot (use --no-rollback to skip it)")
+	}
+	if settings.recipients, err = parseRecipientStrings(recipients); err != nil {
+		return settings, err
+	}
+	return settings, nil
+}
+
+// createRollbackSnapshot archives the current state of every path the plan
+// is about to modify into <dir>/rollback-<id>.tar.gz[.age] and records the
+// paths it is about to create. Snapshots beyond settings.keep are removed,
+// oldest first.
+func createRollbackSnapshot(ctx context.Context, plan *restorePlan, settings rollbackSettings, logger *logging.Logger) (*rollbackManifest, error) {
+	dir := settings.dir
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create rollback directory: %w", err)
+	}
+
+	now := time.Now()
+	id := now.Format("20060102-150405")
+	for i := 2; ; i++ {
+		if _, err := os.Stat(rollbackManifestPath(dir, id)); os.IsNotExist(err) {
+			break
+		}
+		id = fmt.Sprintf("%s-%d", now.Format("20060102-150405"), i)
+	}
+
+	manifest := &rollbackManifest{
+		ID:        id,
+		CreatedAt: now,
+		Backup:    plan.Backup,
+		Target:    plan.Target,
+		Saved:     []string{},
+		Created:   []string{},
+		Encrypted: len(settings.recipients) > 0,
+	}
+
+	archivePath := rollbackArchivePath(dir, id, manifest.Encrypted)
+	file, err := os.OpenFile(archivePath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("create rollback archive: %w", err)
+	}
+	// The snapshot holds live copies of files such as /etc/shadow: with
+	// encryption enabled nothing is written in plaintext
+	var out io.Writer = file
+	var encrypted io.WriteCloser
+	if manifest.Encrypted {
+		if encrypted, err = age.Encrypt(file, settings.recipients...); err != nil {
+			file.Close()
+			_ = os.Remove(archivePath)
+			return nil, fmt.Errorf("encrypt rollback archive: %w", err)
+		}
+		out = encrypted
+	}
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	fail := func(err error) (*rollbackManifest, error) {
+		tw.Close()
+		gz.Close()
+		file.Close()
+		_ = os.Remove(archivePath)
+		return nil, err
+	}
+
+	created := make(map[string]struct{})
+	for _, entry := range plan.Entries {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+		rel := strings.TrimPrefix(entry.Path, "/")
+		if rel == "" {
+			continue
+		}
+		switch entry.Action {
+		case planUnchanged:
+			continue
+		case planCreate:
+			// Record missing parents too: extraction creates them with MkdirAll
+			for p := rel; p != "." && p != "/"; p = filepath.Dir(p) {
+				if _, seen := created[p]; seen {
+					break
+				}
+				if _, err := os.Lstat(filepath.Join(plan.Target, p)); err == nil {
+					break
+				}
+				created[p] = struct{}{}
+			}
+			continue
+		}
+		if err := addRollbackEntry(tw, plan.Target, rel); err != nil {
+			return fail(fmt.Errorf("save %s: %w", entry.Path, err))
+		}
+		manifest.Saved = append(manifest.Saved, rel)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fail(fmt.Errorf("finalize rollback archive: %w", err))
+	}
+	if err := gz.Close(); err != nil {
+		return fail(fmt.Errorf("finalize rollback archive: %w", err))
+	}
+	if encrypted != nil {
+		if err := encrypted.Close(); err != nil {
+			return fail(fmt.Errorf("finalize rollback archive: %w", err))
+		}
+	}
+	if err := file.Close(); err != nil {
+		return fail(fmt.Errorf("finalize rollback archive: %w", err))
+	}
+
+	for p := range created {
+		manifest.Created = append(manifest.Created, p)
+	}
+	sort.Strings(manifest.Created)
+
+	if err := writeRollbackManifest(dir, manifest); err != nil {
+		_ = os.Remove(archivePath)
+		return nil, err
+	}
+	logger.Debug("Rollback snapshot %s: %d saved, %d to be created", id, len(manifest.Saved), len(manifest.Created))
+	pruneRollbackSnapshots(dir, settings.keep, logger)
+	return manifest, nil
+}
+
+// pruneRollbackSnapshots removes the oldest snapshots so that at most keep
+// remain (0 keeps all). Failures are logged: they never block a restore.
+func pruneRollbackSnapshots(dir string, keep int, logger *logging.Logger) {
+	if keep <= 0 {
+		return
+	}
+	snapshots, err := listRollbackSnapshots(dir)
+	if err != nil {
+		logger.Warning("Failed to list rollback snapshots for pruning: %v", err)
+		return
+	}
+	for _, m := range snapshots[min(keep, len(snapshots)):] {
+		if err := deleteRollbackSnapshot(dir, m); err != nil {
+			logger.Warning("Failed to remove old rollback snapshot %s: %v", m.ID, err)
+			continue
+		}
+		logger.Debug("Removed old rollback snapshot %s (ROLLBACK_KEEP=%d)", m.ID, keep)
+	}
+}
+
+// deleteRollbackSnapshot removes the archive and the manifest of a snapshot
+func deleteRollbackSnapshot(dir string, m *rollbackManifest) error {
+	if err := os.Remove(rollbackArchivePath(dir, m.ID, m.Encrypted)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(rollbackManifestPath(dir, m.ID))
+}
+
+// addRollbackEntry stores the current state of root/rel in the archive.
+// Directories are stored without their content.
+func addRollbackEntry(tw *tar.Writer, root, rel string) error {
+	path := filepath.Join(root, rel)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(rel)
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	header.Format = tar.FormatPAX
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func writeRollbackManifest(dir string, manifest *rollbackManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode rollback manifest: %w", err)
+	}
+	if err := os.WriteFile(rollbackManifestPath(dir, manifest.ID), data, 0o600); err != nil {
+		return fmt.Errorf("write rollback manifest: %w", err)
+	}
+	return nil
+}
+
+// listRollbackSnapshots returns the snapshots stored in dir, newest first
+func listRollbackSnapshots(dir string) ([]*rollbackManifest, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, rollbackFilePrefix+"*"+rollbackManifestExt))
+	if err != nil {
+		return nil, err
+	}
+	var manifests []*rollbackManifest
+	for _, path := range matches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var m rollbackManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		manifests = append(manifests, &m)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].CreatedAt.After(manifests[j].CreatedAt) })
+	return manifests, nil
+}
+
+// resolveRollbackSnapshot finds a snapshot by id or "latest"
+func resolveRollbackSnapshot(dir, id string) (*rollbackManifest, error) {
+	snapshots, err := listRollbackSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("no rollback snapshots found in %s", dir)
+	}
+	if id == "latest" {
+		return snapshots[0], nil
+	}
+	for _, m := range snapshots {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	ids := make([]string, 0, len(snapshots))
+	for _, m := range snapshots {
+		ids = append(ids, m.ID)
+	}
+	return nil, fmt.Errorf("rollback snapshot %q not found (available: %s)", id, strings.Join(ids, ", "))
+}
+
+// RollbackOptions configures RunRestoreRollback
+type RollbackOptions struct {
+	// ID selects the snapshot; "latest" picks the newest and "list" only
+	// prints the available snapshots. With Delete, "all" selects every
+	// snapshot.
+	ID string
+	// Delete removes the selected snapshots instead of applying one.
+	Delete bool
+	// IdentityFile holds the AGE identity (or deterministic passphrase) that
+	// decrypts an encrypted snapshot without prompting.
+	IdentityFile string
+	// AssumeYes skips the typed ROLLBACK confirmation.
+	AssumeYes bool
+	// Output receives the snapshot listing (default stdout).
+	Output io.Writer
+}
+
+// RunRestoreRollback puts back the files saved before a restore and removes
+// the files that restore created.
+func RunRestoreRollback(ctx context.Context, cfg *config.Config, logger *logging.Logger, opts RollbackOptions) error {
+	if cfg == nil {
+		return fmt.Errorf("configuration not available")
+	}
+	dir := cfg.RollbackPath
+	if strings.TrimSpace(dir) == "" {
+		return fmt.Errorf("ROLLBACK_PATH is not configured")
+	}
+	output := opts.Output
+	if output == nil {
+		output = os.Stdout
+	}
+
+	if opts.ID == "list" {
+		snapshots, err := listRollbackSnapshots(dir)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(output, "%-20s %-19s %-8s %-8s %-8s %-9s %s\n", "ID", "CREATED", "SAVED", "CREATED", "APPLIED", "ENCRYPTED", "BACKUP")
+		for _, m := range snapshots {
+			applied, encrypted := "no", "no"
+			if m.RolledBackAt != nil {
+				applied = "yes"
+			}
+			if m.Encrypted {
+				encrypted = "yes"
+			}
+			fmt.Fprintf(output, "%-20s %-19s %-8d %-8d %-8s %-9s %s\n", m.ID, m.CreatedAt.Format("2006-01-02 15:04:05"),
+				len(m.Saved), len(m.Created), applied, encrypted, m.Backup)
+		}
+		return nil
+	}
+
+	if opts.Delete {
+		return deleteRollbackSnapshots(dir, opts.ID, logger)
+	}
+
+	manifest, err := resolveRollbackSnapshot(dir, opts.ID)
+	if err != nil {
+		return err
+	}
+	var identities []age.Identity
+	if manifest.Encrypted {
+		if identities, err = rollbackIdentities(ctx, dir, manifest, opts, logger); err != nil {
+			return err
+		}
+	}
+	if manifest.Target == "/" && os.Geteuid() != 0 {
+		return fmt.Errorf("rollback of %s requires root privileges", manifest.Target)
+	}
+
+	logger.Info("Rollback snapshot %s taken %s before restoring %s into %s",
+		manifest.ID, manifest.CreatedAt.Format("2006-01-02 15:04:05"), manifest.Backup, manifest.Target)
+	logger.Info("  %d paths will be put back, %d paths created by the restore will be removed",
+		len(manifest.Saved), len(manifest.Created))
+	if manifest.RolledBackAt != nil {
+		logger.Warning("This snapshot was already applied on %s", manifest.RolledBackAt.Format("2006-01-02 15:04:05"))
+	}
+
+	if !opts.AssumeYes {
+		if err := confirmRollback(ctx, bufio.NewReader(os.Stdin), manifest); err != nil {
+			return err
+		}
+	}
+
+	// Remove created paths deepest first so directories are empty when reached
+	created := append([]string(nil), manifest.Created...)
+	sort.Slice(created, func(i, j int) bool { return len(created[i]) > len(created[j]) })
+	for _, rel := range created {
+		target, err := restoreTargetPath(manifest.Target, rel)
+		if err != nil {
+			logger.Warning("Skipping %s: %v", rel, err)
+			continue
+		}
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			logger.Warning("Failed to remove %s: %v", target, err)
+		}
+	}
+
+	restored, err := extractRollbackArchive(ctx, rollbackArchivePath(dir, manifest.ID, manifest.Encrypted), identities, manifest.Target, logger)
+	if err != nil {
+		// The snapshot is not marked as applied, so it can be run again
+		// once the failed paths are fixed
+		var failed *extractFailedError
+		if errors.As(err, &failed) {
+			logger.Warning("Rollback %s incomplete: %d paths restored, %d failed", manifest.ID, restored, failed.failed)
+		}
+		return fmt.Errorf("rollback %s: %w", manifest.ID, err)
+	}
+
+	now := time.Now()
+	manifest.RolledBackAt = &now
+	if err := writeRollbackManifest(dir, manifest); err != nil {
+		logger.Warning("Failed to mark snapshot %s as applied: %v", manifest.ID, err)
+	}
+	logger.Info("Rollback %s completed: %d paths restored, %d created paths removed", manifest.ID, restored, len(created))
+	return nil
+}
+
+// deleteRollbackSnapshots removes the snapshot selected by id ("latest",
+// an id or "all")
+func deleteRollbackSnapshots(dir, id string, logger *logging.Logger) error {
+	var selected []*rollbackManifest
+	if id == "all" {
+		snapshots, err := listRollbackSnapshots(dir)
+		if err != nil {
+			return err
+		}
+		selected = snapshots
+	} else {
+		manifest, err := resolveRollbackSnapshot(dir, id)
+		if err != nil {
+			return err
+		}
+		selected = []*rollbackManifest{manifest}
+	}
+	for _, m := range selected {
+		if err := deleteRollbackSnapshot(dir, m); err != nil {
+			return fmt.Errorf("delete rollback snapshot %s: %w", m.ID, err)
+		}
+		logger.Info("Rollback snapshot %s deleted", m.ID)
+	}
+	if len(selected) == 0 {
+		logger.Info("No rollback snapshots to delete in %s", dir)
+	}
+	return nil
+}
+
+// rollbackIdentities returns the identities that decrypt an encrypted
+// snapshot: from opts.IdentityFile, or prompted for when interactive
+func rollbackIdentities(ctx context.Context, dir string, manifest *rollbackManifest, opts RollbackOptions, logger *logging.Logger) ([]age.Identity, error) {
+	archivePath := rollbackArchivePath(dir, manifest.ID, true)
+	check := func(identities ...age.Identity) error {
+		file, err := os.Open(archivePath)
+		if err != nil {
+			return fmt.Errorf("open rollback archive: %w", err)
+		}
+		defer file.Close()
+		_, err = age.Decrypt(file, identities...)
+		return err
+	}
+	if strings.TrimSpace(opts.IdentityFile) != "" {
+		identities, err := loadIdentityFile(opts.IdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := check(identities...); err != nil {
+			return nil, fmt.Errorf("identity file %s cannot decrypt rollback snapshot %s: %w", opts.IdentityFile, manifest.ID, err)
+		}
+		return identities, nil
+	}
+	if opts.AssumeYes {
+		return nil, fmt.Errorf("rollback snapshot %s is encrypted: an identity file is required for unattended rollback", manifest.ID)
+	}
+	identity, err := promptDecryptIdentity(ctx, logger, func(id age.Identity) error { return check(id) })
+	if err != nil {
+		if errors.Is(err, ErrDecryptAborted) {
+			return nil, ErrRollbackAborted
+		}
+		return nil, err
+	}
+	return []age.Identity{identity}, nil
+}
+
+// extractRollbackArchive writes the saved entries back. A path whose type
+// changed during the restore (e.g. a file that replaced an empty directory)
+// is removed first so the original can be recreated. Encrypted snapshots
+// are decrypted in streaming with identities. Entries that cannot be
+// written are reported together as an *extractFailedError.
+func extractRollbackArchive(ctx context.Context, archivePath string, identities []age.Identity, destRoot string, logger *logging.Logger) (int, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return 0, fmt.Errorf("open rollback archive: %w", err)
+	}
+	defer file.Close()
+	var in io.Reader = file
+	if len(identities) > 0 {
+		if in, err = age.Decrypt(file, identities...); err != nil {
+			return 0, fmt.Errorf("decrypt rollback archive: %w", err)
+		}
+	}
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return 0, fmt.Errorf("read rollback archive: %w", err)
+	}
+	defer gz.Close()
+
+	tarReader := tar.NewReader(gz)
+	restored := 0
+	var failed *extractFailedError
+	entryFailed := func(name string, err error) {
+		logger.Warning("Failed to roll back %s: %v", name, err)
+		if failed == nil {
+			failed = &extractFailedError{first: fmt.Errorf("%s: %w", name, err)}
+		}
+		failed.failed++
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return restored, err
+		}
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return restored, fmt.Errorf("read rollback archive: %w", err)
+		}
+		target, err := restoreTargetPath(destRoot, header.Name)
+		if err != nil {
+			entryFailed(header.Name, err)
+			continue
+		}
+		if current, err := os.Lstat(target); err == nil && current.IsDir() != (header.Typeflag == tar.TypeDir) {
+			if err := os.Remove(target); err != nil {
+				logger.Warning("Failed to remove %s before rollback: %v", target, err)
+			}
+		}
+		if err := extractTarEntry(tarReader, header, destRoot, logger); err != nil {
+			entryFailed(header.Name, err)
+			continue
+		}
+		restored++
+	}
+	if failed != nil {
+		return restored, failed
+	}
+	return restored, nil
+}
+
+func confirmRollback(ctx context.Context, reader *bufio.Reader, manifest *rollbackManifest) error {
+	fmt.Println()
+	fmt.Printf("Rollback snapshot: %s (%s)\n", manifest.ID, manifest.CreatedAt.Format("2006-01-02 15:04:05"))
+	fmt.Printf("Target: %s\n", manifest.Target)
+	fmt.Println("WARNING: files changed since the restore will be replaced by their pre-restore version.")
+	fmt.Println("Type ROLLBACK to proceed or 0 to cancel.")
+
+	for {
+		fmt.Print("Confirmation: ")
+		input, err := readLineWithContext(ctx, reader)
+		if err != nil {
+			return err
+		}
+		switch strings.TrimSpace(input) {
+		case "ROLLBACK":
+			return nil
+		case "0":
+			return ErrRollbackAborted
+		default:
+			fmt.Println("Please type ROLLBACK to confirm or 0 to cancel.")
+		}
+	}
+}
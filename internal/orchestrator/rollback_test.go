@@ -0,0 +1,246 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/config"
+)
+
+func TestRestoreRollbackRoundTrip(t *testing.T) {
+	backupDir := t.TempDir()
+	target := t.TempDir()
+	rollbackDir := filepath.Join(t.TempDir(), "rollback")
+
+	archive := buildTestTar(t, map[string]string{
+		"etc/hosts":                    "127.0.0.1 restored\n",
+		"etc/network/interfaces":       "auto vmbr0\n",
+		"etc/pve/qemu-server/105.conf": "cores: 4\n",
+	})
+	writeTestBundle(t, backupDir, "pve1-backup-20250101-010000.tar", time.Now(), archive, nil)
+
+	if err := os.MkdirAll(filepath.Join(target, "etc/network"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(target, "etc/hosts"), []byte("127.0.0.1 live\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("interfaces.live", filepath.Join(target, "etc/network/interfaces")); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{BackupPath: backupDir, RollbackPath: rollbackDir}
+	opts := RestoreOptions{Source: "latest", TargetRoot: target, AssumeYes: true}
+	if err := RunRestoreWorkflow(context.Background(), cfg, newTestLogger(), "test", opts); err != nil {
+		t.Fatalf("RunRestoreWorkflow: %v", err)
+	}
+	if got := readTestFile(t, filepath.Join(target, "etc/hosts")); got != "127.0.0.1 restored\n" {
+		t.Fatalf("restore did not overwrite hosts: %q", got)
+	}
+
+	snapshots, err := listRollbackSnapshots(rollbackDir)
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("listRollbackSnapshots = %v, %v; want one snapshot", snapshots, err)
+	}
+	snap := snapshots[0]
+	if strings.Join(snap.Saved, ",") != "etc/hosts,etc/network/interfaces" {
+		t.Errorf("saved = %v", snap.Saved)
+	}
+	if strings.Join(snap.Created, ",") != "etc/pve,etc/pve/qemu-server,etc/pve/qemu-server/105.conf" {
+		t.Errorf("created = %v", snap.Created)
+	}
+
+	var listing bytes.Buffer
+	if err := RunRestoreRollback(context.Background(), cfg, newTestLogger(), RollbackOptions{ID: "list", Output: &listing}); err != nil {
+		t.Fatalf("rollback list: %v", err)
+	}
+	if !strings.Contains(listing.String(), snap.ID) {
+		t.Errorf("listing lacks %s:\n%s", snap.ID, listing.String())
+	}
+
+	if err := RunRestoreRollback(context.Background(), cfg, newTestLogger(), RollbackOptions{ID: "missing", AssumeYes: true}); err == nil {
+		t.Error("expected error for unknown snapshot id")
+	}
+	if err := RunRestoreRollback(context.Background(), cfg, newTestLogger(), RollbackOptions{ID: snap.ID, AssumeYes: true}); err != nil {
+		t.Fatalf("RunRestoreRollback: %v", err)
+	}
+
+	if got := readTestFile(t, filepath.Join(target, "etc/hosts")); got != "127.0.0.1 live\n" {
+		t.Errorf("hosts after rollback = %q", got)
+	}
+	if link, err := os.Readlink(filepath.Join(target, "etc/network/interfaces")); err != nil || link != "interfaces.live" {
+		t.Errorf("interfaces symlink after rollback = %q, %v", link, err)
+	}
+	if _, err := os.Lstat(filepath.Join(target, "etc/pve")); !os.IsNotExist(err) {
+		t.Errorf("etc/pve created by the restore still exists (err=%v)", err)
+	}
+
+	snapshots, err = listRollbackSnapshots(rollbackDir)
+	if err != nil || len(snapshots) != 1 || snapshots[0].RolledBackAt == nil {
+		t.Errorf("snapshot not marked as applied: %+v, %v", snapshots, err)
+	}
+}
+
+func TestRestoreRollbackReportsFailedPaths(t *testing.T) {
+	backupDir := t.TempDir()
+	target := t.TempDir()
+	rollbackDir := filepath.Join(t.TempDir(), "rollback")
+
+	archive := buildTestTar(t, map[string]string{
+		"etc/hosts":              "127.0.0.1 restored\n",
+		"etc/network/interfaces": "auto vmbr0\n",
+	})
+	writeTestBundle(t, backupDir, "pve1-backup-20250101-010000.tar", time.Now(), archive, nil)
+	for name, body := range map[string]string{"etc/hosts": "127.0.0.1 live\n", "etc/network/interfaces": "auto eno1\n"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(target, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(target, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.Config{BackupPath: backupDir, RollbackPath: rollbackDir}
+	opts := RestoreOptions{Source: "latest", TargetRoot: target, AssumeYes: true}
+	if err := RunRestoreWorkflow(context.Background(), cfg, newTestLogger(), "test", opts); err != nil {
+		t.Fatalf("RunRestoreWorkflow: %v", err)
+	}
+	snapshots, err := listRollbackSnapshots(rollbackDir)
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("listRollbackSnapshots = %v, %v; want one snapshot", snapshots, err)
+	}
+
+	// A file where the saved directory was: etc/network/interfaces cannot
+	// be put back
+	if err := os.RemoveAll(filepath.Join(target, "etc/network")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(target, "etc/network"), []byte("blocked\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = RunRestoreRollback(context.Background(), cfg, newTestLogger(), RollbackOptions{ID: snapshots[0].ID, AssumeYes: true})
+	var failed *extractFailedError
+	if !errors.As(err, &failed) || failed.failed != 1 {
+		t.Fatalf("RunRestoreRollback error = %v; want one failed path", err)
+	}
+	if got := readTestFile(t, filepath.Join(target, "etc/hosts")); got != "127.0.0.1 live\n" {
+		t.Errorf("hosts after partial rollback = %q", got)
+	}
+	snapshots, err = listRollbackSnapshots(rollbackDir)
+	if err != nil || len(snapshots) != 1 || snapshots[0].RolledBackAt != nil {
+		t.Errorf("partial rollback marked as applied: %+v, %v", snapshots, err)
+	}
+}
+
+func TestRestoreWithoutChangesSkipsSnapshot(t *testing.T) {
+	backupDir := t.TempDir()
+	target := filepath.Join(t.TempDir(), "staging")
+	rollbackDir := filepath.Join(t.TempDir(), "rollback")
+
+	archive := buildTestTar(t, map[string]string{"etc/hostname": "pve1\n"})
+	writeTestBundle(t, backupDir, "pve1-backup-20250101-010000.tar", time.Now(), archive, nil)
+
+	cfg := &config.Config{BackupPath: backupDir, RollbackPath: rollbackDir}
+	opts := RestoreOptions{Source: "latest", TargetRoot: target, AssumeYes: true}
+	if err := RunRestoreWorkflow(context.Background(), cfg, newTestLogger(), "test", opts); err != nil {
+		t.Fatalf("RunRestoreWorkflow: %v", err)
+	}
+	if snapshots, _ := listRollbackSnapshots(rollbackDir); len(snapshots) != 0 {
+		t.Errorf("staging restore into an empty directory took %d snapshots", len(snapshots))
+	}
+}
+
+func TestRollbackSnapshotsEncryptedAndPruned(t *testing.T) {
+	backupDir := t.TempDir()
+	target := t.TempDir()
+	rollbackDir := filepath.Join(t.TempDir(), "rollback")
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "age.key")
+	if err := os.WriteFile(keyFile, []byte(identity.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := buildTestTar(t, map[string]string{"etc/shadow": "root:restored:19000::::::\n"})
+	writeTestBundle(t, backupDir, "pve1-backup-20250101-010000.tar", time.Now(), archive, nil)
+
+	cfg := &config.Config{
+		BackupPath:     backupDir,
+		RollbackPath:   rollbackDir,
+		RollbackKeep:   2,
+		EncryptArchive: true,
+		AgeRecipients:  []string{identity.Recipient().String()},
+	}
+	opts := RestoreOptions{Source: "latest", TargetRoot: target, AssumeYes: true}
+	if err := os.MkdirAll(filepath.Join(target, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		live := fmt.Sprintf("root:live%d:19000::::::\n", i)
+		if err := os.WriteFile(filepath.Join(target, "etc/shadow"), []byte(live), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := RunRestoreWorkflow(context.Background(), cfg, newTestLogger(), "test", opts); err != nil {
+			t.Fatalf("restore %d: %v", i, err)
+		}
+	}
+
+	snapshots, err := listRollbackSnapshots(rollbackDir)
+	if err != nil || len(snapshots) != 2 {
+		t.Fatalf("listRollbackSnapshots = %d, %v; want the 2 newest (ROLLBACK_KEEP=2)", len(snapshots), err)
+	}
+	files, _ := filepath.Glob(filepath.Join(rollbackDir, "*"))
+	if len(files) != 4 {
+		t.Errorf("rollback directory holds %v; want 2 archives and 2 manifests", files)
+	}
+	for _, m := range snapshots {
+		data, err := os.ReadFile(rollbackArchivePath(rollbackDir, m.ID, true))
+		if err != nil || !m.Encrypted {
+			t.Fatalf("snapshot %s not encrypted: %v", m.ID, err)
+		}
+		if bytes.Contains(data, []byte("root:live")) || !bytes.HasPrefix(data, []byte("age-encryption.org/")) {
+			t.Errorf("snapshot %s is not an age file", m.ID)
+		}
+	}
+
+	// An encrypted snapshot needs the identity for an unattended rollback
+	if err := RunRestoreRollback(context.Background(), cfg, newTestLogger(), RollbackOptions{ID: "latest", AssumeYes: true}); err == nil {
+		t.Error("expected error for an encrypted snapshot without identity")
+	}
+	rollback := RollbackOptions{ID: "latest", IdentityFile: keyFile, AssumeYes: true}
+	if err := RunRestoreRollback(context.Background(), cfg, newTestLogger(), rollback); err != nil {
+		t.Fatalf("RunRestoreRollback: %v", err)
+	}
+	if got := readTestFile(t, filepath.Join(target, "etc/shadow")); got != "root:live3:19000::::::\n" {
+		t.Errorf("shadow after rollback = %q", got)
+	}
+
+	if err := RunRestoreRollback(context.Background(), cfg, newTestLogger(), RollbackOptions{ID: "all", Delete: true}); err != nil {
+		t.Fatalf("delete all: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(rollbackDir, "*")); len(files) != 0 {
+		t.Errorf("snapshots left after delete: %v", files)
+	}
+
+	// Without recipients the snapshot is refused rather than written in plaintext
+	cfg.AgeRecipients = nil
+	cfg.BaseDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(target, "etc/shadow"), []byte("root:live4:19000::::::\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunRestoreWorkflow(context.Background(), cfg, newTestLogger(), "test", opts); err == nil || !strings.Contains(err.Error(), "no AGE recipients") {
+		t.Errorf("restore without recipients: err = %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/tis24dev/proxmox-backup/internal/backup"
 	"github.com/tis24dev/proxmox-backup/internal/config"
 	"github.com/tis24dev/proxmox-backup/internal/logging"
 	"github.com/tis24dev/proxmox-backup/internal/storage"
@@ -85,9 +86,18 @@ func (s *StorageAdapter) Sync(ctx context.Context, stats *BackupStats) error {
 		Version:     stats.Version,
 	}
 
-	// Step 3: Store backup
+	// Step 3: Store backup (or its snapshot in repository mode)
+	repo, err := s.repository(stats)
+	if err != nil {
+		return err
+	}
 	s.logger.Step("%s: Storing backup", s.backend.Name())
-	if err := s.backend.Store(ctx, stats.ArchivePath, metadata); err != nil {
+	if repo != nil {
+		err = s.storeSnapshot(ctx, repo, stats)
+	} else {
+		err = s.backend.Store(ctx, stats.ArchivePath, metadata)
+	}
+	if err != nil {
 		// Check if error is critical
 		if s.backend.IsCritical() {
 			return fmt.Errorf("%s store operation failed (CRITICAL): %w", s.backend.Name(), err)
@@ -112,8 +122,13 @@ func (s *StorageAdapter) Sync(ctx context.Context, stats *BackupStats) error {
 		}
 		s.logRetentionPolicyDetails(retentionConfig)
 
-		s.logCurrentBackupCount()
-		deleted, err := s.backend.ApplyRetention(ctx, retentionConfig)
+		var deleted int
+		if repo != nil {
+			deleted, err = storage.ApplyRepositoryRetention(ctx, repo, retentionConfig, s.logger)
+		} else {
+			s.logCurrentBackupCount()
+			deleted, err = s.backend.ApplyRetention(ctx, retentionConfig)
+		}
 		if err != nil {
 			// Check if error is critical
 			if s.backend.IsCritical() {
@@ -124,7 +139,7 @@ func (s *StorageAdapter) Sync(ctx context.Context, stats *BackupStats) error {
 			s.logger.Warning("WARNING: %s retention failed: %v", s.backend.Name(), err)
 			hasWarnings = true
 		} else if deleted > 0 {
-			if reporter, ok := s.backend.(storage.RetentionReporter); ok {
+			if reporter, ok := s.backend.(storage.RetentionReporter); ok && repo == nil {
 				summary := reporter.LastRetentionSummary()
 				backupsDeleted := summary.BackupsDeleted
 				if backupsDeleted == 0 {
@@ -143,6 +158,9 @@ func (s *StorageAdapter) Sync(ctx context.Context, stats *BackupStats) error {
 
 	// Step 5: Get and log statistics
 	storageStats, err := s.backend.GetStats(ctx)
+	if err == nil && repo != nil {
+		err = applyRepositoryStats(ctx, repo, storageStats)
+	}
 	if err != nil {
 		s.logger.Debug("%s: Failed to get statistics: %v", s.backend.Name(), err)
 	} else {
@@ -169,6 +187,59 @@ func (s *StorageAdapter) Sync(ctx context.Context, stats *BackupStats) error {
 	return nil
 }
 
+// repository returns the repository of the backend when the run stores a
+// snapshot (BACKUP_REPOSITORY), nil otherwise
+func (s *StorageAdapter) repository(stats *BackupStats) (*backup.Repository, error) {
+	if stats == nil || stats.repository == nil {
+		return nil, nil
+	}
+	backend, ok := s.backend.(storage.RepositoryBackend)
+	if !ok {
+		return nil, fmt.Errorf("%s does not support BACKUP_REPOSITORY", s.backend.Name())
+	}
+	return backup.NewRepository(backend.RepositoryStore(), s.logger), nil
+}
+
+// storeSnapshot writes the snapshot of the run and the blobs the repository
+// lacks. The primary storage reports the size this backup added.
+func (s *StorageAdapter) storeSnapshot(ctx context.Context, repo *backup.Repository, stats *BackupStats) error {
+	snapshot := stats.repository
+	result, err := repo.WriteSnapshot(ctx, snapshot.root, snapshot.name, snapshot.index, snapshot.manifest, snapshot.recipients, snapshot.blobKey)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("%s: snapshot %s stored in %s: %d new blobs (%s), %d of %d files already stored",
+		s.backend.Name(), result.File, repo, result.NewBlobs, formatBytes(result.NewBytes), result.ReusedBlobs, result.Files)
+	if s.backend.Location() == storage.LocationPrimary {
+		stats.ArchiveSize = result.Size + result.NewBytes
+		stats.CompressedSize = stats.ArchiveSize
+		stats.Checksum = result.SHA256
+		stats.updateCompressionMetrics()
+	}
+	return nil
+}
+
+// applyRepositoryStats replaces the backup count and size of storageStats
+// with those of the repository
+func applyRepositoryStats(ctx context.Context, repo *backup.Repository, storageStats *storage.StorageStats) error {
+	snapshots, err := storage.RepositorySnapshots(ctx, repo)
+	if err != nil {
+		return err
+	}
+	size, err := repo.Size(ctx)
+	if err != nil {
+		return err
+	}
+	storageStats.TotalBackups = len(snapshots)
+	storageStats.TotalSize = size
+	storageStats.OldestBackup, storageStats.NewestBackup = nil, nil
+	if len(snapshots) > 0 {
+		newest, oldest := snapshots[0].Timestamp, snapshots[len(snapshots)-1].Timestamp
+		storageStats.NewestBackup, storageStats.OldestBackup = &newest, &oldest
+	}
+	return nil
+}
+
 func (s *StorageAdapter) logCurrentBackupCount() {
 	listable, ok := s.backend.(interface {
 		List(context.Context) ([]*types.BackupMetadata, error)
@@ -224,7 +295,11 @@ func (s *StorageAdapter) applyStorageStats(storageStats *storage.StorageStats, r
 	var gfsStats map[storage.RetentionCategory]int
 	if retentionConfig.Policy == "gfs" {
 		// Get backups list for classification
-		if listable, ok := s.backend.(interface {
+		if repo, err := s.repository(stats); repo != nil && err == nil {
+			if snapshots, err := storage.RepositorySnapshots(context.Background(), repo); err == nil && len(snapshots) > 0 {
+				gfsStats = storage.GetRetentionStats(storage.ClassifyBackupsGFS(snapshots, retentionConfig))
+			}
+		} else if listable, ok := s.backend.(interface {
 			List(context.Context) ([]*types.BackupMetadata, error)
 		}); ok {
 			backups, err := listable.List(context.Background())
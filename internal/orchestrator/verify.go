@@ -0,0 +1,454 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/storage"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+// Verification results of a stored backup (verify command)
+const (
+	VerifyOK             = "ok"
+	VerifyCorrupted      = "corrupted"
+	VerifyMissingSidecar = "missing-sidecar"
+	VerifyUnreadable     = "unreadable"
+)
+
+// How the checksum of a stored backup was obtained
+const (
+	verifyMethodLocal      = "local"
+	verifyMethodRemoteHash = "remote-hash"
+	verifyMethodDownload   = "download"
+)
+
+// verifySidecarMaxSize bounds the .sha256 and .metadata files read
+const verifySidecarMaxSize = 1 << 20
+
+// errStreamChecked stops feeding the test decompression once it is done
+var errStreamChecked = errors.New("tar stream checked")
+
+// VerifyOptions configures VerifyStoredBackup
+type VerifyOptions struct {
+	// Deep streams backups whose checksum the remote computes itself, so
+	// their tar stream is tested too
+	Deep bool
+	// IdentityFile decrypts the blobs of encrypted repository snapshots,
+	// so their content can be re-hashed
+	IdentityFile string
+}
+
+// VerifyResult is the outcome of verifying one stored backup
+type VerifyResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Method is local, remote-hash (computed by the remote) or download
+	// (streamed from the remote and hashed here)
+	Method string `json:"method"`
+	// Stream is the result of the test decompression of the tar stream
+	Stream string `json:"stream"`
+}
+
+// checksumSource is one recorded checksum of an archive
+type checksumSource struct {
+	name string // ".sha256" or "manifest"
+	sum  string
+}
+
+// archiveCheck is what reading a stored archive found
+type archiveCheck struct {
+	sum       string
+	entries   int
+	tested    bool
+	streamErr error // decompression or tar error: the archive is corrupted
+	readErr   error // the stored file could not be read
+}
+
+// VerifyStoredBackup re-hashes a backup listed by backend and compares it
+// with its .sha256 sidecar and manifest. Unencrypted archives are also
+// decompressed and every tar entry is read. Nothing is written to disk.
+func VerifyStoredBackup(ctx context.Context, backend storage.Storage, meta *types.BackupMetadata, opts VerifyOptions) VerifyResult {
+	name := filepath.Base(meta.BackupFile)
+	archive := strings.TrimSuffix(name, ".bundle.tar")
+	result := VerifyResult{Name: archive, Method: verifyMethodLocal}
+	if backend.Location() == storage.LocationCloud {
+		result.Method = verifyMethodDownload
+	}
+
+	reader, ok := backend.(storage.BackupReader)
+	if !ok {
+		result.Status = VerifyUnreadable
+		result.Detail = fmt.Sprintf("%s cannot read back stored backups", backend.Name())
+		return result
+	}
+	// Encrypted archives cannot be decompressed without the key
+	test := !strings.HasSuffix(archive, ".age") && !strings.EqualFold(meta.EncryptionMode, "age")
+
+	var check archiveCheck
+	var recorded []checksumSource
+	if archive != name {
+		check, recorded = verifyBundle(ctx, reader, meta.BackupFile, archive, test)
+	} else {
+		if meta.Checksum != "" {
+			recorded = append(recorded, checksumSource{name: "manifest", sum: meta.Checksum})
+		}
+		sidecar, err := readChecksumSidecar(ctx, reader, meta.BackupFile, archive)
+		switch {
+		case err == nil:
+			recorded = append(recorded, checksumSource{name: ".sha256", sum: sidecar})
+		case !errors.Is(err, os.ErrNotExist):
+			result.Status = VerifyUnreadable
+			result.Detail = err.Error()
+			return result
+		}
+		if len(meta.Volumes) > 0 {
+			check = verifyVolumes(ctx, reader, meta.Volumes, archive, test)
+		} else {
+			check = verifyRawArchive(ctx, backend, reader, meta.BackupFile, archive, test, opts, &result)
+		}
+	}
+	return finishVerify(result, check, recorded)
+}
+
+// VerifyRepositorySnapshot re-hashes a repository snapshot file and compares
+// it with its .sha256 sidecar and manifest, then reads every blob the
+// snapshot refers to. Blobs are decompressed and compared with their content
+// hash; encrypted blobs are only read unless opts.IdentityFile decrypts them.
+func VerifyRepositorySnapshot(ctx context.Context, repo *backup.Repository, location storage.BackupLocation, meta *types.BackupMetadata, opts VerifyOptions) VerifyResult {
+	file := meta.BackupFile
+	result := VerifyResult{Name: file, Method: verifyMethodLocal}
+	if location == storage.LocationCloud {
+		result.Method = verifyMethodDownload
+	}
+
+	var identities []age.Identity
+	if strings.TrimSpace(opts.IdentityFile) != "" {
+		loaded, err := loadIdentityFile(opts.IdentityFile)
+		if err != nil {
+			result.Status = VerifyUnreadable
+			result.Detail = fmt.Sprintf("load identity: %v", err)
+			return result
+		}
+		identities = loaded
+	}
+
+	var recorded []checksumSource
+	if sum, err := readRepositorySidecar(ctx, repo, file); err == nil {
+		recorded = append(recorded, checksumSource{name: ".sha256", sum: sum})
+	} else if !errors.Is(err, os.ErrNotExist) {
+		result.Status = VerifyUnreadable
+		result.Detail = err.Error()
+		return result
+	}
+	if rc, err := repo.OpenSnapshotFile(ctx, file+".metadata"); err == nil {
+		var manifest backup.Manifest
+		if err := json.NewDecoder(io.LimitReader(rc, verifySidecarMaxSize)).Decode(&manifest); err == nil && manifest.SHA256 != "" {
+			recorded = append(recorded, checksumSource{name: "manifest", sum: manifest.SHA256})
+		}
+		rc.Close()
+	}
+
+	rc, err := repo.OpenSnapshotFile(ctx, file)
+	if err != nil {
+		result.Status = VerifyUnreadable
+		result.Detail = err.Error()
+		return result
+	}
+	check := checkArchiveStream(ctx, rc, file, false)
+	rc.Close()
+
+	var blobs backup.BlobCheck
+	if check.readErr == nil {
+		blobs, err = repo.CheckBlobs(ctx, file, identities)
+		switch {
+		case errors.Is(err, backup.ErrBlobDamaged):
+			check.streamErr = err
+		case err != nil:
+			check.readErr = err
+		}
+	}
+	result = finishVerify(result, check, recorded)
+	if check.readErr == nil && check.streamErr == nil {
+		if blobs.Verified == blobs.Blobs {
+			result.Stream = fmt.Sprintf("ok (%d re-hashed)", blobs.Blobs)
+		} else {
+			result.Stream = fmt.Sprintf("not re-hashed (%d encrypted, read only; use --identity)", blobs.Blobs)
+		}
+	}
+	return result
+}
+
+// readRepositorySidecar returns the hash recorded in the .sha256 sidecar of
+// a repository snapshot
+func readRepositorySidecar(ctx context.Context, repo *backup.Repository, file string) (string, error) {
+	rc, err := repo.OpenSnapshotFile(ctx, file+".sha256")
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, verifySidecarMaxSize))
+	if err != nil {
+		return "", fmt.Errorf("read %s.sha256: %w", file, err)
+	}
+	return parseChecksumFile(data, file)
+}
+
+// verifyVolumes streams the volumes of a split archive in order. Every
+// volume is checked against its own .sha256 sidecar, and the joined stream
+// is hashed and tested like an archive stored as a single file.
+func verifyVolumes(ctx context.Context, reader storage.BackupReader, volumes []string, archive string, test bool) archiveCheck {
+	recorded := make([]backup.ArchiveVolume, 0, len(volumes))
+	for _, volume := range volumes {
+		sum, err := readChecksumSidecar(ctx, reader, volume, filepath.Base(volume))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return archiveCheck{readErr: err}
+		}
+		recorded = append(recorded, backup.ArchiveVolume{Name: volume, SHA256: sum})
+	}
+	rc := backup.OpenVolumes(recorded, func(name string) (io.ReadCloser, error) {
+		return reader.Open(ctx, name)
+	})
+	defer rc.Close()
+	check := checkArchiveStream(ctx, rc, archive, test)
+	if errors.Is(check.readErr, backup.ErrVolumeMismatch) {
+		// The volume was read: its content is wrong
+		check = archiveCheck{streamErr: check.readErr}
+	}
+	return check
+}
+
+// verifyRawArchive hashes an archive stored without bundle. Remotes that
+// compute SHA-256 themselves are not downloaded unless opts.Deep is set.
+func verifyRawArchive(ctx context.Context, backend storage.Storage, reader storage.BackupReader, backupFile, archive string, test bool, opts VerifyOptions, result *VerifyResult) archiveCheck {
+	if hasher, ok := backend.(storage.RemoteHasher); ok && !opts.Deep {
+		sum, err := hasher.RemoteSHA256(ctx, backupFile)
+		if err == nil {
+			result.Method = verifyMethodRemoteHash
+			return archiveCheck{sum: sum}
+		}
+		if !errors.Is(err, storage.ErrHashUnsupported) {
+			return archiveCheck{readErr: err}
+		}
+	}
+
+	rc, err := reader.Open(ctx, backupFile)
+	if err != nil {
+		return archiveCheck{readErr: err}
+	}
+	defer rc.Close()
+	return checkArchiveStream(ctx, rc, archive, test)
+}
+
+// verifyBundle streams a bundle once: the archive member is hashed and
+// tested, and the checksum sidecar and manifest are read from the bundle
+func verifyBundle(ctx context.Context, reader storage.BackupReader, bundlePath, archive string, test bool) (archiveCheck, []checksumSource) {
+	rc, err := reader.Open(ctx, bundlePath)
+	if err != nil {
+		return archiveCheck{readErr: err}, nil
+	}
+	defer rc.Close()
+
+	var check archiveCheck
+	var recorded []checksumSource
+	found := false
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			check.streamErr = fmt.Errorf("read bundle: %w", err)
+			return check, recorded
+		}
+		switch filepath.Base(hdr.Name) {
+		case archive:
+			check = checkArchiveStream(ctx, tr, archive, test)
+			if check.readErr != nil {
+				return check, recorded
+			}
+			found = true
+		case archive + ".sha256":
+			data, err := io.ReadAll(io.LimitReader(tr, verifySidecarMaxSize))
+			if err != nil {
+				return archiveCheck{readErr: err}, recorded
+			}
+			if sum, err := parseChecksumFile(data, archive); err == nil {
+				recorded = append(recorded, checksumSource{name: ".sha256", sum: sum})
+			}
+		case archive + ".metadata":
+			var manifest backup.Manifest
+			if err := json.NewDecoder(io.LimitReader(tr, verifySidecarMaxSize)).Decode(&manifest); err == nil && manifest.SHA256 != "" {
+				recorded = append(recorded, checksumSource{name: "manifest", sum: manifest.SHA256})
+			}
+		}
+	}
+	if !found {
+		return archiveCheck{streamErr: fmt.Errorf("archive %s not found in bundle", archive)}, recorded
+	}
+	return check, recorded
+}
+
+// readChecksumSidecar returns the hash recorded in backupFile.sha256
+func readChecksumSidecar(ctx context.Context, reader storage.BackupReader, backupFile, archive string) (string, error) {
+	rc, err := reader.Open(ctx, backupFile+".sha256")
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, verifySidecarMaxSize))
+	if err != nil {
+		return "", fmt.Errorf("read %s.sha256: %w", archive, err)
+	}
+	return parseChecksumFile(data, archive)
+}
+
+// checkArchiveStream hashes a stored archive and, when test is set, feeds
+// the same bytes to a decompressor reading every tar entry. The archive is
+// hashed to the end even when the test stops early.
+func checkArchiveStream(ctx context.Context, r io.Reader, archive string, test bool) archiveCheck {
+	hasher := sha256.New()
+	if !test {
+		if _, err := io.Copy(hasher, &contextReader{ctx: ctx, r: r}); err != nil {
+			return archiveCheck{readErr: err}
+		}
+		return archiveCheck{sum: hex.EncodeToString(hasher.Sum(nil))}
+	}
+
+	pr, pw := io.Pipe()
+	type streamResult struct {
+		entries int
+		err     error
+	}
+	done := make(chan streamResult, 1)
+	go func() {
+		entries, err := readTarStream(pr, strings.TrimSuffix(archive, ".age"))
+		pr.CloseWithError(errStreamChecked)
+		done <- streamResult{entries, err}
+	}()
+
+	feeding := true
+	buf := make([]byte, 256<<10)
+	var readErr error
+	for {
+		if readErr = ctx.Err(); readErr != nil {
+			break
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			hasher.Write(buf[:n])
+			if feeding {
+				if _, werr := pw.Write(buf[:n]); werr != nil {
+					feeding = false
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+	if readErr != nil {
+		pw.CloseWithError(readErr)
+	} else {
+		pw.Close()
+	}
+	res := <-done
+	if readErr != nil {
+		return archiveCheck{readErr: readErr}
+	}
+	return archiveCheck{
+		sum:       hex.EncodeToString(hasher.Sum(nil)),
+		entries:   res.entries,
+		tested:    true,
+		streamErr: res.err,
+	}
+}
+
+// readTarStream decompresses an archive and reads every entry and the
+// compressed stream to its end, so trailing checksums are checked too
+func readTarStream(r io.Reader, archiveName string) (int, error) {
+	dec, err := createDecompressionReader(r, archiveName)
+	if err != nil {
+		return 0, err
+	}
+	defer dec.Close()
+
+	entries := 0
+	tr := tar.NewReader(dec)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entries, fmt.Errorf("read tar header: %w", err)
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return entries, fmt.Errorf("read %s: %w", hdr.Name, err)
+		}
+		entries++
+	}
+	if _, err := io.Copy(io.Discard, dec); err != nil {
+		return entries, fmt.Errorf("decompress: %w", err)
+	}
+	return entries, nil
+}
+
+// finishVerify classifies the outcome: unreadable, then corrupted, then
+// missing sidecar
+func finishVerify(result VerifyResult, check archiveCheck, recorded []checksumSource) VerifyResult {
+	if check.readErr != nil {
+		result.Status = VerifyUnreadable
+		result.Detail = check.readErr.Error()
+		return result
+	}
+	result.SHA256 = check.sum
+	switch {
+	case check.tested && check.streamErr == nil:
+		result.Stream = fmt.Sprintf("ok (%d entries)", check.entries)
+	case check.tested || check.streamErr != nil:
+		result.Stream = "failed"
+	case result.Method == verifyMethodRemoteHash:
+		result.Stream = "not tested (checksum computed by the remote; use --deep)"
+	default:
+		result.Stream = "not tested (encrypted)"
+	}
+
+	if check.streamErr != nil {
+		result.Status = VerifyCorrupted
+		result.Detail = check.streamErr.Error()
+		return result
+	}
+	for _, src := range recorded {
+		if !strings.EqualFold(src.sum, check.sum) {
+			result.Status = VerifyCorrupted
+			result.Detail = fmt.Sprintf("checksum mismatch: %s records %s, archive hashes to %s", src.name, src.sum, check.sum)
+			return result
+		}
+	}
+	if len(recorded) == 0 {
+		result.Status = VerifyMissingSidecar
+		result.Detail = "no .sha256 sidecar or manifest checksum to compare with"
+		return result
+	}
+	result.Status = VerifyOK
+	return result
+}
@@ -0,0 +1,234 @@
+package orchestrator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/storage"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+// fakeVerifyBackend serves stored backups from a directory
+type fakeVerifyBackend struct {
+	storage.Storage
+	dir      string
+	location storage.BackupLocation
+	opened   []string
+}
+
+func (f *fakeVerifyBackend) Name() string                     { return "fake" }
+func (f *fakeVerifyBackend) Location() storage.BackupLocation { return f.location }
+
+func (f *fakeVerifyBackend) Open(ctx context.Context, backupFile string) (io.ReadCloser, error) {
+	f.opened = append(f.opened, filepath.Base(backupFile))
+	return os.Open(filepath.Join(f.dir, filepath.Base(backupFile)))
+}
+
+// fakeHashingBackend is a remote that computes SHA-256 itself
+type fakeHashingBackend struct {
+	fakeVerifyBackend
+	sum string
+	err error
+}
+
+func (f *fakeHashingBackend) RemoteSHA256(ctx context.Context, backupFile string) (string, error) {
+	return f.sum, f.err
+}
+
+func writeVerifyArchive(t *testing.T, dir, name string, data []byte, sidecar string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if sidecar != "" {
+		if err := os.WriteFile(path+".sha256", []byte(sidecar+"  "+name+"\n"), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func gzipTestData(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyStoredBackupRawArchive(t *testing.T) {
+	dir := t.TempDir()
+	backend := &fakeVerifyBackend{dir: dir, location: storage.LocationPrimary}
+	archive := gzipTestData(t, buildTestTar(t, map[string]string{"etc/hostname": "pve1\n", "etc/hosts": "127.0.0.1 localhost\n"}))
+	ctx := context.Background()
+
+	path := writeVerifyArchive(t, dir, "ok.tar.gz", archive, sha256Hex(archive))
+	got := VerifyStoredBackup(ctx, backend, &types.BackupMetadata{BackupFile: path, Checksum: sha256Hex(archive)}, VerifyOptions{})
+	if got.Status != VerifyOK || got.Stream != "ok (2 entries)" || got.Method != verifyMethodLocal || got.SHA256 != sha256Hex(archive) {
+		t.Errorf("ok archive: %+v", got)
+	}
+
+	path = writeVerifyArchive(t, dir, "mismatch.tar.gz", archive, strings.Repeat("0", 64))
+	got = VerifyStoredBackup(ctx, backend, &types.BackupMetadata{BackupFile: path}, VerifyOptions{})
+	if got.Status != VerifyCorrupted || !strings.Contains(got.Detail, ".sha256 records") {
+		t.Errorf("checksum mismatch: %+v", got)
+	}
+
+	truncated := archive[:len(archive)-12]
+	path = writeVerifyArchive(t, dir, "truncated.tar.gz", truncated, sha256Hex(truncated))
+	got = VerifyStoredBackup(ctx, backend, &types.BackupMetadata{BackupFile: path}, VerifyOptions{})
+	if got.Status != VerifyCorrupted || got.Stream != "failed" {
+		t.Errorf("truncated archive: %+v", got)
+	}
+
+	path = writeVerifyArchive(t, dir, "nosidecar.tar.gz", archive, "")
+	got = VerifyStoredBackup(ctx, backend, &types.BackupMetadata{BackupFile: path}, VerifyOptions{})
+	if got.Status != VerifyMissingSidecar {
+		t.Errorf("missing sidecar: %+v", got)
+	}
+
+	got = VerifyStoredBackup(ctx, backend, &types.BackupMetadata{BackupFile: filepath.Join(dir, "gone.tar.gz"), Checksum: sha256Hex(archive)}, VerifyOptions{})
+	if got.Status != VerifyUnreadable {
+		t.Errorf("missing archive: %+v", got)
+	}
+}
+
+func TestVerifyStoredBackupBundle(t *testing.T) {
+	dir := t.TempDir()
+	backend := &fakeVerifyBackend{dir: dir, location: storage.LocationSecondary}
+	archive := buildTestTar(t, map[string]string{"etc/hostname": "pve1\n"})
+	created := time.Date(2025, 1, 1, 1, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	plain := writeTestBundle(t, dir, "plain.tar", created, archive, nil)
+	got := VerifyStoredBackup(ctx, backend, &types.BackupMetadata{BackupFile: plain}, VerifyOptions{})
+	if got.Status != VerifyOK || got.Name != "plain.tar" || got.Stream != "ok (1 entries)" {
+		t.Errorf("plain bundle: %+v", got)
+	}
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := writeTestBundle(t, dir, "secret.tar", created, archive, identity.Recipient())
+	got = VerifyStoredBackup(ctx, backend, &types.BackupMetadata{BackupFile: encrypted, EncryptionMode: "age"}, VerifyOptions{})
+	if got.Status != VerifyOK || got.Stream != "not tested (encrypted)" {
+		t.Errorf("encrypted bundle: %+v", got)
+	}
+
+	// Flip a byte of the archive member: the bundle sidecar no longer matches
+	data, err := os.ReadFile(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := bytes.Index(data, []byte("pve1\n"))
+	if idx < 0 {
+		t.Fatal("archive content not found in bundle")
+	}
+	data[idx] = 'X'
+	if err := os.WriteFile(plain, data, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	got = VerifyStoredBackup(ctx, backend, &types.BackupMetadata{BackupFile: plain}, VerifyOptions{})
+	if got.Status != VerifyCorrupted || !strings.Contains(got.Detail, "checksum mismatch") {
+		t.Errorf("damaged bundle: %+v", got)
+	}
+}
+
+func TestVerifyStoredBackupRemoteHash(t *testing.T) {
+	dir := t.TempDir()
+	archive := gzipTestData(t, buildTestTar(t, map[string]string{"etc/hostname": "pve1\n"}))
+	path := writeVerifyArchive(t, dir, "remote.tar.gz", archive, sha256Hex(archive))
+	meta := &types.BackupMetadata{BackupFile: "remote:pbs/remote.tar.gz"}
+	ctx := context.Background()
+
+	backend := &fakeHashingBackend{fakeVerifyBackend: fakeVerifyBackend{dir: dir, location: storage.LocationCloud}, sum: sha256Hex(archive)}
+	got := VerifyStoredBackup(ctx, backend, meta, VerifyOptions{})
+	if got.Status != VerifyOK || got.Method != verifyMethodRemoteHash || !strings.HasPrefix(got.Stream, "not tested") {
+		t.Errorf("remote hash: %+v", got)
+	}
+	for _, name := range backend.opened {
+		if name == filepath.Base(path) {
+			t.Error("archive was downloaded although the remote computed the checksum")
+		}
+	}
+
+	got = VerifyStoredBackup(ctx, backend, meta, VerifyOptions{Deep: true})
+	if got.Status != VerifyOK || got.Method != verifyMethodDownload || got.Stream != "ok (1 entries)" {
+		t.Errorf("deep: %+v", got)
+	}
+
+	backend.sum, backend.err = "", storage.ErrHashUnsupported
+	got = VerifyStoredBackup(ctx, backend, meta, VerifyOptions{})
+	if got.Status != VerifyOK || got.Method != verifyMethodDownload {
+		t.Errorf("hash unsupported: %+v", got)
+	}
+
+	backend.sum, backend.err = sha256Hex([]byte("other")), nil
+	got = VerifyStoredBackup(ctx, backend, meta, VerifyOptions{})
+	if got.Status != VerifyCorrupted {
+		t.Errorf("remote mismatch: %+v", got)
+	}
+}
+
+func TestVerifyStoredBackupSplitArchive(t *testing.T) {
+	dir := t.TempDir()
+	backend := &fakeVerifyBackend{dir: dir, location: storage.LocationSecondary}
+	archive := gzipTestData(t, buildTestTar(t, map[string]string{"etc/hostname": "pve1\n", "etc/hosts": "127.0.0.1 localhost\n"}))
+	ctx := context.Background()
+
+	path := writeVerifyArchive(t, dir, "split.tar.gz", archive, sha256Hex(archive))
+	volumes, err := backup.SplitArchive(ctx, newTestLogger(), path, int64(len(archive)/2+1))
+	if err != nil || len(volumes) != 2 {
+		t.Fatalf("SplitArchive = %+v (%v), want 2 volumes", volumes, err)
+	}
+	meta := &types.BackupMetadata{BackupFile: path, Checksum: sha256Hex(archive)}
+	for _, v := range volumes {
+		meta.Volumes = append(meta.Volumes, filepath.Join(dir, v.Name))
+	}
+
+	got := VerifyStoredBackup(ctx, backend, meta, VerifyOptions{})
+	if got.Status != VerifyOK || got.Stream != "ok (2 entries)" || got.SHA256 != sha256Hex(archive) {
+		t.Errorf("split archive: %+v", got)
+	}
+	if want := []string{"split.tar.gz.sha256", "split.tar.gz.001.sha256", "split.tar.gz.002.sha256", "split.tar.gz.001", "split.tar.gz.002"}; strings.Join(backend.opened, ",") != strings.Join(want, ",") {
+		t.Errorf("opened %v, want %v", backend.opened, want)
+	}
+
+	second := filepath.Join(dir, volumes[1].Name)
+	data, err := os.ReadFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(second, data, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	got = VerifyStoredBackup(ctx, backend, meta, VerifyOptions{})
+	if got.Status != VerifyCorrupted || !strings.Contains(got.Detail, volumes[1].Name) {
+		t.Errorf("damaged volume: %+v", got)
+	}
+}
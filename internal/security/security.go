@@ -209,20 +209,7 @@ func (c *Checker) checkDependencies() {
 
 func (c *Checker) buildDependencyList() []dependencyEntry {
 	deps := []dependencyEntry{
-		c.binaryDependency("tar", []string{"tar"}, true, "required for archive verification and bundle handling"),
-	}
-
-	switch c.cfg.CompressionType {
-	case types.CompressionXZ:
-		deps = append(deps, c.binaryDependency("xz", []string{"xz"}, true, "compression type set to xz"))
-	case types.CompressionZstd:
-		deps = append(deps, c.binaryDependency("zstd", []string{"zstd"}, true, "compression type set to zstd"))
-	case types.CompressionPigz:
-		deps = append(deps, c.binaryDependency("pigz", []string{"pigz"}, true, "compression type set to pigz"))
-	case types.CompressionBzip2:
-		deps = append(deps, c.binaryDependency("pbzip2/bzip2", []string{"pbzip2", "bzip2"}, true, "compression type set to bzip2"))
-	case types.CompressionLZMA:
-		deps = append(deps, c.binaryDependency("lzma", []string{"lzma"}, true, "compression type set to lzma"))
+		c.binaryDependency("tar", []string{"tar"}, true, "required for bundle handling"),
 	}
 
 	if c.cfg.CloudEnabled && strings.TrimSpace(c.cfg.CloudRemote) != "" {
@@ -400,6 +387,7 @@ func (c *Checker) verifySensitiveFiles() {
 		optional    bool
 	}{
 		{filepath.Join(c.cfg.BaseDir, "identity", ".server_identity"), 0o600, "server identity file", true},
+		{filepath.Join(c.cfg.BaseDir, "identity", "age", "repository.key"), 0o600, "repository key", true},
 	}
 
 	ageRecipientPath := c.cfg.AgeRecipientFile
@@ -466,6 +454,7 @@ func (c *Checker) verifyDirectories() {
 		{c.cfg.LogPath, 0o755},
 		{c.cfg.LockPath, 0o755},
 		{c.cfg.SecureAccount, 0o700},
+		{c.cfg.RollbackPath, 0o700},
 		{filepath.Join(c.cfg.BaseDir, "identity"), 0o700},
 		{filepath.Join(c.cfg.BaseDir, "identity", "age"), 0o700},
 	}
@@ -37,11 +37,13 @@ func stubLookPath(existing map[string]bool) func(string) (string, error) {
 
 func TestCheckDependenciesMissingRequiredAddsError(t *testing.T) {
 	cfg := &config.Config{
-		CompressionType: types.CompressionXZ, // requires xz binary in addition to tar
+		CompressionType: types.CompressionXZ, // compressed in-process, no xz binary needed
+		CloudEnabled:    true,
+		CloudRemote:     "remote", // requires rclone in addition to tar
 	}
 	checker := newCheckerForTest(cfg, stubLookPath(map[string]bool{
 		"tar": true, // present
-		// "xz" missing
+		// "xz" and "rclone" missing
 	}))
 
 	checker.checkDependencies()
@@ -50,7 +52,7 @@ func TestCheckDependenciesMissingRequiredAddsError(t *testing.T) {
 		t.Fatalf("expected 1 error, got %d issues=%+v", got, checker.result.Issues)
 	}
 	msg := checker.result.Issues[0].Message
-	if !strings.Contains(msg, "Required dependency") || !strings.Contains(msg, "xz") {
+	if !strings.Contains(msg, "Required dependency") || !strings.Contains(msg, "rclone") {
 		t.Fatalf("unexpected issue message: %s", msg)
 	}
 }
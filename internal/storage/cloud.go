@@ -2,8 +2,15 @@ package storage
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"os"
 	"os/exec"
 	"path"
@@ -13,6 +20,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/tis24dev/proxmox-backup/internal/backup"
 	"github.com/tis24dev/proxmox-backup/internal/config"
 	"github.com/tis24dev/proxmox-backup/internal/logging"
 	"github.com/tis24dev/proxmox-backup/internal/types"
@@ -36,6 +44,7 @@ type CloudStorage struct {
 	parallelJobs   int
 	parallelVerify bool
 	execCommand    func(ctx context.Context, name string, args ...string) ([]byte, error)
+	openCommand    func(ctx context.Context, name string, args ...string) (io.ReadCloser, error)
 	lookPath       func(string) (string, error)
 	sleep          func(time.Duration)
 	lastRet        RetentionSummary
@@ -48,6 +57,11 @@ func (c *CloudStorage) remoteLabel() string {
 	return c.remote + ":"
 }
 
+// RemoteLabel returns the rclone reference of the backup directory (remote:path)
+func (c *CloudStorage) RemoteLabel() string {
+	return c.remoteLabel()
+}
+
 func (c *CloudStorage) remoteBase() string {
 	return c.remoteLabel()
 }
@@ -87,6 +101,61 @@ func remoteDirRef(ref string) string {
 	return fmt.Sprintf("%s:%s", remoteName, dir)
 }
 
+// defaultOpenCommand streams the stdout of a command. The exit status is
+// reported when the output has been read to the end; a remote object that
+// does not exist is reported as os.ErrNotExist.
+func defaultOpenCommand(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	stream := &commandStream{cmd: cmd}
+	cmd.Stderr = &stream.stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	stream.stdout = stdout
+	return stream, nil
+}
+
+type commandStream struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr strings.Builder
+	done   bool
+	err    error
+}
+
+func (s *commandStream) Read(p []byte) (int, error) {
+	n, err := s.stdout.Read(p)
+	if err == io.EOF && !s.done {
+		s.done = true
+		if waitErr := s.cmd.Wait(); waitErr != nil {
+			msg := strings.TrimSpace(s.stderr.String())
+			s.err = fmt.Errorf("%w: %s", waitErr, msg)
+			if strings.Contains(strings.ToLower(msg), "not found") {
+				s.err = fmt.Errorf("%w: %s", os.ErrNotExist, msg)
+			}
+		}
+	}
+	if err == io.EOF && s.err != nil {
+		return n, s.err
+	}
+	return n, err
+}
+
+// Close stops a command whose output was not read to the end
+func (s *commandStream) Close() error {
+	if s.done {
+		return nil
+	}
+	s.done = true
+	_ = s.cmd.Process.Kill()
+	_ = s.cmd.Wait()
+	return nil
+}
+
 func remoteBaseName(ref string) string {
 	_, relPath := splitRemoteRef(ref)
 	if relPath == "" {
@@ -119,6 +188,7 @@ func NewCloudStorage(cfg *config.Config, logger *logging.Logger) (*CloudStorage,
 		parallelJobs:   parallelJobs,
 		parallelVerify: cfg.CloudParallelVerify,
 		execCommand:    defaultExecCommand,
+		openCommand:    defaultOpenCommand,
 		lookPath:       exec.LookPath,
 		sleep:          time.Sleep,
 	}, nil
@@ -418,8 +488,8 @@ func (c *CloudStorage) Store(ctx context.Context, backupFile string, metadata *t
 		return err
 	}
 
-	// Verify source file exists
-	stat, err := os.Stat(backupFile)
+	// Verify source file (or the volumes of a split archive) exists
+	_, size, err := statBackup(backupFile)
 	if err != nil {
 		c.logger.Debug("Cloud storage: source file %s not found", backupFile)
 		c.logger.Warning("WARNING: Cloud storage - backup file not found: %s: %v", backupFile, err)
@@ -434,11 +504,10 @@ func (c *CloudStorage) Store(ctx context.Context, backupFile string, metadata *t
 	}
 
 	filename := filepath.Base(backupFile)
-	remoteFile := c.remotePathFor(filename)
 
 	c.logger.Info("Uploading backup to cloud storage: %s (%s) -> %s (timeout: %ds)",
 		filename,
-		utils.FormatBytes(stat.Size()),
+		utils.FormatBytes(size),
 		c.remoteLabel(),
 		c.config.RcloneTimeoutOperation)
 	c.logger.Debug("Cloud storage: upload retries=%d threads=%d bwlimit=%s",
@@ -449,16 +518,29 @@ func (c *CloudStorage) Store(ctx context.Context, backupFile string, metadata *t
 	defer cancel()
 
 	tasks := make([]uploadTask, 0, 4)
-	tasks = append(tasks, uploadTask{
-		local:  backupFile,
-		remote: remoteFile,
-		verify: true,
-	})
-	if !c.config.BundleAssociatedFiles {
+	// Split archives are uploaded volume by volume, each with its checksum;
+	// they are never bundled
+	files, _ := backupFiles(backupFile)
+	split := files[0] != backupFile
+	for _, file := range files {
+		tasks = append(tasks, uploadTask{
+			local:   file,
+			remote:  c.remotePathFor(filepath.Base(file)),
+			verify:  true,
+			primary: true,
+		})
+	}
+	if !c.config.BundleAssociatedFiles || split {
 		associatedFiles := []string{
 			backupFile + ".sha256",
 			backupFile + ".metadata",
 			backupFile + ".metadata.sha256",
+			backupFile + backup.ContentIndexSuffix,
+		}
+		if split {
+			for _, volume := range files {
+				associatedFiles = append(associatedFiles, volume+".sha256")
+			}
 		}
 
 		for _, srcFile := range associatedFiles {
@@ -589,6 +671,9 @@ type uploadTask struct {
 	local  string
 	remote string
 	verify bool
+	// primary tasks upload the backup itself (the archive or its volumes):
+	// they lead the task list and run one at a time before the others
+	primary bool
 }
 
 func (c *CloudStorage) uploadTasks(ctx context.Context, tasks []uploadTask) (bool, error) {
@@ -613,12 +698,17 @@ func (c *CloudStorage) uploadTasks(ctx context.Context, tasks []uploadTask) (boo
 		return nil
 	}
 
-	first := tasks[0]
-	if err := runUpload(ctx, first); err != nil {
-		return true, fmt.Errorf("%s: %w", filepath.Base(first.local), err)
+	primary := 1
+	for primary < len(tasks) && tasks[primary].primary {
+		primary++
+	}
+	for _, task := range tasks[:primary] {
+		if err := runUpload(ctx, task); err != nil {
+			return true, fmt.Errorf("%s: %w", filepath.Base(task.local), err)
+		}
 	}
 
-	remaining := tasks[1:]
+	remaining := tasks[primary:]
 	if len(remaining) == 0 {
 		return false, nil
 	}
@@ -720,6 +810,122 @@ func (c *CloudStorage) rcloneCopy(ctx context.Context, localFile, remoteFile str
 	return nil
 }
 
+// downloadHashes lists the rclone hash types used to verify downloads, in order of preference
+var downloadHashes = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha256", sha256.New},
+	{"sha1", sha1.New},
+	{"md5", md5.New},
+}
+
+// Download copies a backup file from the remote to localPath and verifies it
+// against the checksum rclone reports for the remote file. Remotes without a
+// supported hash fall back to a size comparison.
+func (c *CloudStorage) Download(ctx context.Context, backupFile, localPath string) error {
+	remoteFile := c.remotePathFor(filepath.Base(backupFile))
+
+	attempts := c.config.RcloneRetries
+	if attempts < 1 {
+		attempts = 1
+	}
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if attempt > 1 {
+			c.logger.Info("Download retry attempt %d/%d for %s", attempt, attempts, filepath.Base(backupFile))
+		}
+		if lastErr = c.rcloneDownload(ctx, remoteFile, localPath); lastErr == nil {
+			break
+		}
+		c.logger.Warning("Download attempt %d/%d failed: %v", attempt, attempts, lastErr)
+		if attempt < attempts {
+			c.sleep(time.Duration(1<<uint(attempt)) * time.Second)
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("download of %s failed after %d attempts: %w", remoteFile, attempts, lastErr)
+	}
+
+	return c.verifyDownload(ctx, remoteFile, localPath)
+}
+
+// rcloneDownload executes rclone copyto from the remote to a local file
+func (c *CloudStorage) rcloneDownload(ctx context.Context, remoteFile, localPath string) error {
+	args := []string{"rclone", "copyto", "--checksum"}
+	if c.config.RcloneBandwidthLimit != "" {
+		args = append(args, "--bwlimit", c.config.RcloneBandwidthLimit)
+	}
+	args = append(args, remoteFile, localPath)
+
+	c.logger.Debug("Running: %s", strings.Join(args, " "))
+	output, err := c.exec(ctx, args[0], args[1:]...)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("rclone operation timeout")
+		}
+		return fmt.Errorf("rclone copyto failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// verifyDownload compares the local copy with the hash rclone computes for
+// the remote file, trying the hash types in downloadHashes
+func (c *CloudStorage) verifyDownload(ctx context.Context, remoteFile, localPath string) error {
+	for _, h := range downloadHashes {
+		output, err := c.exec(ctx, "rclone", "hashsum", h.name, remoteFile)
+		if err != nil {
+			c.logger.Debug("rclone hashsum %s unavailable for %s: %v", h.name, remoteFile, err)
+			continue
+		}
+		fields := strings.Fields(string(output))
+		if len(fields) == 0 {
+			continue
+		}
+		remoteSum := strings.ToLower(fields[0])
+		if _, err := hex.DecodeString(remoteSum); err != nil || len(remoteSum) != 2*h.new().Size() {
+			continue
+		}
+		localSum, err := hashLocalFile(localPath, h.new())
+		if err != nil {
+			return err
+		}
+		if localSum != remoteSum {
+			return fmt.Errorf("%s checksum mismatch for %s: remote %s, downloaded %s", h.name, filepath.Base(localPath), remoteSum, localSum)
+		}
+		c.logger.Debug("Download verified (%s): %s", h.name, filepath.Base(localPath))
+		return nil
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("cannot stat downloaded file: %w", err)
+	}
+	if ok, err := c.verifyPrimary(ctx, remoteFile, info.Size(), filepath.Base(localPath)); !ok {
+		if err == nil {
+			err = fmt.Errorf("verification failed")
+		}
+		return fmt.Errorf("download verification failed for %s: %w", filepath.Base(localPath), err)
+	}
+	c.logger.Warning("Remote %s exposes no supported checksum: %s verified by size only", c.remoteLabel(), filepath.Base(localPath))
+	return nil
+}
+
+func hashLocalFile(path string, h hash.Hash) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // VerifyUpload verifies that a file was successfully uploaded to cloud storage
 // Uses two methods: primary (rclone lsl) and alternative (rclone ls + grep)
 func (c *CloudStorage) VerifyUpload(ctx context.Context, localFile, remoteFile string) (bool, error) {
@@ -853,6 +1059,8 @@ func (c *CloudStorage) List(ctx context.Context) ([]*types.BackupMetadata, error
 	}
 
 	var backups []*types.BackupMetadata
+	volumeSets := make(map[string]*types.BackupMetadata)
+	volumeFiles := make(map[string]*types.BackupMetadata) // size and time of each volume
 
 	// Parse lsl output
 	lines := strings.Split(string(output), "\n")
@@ -883,7 +1091,8 @@ func (c *CloudStorage) List(ctx context.Context) ([]*types.BackupMetadata, error
 
 		// Skip associated files
 		if strings.HasSuffix(filename, ".sha256") ||
-			strings.HasSuffix(filename, ".metadata") {
+			strings.HasSuffix(filename, ".metadata") ||
+			strings.HasSuffix(filename, backup.ContentIndexSuffix) {
 			continue
 		}
 
@@ -902,11 +1111,45 @@ func (c *CloudStorage) List(ctx context.Context) ([]*types.BackupMetadata, error
 			continue
 		}
 
-		backups = append(backups, &types.BackupMetadata{
-			BackupFile: filename,
-			Timestamp:  timestamp,
-			Size:       size,
-		})
+		// The volumes of a split archive are listed as one backup
+		archive, _, isVolume := backup.ParseVolumeName(filename)
+		if isVolume {
+			volumeFiles[filename] = &types.BackupMetadata{Size: size, Timestamp: timestamp}
+		}
+		if set := volumeSets[archive]; isVolume && set != nil {
+			set.Volumes = append(set.Volumes, filename)
+			continue
+		}
+
+		name := filename
+		if isVolume {
+			name = archive
+		}
+		metadata := metadataFromName(name)
+		metadata.Timestamp = timestamp
+		metadata.Size = size
+		if isVolume {
+			metadata.Volumes = []string{filename}
+			volumeSets[archive] = metadata
+		}
+		backups = append(backups, metadata)
+	}
+	// As on the filesystem backends, only the files the manifest lists are
+	// volumes: anything else with a numeric extension is left alone
+	for archive, set := range volumeSets {
+		set.Volumes = c.manifestVolumes(ctx, archive, set.Volumes)
+		if len(set.Volumes) == 0 {
+			continue
+		}
+		set.Size, set.Timestamp = 0, time.Time{}
+		for _, volume := range set.Volumes {
+			file := volumeFiles[volume]
+			set.Size += file.Size
+			if file.Timestamp.After(set.Timestamp) {
+				set.Timestamp = file.Timestamp
+			}
+		}
+		sortVolumes(set.Volumes)
 	}
 
 	// Sort by timestamp (newest first)
@@ -917,13 +1160,82 @@ func (c *CloudStorage) List(ctx context.Context) ([]*types.BackupMetadata, error
 	return backups, nil
 }
 
+// manifestVolumes reads the manifest of archive from the remote and keeps
+// the files it lists as volumes; nil when it cannot be read
+func (c *CloudStorage) manifestVolumes(ctx context.Context, archive string, files []string) []string {
+	reader, err := c.Open(ctx, archive+".metadata")
+	if err != nil {
+		c.logger.Debug("Cloud storage: cannot read the manifest of %s: %v", archive, err)
+		return nil
+	}
+	defer reader.Close()
+	var manifest backup.Manifest
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		c.logger.Debug("Cloud storage: cannot read the manifest of %s: %v", archive, err)
+		return nil
+	}
+	return listedVolumes(&manifest, files)
+}
+
+// Open streams a stored file with rclone cat, without a local copy
+func (c *CloudStorage) Open(ctx context.Context, backupFile string) (io.ReadCloser, error) {
+	remoteFile := c.remotePathFor(filepath.Base(backupFile))
+	open := c.openCommand
+	if open == nil {
+		open = defaultOpenCommand
+	}
+	reader, err := open(ctx, "rclone", "cat", remoteFile)
+	if err != nil {
+		return nil, fmt.Errorf("rclone cat %s: %w", remoteFile, err)
+	}
+	return reader, nil
+}
+
+// RemoteSHA256 asks the remote for the SHA-256 of a stored file
+func (c *CloudStorage) RemoteSHA256(ctx context.Context, backupFile string) (string, error) {
+	remoteFile := c.remotePathFor(filepath.Base(backupFile))
+	output, err := c.exec(ctx, "rclone", "hashsum", "sha256", remoteFile)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("%w: %s", ErrHashUnsupported, strings.TrimSpace(string(output)))
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return "", ErrHashUnsupported
+	}
+	sum := strings.ToLower(fields[0])
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != 2*sha256.Size {
+		return "", ErrHashUnsupported
+	}
+	return sum, nil
+}
+
 // Delete removes a backup file from cloud storage
 func (c *CloudStorage) Delete(ctx context.Context, backupFile string) error {
-	_, err := c.deleteBackupInternal(ctx, backupFile)
+	_, err := c.deleteBackupInternal(ctx, backupFile, c.remoteVolumes(ctx, backupFile))
 	return err
 }
 
-func (c *CloudStorage) deleteBackupInternal(ctx context.Context, backupFile string) (bool, error) {
+// remoteVolumes looks up the volumes of a split archive in the listing of
+// the remote; nil when the backup is not split
+func (c *CloudStorage) remoteVolumes(ctx context.Context, backupFile string) []string {
+	backups, err := c.List(ctx)
+	if err != nil {
+		return nil
+	}
+	for _, b := range backups {
+		if b.BackupFile == filepath.Base(backupFile) {
+			return b.Volumes
+		}
+	}
+	return nil
+}
+
+// deleteBackupInternal removes a backup and its associated files; volumes
+// lists the volumes of a split archive, as returned by List
+func (c *CloudStorage) deleteBackupInternal(ctx context.Context, backupFile string, volumes []string) (bool, error) {
 	if err := ctx.Err(); err != nil {
 		return false, err
 	}
@@ -936,8 +1248,16 @@ func (c *CloudStorage) deleteBackupInternal(ctx context.Context, backupFile stri
 	// List of files to delete
 	filesToDelete := []string{remoteFile}
 
+	// Split archives are stored as volumes, each with its checksum file
+	if len(volumes) > 0 {
+		filesToDelete = filesToDelete[:0]
+		for _, volume := range withVolumeChecksums(volumes) {
+			filesToDelete = append(filesToDelete, c.remotePathFor(filepath.Base(volume)))
+		}
+	}
+
 	// If bundling is enabled, only delete the bundle
-	if c.config.BundleAssociatedFiles {
+	if c.config.BundleAssociatedFiles && len(volumes) == 0 {
 		filesToDelete = []string{c.remotePathFor(filename + ".bundle.tar")}
 	} else {
 		// Delete associated files
@@ -966,6 +1286,14 @@ func (c *CloudStorage) deleteBackupInternal(ctx context.Context, backupFile stri
 		}
 	}
 
+	// Best-effort: backups created before content indexes have none
+	if !c.config.BundleAssociatedFiles || len(volumes) > 0 {
+		indexFile := c.remotePathFor(filename + backup.ContentIndexSuffix)
+		if output, err := c.exec(ctx, "rclone", "deletefile", indexFile); err != nil {
+			c.logger.Debug("Cloud storage: no content index deleted for %s: %v: %s", filename, err, strings.TrimSpace(string(output)))
+		}
+	}
+
 	// Best-effort: delete associated cloud log file for this backup
 	logDeleted := c.deleteAssociatedLog(ctx, backupFile)
 
@@ -1141,16 +1469,15 @@ func (c *CloudStorage) applySimpleRetention(ctx context.Context, backups []*type
 		return 0, nil
 	}
 
-	// Calculate how many to delete
-	toDelete := totalBackups - maxBackups
+	// Collect oldest backups (already sorted newest first); parents of kept
+	// incremental backups stay
+	oldBackups := SimpleRetentionCandidates(backups, maxBackups)
+	toDelete := len(oldBackups)
 	c.logger.Info("Applying simple retention policy: %d backups found, limit is %d, deleting %d oldest",
 		totalBackups, maxBackups, toDelete)
 	c.logger.Info("Simple retention → current: %d, limit: %d, to_delete: %d",
 		totalBackups, maxBackups, toDelete)
 
-	// Collect oldest backups (already sorted newest first)
-	oldBackups := backups[maxBackups:]
-
 	// Delete in batches to avoid API rate limits
 	return c.deleteBatched(ctx, oldBackups, totalBackups)
 }
@@ -1172,7 +1499,7 @@ func (c *CloudStorage) deleteBatched(ctx context.Context, backups []*types.Backu
 			backup.BackupFile,
 			backup.Timestamp.Format("2006-01-02 15:04:05"))
 
-		logDeleted, err := c.deleteBackupInternal(ctx, backup.BackupFile)
+		logDeleted, err := c.deleteBackupInternal(ctx, backup.BackupFile, backup.Volumes)
 		if err != nil {
 			c.logger.Warning("WARNING: Cloud storage - failed to delete %s: %v", backup.BackupFile, err)
 			continue
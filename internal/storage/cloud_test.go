@@ -2,7 +2,10 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -10,6 +13,7 @@ import (
 	"time"
 
 	"github.com/tis24dev/proxmox-backup/internal/config"
+	"github.com/tis24dev/proxmox-backup/internal/types"
 )
 
 type commandCall struct {
@@ -107,7 +111,7 @@ func TestCloudStorageListParsesBackups(t *testing.T) {
 				name: "rclone",
 				args: []string{"lsl", "remote:"},
 				out: strings.TrimSpace(`
-99999 2024-11-12 12:00:00 host-backup-20241112.tar.zst
+99999 2024-11-12 12:00:00 host-backup-20241112.tar.zst.age.bundle.tar
 12000 2024-11-10 08:00:00 proxmox-backup-legacy.tar.gz
 555 random line ignored
 `),
@@ -123,12 +127,18 @@ func TestCloudStorageListParsesBackups(t *testing.T) {
 	if len(backups) != 2 {
 		t.Fatalf("List() = %d backups, want 2", len(backups))
 	}
-	if backups[0].BackupFile != "host-backup-20241112.tar.zst" {
+	if backups[0].BackupFile != "host-backup-20241112.tar.zst.age.bundle.tar" {
 		t.Fatalf("expected newest backup first, got %s", backups[0].BackupFile)
 	}
+	if backups[0].Compression != types.CompressionZstd || backups[0].EncryptionMode != "age" {
+		t.Errorf("metadata from name = %s/%s, want zst/age", backups[0].Compression, backups[0].EncryptionMode)
+	}
 	if backups[1].BackupFile != "proxmox-backup-legacy.tar.gz" {
 		t.Fatalf("expected legacy backup second, got %s", backups[1].BackupFile)
 	}
+	if backups[1].Compression != types.CompressionGzip || backups[1].EncryptionMode != "none" {
+		t.Errorf("metadata from name = %s/%s, want gz/none", backups[1].Compression, backups[1].EncryptionMode)
+	}
 }
 
 func TestCloudStorageApplyRetentionDeletesOldest(t *testing.T) {
@@ -160,6 +170,7 @@ func TestCloudStorageApplyRetentionDeletesOldest(t *testing.T) {
 			{name: "rclone", args: []string{"deletefile", "remote:alpha-backup-1.tar.zst.sha256"}},
 			{name: "rclone", args: []string{"deletefile", "remote:alpha-backup-1.tar.zst.metadata"}},
 			{name: "rclone", args: []string{"deletefile", "remote:alpha-backup-1.tar.zst.metadata.sha256"}},
+			{name: "rclone", args: []string{"deletefile", "remote:alpha-backup-1.tar.zst.index.json.gz"}, err: errors.New("object not found")},
 			{name: "rclone", args: []string{"lsl", "remote:"}, out: recountOutput},
 		},
 	}
@@ -314,3 +325,188 @@ func TestCloudStorageUploadToRemotePath(t *testing.T) {
 		t.Fatalf("UploadToRemotePath() error = %v", err)
 	}
 }
+
+func TestCloudStorageDownloadVerifiesChecksum(t *testing.T) {
+	cfg := &config.Config{
+		CloudEnabled:    true,
+		CloudRemote:     "gdrive",
+		CloudRemotePath: "pbs-backups",
+	}
+	local := filepath.Join(t.TempDir(), "host-backup.tar.xz.bundle.tar")
+	writeTestFile(t, local, "bundle content")
+	sum := sha256.Sum256([]byte("bundle content"))
+	good := hex.EncodeToString(sum[:])
+
+	cs := newCloudStorageForTest(cfg)
+	queue := &commandQueue{
+		t: t,
+		queue: []queuedResponse{
+			{name: "rclone", args: []string{"copyto", "--checksum", "gdrive:pbs-backups/host-backup.tar.xz.bundle.tar", local}},
+			{name: "rclone", args: []string{"hashsum", "sha256", "gdrive:pbs-backups/host-backup.tar.xz.bundle.tar"}, out: good + "  host-backup.tar.xz.bundle.tar\n"},
+		},
+	}
+	cs.execCommand = queue.exec
+	if err := cs.Download(context.Background(), "host-backup.tar.xz.bundle.tar", local); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+
+	cs = newCloudStorageForTest(cfg)
+	queue = &commandQueue{
+		t: t,
+		queue: []queuedResponse{
+			{name: "rclone"},
+			{name: "rclone", out: strings.Repeat("0", 64) + "  host-backup.tar.xz.bundle.tar\n"},
+		},
+	}
+	cs.execCommand = queue.exec
+	if err := cs.Download(context.Background(), "host-backup.tar.xz.bundle.tar", local); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("Download() error = %v; want checksum mismatch", err)
+	}
+}
+
+func TestCloudStorageDownloadFallsBackToSize(t *testing.T) {
+	cfg := &config.Config{CloudEnabled: true, CloudRemote: "remote"}
+	local := filepath.Join(t.TempDir(), "host-backup.tar.zst")
+	writeTestFile(t, local, "12345")
+
+	cs := newCloudStorageForTest(cfg)
+	queue := &commandQueue{
+		t: t,
+		queue: []queuedResponse{
+			{name: "rclone", args: []string{"copyto", "--checksum", "remote:host-backup.tar.zst", local}},
+			{name: "rclone", err: errors.New("hash type not supported")},
+			{name: "rclone", err: errors.New("hash type not supported")},
+			{name: "rclone", err: errors.New("hash type not supported")},
+			{name: "rclone", args: []string{"lsl", "remote:host-backup.tar.zst"}, out: "5 2024-11-12 12:00:00.000000000 host-backup.tar.zst\n"},
+		},
+	}
+	cs.execCommand = queue.exec
+	if err := cs.Download(context.Background(), "host-backup.tar.zst", local); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if len(queue.queue) != 0 {
+		t.Fatalf("%d expected commands not run", len(queue.queue))
+	}
+}
+
+func TestCloudStorageRemoteSHA256(t *testing.T) {
+	cfg := &config.Config{
+		CloudEnabled: true,
+		CloudRemote:  "remote",
+	}
+	cs := newCloudStorageForTest(cfg)
+	sum := sha256.Sum256([]byte("archive"))
+	expected := hex.EncodeToString(sum[:])
+	queue := &commandQueue{
+		t: t,
+		queue: []queuedResponse{
+			{name: "rclone", args: []string{"hashsum", "sha256", "remote:backup.tar.xz"}, out: strings.ToUpper(expected) + "  backup.tar.xz\n"},
+			{name: "rclone", out: "hash type not supported", err: errors.New("exit status 1")},
+		},
+	}
+	cs.execCommand = queue.exec
+
+	got, err := cs.RemoteSHA256(context.Background(), "/local/backup.tar.xz")
+	if err != nil || got != expected {
+		t.Fatalf("RemoteSHA256() = %q, %v; want %q", got, err, expected)
+	}
+	if _, err := cs.RemoteSHA256(context.Background(), "backup.tar.xz"); !errors.Is(err, ErrHashUnsupported) {
+		t.Fatalf("RemoteSHA256() error = %v; want ErrHashUnsupported", err)
+	}
+}
+
+func TestCloudStorageOpenStreamsWithCat(t *testing.T) {
+	cfg := &config.Config{
+		CloudEnabled: true,
+		CloudRemote:  "remote",
+	}
+	cs := newCloudStorageForTest(cfg)
+	var gotArgs []string
+	cs.openCommand = func(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+		gotArgs = append([]string{name}, args...)
+		return io.NopCloser(strings.NewReader("data")), nil
+	}
+
+	rc, err := cs.Open(context.Background(), "backup.tar.xz.bundle.tar")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer rc.Close()
+	data, _ := io.ReadAll(rc)
+	if string(data) != "data" || strings.Join(gotArgs, " ") != "rclone cat remote:backup.tar.xz.bundle.tar" {
+		t.Fatalf("Open() read %q with %v", data, gotArgs)
+	}
+}
+
+func TestCloudStorageHandlesSplitArchives(t *testing.T) {
+	cfg := &config.Config{
+		CloudEnabled:          true,
+		CloudRemote:           "remote",
+		CloudBatchSize:        1,
+		BundleAssociatedFiles: true,
+	}
+	cs := newCloudStorageForTest(cfg)
+	cs.sleep = func(time.Duration) {}
+
+	listOutput := strings.TrimSpace(`
+1000 2024-11-12 10:00:00 gamma-backup-3.tar.zst.002
+1000 2024-11-12 10:00:00 gamma-backup-3.tar.zst.001
+500 2024-11-12 10:00:05 gamma-backup-3.tar.zst.003
+700 2024-11-13 10:00:00 gamma-backup-3.tar.zst.004
+80 2024-11-12 10:00:05 gamma-backup-3.tar.zst.001.sha256
+100 2024-11-11 10:00:00 beta-backup-2.tar.zst.bundle.tar
+`)
+	queue := &commandQueue{
+		t: t,
+		queue: []queuedResponse{
+			{name: "rclone", args: []string{"lsl", "remote:"}, out: listOutput},
+		},
+	}
+	cs.execCommand = queue.exec
+	// gamma-backup-3.tar.zst.004 is not in the manifest: an unrelated file
+	// that is neither listed nor deleted with the backup
+	manifest := `{"volumes":[{"name":"gamma-backup-3.tar.zst.001"},{"name":"gamma-backup-3.tar.zst.002"},{"name":"gamma-backup-3.tar.zst.003"}]}`
+	cs.openCommand = func(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+		if strings.Join(args, " ") != "cat remote:gamma-backup-3.tar.zst.metadata" {
+			return nil, errors.New("object not found")
+		}
+		return io.NopCloser(strings.NewReader(manifest)), nil
+	}
+
+	backups, err := cs.List(context.Background())
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("List() = %d backups, want 2", len(backups))
+	}
+	split := backups[0]
+	wantVolumes := []string{"gamma-backup-3.tar.zst.001", "gamma-backup-3.tar.zst.002", "gamma-backup-3.tar.zst.003"}
+	if split.BackupFile != "gamma-backup-3.tar.zst" || split.Size != 2500 || strings.Join(split.Volumes, ",") != strings.Join(wantVolumes, ",") {
+		t.Fatalf("split backup = %+v", split)
+	}
+	if want := time.Date(2024, 11, 12, 10, 0, 5, 0, time.UTC); !split.Timestamp.Equal(want) {
+		t.Errorf("split backup timestamp = %s, want the last volume %s", split.Timestamp, want)
+	}
+
+	// Deleting a split archive removes every volume and the loose sidecars
+	queue.queue = []queuedResponse{
+		{name: "rclone", args: []string{"lsl", "remote:"}, out: listOutput},
+		{name: "rclone", args: []string{"deletefile", "remote:gamma-backup-3.tar.zst.001"}},
+		{name: "rclone", args: []string{"deletefile", "remote:gamma-backup-3.tar.zst.001.sha256"}},
+		{name: "rclone", args: []string{"deletefile", "remote:gamma-backup-3.tar.zst.002"}},
+		{name: "rclone", args: []string{"deletefile", "remote:gamma-backup-3.tar.zst.002.sha256"}},
+		{name: "rclone", args: []string{"deletefile", "remote:gamma-backup-3.tar.zst.003"}},
+		{name: "rclone", args: []string{"deletefile", "remote:gamma-backup-3.tar.zst.003.sha256"}},
+		{name: "rclone", args: []string{"deletefile", "remote:gamma-backup-3.tar.zst.sha256"}},
+		{name: "rclone", args: []string{"deletefile", "remote:gamma-backup-3.tar.zst.metadata"}},
+		{name: "rclone", args: []string{"deletefile", "remote:gamma-backup-3.tar.zst.metadata.sha256"}},
+		{name: "rclone", args: []string{"deletefile", "remote:gamma-backup-3.tar.zst.index.json.gz"}, err: errors.New("object not found")},
+	}
+	if err := cs.Delete(context.Background(), "gamma-backup-3.tar.zst"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if len(queue.queue) != 0 {
+		t.Fatalf("%d expected rclone calls not made", len(queue.queue))
+	}
+}
@@ -98,8 +98,9 @@ func (l *LocalStorage) Store(ctx context.Context, backupFile string, metadata *t
 		return err
 	}
 
-	// Verify file exists
-	if _, err := os.Stat(backupFile); err != nil {
+	// Verify file (or the volumes of a split archive) exists
+	files, err := backupFiles(backupFile)
+	if err != nil {
 		l.logger.Debug("Local storage: source file %s not found", backupFile)
 		return &StorageError{
 			Location:   LocationPrimary,
@@ -111,10 +112,12 @@ func (l *LocalStorage) Store(ctx context.Context, backupFile string, metadata *t
 	}
 
 	// Set proper permissions on the backup file
-	l.logger.Debug("Local storage: setting ownership/permissions on %s", filepath.Base(backupFile))
-	if err := l.fsDetector.SetPermissions(ctx, backupFile, 0, 0, 0600, l.fsInfo); err != nil {
-		l.logger.Warning("Failed to set permissions on %s: %v", backupFile, err)
-		// Not critical - continue
+	for _, file := range files {
+		l.logger.Debug("Local storage: setting ownership/permissions on %s", filepath.Base(file))
+		if err := l.fsDetector.SetPermissions(ctx, file, 0, 0, 0600, l.fsInfo); err != nil {
+			l.logger.Warning("Failed to set permissions on %s: %v", file, err)
+			// Not critical - continue
+		}
 	}
 
 	l.logger.Debug("Backup stored successfully in local storage: %s", backupFile)
@@ -183,13 +186,17 @@ func (l *LocalStorage) List(ctx context.Context) ([]*types.BackupMetadata, error
 		}
 	}
 
+	// A split archive is listed once, under the name of the archive
+	matches, volumes := groupVolumes(matches)
+
 	var backups []*types.BackupMetadata
 
 	// Filter and parse backup files
 	for _, match := range matches {
 		// Skip associated files (.sha256, .metadata)
 		if strings.HasSuffix(match, ".sha256") ||
-			strings.HasSuffix(match, ".metadata") {
+			strings.HasSuffix(match, ".metadata") ||
+			strings.HasSuffix(match, backup.ContentIndexSuffix) {
 			continue
 		}
 
@@ -198,16 +205,15 @@ func (l *LocalStorage) List(ctx context.Context) ([]*types.BackupMetadata, error
 		if err != nil {
 			l.logger.Warning("Failed to load metadata for %s: %v", match, err)
 			// Create minimal metadata from filename
-			metadata = &types.BackupMetadata{
-				BackupFile: match,
-			}
-			if stat, statErr := os.Stat(match); statErr == nil {
-				metadata.Timestamp = stat.ModTime()
-				metadata.Size = stat.Size()
+			metadata = metadataFromName(match)
+			if modTime, size, statErr := statBackup(match); statErr == nil {
+				metadata.Timestamp = modTime
+				metadata.Size = size
 			} else {
 				l.logger.Debug("Failed to stat %s after metadata load failure: %v", match, statErr)
 			}
 		}
+		metadata.Volumes = manifestVolumes(match, volumes[match])
 
 		backups = append(backups, metadata)
 	}
@@ -222,15 +228,21 @@ func (l *LocalStorage) List(ctx context.Context) ([]*types.BackupMetadata, error
 
 // loadMetadata loads metadata for a backup file
 func (l *LocalStorage) loadMetadata(backupFile string) (*types.BackupMetadata, error) {
+	return loadBackupMetadata(backupFile, l != nil && l.config != nil && l.config.BundleAssociatedFiles)
+}
+
+// loadBackupMetadata reads the manifest of a backup file from its
+// .metadata sidecar or, for bundles, from inside the bundle. When
+// preferBundle is set the bundle next to a raw archive is read first.
+func loadBackupMetadata(backupFile string, preferBundle bool) (*types.BackupMetadata, error) {
 	if strings.HasSuffix(backupFile, ".bundle.tar") {
-		return l.loadMetadataFromBundle(backupFile)
+		return loadMetadataFromBundle(backupFile)
 	}
 
-	// When bundles are enabled, prefer reading metadata from the bundle
-	if l != nil && l.config != nil && l.config.BundleAssociatedFiles {
+	if preferBundle {
 		bundlePath := backupFile + ".bundle.tar"
 		if _, err := os.Stat(bundlePath); err == nil {
-			return l.loadMetadataFromBundle(bundlePath)
+			return loadMetadataFromBundle(bundlePath)
 		}
 	}
 
@@ -243,32 +255,10 @@ func (l *LocalStorage) loadMetadata(backupFile string) (*types.BackupMetadata, e
 	if err != nil {
 		return nil, err
 	}
-
-	metadata := &types.BackupMetadata{
-		BackupFile:  backupFile,
-		Timestamp:   manifest.CreatedAt,
-		Size:        manifest.ArchiveSize,
-		Checksum:    manifest.SHA256,
-		ProxmoxType: types.ProxmoxType(manifest.ProxmoxType),
-		Compression: types.CompressionType(manifest.CompressionType),
-		Version:     manifest.ScriptVersion,
-	}
-
-	if metadata.Timestamp.IsZero() || metadata.Size == 0 {
-		if stat, statErr := os.Stat(backupFile); statErr == nil {
-			if metadata.Timestamp.IsZero() {
-				metadata.Timestamp = stat.ModTime()
-			}
-			if metadata.Size == 0 {
-				metadata.Size = stat.Size()
-			}
-		}
-	}
-
-	return metadata, nil
+	return metadataFromManifest(backupFile, manifest), nil
 }
 
-func (l *LocalStorage) loadMetadataFromBundle(bundlePath string) (*types.BackupMetadata, error) {
+func loadMetadataFromBundle(bundlePath string) (*types.BackupMetadata, error) {
 	file, err := os.Open(bundlePath)
 	if err != nil {
 		return nil, err
@@ -295,30 +285,43 @@ func (l *LocalStorage) loadMetadataFromBundle(bundlePath string) (*types.BackupM
 		if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
 			return nil, fmt.Errorf("parse manifest from bundle %s: %w", filepath.Base(bundlePath), err)
 		}
+		return metadataFromManifest(bundlePath, &manifest), nil
+	}
+}
+
+// metadataFromManifest converts a backup manifest, completing the
+// timestamp and size from the file when the manifest lacks them
+func metadataFromManifest(backupFile string, manifest *backup.Manifest) *types.BackupMetadata {
+	metadata := &types.BackupMetadata{
+		BackupFile:     backupFile,
+		Timestamp:      manifest.CreatedAt,
+		Size:           manifest.ArchiveSize,
+		Checksum:       manifest.SHA256,
+		ProxmoxType:    types.ProxmoxType(manifest.ProxmoxType),
+		Compression:    types.CompressionType(manifest.CompressionType),
+		Version:        manifest.ScriptVersion,
+		EncryptionMode: manifest.EncryptionMode,
+	}
+	if metadata.EncryptionMode == "" {
+		metadata.EncryptionMode = encryptionFromName(backupFile)
+	}
 
-		metadata := &types.BackupMetadata{
-			BackupFile:  bundlePath,
-			Timestamp:   manifest.CreatedAt,
-			Size:        manifest.ArchiveSize,
-			Checksum:    manifest.SHA256,
-			ProxmoxType: types.ProxmoxType(manifest.ProxmoxType),
-			Compression: types.CompressionType(manifest.CompressionType),
-			Version:     manifest.ScriptVersion,
-		}
-
-		if metadata.Timestamp.IsZero() || metadata.Size == 0 {
-			if stat, statErr := os.Stat(bundlePath); statErr == nil {
-				if metadata.Timestamp.IsZero() {
-					metadata.Timestamp = stat.ModTime()
-				}
-				if metadata.Size == 0 {
-					metadata.Size = stat.Size()
-				}
+	if metadata.Timestamp.IsZero() || metadata.Size == 0 {
+		if stat, statErr := os.Stat(backupFile); statErr == nil {
+			if metadata.Timestamp.IsZero() {
+				metadata.Timestamp = stat.ModTime()
+			}
+			if metadata.Size == 0 {
+				metadata.Size = stat.Size()
 			}
 		}
-
-		return metadata, nil
 	}
+	return metadata
+}
+
+// Open streams a backup file or one of its sidecars
+func (l *LocalStorage) Open(ctx context.Context, backupFile string) (io.ReadCloser, error) {
+	return openLocalFile(ctx, backupFile)
 }
 
 // Delete removes a backup file and its associated files
@@ -337,8 +340,14 @@ func (l *LocalStorage) deleteBackupInternal(ctx context.Context, backupFile stri
 	// List of files to delete
 	filesToDelete := []string{backupFile}
 
+	// Split archives are stored as volumes, each with its checksum file
+	volumes := localVolumes(backupFile)
+	if len(volumes) > 0 {
+		filesToDelete = withVolumeChecksums(volumes)
+	}
+
 	// If bundling is enabled, only delete the bundle
-	if l.config.BundleAssociatedFiles {
+	if l.config.BundleAssociatedFiles && len(volumes) == 0 {
 		bundleFile := backupFile + ".bundle.tar"
 		if _, err := os.Stat(bundleFile); err == nil {
 			filesToDelete = []string{bundleFile}
@@ -349,6 +358,7 @@ func (l *LocalStorage) deleteBackupInternal(ctx context.Context, backupFile stri
 			backupFile + ".sha256",
 			backupFile + ".metadata",
 			backupFile + ".metadata.sha256",
+			backupFile + backup.ContentIndexSuffix,
 		}
 
 		for _, f := range associatedFiles {
@@ -544,23 +554,24 @@ func (l *LocalStorage) applySimpleRetention(ctx context.Context, backups []*type
 		return 0, nil
 	}
 
-	// Calculate how many to delete
-	toDelete := totalBackups - maxBackups
+	// Calculate how many to delete (parents of kept incremental backups stay)
+	oldBackups := SimpleRetentionCandidates(backups, maxBackups)
+	toDelete := len(oldBackups)
 	l.logger.Info("Applying simple retention policy: %d backups found, limit is %d, deleting %d oldest",
 		totalBackups, maxBackups, toDelete)
 	l.logger.Info("Simple retention → current: %d, limit: %d, to_delete: %d",
 		totalBackups, maxBackups, toDelete)
 
-	// Delete oldest backups (already sorted newest first)
+	// Delete oldest backups first (already sorted newest first)
 	initialLogs := l.countLogFiles()
 	logsDeleted := 0
 	deleted := 0
-	for i := totalBackups - 1; i >= maxBackups; i-- {
+	for i := len(oldBackups) - 1; i >= 0; i-- {
 		if err := ctx.Err(); err != nil {
 			return deleted, err
 		}
 
-		backup := backups[i]
+		backup := oldBackups[i]
 		l.logger.Debug("Deleting old backup: %s (created: %s)",
 			filepath.Base(backup.BackupFile),
 			backup.Timestamp.Format("2006-01-02 15:04:05"))
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/logging"
+	"github.com/tis24dev/proxmox-backup/internal/types"
+)
+
+// RepositoryBackend is implemented by the storages that can hold a
+// deduplicating repository (BACKUP_REPOSITORY)
+type RepositoryBackend interface {
+	// RepositoryStore returns the store of the repository kept in the
+	// backup directory of this storage
+	RepositoryStore() backup.RepositoryStore
+}
+
+// RepositoryStore returns the repository below the primary backup directory
+func (l *LocalStorage) RepositoryStore() backup.RepositoryStore {
+	return backup.NewDirRepositoryStore(filepath.Join(l.basePath, backup.RepositoryDirName))
+}
+
+// RepositoryStore returns the repository below the secondary backup directory
+func (s *SecondaryStorage) RepositoryStore() backup.RepositoryStore {
+	return backup.NewDirRepositoryStore(filepath.Join(s.basePath, backup.RepositoryDirName))
+}
+
+// RepositoryStore returns the repository below the remote backup directory
+func (c *CloudStorage) RepositoryStore() backup.RepositoryStore {
+	return &cloudRepositoryStore{cloud: c}
+}
+
+// cloudRepositoryStore keeps a repository on an rclone remote
+type cloudRepositoryStore struct {
+	cloud *CloudStorage
+}
+
+func (s *cloudRepositoryStore) String() string {
+	return s.cloud.remotePathFor(backup.RepositoryDirName)
+}
+
+func (s *cloudRepositoryStore) remotePath(name string) string {
+	return s.cloud.remotePathFor(path.Join(backup.RepositoryDirName, path.Clean("/"+name)))
+}
+
+func (s *cloudRepositoryStore) List(ctx context.Context, dir string) ([]backup.RepositoryFile, error) {
+	output, err := s.cloud.exec(ctx, "rclone", "lsjson", "-R", "--files-only", "--no-mimetype", "--no-modtime", s.remotePath(dir))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if isRemoteNotFound(output) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("rclone lsjson failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	var entries []struct {
+		Path string `json:"Path"`
+		Size int64  `json:"Size"`
+	}
+	if err := json.Unmarshal(output, &entries); err != nil {
+		return nil, fmt.Errorf("parse rclone lsjson output: %w", err)
+	}
+	files := make([]backup.RepositoryFile, 0, len(entries))
+	for _, entry := range entries {
+		files = append(files, backup.RepositoryFile{Name: entry.Path, Size: entry.Size})
+	}
+	return files, nil
+}
+
+func (s *cloudRepositoryStore) Put(ctx context.Context, name, localFile string) error {
+	return s.cloud.rcloneCopy(ctx, localFile, s.remotePath(name))
+}
+
+func (s *cloudRepositoryStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	remoteFile := s.remotePath(name)
+	open := s.cloud.openCommand
+	if open == nil {
+		open = defaultOpenCommand
+	}
+	reader, err := open(ctx, "rclone", "cat", remoteFile)
+	if err != nil {
+		return nil, fmt.Errorf("rclone cat %s: %w", remoteFile, err)
+	}
+	return reader, nil
+}
+
+func (s *cloudRepositoryStore) Remove(ctx context.Context, name string) error {
+	output, err := s.cloud.exec(ctx, "rclone", "deletefile", s.remotePath(name))
+	if err != nil && !isRemoteNotFound(output) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("rclone deletefile failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// isRemoteNotFound reports rclone output about a missing file or directory
+func isRemoteNotFound(output []byte) bool {
+	return strings.Contains(strings.ToLower(string(output)), "not found")
+}
+
+// RepositorySnapshots lists the snapshots of a repository as backups,
+// newest first. The timestamp is the one in the snapshot name.
+func RepositorySnapshots(ctx context.Context, repo *backup.Repository) ([]*types.BackupMetadata, error) {
+	files, err := repo.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*types.BackupMetadata, 0, len(files))
+	for _, file := range files {
+		metadata := &types.BackupMetadata{BackupFile: file, Compression: types.CompressionGzip}
+		if strings.HasSuffix(file, ".age") {
+			metadata.EncryptionMode = "age"
+		}
+		if _, ts, ok := extractLogKeyFromBackup(file); ok {
+			if parsed, err := time.ParseInLocation("20060102-150405", ts, time.Local); err == nil {
+				metadata.Timestamp = parsed
+			}
+		}
+		snapshots = append(snapshots, metadata)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp.After(snapshots[j].Timestamp)
+	})
+	return snapshots, nil
+}
+
+// ApplyRepositoryRetention removes the snapshots the retention policy does
+// not keep, then the blobs no remaining snapshot refers to. It returns the
+// number of snapshots removed.
+func ApplyRepositoryRetention(ctx context.Context, repo *backup.Repository, config RetentionConfig, logger *logging.Logger) (int, error) {
+	snapshots, err := RepositorySnapshots(ctx, repo)
+	if err != nil {
+		return 0, err
+	}
+
+	var expired []*types.BackupMetadata
+	if config.Policy == "gfs" {
+		classification := ClassifyBackupsGFS(snapshots, config)
+		for _, snapshot := range snapshots {
+			if classification[snapshot] == CategoryDelete {
+				expired = append(expired, snapshot)
+			}
+		}
+	} else {
+		expired = SimpleRetentionCandidates(snapshots, config.MaxBackups)
+	}
+	logger.Debug("Repository %s: %d snapshots, %d expired", repo, len(snapshots), len(expired))
+
+	deleted := 0
+	for _, snapshot := range expired {
+		logger.Debug("Removing snapshot %s (created: %s)", snapshot.BackupFile, snapshot.Timestamp.Format("2006-01-02 15:04:05"))
+		if err := repo.RemoveSnapshot(ctx, snapshot.BackupFile); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	removed, freed, err := repo.Prune(ctx)
+	if errors.Is(err, backup.ErrRepositoryLocked) {
+		logger.Warning("Repository %s: %v; unreferenced blobs are kept until the next prune", repo, err)
+		return deleted, nil
+	}
+	if err != nil {
+		return deleted, fmt.Errorf("prune repository: %w", err)
+	}
+	if removed > 0 {
+		logger.Debug("Repository %s: removed %d unreferenced blobs (%s)", repo, removed, backup.FormatBytes(freed))
+	}
+	return deleted, nil
+}
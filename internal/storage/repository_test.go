@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tis24dev/proxmox-backup/internal/backup"
+	"github.com/tis24dev/proxmox-backup/internal/config"
+)
+
+// fakeRemote serves the rclone commands of the repository store from a
+// local directory standing for remote:
+type fakeRemote struct {
+	t    *testing.T
+	root string
+}
+
+func (f *fakeRemote) local(ref string) string {
+	rel, ok := strings.CutPrefix(ref, "remote:")
+	if !ok {
+		f.t.Fatalf("unexpected remote reference %q", ref)
+	}
+	return filepath.Join(f.root, filepath.FromSlash(rel))
+}
+
+func (f *fakeRemote) exec(ctx context.Context, name string, args ...string) ([]byte, error) {
+	switch args[0] {
+	case "lsjson":
+		dir := f.local(args[len(args)-1])
+		if _, err := os.Stat(dir); err != nil {
+			return []byte("error listing: directory not found"), errors.New("exit status 3")
+		}
+		type entry struct {
+			Path string
+			Size int64
+		}
+		entries := []entry{}
+		err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, _ := filepath.Rel(dir, p)
+			entries = append(entries, entry{Path: filepath.ToSlash(rel), Size: info.Size()})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(entries)
+	case "copyto":
+		src, dst := args[len(args)-2], f.local(args[len(args)-1])
+		data, err := os.ReadFile(src)
+		if err == nil {
+			if err = os.MkdirAll(filepath.Dir(dst), 0o755); err == nil {
+				err = os.WriteFile(dst, data, 0o640)
+			}
+		}
+		return nil, err
+	case "deletefile":
+		if err := os.Remove(f.local(args[1])); err != nil {
+			return []byte("object not found"), errors.New("exit status 4")
+		}
+		return nil, nil
+	}
+	f.t.Fatalf("unexpected command: %s %v", name, args)
+	return nil, nil
+}
+
+func (f *fakeRemote) open(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	if args[0] != "cat" {
+		f.t.Fatalf("unexpected command: %s %v", name, args)
+	}
+	return os.Open(f.local(args[1]))
+}
+
+func TestCloudRepositoryRetention(t *testing.T) {
+	ctx := context.Background()
+	remote := &fakeRemote{t: t, root: t.TempDir()}
+	cs := newCloudStorageForTest(&config.Config{CloudEnabled: true, CloudRemote: "remote", CloudRemotePath: "pbs"})
+	cs.execCommand = remote.exec
+	cs.openCommand = remote.open
+	repo := backup.NewRepository(cs.RepositoryStore(), newTestLogger())
+
+	tree := t.TempDir()
+	for i, hostname := range []string{"pve1\n", "pve2\n", "pve3\n"} {
+		if err := os.MkdirAll(filepath.Join(tree, "etc"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, filepath.Join(tree, "etc", "hostname"), hostname)
+		writeTestFile(t, filepath.Join(tree, "etc", "hosts"), "127.0.0.1 localhost\n")
+		index, err := backup.IndexTree(ctx, tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("pve-backup-2025010%d-010000", i+1)
+		if _, err := repo.WriteSnapshot(ctx, tree, name, index, backup.Manifest{}, nil, nil); err != nil {
+			t.Fatalf("WriteSnapshot %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(remote.root, "pbs", "repository", "snapshots", "pve-backup-20250103-010000.snapshot.metadata")); err != nil {
+		t.Fatalf("snapshot not stored below remote:pbs/repository: %v", err)
+	}
+
+	deleted, err := ApplyRepositoryRetention(ctx, repo, RetentionConfig{Policy: "simple", MaxBackups: 2}, newTestLogger())
+	if err != nil || deleted != 1 {
+		t.Fatalf("ApplyRepositoryRetention deleted %d (%v)", deleted, err)
+	}
+	snapshots, err := RepositorySnapshots(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range snapshots {
+		names = append(names, s.BackupFile)
+	}
+	if strings.Join(names, " ") != "pve-backup-20250103-010000.snapshot pve-backup-20250102-010000.snapshot" {
+		t.Errorf("snapshots after retention = %v", names)
+	}
+
+	// hosts is shared, pve2 and pve3 are referenced: only pve1 is gone
+	blobs, err := cs.RepositoryStore().List(ctx, "blobs")
+	if err != nil || len(blobs) != 3 {
+		t.Errorf("blobs after retention = %v (%v)", blobs, err)
+	}
+}
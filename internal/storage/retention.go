@@ -5,6 +5,7 @@ import (
 	"sort"
 	"time"
 
+	"github.com/tis24dev/proxmox-backup/internal/backup"
 	"github.com/tis24dev/proxmox-backup/internal/config"
 	"github.com/tis24dev/proxmox-backup/internal/types"
 )
@@ -34,6 +35,9 @@ const (
 	CategoryMonthly RetentionCategory = "monthly"
 	CategoryYearly  RetentionCategory = "yearly"
 	CategoryDelete  RetentionCategory = "delete"
+	// CategoryParent marks backups kept only because a kept incremental
+	// backup is based on them
+	CategoryParent RetentionCategory = "parent"
 )
 
 // NewRetentionConfigFromConfig creates a RetentionConfig from main Config
@@ -192,9 +196,73 @@ func ClassifyBackupsGFS(backups []*types.BackupMetadata, config RetentionConfig)
 		}
 	}
 
+	// 6. Keep the parents of the incremental backups that are kept
+	kept := make(map[*types.BackupMetadata]bool, len(backups))
+	for _, b := range backups {
+		kept[b] = classification[b] != CategoryDelete
+	}
+	for b := range incrementalParents(backups, kept) {
+		classification[b] = CategoryParent
+	}
+
 	return classification
 }
 
+// SimpleRetentionCandidates returns the backups the simple policy deletes:
+// everything after the newest maxBackups (backups sorted newest first),
+// except the parents of the incremental backups that are kept
+func SimpleRetentionCandidates(backups []*types.BackupMetadata, maxBackups int) []*types.BackupMetadata {
+	if maxBackups <= 0 || len(backups) <= maxBackups {
+		return nil
+	}
+	kept := make(map[*types.BackupMetadata]bool, len(backups))
+	for _, b := range backups[:maxBackups] {
+		kept[b] = true
+	}
+	spared := incrementalParents(backups, kept)
+
+	candidates := make([]*types.BackupMetadata, 0, len(backups)-maxBackups)
+	for _, b := range backups[maxBackups:] {
+		if !spared[b] {
+			candidates = append(candidates, b)
+		}
+	}
+	return candidates
+}
+
+// incrementalParents returns the backups outside kept that a kept
+// incremental backup needs for restore. An incremental backup is based on
+// the previous backup of the same host, so every backup older than a kept
+// incremental one is needed down to the next full backup.
+func incrementalParents(backups []*types.BackupMetadata, kept map[*types.BackupMetadata]bool) map[*types.BackupMetadata]bool {
+	byHost := make(map[string][]*types.BackupMetadata)
+	for _, b := range backups {
+		host, _, ok := extractLogKeyFromBackup(b.BackupFile)
+		if !ok {
+			continue
+		}
+		byHost[host] = append(byHost[host], b)
+	}
+
+	spared := make(map[*types.BackupMetadata]bool)
+	for _, list := range byHost {
+		sorted := append([]*types.BackupMetadata(nil), list...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].Timestamp.After(sorted[j].Timestamp)
+		})
+		needed := false
+		for _, b := range sorted {
+			keep := kept[b]
+			if needed && !keep {
+				spared[b] = true
+				keep = true
+			}
+			needed = keep && backup.IsIncrementalName(b.BackupFile)
+		}
+	}
+	return spared
+}
+
 // GetRetentionStats returns statistics about classification results
 func GetRetentionStats(classification map[*types.BackupMetadata]RetentionCategory) map[RetentionCategory]int {
 	stats := make(map[RetentionCategory]int)
@@ -11,6 +11,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/tis24dev/proxmox-backup/internal/backup"
 	"github.com/tis24dev/proxmox-backup/internal/config"
 	"github.com/tis24dev/proxmox-backup/internal/logging"
 	"github.com/tis24dev/proxmox-backup/internal/types"
@@ -103,8 +104,9 @@ func (s *SecondaryStorage) Store(ctx context.Context, backupFile string, metadat
 		return err
 	}
 
-	// Verify source file exists
-	if _, err := os.Stat(backupFile); err != nil {
+	// Verify source file (or the volumes of a split archive) exists
+	files, err := backupFiles(backupFile)
+	if err != nil {
 		s.logger.Debug("Secondary storage: source file %s not found", backupFile)
 		s.logger.Warning("WARNING: Secondary storage - backup file not found: %s: %v", backupFile, err)
 		return &StorageError{
@@ -131,31 +133,40 @@ func (s *SecondaryStorage) Store(ctx context.Context, backupFile string, metadat
 		}
 	}
 
-	// Determine destination filename
-	destFile := filepath.Join(s.basePath, filepath.Base(backupFile))
-
 	s.logger.Debug("Secondary Storage: Start copy...")
 	s.logger.Debug("Copying backup to secondary storage: %s -> %s", filepath.Base(backupFile), s.basePath)
 
-	if err := s.copyFile(ctx, backupFile, destFile); err != nil {
-		s.logger.Warning("WARNING: Secondary Storage: File copy failed for %s: %v", filepath.Base(backupFile), err)
-		s.logger.Warning("WARNING: Secondary Storage: Backup not saved to %s", s.basePath)
-		return &StorageError{
-			Location:    LocationSecondary,
-			Operation:   "store",
-			Path:        backupFile,
-			Err:         fmt.Errorf("copy failed: %w", err),
-			IsCritical:  false,
-			Recoverable: true,
+	// Split archives are copied volume by volume, each with its checksum;
+	// they are never bundled
+	split := files[0] != backupFile
+	if split {
+		files = withVolumeChecksums(files)
+	}
+	destFiles := make([]string, 0, len(files))
+	for _, srcFile := range files {
+		destFile := filepath.Join(s.basePath, filepath.Base(srcFile))
+		if err := s.copyFile(ctx, srcFile, destFile); err != nil {
+			s.logger.Warning("WARNING: Secondary Storage: File copy failed for %s: %v", filepath.Base(srcFile), err)
+			s.logger.Warning("WARNING: Secondary Storage: Backup not saved to %s", s.basePath)
+			return &StorageError{
+				Location:    LocationSecondary,
+				Operation:   "store",
+				Path:        backupFile,
+				Err:         fmt.Errorf("copy failed: %w", err),
+				IsCritical:  false,
+				Recoverable: true,
+			}
 		}
+		destFiles = append(destFiles, destFile)
 	}
 
 	// Copy associated files if not bundled
-	if !s.config.BundleAssociatedFiles {
+	if !s.config.BundleAssociatedFiles || split {
 		associatedFiles := []string{
 			backupFile + ".sha256",
 			backupFile + ".metadata",
 			backupFile + ".metadata.sha256",
+			backupFile + backup.ContentIndexSuffix,
 		}
 		failedAssoc := make([]string, 0)
 
@@ -191,10 +202,12 @@ func (s *SecondaryStorage) Store(ctx context.Context, backupFile string, metadat
 
 	// Set permissions on destination (best effort)
 	if s.fsInfo != nil && s.fsInfo.SupportsOwnership {
-		if err := s.fsDetector.SetPermissions(ctx, destFile, 0, 0, 0600, s.fsInfo); err != nil {
-			s.logger.Warning("WARNING: Secondary storage - failed to set permissions on %s: %v",
-				filepath.Base(destFile), err)
-			// Not critical - continue
+		for _, destFile := range destFiles {
+			if err := s.fsDetector.SetPermissions(ctx, destFile, 0, 0, 0600, s.fsInfo); err != nil {
+				s.logger.Warning("WARNING: Secondary storage - failed to set permissions on %s: %v",
+					filepath.Base(destFile), err)
+				// Not critical - continue
+			}
 		}
 	}
 
@@ -349,27 +362,34 @@ func (s *SecondaryStorage) List(ctx context.Context) ([]*types.BackupMetadata, e
 		}
 	}
 
+	// A split archive is listed once, under the name of the archive
+	matches, volumes := groupVolumes(matches)
+
 	var backups []*types.BackupMetadata
 
 	// Filter and parse backup files
 	for _, match := range matches {
 		// Skip associated files
 		if strings.HasSuffix(match, ".sha256") ||
-			strings.HasSuffix(match, ".metadata") {
+			strings.HasSuffix(match, ".metadata") ||
+			strings.HasSuffix(match, backup.ContentIndexSuffix) {
 			continue
 		}
 
-		// Get file info
-		stat, err := os.Stat(match)
+		metadata, err := loadBackupMetadata(match, s.config != nil && s.config.BundleAssociatedFiles)
 		if err != nil {
-			continue
+			s.logger.Debug("Secondary storage: no metadata for %s: %v", match, err)
+			modTime, size, statErr := statBackup(match)
+			if statErr != nil {
+				continue
+			}
+			metadata = metadataFromName(match)
+			metadata.Timestamp = modTime
+			metadata.Size = size
 		}
+		metadata.Volumes = manifestVolumes(match, volumes[match])
 
-		backups = append(backups, &types.BackupMetadata{
-			BackupFile: match,
-			Timestamp:  stat.ModTime(),
-			Size:       stat.Size(),
-		})
+		backups = append(backups, metadata)
 	}
 
 	// Sort by timestamp (newest first)
@@ -380,6 +400,11 @@ func (s *SecondaryStorage) List(ctx context.Context) ([]*types.BackupMetadata, e
 	return backups, nil
 }
 
+// Open streams a backup file or one of its sidecars
+func (s *SecondaryStorage) Open(ctx context.Context, backupFile string) (io.ReadCloser, error) {
+	return openLocalFile(ctx, backupFile)
+}
+
 // Delete removes a backup file and its associated files
 func (s *SecondaryStorage) Delete(ctx context.Context, backupFile string) error {
 	_, err := s.deleteBackupInternal(ctx, backupFile)
@@ -396,8 +421,14 @@ func (s *SecondaryStorage) deleteBackupInternal(ctx context.Context, backupFile
 	// List of files to delete
 	filesToDelete := []string{backupFile}
 
+	// Split archives are stored as volumes, each with its checksum file
+	volumes := localVolumes(backupFile)
+	if len(volumes) > 0 {
+		filesToDelete = withVolumeChecksums(volumes)
+	}
+
 	// If bundling is enabled, only delete the bundle
-	if s.config.BundleAssociatedFiles {
+	if s.config.BundleAssociatedFiles && len(volumes) == 0 {
 		bundleFile := backupFile + ".bundle.tar"
 		if _, err := os.Stat(bundleFile); err == nil {
 			filesToDelete = []string{bundleFile}
@@ -408,6 +439,7 @@ func (s *SecondaryStorage) deleteBackupInternal(ctx context.Context, backupFile
 			backupFile + ".sha256",
 			backupFile + ".metadata",
 			backupFile + ".metadata.sha256",
+			backupFile + backup.ContentIndexSuffix,
 		}
 
 		for _, f := range associatedFiles {
@@ -604,23 +636,24 @@ func (s *SecondaryStorage) applySimpleRetention(ctx context.Context, backups []*
 		return 0, nil
 	}
 
-	// Calculate how many to delete
-	toDelete := totalBackups - maxBackups
+	// Calculate how many to delete (parents of kept incremental backups stay)
+	oldBackups := SimpleRetentionCandidates(backups, maxBackups)
+	toDelete := len(oldBackups)
 	s.logger.Info("Applying simple retention policy: %d backups found, limit is %d, deleting %d oldest",
 		totalBackups, maxBackups, toDelete)
 	s.logger.Info("Simple retention → current: %d, limit: %d, to_delete: %d",
 		totalBackups, maxBackups, toDelete)
 
-	// Delete oldest backups (already sorted newest first)
+	// Delete oldest backups first (already sorted newest first)
 	initialLogs := s.countLogFiles()
 	logsDeleted := 0
 	deleted := 0
-	for i := totalBackups - 1; i >= maxBackups; i-- {
+	for i := len(oldBackups) - 1; i >= 0; i-- {
 		if err := ctx.Err(); err != nil {
 			return deleted, err
 		}
 
-		backup := backups[i]
+		backup := oldBackups[i]
 		s.logger.Debug("Deleting old backup: %s (created: %s)",
 			filepath.Base(backup.BackupFile),
 			backup.Timestamp.Format("2006-01-02 15:04:05"))
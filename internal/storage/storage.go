@@ -4,11 +4,38 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/tis24dev/proxmox-backup/internal/backup"
 	"github.com/tis24dev/proxmox-backup/internal/types"
 )
 
+// BackupReader is implemented by backends whose stored files can be read
+// back, e.g. to verify them
+type BackupReader interface {
+	// Open streams a stored file: a backup returned by List or one of its
+	// sidecars (backup + ".sha256"). A missing file returns an error
+	// matching os.ErrNotExist.
+	Open(ctx context.Context, backupFile string) (io.ReadCloser, error)
+}
+
+// RemoteHasher is implemented by backends that can hash a stored file
+// without transferring it
+type RemoteHasher interface {
+	// RemoteSHA256 returns the hex SHA-256 of a stored file, or an error
+	// matching ErrHashUnsupported when the backend cannot compute it
+	RemoteSHA256(ctx context.Context, backupFile string) (string, error)
+}
+
+// ErrHashUnsupported reports a remote that exposes no SHA-256
+var ErrHashUnsupported = errors.New("remote does not support sha256")
+
 // FilesystemType represents the detected filesystem type
 type FilesystemType string
 
@@ -196,3 +223,172 @@ func (f FilesystemType) ShouldAutoExclude() bool {
 func (f FilesystemType) String() string {
 	return string(f)
 }
+
+// metadataFromName returns the metadata a backup file name implies, for
+// backups whose manifest cannot be read (e.g. cloud listings)
+func metadataFromName(backupFile string) *types.BackupMetadata {
+	return &types.BackupMetadata{
+		BackupFile:     backupFile,
+		Compression:    compressionFromName(backupFile),
+		EncryptionMode: encryptionFromName(backupFile),
+	}
+}
+
+// archiveName strips the bundle suffix from a backup file name
+func archiveName(backupFile string) string {
+	return strings.TrimSuffix(filepath.Base(backupFile), ".bundle.tar")
+}
+
+func compressionFromName(backupFile string) types.CompressionType {
+	name := strings.TrimSuffix(archiveName(backupFile), ".age")
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return types.CompressionNone
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return types.CompressionGzip
+	case strings.HasSuffix(name, ".tar.bz2"):
+		return types.CompressionBzip2
+	case strings.HasSuffix(name, ".tar.xz"):
+		return types.CompressionXZ
+	case strings.HasSuffix(name, ".tar.lzma"):
+		return types.CompressionLZMA
+	case strings.HasSuffix(name, ".tar.zst"):
+		return types.CompressionZstd
+	default:
+		return ""
+	}
+}
+
+func encryptionFromName(backupFile string) string {
+	if strings.HasSuffix(archiveName(backupFile), ".age") {
+		return "age"
+	}
+	return "none"
+}
+
+// openLocalFile opens a file of a filesystem backend
+func openLocalFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// localVolumes returns the volumes of the split archive backupFile found
+// next to it, in order; nil when the archive is not split
+func localVolumes(backupFile string) []string {
+	matches, err := filepath.Glob(backupFile + ".[0-9][0-9][0-9]*")
+	if err != nil {
+		return nil
+	}
+	_, volumes := groupVolumes(matches)
+	return manifestVolumes(backupFile, volumes[backupFile])
+}
+
+// manifestVolumes keeps the files named like volumes of backupFile that its
+// manifest (.metadata sidecar) lists as volumes, so an unrelated file with a
+// numeric extension is never listed, copied or deleted with the backup.
+// Without a manifest listing volumes the archive is not split.
+func manifestVolumes(backupFile string, files []string) []string {
+	if len(files) == 0 {
+		return nil
+	}
+	manifest, err := backup.LoadManifest(backupFile + ".metadata")
+	if err != nil {
+		return nil
+	}
+	return listedVolumes(manifest, files)
+}
+
+// listedVolumes keeps the files that manifest lists as volumes
+func listedVolumes(manifest *backup.Manifest, files []string) []string {
+	if len(manifest.Volumes) == 0 {
+		return nil
+	}
+	listed := make(map[string]bool, len(manifest.Volumes))
+	for _, v := range manifest.Volumes {
+		listed[filepath.Base(v.Name)] = true
+	}
+	var volumes []string
+	for _, file := range files {
+		if listed[filepath.Base(file)] {
+			volumes = append(volumes, file)
+		}
+	}
+	return volumes
+}
+
+// groupVolumes replaces the volumes of split archives in a file listing by
+// the archive they belong to, so every volume set is listed once. The
+// volumes of each archive are returned in order.
+func groupVolumes(files []string) ([]string, map[string][]string) {
+	grouped := make([]string, 0, len(files))
+	volumes := make(map[string][]string)
+	for _, file := range files {
+		archive, _, ok := backup.ParseVolumeName(filepath.Base(file))
+		if !ok {
+			grouped = append(grouped, file)
+			continue
+		}
+		archive = filepath.Join(filepath.Dir(file), archive)
+		if _, seen := volumes[archive]; !seen {
+			grouped = append(grouped, archive)
+		}
+		volumes[archive] = append(volumes[archive], file)
+	}
+	for _, files := range volumes {
+		sortVolumes(files)
+	}
+	return grouped, volumes
+}
+
+// sortVolumes orders the volumes of a split archive by volume number
+func sortVolumes(files []string) {
+	number := func(file string) int {
+		_, n, _ := backup.ParseVolumeName(filepath.Base(file))
+		return n
+	}
+	sort.Slice(files, func(i, j int) bool { return number(files[i]) < number(files[j]) })
+}
+
+// backupFiles returns the files that hold a backup: the file itself or the
+// volumes of a split archive
+func backupFiles(backupFile string) ([]string, error) {
+	_, err := os.Stat(backupFile)
+	if err == nil {
+		return []string{backupFile}, nil
+	}
+	if volumes := localVolumes(backupFile); len(volumes) > 0 {
+		return volumes, nil
+	}
+	return nil, err
+}
+
+// statBackup returns the modification time and total size of a backup file
+// or of the volumes of a split archive
+func statBackup(backupFile string) (time.Time, int64, error) {
+	files, err := backupFiles(backupFile)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	var modTime time.Time
+	var size int64
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		modTime = info.ModTime()
+		size += info.Size()
+	}
+	return modTime, size, nil
+}
+
+// withVolumeChecksums appends the .sha256 file of every volume
+func withVolumeChecksums(volumes []string) []string {
+	files := make([]string, 0, 2*len(volumes))
+	for _, volume := range volumes {
+		files = append(files, volume, volume+".sha256")
+	}
+	return files
+}
@@ -11,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/tis24dev/proxmox-backup/internal/backup"
 	"github.com/tis24dev/proxmox-backup/internal/config"
 	"github.com/tis24dev/proxmox-backup/internal/logging"
 	"github.com/tis24dev/proxmox-backup/internal/types"
@@ -212,6 +213,50 @@ func TestSecondaryStorageStoreCopiesBackupAndAssociatedFiles(t *testing.T) {
 	}
 }
 
+func TestSecondaryStorageListReadsManifest(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	secondary, err := NewSecondaryStorage(&config.Config{SecondaryEnabled: true, SecondaryPath: dir}, newTestLogger())
+	if err != nil {
+		t.Fatalf("NewSecondaryStorage() error = %v", err)
+	}
+
+	created := time.Date(2024, 11, 12, 3, 0, 0, 0, time.UTC)
+	withManifest := filepath.Join(dir, "pve1-backup-20241112.tar.xz.age")
+	manifest := `{"archive_path":"pve1-backup-20241112.tar.xz.age","archive_size":4096,"created_at":"2024-11-12T03:00:00Z",` +
+		`"compression_type":"xz","proxmox_type":"pve","encryption_mode":"age"}`
+	for path, data := range map[string]string{
+		withManifest:               "archive",
+		withManifest + ".metadata": manifest,
+		filepath.Join(dir, "pve1-backup-20241110.tar.zst"): "archive",
+	} {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := secondary.List(context.Background())
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("List() = %d backups, want 2", len(backups))
+	}
+	byName := make(map[string]*types.BackupMetadata)
+	for _, b := range backups {
+		byName[filepath.Base(b.BackupFile)] = b
+	}
+	got := byName["pve1-backup-20241112.tar.xz.age"]
+	if got == nil || got.ProxmoxType != "pve" || got.Size != 4096 || !got.Timestamp.Equal(created) || got.EncryptionMode != "age" {
+		t.Errorf("backup with manifest = %+v", got)
+	}
+	got = byName["pve1-backup-20241110.tar.zst"]
+	if got == nil || got.Compression != types.CompressionZstd || got.EncryptionMode != "none" || got.Size != int64(len("archive")) {
+		t.Errorf("backup without manifest = %+v", got)
+	}
+}
+
 func TestClassifyBackupsGFSLimitsDailyCount(t *testing.T) {
 	t.Parallel()
 
@@ -243,3 +288,147 @@ func TestClassifyBackupsGFSLimitsDailyCount(t *testing.T) {
 		t.Fatalf("expected 3 daily backups, got %d", countDaily)
 	}
 }
+
+func TestRetentionKeepsIncrementalParents(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	names := []string{
+		"pve1-backup-20250106-010000.incr.tar.xz.bundle.tar",
+		"pve2-backup-20250105-020000.incr.tar.xz.bundle.tar",
+		"pve1-backup-20250105-010000.incr.tar.xz.bundle.tar",
+		"pve1-backup-20250104-010000.tar.xz.bundle.tar",
+		"pve1-backup-20250103-010000.incr.tar.xz.bundle.tar",
+		"pve2-backup-20250102-020000.tar.xz.bundle.tar",
+		"pve1-backup-20250102-010000.tar.xz.bundle.tar",
+	}
+	var backups []*types.BackupMetadata
+	for i, name := range names {
+		backups = append(backups, &types.BackupMetadata{
+			BackupFile: name,
+			Timestamp:  now.Add(-time.Duration(i) * time.Hour),
+		})
+	}
+
+	// The two newest backups depend on the chains back to the full backups
+	// of pve1 (via the older incremental) and pve2
+	var deleted []string
+	for _, b := range SimpleRetentionCandidates(backups, 2) {
+		deleted = append(deleted, b.BackupFile)
+	}
+	want := []string{names[4], names[6]}
+	if strings.Join(deleted, ",") != strings.Join(want, ",") {
+		t.Errorf("simple retention deletes %v, want %v", deleted, want)
+	}
+	if got := SimpleRetentionCandidates(backups, 0); got != nil {
+		t.Errorf("disabled retention deletes %v", got)
+	}
+
+	classification := ClassifyBackupsGFS(backups, RetentionConfig{Policy: "gfs", Daily: 1})
+	for i, b := range backups {
+		want := CategoryDelete
+		switch i {
+		case 0:
+			want = CategoryDaily
+		case 2, 3:
+			want = CategoryParent
+		}
+		if classification[b] != want {
+			t.Errorf("%s classified %s, want %s", b.BackupFile, classification[b], want)
+		}
+	}
+}
+
+func TestSecondaryStorageHandlesSplitArchives(t *testing.T) {
+	t.Parallel()
+
+	srcDir := t.TempDir()
+	destDir := t.TempDir()
+	// Split archives are copied as volumes even when bundling is enabled
+	cfg := &config.Config{
+		SecondaryEnabled:      true,
+		SecondaryPath:         destDir,
+		BundleAssociatedFiles: true,
+	}
+	secondary, err := NewSecondaryStorage(cfg, newTestLogger())
+	if err != nil {
+		t.Fatalf("NewSecondaryStorage() error = %v", err)
+	}
+
+	ctx := context.Background()
+	base := time.Date(2024, 11, 10, 3, 0, 0, 0, time.UTC)
+	var names []string
+	for day := 0; day < 2; day++ {
+		created := base.Add(time.Duration(day) * 24 * time.Hour)
+		name := fmt.Sprintf("pve1-backup-%s.tar.zst", created.Format("20060102-150405"))
+		backupFile := filepath.Join(srcDir, name)
+		writeTestFile(t, backupFile, strings.Repeat("x", 2500))
+		writeTestFile(t, backupFile+".sha256", "sum  "+name+"\n")
+		volumes, err := backup.SplitArchive(ctx, newTestLogger(), backupFile, 1000)
+		if err != nil {
+			t.Fatalf("SplitArchive: %v", err)
+		}
+		manifest := &backup.Manifest{
+			ArchivePath:     backupFile,
+			ArchiveSize:     2500,
+			CreatedAt:       created,
+			CompressionType: "zstd",
+			ProxmoxType:     "pve",
+			Volumes:         volumes,
+		}
+		if err := backup.CreateManifest(ctx, newTestLogger(), manifest, backupFile+".metadata"); err != nil {
+			t.Fatal(err)
+		}
+		if err := secondary.Store(ctx, backupFile, &types.BackupMetadata{}); err != nil {
+			t.Fatalf("Store() error = %v", err)
+		}
+		names = append(names, name)
+	}
+
+	backups, err := secondary.List(ctx)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("List() = %d backups, want 2", len(backups))
+	}
+	newest := backups[0]
+	if newest.BackupFile != filepath.Join(destDir, names[1]) || newest.Size != 2500 || len(newest.Volumes) != 3 {
+		t.Fatalf("newest backup = %+v", newest)
+	}
+	for i, volume := range newest.Volumes {
+		if want := filepath.Join(destDir, backup.VolumeName(names[1], i+1)); volume != want {
+			t.Errorf("volume %d = %s, want %s", i+1, volume, want)
+		}
+	}
+
+	// A file named like a volume that the manifest does not list is not
+	// part of the backup
+	stray := filepath.Join(destDir, names[0]+".0042")
+	writeTestFile(t, stray, "unrelated")
+
+	deleted, err := secondary.ApplyRetention(ctx, RetentionConfig{Policy: "simple", MaxBackups: 1})
+	if err != nil || deleted != 1 {
+		t.Fatalf("ApplyRetention() = %d, %v; want 1 deleted", deleted, err)
+	}
+	if _, err := os.Stat(stray); err != nil {
+		t.Errorf("unlisted volume-like file deleted with the backup: %v", err)
+	}
+	if err := os.Remove(stray); err != nil {
+		t.Fatal(err)
+	}
+	remaining, err := filepath.Glob(filepath.Join(destDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(remaining)
+	// Three volumes with their checksums, the archive checksum and the manifest
+	if len(remaining) != 8 {
+		t.Fatalf("remaining files = %v, want the 8 files of %s", remaining, names[1])
+	}
+	for _, path := range remaining {
+		if !strings.HasPrefix(filepath.Base(path), names[1]) {
+			t.Errorf("file %s of the deleted backup left behind", path)
+		}
+	}
+}
@@ -99,6 +99,13 @@ type BackupMetadata struct {
 
 	// Version is the backup format version
 	Version string
+
+	// EncryptionMode is "age" for encrypted archives, "none" otherwise
+	EncryptionMode string
+
+	// Volumes lists the files of an archive split into volumes, in order.
+	// BackupFile then names the archive, which is not stored as such.
+	Volumes []string
 }
 
 // StorageLocation rappresenta una destinazione di storage